@@ -1,32 +1,387 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/element-of-surprise/bakedbaker/internal/http"
 	"github.com/element-of-surprise/bakedbaker/internal/versions"
 )
 
-var (
-	addr = flag.String("addr", "localhost:8080", "address to listen on")
-)
+// adminTokenEnv is the environment variable that holds the token for the /admin endpoints.
+// If it isn't set, the /admin endpoints are not served.
+const adminTokenEnv = "BAKEDBAKER_ADMIN_TOKEN"
+
+// refreshTimeout bounds the refresh of the versions that a SIGHUP starts when -start-timeout is not set.
+// Otherwise -start-timeout bounds it, see versions.Mapping.Refresh().
+const refreshTimeout = 5 * time.Minute
 
 func main() {
-	flag.Parse()
+	if err := Run(context.Background(), os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Run runs bakedbaker with the command line arguments in args, not including the program name. It starts
+// the agent bakers and serves requests until ctx is done or we get a SIGTERM or SIGINT, then shuts down.
+// Output from -list goes to stdout and logs go to stderr. It returns nil if bakedbaker shut down cleanly.
+// If the first argument is "replay", it instead replays a capture, see runReplay().
+func Run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if len(args) > 0 && args[0] == "replay" {
+		return runReplay(ctx, args[1:], stdout, stderr)
+	}
+
+	flags := flag.NewFlagSet("bakedbaker", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		addr       = flags.String("addr", "localhost:8080", "address to listen on")
+		latest     = flags.String("latest", "", "agent baker version that requests for latest go to, defaults to the highest version")
+		list       = flags.Bool("list", false, "print the embedded agent baker versions and exit, without starting them")
+		pprof      = flags.Bool("pprof", false, "serve the pprof endpoints under /debug/pprof, requires "+adminTokenEnv)
+		config     = flags.String("config", "", "JSON or YAML file with server settings, these win over the flags")
+		ports      = flags.Int("ports", 0, "first port of stable per-version agent baker ports, if 0 ports are handed out in start order")
+		warmup     = flags.String("warmup", "", "path on every agent baker that is sent a GET once it is ready, before BB serves")
+		grace      = flags.Duration("shutdown-grace", 30*time.Second, "how long SIGTERM or SIGINT waits for requests to finish and agent bakers to exit before exiting anyway")
+		adminStop  = flags.Bool("admin-shutdown", false, "serve POST /admin/shutdown, which shuts BB down like SIGTERM does, requires "+adminTokenEnv)
+		bindHost   = flags.String("bind-host", "", "IP address agent bakers are told to listen on with -host, if not set they listen on localhost so that other hosts can't reach them")
+		capture    = flags.String("capture", "", "file that every request sent to an agent baker and its response are appended to, for debugging")
+		redact     = flags.String("capture-redact", "", "comma separated JSON field names whose values are redacted in the -capture file")
+		upProxy    = flags.String("upstream-proxy", "", "http:// or socks5:// proxy that agent bakers not on a loopback address are reached through")
+		probeEvery = flags.Duration("health-probe-interval", 0, "if set, each agent baker version is health probed in the background about this often, on its own jittered schedule")
+		compress   = flags.Bool("compress", true, "compress responses for clients that accept it, set to false for clients that mishandle compressed responses")
+		startLimit = flags.Duration("start-timeout", 0, "if set, BB exits with an error if the agent bakers are not all started and ready within this long")
+		requireVer = flags.Bool("require-version", false, "reject requests that don't name an agent baker version with a 400, instead of sending them to latest")
+		workDir    = flags.String("work-dir", "", "directory each agent baker runs in a subdirectory of, named after its version, defaults to the directory it is extracted to")
+		timing     = flags.Bool("server-timing", false, "while logging at DEBUG, send clients a Server-Timing header with how long each phase of their request took")
+		healthPol  = flags.String("health-policy", "all", "what /ready needs to pass: all versions ready, latest (the version latest points to is ready) or quorum:<percent> of versions ready")
+		binDir     = flags.String("binaries", "", "directory of agent baker versions, laid out like the embedded ones, to use instead of them; SIGHUP re-reads it and adds, removes and restarts versions to match")
+		resolveMem = flags.Bool("resolution-cache", false, "cache which agent baker version each requested version resolves to until the versions change, instead of working it out for every request")
+	)
+	if err := flags.Parse(args); err != nil {
+		// -h is not an error, the usage has already been printed.
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// level can be changed while we run, either with SIGUSR1 or the /admin/loglevel endpoint.
+	level := &slog.LevelVar{}
+	log := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level}))
+	go toggleLevel(ctx, level, log)
 
 	// Create a new version map that maps versions to localhost addresses where
 	// the agent baker service for that version is running.
-	verMap, err := versions.New()
+	verOptions := []versions.Option{versions.WithLogger(log)}
+	if *latest != "" {
+		verOptions = append(verOptions, versions.WithLatest(versions.Version(*latest)))
+	}
+	if *ports != 0 {
+		verOptions = append(verOptions, versions.WithStablePorts(*ports))
+	}
+	if *warmup != "" {
+		verOptions = append(verOptions, versions.WithWarmup(*warmup, nil))
+	}
+	if *bindHost != "" {
+		verOptions = append(verOptions, versions.WithBindHost(*bindHost))
+	}
+	if *workDir != "" {
+		verOptions = append(verOptions, versions.WithWorkDir(*workDir))
+	}
+	if *startLimit != 0 {
+		verOptions = append(verOptions, versions.WithStartTimeout(*startLimit))
+	}
+	if *binDir != "" {
+		verOptions = append(verOptions, versions.WithBinaryDir(*binDir))
+	}
+	if *list {
+		return listVersions(stdout, verOptions)
+	}
+
+	// A bad -addr is found before anything is started, rather than after the agent bakers are running.
+	port, err := addrPort(*addr)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	infos, err := versions.Discover(ctx, verOptions...)
+	if err != nil {
+		return fmt.Errorf("could not start the agent bakers: %w", err)
+	}
+	if port != 0 {
+		children, err := versions.Ports(infos, verOptions...)
+		if err != nil {
+			return fmt.Errorf("could not start the agent bakers: %w", err)
+		}
+		if err := portCollision(*addr, port, children); err != nil {
+			return err
+		}
+	}
+
+	verMap, err := versions.Spawn(ctx, infos, verOptions...)
+	if err != nil {
+		// Some versions may have started before the error.
+		return errors.Join(fmt.Errorf("could not start the agent bakers: %w", err), shutdownVersions(verMap, *grace))
+	}
+	if *binDir != "" {
+		go refreshOnHangup(ctx, verMap, *startLimit, log)
+	}
+
+	options := []http.Option{http.WithLogger(log)}
+	if token := os.Getenv(adminTokenEnv); token != "" {
+		options = append(options, http.WithAdminToken(token), http.WithLogLevel(level))
+	}
+	if *pprof {
+		options = append(options, http.WithPprof())
+	}
+	if *adminStop {
+		options = append(options, http.WithAdminShutdown())
+	}
+	if *upProxy != "" {
+		options = append(options, http.WithUpstreamProxy(*upProxy))
+	}
+	if !*compress {
+		options = append(options, http.WithCompression(false))
+	}
+	if *probeEvery != 0 {
+		options = append(options, http.WithHealthProbeInterval(*probeEvery))
+	}
+	if *requireVer {
+		options = append(options, http.WithRequireExplicitVersion())
+	}
+	if *timing {
+		options = append(options, http.WithServerTiming())
+	}
+	if *resolveMem {
+		options = append(options, http.WithResolutionCache())
+	}
+	if *healthPol != "all" {
+		p, err := http.ParseHealthPolicy(*healthPol)
+		if err != nil {
+			return errors.Join(err, shutdownVersions(verMap, *grace))
+		}
+		options = append(options, http.WithHealthPolicy(p))
+	}
+	if *capture != "" {
+		f, err := os.OpenFile(*capture, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Join(fmt.Errorf("could not open the capture file: %w", err), shutdownVersions(verMap, *grace))
+		}
+		defer f.Close()
+		var fields []string
+		if *redact != "" {
+			fields = strings.Split(*redact, ",")
+		}
+		options = append(options, http.WithCapture(f, fields...))
 	}
 
 	// Create a new HTTP server that routes requests to the appropriate agent baker
 	// service based on the version specified in the request.
-	serv, err := http.New(verMap)
+	var serv *http.Server
+	if *config != "" {
+		serv, err = http.NewFromConfig(*config, verMap, options...)
+	} else {
+		serv, err = http.New(verMap, options...)
+	}
+	if err != nil {
+		return errors.Join(err, shutdownVersions(verMap, *grace))
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return errors.Join(fmt.Errorf("could not listen on %s: %w", *addr, err), shutdownVersions(verMap, *grace))
+	}
+	log.Info("serving", "addr", ln.Addr().String())
+	if err := serve(ctx, serv, verMap, ln, *grace, log); err != nil {
+		return fmt.Errorf("did not shut down cleanly: %w", err)
+	}
+	return nil
+}
+
+// addrPort checks that addr, the -addr flag, is a host:port address we can listen on and returns its port.
+// The host may be empty to listen on every address, and the port may be 0 to listen on any free port.
+func addrPort(addr string) (int, error) {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, fmt.Errorf("-addr(%s) must be a host:port address, such as localhost:8080: %w", addr, err)
+	}
+	if p == "" {
+		return 0, fmt.Errorf("-addr(%s) has no port", addr)
+	}
+	port, err := net.LookupPort("tcp", p)
+	if err != nil {
+		return 0, fmt.Errorf("-addr(%s) port must be a number between 0 and 65535: %w", addr, err)
+	}
+	return port, nil
+}
+
+// portCollision returns an error if port, which is the port of addr, is one of the ports in children,
+// which are the sorted ports the agent bakers listen on.
+func portCollision(addr string, port int, children []int) error {
+	for _, child := range children {
+		if child == port {
+			return fmt.Errorf(
+				"-addr(%s) port %d is one of the ports the agent bakers listen on (%d to %d), use another port or move the agent bakers with -ports",
+				addr, port, children[0], children[len(children)-1],
+			)
+		}
+	}
+	return nil
+}
+
+// runReplay runs "bakedbaker replay [flags] <capture file>", which sends the requests in a -capture file to
+// a running bakedbaker and writes which answers differ from the recorded ones to stdout. It returns an
+// error if any do, so that it can be used to check a new agent baker version.
+func runReplay(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("bakedbaker replay", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		target  = flags.String("target", "http://localhost:8080", "URL of the bakedbaker to send the requests to")
+		version = flags.String("version", "", "agent baker version to send every request to, defaults to the version it was recorded against")
+	)
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("replay takes a capture file, got %d arguments", flags.NArg())
+	}
+
+	f, err := os.Open(flags.Arg(0))
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("could not open the capture file: %w", err)
 	}
+	defer f.Close()
+
+	report, err := http.Replay(ctx, f, *target, versions.Version(*version))
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(stdout, report)
+	if n := report.Mismatched(); n > 0 {
+		return fmt.Errorf("%d replayed requests were answered differently than when they were recorded", n)
+	}
+	return nil
+}
 
-	panic(serv.ListenAndServe(*addr))
+// shutdownVersions stops the agent bakers in verMap, giving them grace to exit.
+func shutdownVersions(verMap versions.Mapping, grace time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return verMap.Shutdown(ctx)
+}
+
+// serve serves requests on ln until ctx is done or POST /admin/shutdown is called. It then stops
+// taking requests, waits for the ones being handled to finish and stops the agent bakers. If that
+// takes longer than grace, it gives up waiting and returns an error.
+func serve(ctx context.Context, serv *http.Server, verMap versions.Mapping, ln net.Listener, grace time.Duration, log *slog.Logger) error {
+	served := make(chan error, 1)
+	go func() { served <- serv.Serve(ln) }()
+
+	select {
+	case err := <-served:
+		// We can't serve, but the agent bakers are running and must still be stopped.
+		return errors.Join(err, shutdownVersions(verMap, grace))
+	case <-ctx.Done():
+		log.Info("shutting down", "grace", grace)
+	case <-serv.ShutdownRequested():
+		log.Info("shutting down at the request of /admin/shutdown", "grace", grace)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	inFlight := serv.InFlight()
+	servErr := serv.Shutdown(ctx)
+	left := serv.InFlight()
+	log.Info("drained in-flight requests", "drained", max(inFlight-left, 0), "abandoned", left)
+
+	verErr := verMap.Shutdown(ctx)
+	if err := errors.Join(servErr, verErr); err != nil {
+		return err
+	}
+	log.Info("shut down")
+	return nil
+}
+
+// listVersions writes the versions that would be started to w, one per line, marking the one latest goes to.
+func listVersions(w io.Writer, options []versions.Option) error {
+	infos, err := versions.Discover(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Latest {
+			fmt.Fprintf(w, "%s (%s)\n", info.Version, versions.Latest)
+			continue
+		}
+		fmt.Fprintln(w, info.Version)
+	}
+	return nil
+}
+
+// toggleLevel switches level between info and debug every time we get a SIGUSR1, until ctx is done.
+func toggleLevel(ctx context.Context, level *slog.LevelVar, log *slog.Logger) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+		to := slog.LevelDebug
+		if level.Level() <= slog.LevelDebug {
+			to = slog.LevelInfo
+		}
+		level.Set(to)
+		log.Info("log level changed", "to", to)
+	}
+}
+
+// refreshOnHangup refreshes the versions in verMap from the -binaries directory every time we get a SIGHUP,
+// until ctx is done. What changed, or why the refresh failed, is logged. If startLimit is 0, each refresh is
+// bounded by refreshTimeout, otherwise verMap bounds it by startLimit.
+func refreshOnHangup(ctx context.Context, verMap versions.Mapping, startLimit time.Duration, log *slog.Logger) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+		rctx, cancel := ctx, func() {}
+		if startLimit == 0 {
+			rctx, cancel = context.WithTimeout(ctx, refreshTimeout)
+		}
+		delta, err := verMap.Refresh(rctx)
+		cancel()
+		if err != nil {
+			log.Error("could not refresh the agent baker versions, still serving the ones we had", "err", err)
+			continue
+		}
+		if delta.Empty() {
+			log.Info("agent baker versions are unchanged")
+		}
+	}
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/http"
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+)
+
+func TestServeSIGTERM(t *testing.T) {
+	// This is not parallel, as it sends a SIGTERM to the test binary.
+
+	// The agent baker holds the request so that it is in flight when the signal arrives.
+	release := make(chan struct{})
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				<-release
+				w.Write([]byte(`{"ok":true}`))
+			},
+		),
+	)
+	defer up.Close()
+
+	verMap, err := versions.NewStatic(map[versions.Version]string{"1.0.0": up.URL})
+	if err != nil {
+		t.Fatalf("TestServeSIGTERM: %s", err)
+	}
+	serv, err := http.New(verMap)
+	if err != nil {
+		t.Fatalf("TestServeSIGTERM: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestServeSIGTERM: %s", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+
+	const grace = 5 * time.Second
+	logs := &bytes.Buffer{}
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, serv, verMap, ln, grace, slog.New(slog.NewTextHandler(logs, nil))) }()
+
+	status := make(chan int, 1)
+	go func() {
+		body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+		resp, err := nethttp.Post("http://"+ln.Addr().String()+"/getlatestsigimageconfig", "application/json", strings.NewReader(body))
+		if err != nil {
+			status <- 0
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	for start := time.Now(); serv.InFlight() != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > grace {
+			t.Fatalf("TestServeSIGTERM: the request never got to the server")
+		}
+	}
+
+	start := time.Now()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("TestServeSIGTERM: could not send SIGTERM: %s", err)
+	}
+	time.AfterFunc(200*time.Millisecond, func() { close(release) })
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("TestServeSIGTERM: got err == %s, want err == nil", err)
+		}
+	case <-time.After(2 * grace):
+		t.Fatalf("TestServeSIGTERM: serve() did not return after SIGTERM")
+	}
+	if took := time.Since(start); took > grace {
+		t.Errorf("TestServeSIGTERM: took %v to shut down, want less than the grace period of %v", took, grace)
+	}
+	if got := <-status; got != nethttp.StatusOK {
+		t.Errorf("TestServeSIGTERM: got status %d for the in-flight request, want %d", got, nethttp.StatusOK)
+	}
+	if !strings.Contains(logs.String(), "drained=1") {
+		t.Errorf("TestServeSIGTERM: got logs:\n%s\nwant the drained request counted", logs)
+	}
+	if state, _ := verMap.State("1.0.0"); state != versions.StateStopped {
+		t.Errorf("TestServeSIGTERM: got version state %s, want %s", state, versions.StateStopped)
+	}
+}
+
+func TestServeAdminShutdown(t *testing.T) {
+	t.Parallel()
+
+	const token = "secret"
+
+	up := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {}))
+	defer up.Close()
+
+	verMap, err := versions.NewStatic(map[versions.Version]string{"1.0.0": up.URL})
+	if err != nil {
+		t.Fatalf("TestServeAdminShutdown: %s", err)
+	}
+	serv, err := http.New(verMap, http.WithAdminToken(token), http.WithAdminShutdown())
+	if err != nil {
+		t.Fatalf("TestServeAdminShutdown: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestServeAdminShutdown: %s", err)
+	}
+
+	const grace = 5 * time.Second
+	logs := &bytes.Buffer{}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(context.Background(), serv, verMap, ln, grace, slog.New(slog.NewTextHandler(logs, nil)))
+	}()
+
+	req, err := nethttp.NewRequest("POST", "http://"+ln.Addr().String()+"/admin/shutdown", nil)
+	if err != nil {
+		t.Fatalf("TestServeAdminShutdown: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := nethttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("TestServeAdminShutdown: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusAccepted {
+		t.Errorf("TestServeAdminShutdown: got status %d, want %d", resp.StatusCode, nethttp.StatusAccepted)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("TestServeAdminShutdown: got err == %s, want err == nil", err)
+		}
+	case <-time.After(2 * grace):
+		t.Fatalf("TestServeAdminShutdown: serve() did not return after /admin/shutdown")
+	}
+	if state, _ := verMap.State("1.0.0"); state != versions.StateStopped {
+		t.Errorf("TestServeAdminShutdown: got version state %s, want %s", state, versions.StateStopped)
+	}
+	if !strings.Contains(logs.String(), "/admin/shutdown") {
+		t.Errorf("TestServeAdminShutdown: got logs:\n%s\nwant the shutdown to say why it happened", logs)
+	}
+}
+
+// writeBinaries writes a directory for -binaries with version 1.0.0, whose agent baker does nothing
+// until it is stopped, and returns it.
+func writeBinaries(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "1.0.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1.0.0", "agentbaker"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	// Run() needs an address it can listen on, so we find a free port and give it back.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestRun: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// There are no embedded versions in this tree, so Run() gets a version of its own.
+	binaries := writeBinaries(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() {
+		ran <- Run(ctx, []string{"-addr", addr, "-binaries", binaries, "-shutdown-grace", "5s"}, io.Discard, io.Discard)
+	}()
+
+	started := false
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(20 * time.Millisecond) {
+		resp, err := nethttp.Get(fmt.Sprintf("http://%s/healthz", addr))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == nethttp.StatusOK {
+			started = true
+			break
+		}
+	}
+	if !started {
+		t.Fatalf("TestRun: Run() never served /healthz")
+	}
+
+	cancel()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Errorf("TestRun: got err == %s, want err == nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("TestRun: Run() did not return after ctx was canceled")
+	}
+	if _, err := nethttp.Get(fmt.Sprintf("http://%s/healthz", addr)); err == nil {
+		t.Errorf("TestRun: still serving after Run() returned")
+	}
+}
+
+func TestRunReplay(t *testing.T) {
+	t.Parallel()
+
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				w.Write([]byte(`{"SubscriptionID":"sub"}`))
+			},
+		),
+	)
+	defer up.Close()
+
+	verMap, err := versions.NewStatic(map[versions.Version]string{"1.0.0": up.URL})
+	if err != nil {
+		t.Fatalf("TestRunReplay: %s", err)
+	}
+	serv, err := http.New(verMap)
+	if err != nil {
+		t.Fatalf("TestRunReplay: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestRunReplay: %s", err)
+	}
+	go serv.Serve(ln)
+	defer serv.Shutdown(context.Background())
+
+	const entry = `{"version":"1.0.0","endpoint":"/getlatestsigimageconfig","method":"POST","path":"/getlatestsigimageconfig","request":{"Region":"westus"},"status":200,"response":{"SubscriptionID":%q}}` + "\n"
+
+	tests := []struct {
+		name    string
+		capture string
+		wantOut string
+		wantErr bool
+	}{
+		{name: "Same answers", capture: fmt.Sprintf(entry, "sub"), wantOut: "1.0.0: 1 matched, 0 mismatched, 0 skipped"},
+		{name: "Different answer", capture: fmt.Sprintf(entry, "sub") + fmt.Sprintf(entry, "old"), wantOut: "1.0.0: 1 matched, 1 mismatched, 0 skipped", wantErr: true},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "capture.jsonl")
+		if err := os.WriteFile(path, []byte(test.capture), 0600); err != nil {
+			t.Fatalf("TestRunReplay(%s): %s", test.name, err)
+		}
+
+		out := &bytes.Buffer{}
+		err := Run(context.Background(), []string{"replay", "-target", "http://" + ln.Addr().String(), path}, out, io.Discard)
+		switch {
+		case err == nil && test.wantErr:
+			t.Errorf("TestRunReplay(%s): got err == nil, want err != nil", test.name)
+		case err != nil && !test.wantErr:
+			t.Errorf("TestRunReplay(%s): got err == %s, want err == nil", test.name, err)
+		}
+		if !strings.Contains(out.String(), test.wantOut) {
+			t.Errorf("TestRunReplay(%s): got output:\n%s\nwant it to contain %q", test.name, out, test.wantOut)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	t.Parallel()
+
+	binaries := writeBinaries(t)
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "Unknown flag", args: []string{"-nope"}},
+		{name: "No versions", args: []string{"-addr", "127.0.0.1:0"}},
+		{name: "Bad address", args: []string{"-addr", "not-an-address", "-binaries", binaries}},
+		{name: "Address without a port", args: []string{"-addr", "localhost:", "-binaries", binaries}},
+		{name: "Port out of range", args: []string{"-addr", "localhost:70000", "-binaries", binaries}},
+		{name: "Missing config", args: []string{"-addr", "127.0.0.1:0", "-binaries", binaries, "-config", "/does/not/exist.yaml"}},
+		{name: "Bad bind host", args: []string{"-addr", "127.0.0.1:0", "-binaries", binaries, "-bind-host", "localhost"}},
+		{name: "Negative health probe interval", args: []string{"-addr", "127.0.0.1:0", "-binaries", binaries, "-health-probe-interval", "-1s"}},
+		{name: "Bad upstream proxy", args: []string{"-addr", "127.0.0.1:0", "-binaries", binaries, "-upstream-proxy", "ftp://proxy"}},
+		{name: "Replay without a capture", args: []string{"replay"}},
+		{name: "Replay a missing capture", args: []string{"replay", "/does/not/exist.jsonl"}},
+	}
+
+	for _, test := range tests {
+		if err := Run(context.Background(), test.args, io.Discard, io.Discard); err == nil {
+			t.Errorf("TestRunErrors(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+}
+
+func TestAddrPort(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		addr    string
+		want    int
+		wantErr bool
+	}{
+		{name: "Host and port", addr: "localhost:8080", want: 8080},
+		{name: "Every address", addr: ":9000", want: 9000},
+		{name: "IPv6", addr: "[::1]:9000", want: 9000},
+		{name: "Any free port", addr: "127.0.0.1:0", want: 0},
+		{name: "Error: no port", addr: "localhost", wantErr: true},
+		{name: "Error: empty port", addr: "localhost:", wantErr: true},
+		{name: "Error: port out of range", addr: "localhost:65536", wantErr: true},
+		{name: "Error: negative port", addr: "localhost:-1", wantErr: true},
+		{name: "Error: too many colons", addr: "localhost:80:80", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := addrPort(test.addr)
+		switch {
+		case err == nil && test.wantErr:
+			t.Errorf("TestAddrPort(%s): got err == nil, want err != nil", test.name)
+			continue
+		case err != nil && !test.wantErr:
+			t.Errorf("TestAddrPort(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+		if got != test.want {
+			t.Errorf("TestAddrPort(%s): got port %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPortCollision(t *testing.T) {
+	t.Parallel()
+
+	children := []int{8080, 8081, 8082}
+
+	tests := []struct {
+		name    string
+		port    int
+		wantErr bool
+	}{
+		{name: "Below the agent bakers", port: 8079},
+		{name: "Above the agent bakers", port: 8083},
+		{name: "Error: first agent baker port", port: 8080, wantErr: true},
+		{name: "Error: last agent baker port", port: 8082, wantErr: true},
+	}
+
+	for _, test := range tests {
+		err := portCollision(fmt.Sprintf("localhost:%d", test.port), test.port, children)
+		switch {
+		case err == nil && test.wantErr:
+			t.Errorf("TestPortCollision(%s): got err == nil, want err != nil", test.name)
+		case err != nil && !test.wantErr:
+			t.Errorf("TestPortCollision(%s): got err == %s, want err == nil", test.name, err)
+		}
+	}
+	if err := portCollision("localhost:8080", 8080, nil); err != nil {
+		t.Errorf("TestPortCollision(no agent bakers): got err == %s, want err == nil", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Package backoff provides capped, exponential backoff with full jitter, for waiting between
+// attempts of something that failed, such as restarting a process or retrying a request.
+//
+// Full jitter picks each delay at random between zero and the capped exponential delay. That keeps
+// many callers that fail at the same moment from all trying again at the same moment.
+package backoff
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+)
+
+// Backoff computes the delays between attempts. The zero value has no delay, set at least Base.
+// A Backoff can be shared by many goroutines if Rand is safe for concurrent use.
+type Backoff struct {
+	// Base is the delay before the first retry, before jitter.
+	Base time.Duration
+	// Max caps the delay, before jitter. If zero, there is no cap.
+	Max time.Duration
+	// Factor is what the delay is multiplied by after each attempt. Values below 1 use the default of 2.
+	Factor float64
+	// NoJitter turns off jitter, so each delay is exactly Base * Factor^attempt, capped at Max.
+	NoJitter bool
+	// Rand returns a number in [0, 1) that is used for jitter. If nil, math/rand.Float64 is used.
+	// This is for making delays repeatable in tests.
+	Rand func() float64
+	// Clock is what Wait() waits on. If nil, the wall clock is used. Tests use a *clock.Fake.
+	Clock clock.Clock
+}
+
+// Delay returns how long to wait after attempt, which starts at 0 for the first failure.
+func (b *Backoff) Delay(attempt int) time.Duration {
+	if b.Base <= 0 {
+		return 0
+	}
+	if attempt < 0 {
+		attempt = 0
+	}
+	factor := b.Factor
+	if factor < 1 {
+		factor = 2
+	}
+
+	limit := float64(math.MaxInt64)
+	if b.Max > 0 {
+		limit = float64(b.Max)
+	}
+	// This is in float64 so that a large attempt goes to +Inf instead of overflowing.
+	d := math.Min(float64(b.Base)*math.Pow(factor, float64(attempt)), limit)
+
+	if !b.NoJitter {
+		r := rand.Float64
+		if b.Rand != nil {
+			r = b.Rand
+		}
+		d *= r()
+	}
+	// float64(math.MaxInt64) rounds up past it, so converting it back needs a cap.
+	if d >= float64(math.MaxInt64) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// Wait blocks for the Delay() of attempt. It returns ctx.Err() if ctx is done first.
+func (b *Backoff) Wait(ctx context.Context, attempt int) error {
+	var c clock.Clock = clock.Real{}
+	if b.Clock != nil {
+		c = b.Clock
+	}
+	t := c.NewTimer(b.Delay(attempt))
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C():
+		return nil
+	}
+}
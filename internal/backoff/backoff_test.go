@@ -0,0 +1,144 @@
+package backoff
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestDelayNoJitter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		b    Backoff
+		want []time.Duration
+	}{
+		{
+			name: "Default factor",
+			b:    Backoff{Base: 10 * time.Millisecond, Max: 100 * time.Millisecond, NoJitter: true},
+			want: []time.Duration{
+				10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond,
+				100 * time.Millisecond, 100 * time.Millisecond,
+			},
+		},
+		{
+			name: "Factor of 3",
+			b:    Backoff{Base: time.Second, Max: 20 * time.Second, Factor: 3, NoJitter: true},
+			want: []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 20 * time.Second},
+		},
+		{
+			name: "No base",
+			b:    Backoff{Max: time.Second, NoJitter: true},
+			want: []time.Duration{0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		var got []time.Duration
+		for i := range test.want {
+			got = append(got, test.b.Delay(i))
+		}
+		if diff := pretty.Compare(test.want, got); diff != "" {
+			t.Errorf("TestDelayNoJitter(%s): -want/+got:\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestDelayJitter(t *testing.T) {
+	t.Parallel()
+
+	b := Backoff{
+		Base: 10 * time.Millisecond,
+		Max:  time.Second,
+		Rand: rand.New(rand.NewSource(1)).Float64,
+	}
+	ceiling := Backoff{Base: b.Base, Max: b.Max, NoJitter: true}
+
+	seen := map[time.Duration]bool{}
+	for attempt := 0; attempt < 20; attempt++ {
+		for i := 0; i < 10; i++ {
+			got := b.Delay(attempt)
+			if got < 0 || got > ceiling.Delay(attempt) {
+				t.Errorf("TestDelayJitter(attempt %d): got %v, want between 0 and %v", attempt, got, ceiling.Delay(attempt))
+			}
+			if got > b.Max {
+				t.Errorf("TestDelayJitter(attempt %d): got %v, want at most Max(%v)", attempt, got, b.Max)
+			}
+			seen[got] = true
+		}
+	}
+	// Without jitter there are only 8 different delays, 10ms doubling up to the 1s cap.
+	if len(seen) <= 8 {
+		t.Errorf("TestDelayJitter: got %d different delays, want jitter to spread them", len(seen))
+	}
+
+	// The same rand source gives the same delays.
+	b1 := Backoff{Base: time.Second, Rand: rand.New(rand.NewSource(7)).Float64}
+	b2 := Backoff{Base: time.Second, Rand: rand.New(rand.NewSource(7)).Float64}
+	for attempt := 0; attempt < 5; attempt++ {
+		if d1, d2 := b1.Delay(attempt), b2.Delay(attempt); d1 != d2 {
+			t.Errorf("TestDelayJitter(attempt %d): got %v and %v from the same seed, want them equal", attempt, d1, d2)
+		}
+	}
+}
+
+func TestDelayLargeAttempt(t *testing.T) {
+	t.Parallel()
+
+	b := Backoff{Base: time.Second, NoJitter: true}
+	if got := b.Delay(10000); got <= 0 {
+		t.Errorf("TestDelayLargeAttempt: got %v, want a positive delay without a Max", got)
+	}
+	b.Max = time.Minute
+	if got := b.Delay(10000); got != time.Minute {
+		t.Errorf("TestDelayLargeAttempt: got %v, want %v", got, time.Minute)
+	}
+}
+
+func TestWait(t *testing.T) {
+	t.Parallel()
+
+	b := Backoff{Base: time.Hour, NoJitter: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx, 0); err == nil {
+		t.Errorf("TestWait: got err == nil, want the context's error")
+	}
+
+	b = Backoff{Base: time.Millisecond, NoJitter: true}
+	if err := b.Wait(context.Background(), 0); err != nil {
+		t.Errorf("TestWait: got err == %s, want err == nil", err)
+	}
+}
+
+func TestWaitClock(t *testing.T) {
+	t.Parallel()
+
+	fake := clock.NewFake(time.Now())
+	b := Backoff{Base: time.Hour, NoJitter: true, Clock: fake}
+	waited := make(chan error, 1)
+	go func() { waited <- b.Wait(context.Background(), 0) }()
+
+	fake.BlockUntil(1)
+	fake.Advance(time.Hour - time.Second)
+	select {
+	case <-waited:
+		t.Fatalf("TestWaitClock: Wait() returned before the delay passed on the clock")
+	default:
+	}
+
+	fake.Advance(time.Second)
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("TestWaitClock: got err == %s, want err == nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("TestWaitClock: Wait() did not return once the delay passed on the clock")
+	}
+}
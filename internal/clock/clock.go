@@ -0,0 +1,162 @@
+// Package clock provides the time that code which schedules things reads, so that tests can control it.
+//
+// Code takes a Clock and uses Real{} unless told otherwise. Tests give it a *Fake instead and move time
+// forward with Advance(), which fires the timers that come due without waiting on the wall clock.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer returns a Timer that fires once d has passed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single event, like *time.Timer.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires.
+	C() <-chan time.Time
+	// Stop keeps the timer from firing. It returns false if the timer already fired or was stopped.
+	Stop() bool
+}
+
+// Real is the Clock of the wall clock, which uses the time package.
+type Real struct{}
+
+// Now implements Clock.Now().
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer implements Clock.NewTimer().
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// realTimer is a Timer that is a *time.Timer.
+type realTimer struct {
+	t *time.Timer
+}
+
+// C implements Timer.C().
+func (r realTimer) C() <-chan time.Time {
+	return r.t.C
+}
+
+// Stop implements Timer.Stop().
+func (r realTimer) Stop() bool {
+	return r.t.Stop()
+}
+
+// Fake is a Clock for tests. Its time only moves when Advance() is called. It is safe for concurrent use.
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+	// timers are the timers that haven't fired or been stopped.
+	timers []*fakeTimer
+	// changed is broadcast when timers changes, for BlockUntil().
+	changed *sync.Cond
+}
+
+// NewFake returns a Fake whose time is now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now implements Clock.Now().
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer implements Clock.NewTimer(). A d that isn't positive fires at once.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{fake: f, when: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers = append(f.timers, t)
+	f.changed.Broadcast()
+	return t
+}
+
+// Advance moves the time forward by d and fires the timers that are due, in the order they are due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	var left []*fakeTimer
+	var due []*fakeTimer
+	for _, t := range f.timers {
+		if t.when.After(f.now) {
+			left = append(left, t)
+			continue
+		}
+		due = append(due, t)
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+	for _, t := range due {
+		t.c <- t.when
+	}
+	f.timers = left
+	f.changed.Broadcast()
+}
+
+// Timers returns how many timers are waiting to fire.
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// BlockUntil waits until at least n timers are waiting to fire. Tests use this to know that the
+// code being tested is waiting on the clock before they Advance() it.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.changed.Wait()
+	}
+}
+
+// fakeTimer is a Timer made by a Fake.
+type fakeTimer struct {
+	fake *Fake
+	when time.Time
+	c    chan time.Time
+}
+
+// C implements Timer.C().
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop implements Timer.Stop().
+func (t *fakeTimer) Stop() bool {
+	f := t.fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, other := range f.timers {
+		if other == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			f.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
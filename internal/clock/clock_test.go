@@ -0,0 +1,95 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	first := f.NewTimer(time.Second)
+	second := f.NewTimer(2 * time.Second)
+	stopped := f.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Errorf("TestFake: got Stop() == false for a waiting timer, want true")
+	}
+	if got := f.Timers(); got != 2 {
+		t.Errorf("TestFake: got %d waiting timers, want 2", got)
+	}
+
+	f.Advance(500 * time.Millisecond)
+	select {
+	case <-first.C():
+		t.Errorf("TestFake: timer fired before it was due")
+	default:
+	}
+
+	f.Advance(500 * time.Millisecond)
+	select {
+	case got := <-first.C():
+		if want := start.Add(time.Second); !got.Equal(want) {
+			t.Errorf("TestFake: timer fired with %v, want %v", got, want)
+		}
+	default:
+		t.Errorf("TestFake: timer did not fire when it was due")
+	}
+	select {
+	case <-second.C():
+		t.Errorf("TestFake: second timer fired before it was due")
+	case <-stopped.C():
+		t.Errorf("TestFake: stopped timer fired")
+	default:
+	}
+	if first.Stop() {
+		t.Errorf("TestFake: got Stop() == true for a timer that fired, want false")
+	}
+	if got, want := f.Now(), start.Add(time.Second); !got.Equal(want) {
+		t.Errorf("TestFake: got Now() == %v, want %v", got, want)
+	}
+
+	// A timer that isn't in the future fires at once.
+	select {
+	case <-f.NewTimer(0).C():
+	default:
+		t.Errorf("TestFake: timer for 0 did not fire at once")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	t.Parallel()
+
+	f := NewFake(time.Now())
+	fired := make(chan struct{})
+	go func() {
+		<-f.NewTimer(time.Minute).C()
+		close(fired)
+	}()
+
+	// Without BlockUntil(), Advance() could run before the goroutine made its timer.
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+	select {
+	case <-fired:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("TestFakeBlockUntil: timer never fired")
+	}
+}
+
+func TestReal(t *testing.T) {
+	t.Parallel()
+
+	var c Clock = Real{}
+	before := time.Now()
+	if got := c.Now(); got.Before(before) {
+		t.Errorf("TestReal: got Now() == %v, want at or after %v", got, before)
+	}
+	select {
+	case <-c.NewTimer(time.Millisecond).C():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("TestReal: timer never fired")
+	}
+}
@@ -0,0 +1,187 @@
+package http
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/keyauth"
+)
+
+// WithAdminToken enables the /admin endpoints. Requests to them must have an "Authorization: Bearer <token>"
+// header. Without this, the /admin endpoints are not served.
+func WithAdminToken(token string) Option {
+	return func(s *Server) error {
+		if token == "" {
+			return fmt.Errorf("admin token cannot be empty")
+		}
+		s.adminToken = token
+		return nil
+	}
+}
+
+// WithLogLevel gives the Server the level of the handler passed to WithLogger(), which allows it
+// to be changed with POST /admin/loglevel. This requires WithAdminToken().
+func WithLogLevel(level *slog.LevelVar) Option {
+	return func(s *Server) error {
+		if level == nil {
+			return fmt.Errorf("level cannot be nil")
+		}
+		s.logLevel = level
+		return nil
+	}
+}
+
+// WithAdminShutdown enables POST /admin/shutdown, which asks the program to shut down. The Server only
+// reports the request on ShutdownRequested(), the program does the shutdown the same way it would for a
+// SIGTERM. This requires WithAdminToken().
+func WithAdminShutdown() Option {
+	return func(s *Server) error {
+		s.shutdownReq = make(chan struct{})
+		return nil
+	}
+}
+
+// ShutdownRequested returns a channel that is closed when POST /admin/shutdown is called. If
+// WithAdminShutdown() was not used, the channel is nil and so is never ready.
+func (s *Server) ShutdownRequested() <-chan struct{} {
+	return s.shutdownReq
+}
+
+// requestShutdown is a handler for POST /admin/shutdown. It answers 202 Accepted, as the shutdown
+// happens after the response is sent. Calling it more than once is the same as calling it once.
+func (s *Server) requestShutdown(c *fiber.Ctx) error {
+	s.shutdownOnce.Do(
+		func() {
+			s.log.Info("shutdown requested", "ip", c.IP())
+			close(s.shutdownReq)
+		},
+	)
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// registerAdmin adds the /admin endpoints to app if they are enabled. If they are not, /admin paths
+// are still ours and are answered with a 404 instead of being forwarded to the agent bakers.
+func (s *Server) registerAdmin(app *fiber.App) {
+	if s.adminToken == "" {
+		app.All("/admin/*", s.unknownRoute)
+		return
+	}
+
+	admin := app.Group("/admin", s.adminAuth())
+	admin.Get("/status", s.status)
+	if s.logLevel != nil {
+		admin.Get("/loglevel", s.getLogLevel)
+		admin.Post("/loglevel", s.setLogLevel)
+	}
+	if s.shutdownReq != nil {
+		admin.Post("/shutdown", s.requestShutdown)
+	}
+	// Admin requests are never forwarded to the agent bakers.
+	admin.All("/*", s.unknownRoute)
+}
+
+// adminAuth returns a handler that rejects requests that don't have the admin token.
+func (s *Server) adminAuth() fiber.Handler {
+	return keyauth.New(
+		keyauth.Config{
+			Validator: func(c *fiber.Ctx, key string) (bool, error) {
+				return subtle.ConstantTimeCompare([]byte(key), []byte(s.adminToken)) == 1, nil
+			},
+			// Send our normal JSON error instead of the middleware's plain text.
+			ErrorHandler: func(c *fiber.Ctx, err error) error {
+				return fiber.NewError(fiber.StatusUnauthorized, "missing or invalid admin token")
+			},
+		},
+	)
+}
+
+// logLevelMsg is the JSON body used by the /admin/loglevel endpoint.
+type logLevelMsg struct {
+	// Level is a slog.Level in text form, such as "DEBUG" or "INFO".
+	Level string `json:"level"`
+}
+
+// getLogLevel is a handler for GET /admin/loglevel. It returns the current log level.
+func (s *Server) getLogLevel(c *fiber.Ctx) error {
+	return c.JSON(logLevelMsg{Level: s.logLevel.Level().String()})
+}
+
+// setLogLevel is a handler for POST /admin/loglevel. It sets the log level to the level in the
+// logLevelMsg body and returns the new level.
+func (s *Server) setLogLevel(c *fiber.Ctx) error {
+	var msg logLevelMsg
+	if err := json.Unmarshal(c.Body(), &msg); err != nil {
+		return badRequest(fmt.Errorf("could not decode the body: %w", err))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(msg.Level)); err != nil {
+		return badRequest(err)
+	}
+
+	old := s.logLevel.Level()
+	s.logLevel.Set(level)
+	s.log.Info("log level changed", "from", old, "to", level)
+
+	return c.JSON(logLevelMsg{Level: level.String()})
+}
+
+// statusResp is the JSON body returned by GET /admin/status.
+type statusResp struct {
+	// Versions are the agent baker versions, sorted by version.
+	Versions []versionStatus `json:"versions"`
+}
+
+// versionStatus is the status of an agent baker version.
+type versionStatus struct {
+	Version versions.Version `json:"version"`
+	// Latest indicates requests for versions.Latest are sent to this version.
+	Latest bool `json:"latest,omitempty"`
+	// State is the versions.State in text form, such as "ready".
+	State string `json:"state"`
+	// Ready indicates the version can be sent requests.
+	Ready    bool            `json:"ready"`
+	Replicas []replicaStatus `json:"replicas"`
+}
+
+// replicaStatus is the status of an agent baker process.
+type replicaStatus struct {
+	Addr string `json:"addr"`
+	// PID is omitted for agent bakers we didn't start.
+	PID int `json:"pid,omitempty"`
+	// Uptime is how long the process has been running, such as "1h2m3s".
+	Uptime   string `json:"uptime"`
+	Restarts int    `json:"restarts"`
+}
+
+// status is a handler for GET /admin/status. It returns the process status of every agent baker version.
+func (s *Server) status(c *fiber.Ctx) error {
+	resp := statusResp{Versions: []versionStatus{}}
+	for _, vs := range s.mapping.Status() {
+		v := versionStatus{
+			Version:  vs.Version,
+			Latest:   vs.Latest,
+			State:    vs.State.String(),
+			Ready:    vs.Ready,
+			Replicas: make([]replicaStatus, 0, len(vs.Replicas)),
+		}
+		for _, rs := range vs.Replicas {
+			v.Replicas = append(
+				v.Replicas,
+				replicaStatus{
+					Addr:     rs.Addr,
+					PID:      rs.PID,
+					Uptime:   rs.Uptime.Round(time.Second).String(),
+					Restarts: rs.Restarts,
+				},
+			)
+		}
+		resp.Versions = append(resp.Versions, v)
+	}
+	return c.JSON(resp)
+}
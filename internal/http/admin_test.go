@@ -0,0 +1,299 @@
+package http
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAdminLogLevel(t *testing.T) {
+	t.Parallel()
+
+	const token = "secret"
+
+	up := newStubUpstream(t, `{}`)
+	level := &slog.LevelVar{}
+	capture := &captureHandler{level: level}
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": up.URL},
+		WithLogger(slog.New(capture)),
+		WithLogLevel(level),
+		WithAdminToken(token),
+	)
+
+	// forward sends a request, which logs "forwarded request" at debug.
+	forward := func() {
+		body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestAdminLogLevel: %s", err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("TestAdminLogLevel: got status %d forwarding, want %d", resp.StatusCode, fiber.StatusOK)
+		}
+	}
+	setLevel := func(lvl, tok string) int {
+		req := httptest.NewRequest("POST", "/admin/loglevel", strings.NewReader(`{"level":"`+lvl+`"}`))
+		if tok != "" {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tok)
+		}
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestAdminLogLevel: %s", err)
+		}
+		return resp.StatusCode
+	}
+
+	forward()
+	if got := capture.count("forwarded request"); got != 0 {
+		t.Fatalf("TestAdminLogLevel: got %d debug logs at info level, want 0", got)
+	}
+
+	if got := setLevel("DEBUG", token); got != fiber.StatusOK {
+		t.Fatalf("TestAdminLogLevel: got status %d setting the level, want %d", got, fiber.StatusOK)
+	}
+	forward()
+	if got := capture.count("forwarded request"); got != 1 {
+		t.Errorf("TestAdminLogLevel: got %d debug logs at debug level, want 1", got)
+	}
+
+	if got := setLevel("INFO", token); got != fiber.StatusOK {
+		t.Fatalf("TestAdminLogLevel: got status %d setting the level, want %d", got, fiber.StatusOK)
+	}
+	forward()
+	if got := capture.count("forwarded request"); got != 1 {
+		t.Errorf("TestAdminLogLevel: got %d debug logs after going back to info, want 1", got)
+	}
+
+	// The level can be read back.
+	req := httptest.NewRequest("GET", "/admin/loglevel", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	resp, err := serv.app.Test(req)
+	if err != nil {
+		t.Fatalf("TestAdminLogLevel: %s", err)
+	}
+	var got logLevelMsg
+	b, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("TestAdminLogLevel: could not decode response(%s): %s", b, err)
+	}
+	if got.Level != "INFO" {
+		t.Errorf("TestAdminLogLevel: got level %s, want INFO", got.Level)
+	}
+
+	// Bad requests don't change the level.
+	tests := []struct {
+		name       string
+		level      string
+		token      string
+		wantStatus int
+	}{
+		{name: "No token", level: "DEBUG", wantStatus: fiber.StatusUnauthorized},
+		{name: "Wrong token", level: "DEBUG", token: "wrong", wantStatus: fiber.StatusUnauthorized},
+		{name: "Bad level", level: "LOUD", token: token, wantStatus: fiber.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if got := setLevel(test.level, test.token); got != test.wantStatus {
+			t.Errorf("TestAdminLogLevel(%s): got status %d, want %d", test.name, got, test.wantStatus)
+		}
+		if level.Level() != slog.LevelInfo {
+			t.Errorf("TestAdminLogLevel(%s): level changed to %s", test.name, level.Level())
+		}
+	}
+}
+
+func TestAdminShutdown(t *testing.T) {
+	t.Parallel()
+
+	const token = "secret"
+
+	tests := []struct {
+		name         string
+		options      []Option
+		token        string
+		wantStatus   int
+		wantShutdown bool
+	}{
+		{
+			name:         "Enabled and authorized",
+			options:      []Option{WithAdminToken(token), WithAdminShutdown()},
+			token:        token,
+			wantStatus:   fiber.StatusAccepted,
+			wantShutdown: true,
+		},
+		{
+			name:       "No token",
+			options:    []Option{WithAdminToken(token), WithAdminShutdown()},
+			wantStatus: fiber.StatusUnauthorized,
+		},
+		{
+			name:       "Wrong token",
+			options:    []Option{WithAdminToken(token), WithAdminShutdown()},
+			token:      "wrong",
+			wantStatus: fiber.StatusUnauthorized,
+		},
+		{
+			name:       "Not enabled",
+			options:    []Option{WithAdminToken(token)},
+			token:      token,
+			wantStatus: fiber.StatusNotFound,
+		},
+		{
+			name:       "No admin endpoints",
+			wantStatus: fiber.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, fakeMapping{}, test.options...)
+
+		// Calling it twice must not close the channel twice.
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("POST", "/admin/shutdown", nil)
+			if test.token != "" {
+				req.Header.Set(fiber.HeaderAuthorization, "Bearer "+test.token)
+			}
+			resp, err := serv.app.Test(req)
+			if err != nil {
+				t.Fatalf("TestAdminShutdown(%s): %s", test.name, err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("TestAdminShutdown(%s): got status %d, want %d", test.name, resp.StatusCode, test.wantStatus)
+			}
+		}
+
+		gotShutdown := false
+		select {
+		case <-serv.ShutdownRequested():
+			gotShutdown = true
+		default:
+		}
+		if gotShutdown != test.wantShutdown {
+			t.Errorf("TestAdminShutdown(%s): got shutdown requested == %v, want %v", test.name, gotShutdown, test.wantShutdown)
+		}
+	}
+}
+
+func TestAdminOptions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{name: "Empty token", options: []Option{WithAdminToken("")}},
+		{name: "Nil level", options: []Option{WithAdminToken("t"), WithLogLevel(nil)}},
+		{name: "Level without a token", options: []Option{WithLogLevel(&slog.LevelVar{})}},
+		{name: "Shutdown without a token", options: []Option{WithAdminShutdown()}},
+	}
+
+	for _, test := range tests {
+		if _, err := New(versions.Mapping{}, test.options...); err == nil {
+			t.Errorf("TestAdminOptions(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+}
+
+// childMapping is a fakeMapping whose versions each have a running child process.
+type childMapping struct {
+	fakeMapping
+	children map[versions.Version]*exec.Cmd
+	started  time.Time
+}
+
+func (c childMapping) Status() []versions.VersionStatus {
+	statuses := c.fakeMapping.Status()
+	for i, vs := range statuses {
+		if cmd := c.children[vs.Version]; cmd != nil {
+			statuses[i].Replicas[0].PID = cmd.Process.Pid
+			statuses[i].Replicas[0].Uptime = time.Since(c.started)
+		}
+	}
+	return statuses
+}
+
+func TestAdminStatus(t *testing.T) {
+	t.Parallel()
+
+	const token = "secret"
+
+	child := exec.Command("sleep", "60")
+	if err := child.Start(); err != nil {
+		t.Skipf("TestAdminStatus: could not start a child: %s", err)
+	}
+	t.Cleanup(func() {
+		child.Process.Kill()
+		child.Wait()
+	})
+
+	up := newStubUpstream(t, `{}`)
+	m := childMapping{
+		fakeMapping: fakeMapping{"1.0.0": "http://localhost:1", "1.1.0": up.URL, versions.Latest: up.URL},
+		children:    map[versions.Version]*exec.Cmd{"1.1.0": child},
+		started:     time.Now().Add(-time.Minute),
+	}
+	serv, err := New(versions.Mapping{}, WithAdminToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv.mapping = m
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{name: "No token", wantStatus: fiber.StatusUnauthorized},
+		{name: "Wrong token", token: "wrong", wantStatus: fiber.StatusUnauthorized},
+		{name: "Success", token: token, wantStatus: fiber.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/admin/status", nil)
+		if test.token != "" {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+test.token)
+		}
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestAdminStatus(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("TestAdminStatus(%s): got status %d, want %d", test.name, resp.StatusCode, test.wantStatus)
+			continue
+		}
+		if test.wantStatus != fiber.StatusOK {
+			continue
+		}
+
+		var got statusResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestAdminStatus(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if len(got.Versions) != 2 {
+			t.Fatalf("TestAdminStatus(%s): got %d versions, want 2: %s", test.name, len(got.Versions), b)
+		}
+		vs := got.Versions[1]
+		if vs.Version != "1.1.0" || !vs.Latest || vs.State != "ready" || !vs.Ready {
+			t.Errorf("TestAdminStatus(%s): got %+v, want version 1.1.0 that is latest and ready", test.name, vs)
+		}
+		if len(vs.Replicas) != 1 || vs.Replicas[0].PID != child.Process.Pid {
+			t.Fatalf("TestAdminStatus(%s): got replicas %+v, want one with PID %d", test.name, vs.Replicas, child.Process.Pid)
+		}
+		if vs.Replicas[0].Uptime != "1m0s" {
+			t.Errorf("TestAdminStatus(%s): got uptime %s, want 1m0s", test.name, vs.Replicas[0].Uptime)
+		}
+		if got.Versions[0].Version != "1.0.0" || got.Versions[0].Replicas[0].PID != 0 {
+			t.Errorf("TestAdminStatus(%s): got %+v, want version 1.0.0 with no PID", test.name, got.Versions[0])
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"sync"
+	"time"
+)
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed lets requests through. This is the normal state.
+	breakerClosed breakerState = iota
+	// breakerOpen rejects requests because the upstream has been failing.
+	breakerOpen
+	// breakerHalfOpen lets a single request through to find out if the upstream has recovered.
+	breakerHalfOpen
+)
+
+// String implements fmt.Stringer.
+func (b breakerState) String() string {
+	switch b {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// breaker is a circuit breaker for a single upstream. After threshold failures in a row it opens
+// and rejects requests. After cooldown it half-opens and lets one request through. If that request
+// succeeds it closes, otherwise it opens again.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// allow reports if a request may be sent to the upstream. If this returns true, the caller
+// must call record() with the result of the request, or release() if it has none.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		// Let this request through to test the upstream. Everyone else waits on its result.
+		b.state = breakerHalfOpen
+		return true
+	}
+	// Half-open, someone else is already testing the upstream.
+	return false
+}
+
+// record records the result of a request that allow() let through.
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives up a request that allow() let through without a result, such as one that ran out of
+// the client's deadline. A half-open breaker opens again, so the next request tests the upstream instead.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// current returns the current state of the breaker.
+func (b *breaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakers holds a circuit breaker for each upstream. A nil *breakers always allows requests,
+// which is what is used when circuit breaking is not enabled.
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+// get returns the breaker for the upstream at base, creating it if needed.
+func (b *breakers) get(base string) *breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.m[base]
+	if !ok {
+		br = &breaker{threshold: b.threshold, cooldown: b.cooldown}
+		b.m[base] = br
+	}
+	return br
+}
+
+// allow reports if a request may be sent to the upstream at base.
+func (b *breakers) allow(base string) bool {
+	if b == nil {
+		return true
+	}
+	return b.get(base).allow()
+}
+
+// record records the result of a request to the upstream at base and returns the resulting state.
+func (b *breakers) record(base string, success bool) breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	br := b.get(base)
+	br.record(success)
+	return br.current()
+}
+
+// release gives up a request to the upstream at base that allow() let through without a result.
+func (b *breakers) release(base string) {
+	if b == nil {
+		return
+	}
+	b.get(base).release()
+}
+
+// states returns the state of every upstream's breaker that is not closed.
+func (b *breakers) states() map[string]string {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states := map[string]string{}
+	for base, br := range b.m {
+		if st := br.current(); st != breakerClosed {
+			states[base] = st.String()
+		}
+	}
+	return states
+}
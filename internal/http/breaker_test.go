@@ -0,0 +1,198 @@
+package http
+
+import (
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestBreaker(t *testing.T) {
+	t.Parallel()
+
+	b := &breaker{threshold: 3, cooldown: 20 * time.Millisecond}
+
+	// Failures below the threshold keep it closed.
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("TestBreaker: closed breaker did not allow a request")
+		}
+		b.record(false)
+	}
+	if b.current() != breakerClosed {
+		t.Fatalf("TestBreaker: got state %s after 2 failures, want closed", b.current())
+	}
+
+	// A success resets the count.
+	b.allow()
+	b.record(true)
+	for i := 0; i < 3; i++ {
+		b.allow()
+		b.record(false)
+	}
+	if b.current() != breakerOpen {
+		t.Fatalf("TestBreaker: got state %s after 3 failures, want open", b.current())
+	}
+	if b.allow() {
+		t.Fatalf("TestBreaker: open breaker allowed a request before the cooldown")
+	}
+
+	// After the cooldown, one request is let through.
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow() {
+		t.Fatalf("TestBreaker: breaker did not half-open after the cooldown")
+	}
+	if b.allow() {
+		t.Fatalf("TestBreaker: half-open breaker allowed a second request")
+	}
+
+	// A failure while half-open opens it again.
+	b.record(false)
+	if b.current() != breakerOpen {
+		t.Fatalf("TestBreaker: got state %s after a half-open failure, want open", b.current())
+	}
+
+	// A success while half-open closes it.
+	time.Sleep(30 * time.Millisecond)
+	b.allow()
+	b.record(true)
+	if b.current() != breakerClosed {
+		t.Fatalf("TestBreaker: got state %s after a half-open success, want closed", b.current())
+	}
+}
+
+func TestCircuitBreakerForwarding(t *testing.T) {
+	t.Parallel()
+
+	var failing atomic.Bool
+	var calls atomic.Int32
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				calls.Add(1)
+				if failing.Load() {
+					w.WriteHeader(nethttp.StatusInternalServerError)
+					return
+				}
+				w.Write([]byte("ok"))
+			},
+		),
+	)
+	t.Cleanup(up.Close)
+
+	const cooldown = 50 * time.Millisecond
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, WithCircuitBreaker(3, cooldown))
+
+	send := func() int {
+		body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestCircuitBreakerForwarding: %s", err)
+		}
+		return resp.StatusCode
+	}
+
+	// Sustained failures trip the breaker.
+	failing.Store(true)
+	for i := 0; i < 3; i++ {
+		if got := send(); got != fiber.StatusBadGateway {
+			t.Fatalf("TestCircuitBreakerForwarding: got status %d while failing, want %d", got, fiber.StatusBadGateway)
+		}
+	}
+	if got := send(); got != fiber.StatusServiceUnavailable {
+		t.Fatalf("TestCircuitBreakerForwarding: got status %d with the breaker open, want %d", got, fiber.StatusServiceUnavailable)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("TestCircuitBreakerForwarding: upstream got %d calls, want 3 (open breaker must not call the upstream)", got)
+	}
+
+	// The breaker state is reported by /ready.
+	resp, err := serv.app.Test(httptest.NewRequest("GET", "/ready", nil))
+	if err != nil {
+		t.Fatalf("TestCircuitBreakerForwarding: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("TestCircuitBreakerForwarding: got /ready status %d, want %d", resp.StatusCode, fiber.StatusServiceUnavailable)
+	}
+
+	// The upstream recovers, after the cooldown a request closes the breaker.
+	failing.Store(false)
+	time.Sleep(2 * cooldown)
+	for i := 0; i < 3; i++ {
+		if got := send(); got != fiber.StatusOK {
+			t.Fatalf("TestCircuitBreakerForwarding: got status %d after recovery, want %d", got, fiber.StatusOK)
+		}
+	}
+	if got := serv.breakers.get(up.URL).current(); got != breakerClosed {
+		t.Errorf("TestCircuitBreakerForwarding: got breaker state %s after recovery, want closed", got)
+	}
+}
+
+func TestCircuitBreakerDeadlineProbe(t *testing.T) {
+	t.Parallel()
+
+	var slow atomic.Bool
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				if slow.Load() {
+					time.Sleep(200 * time.Millisecond)
+				}
+				w.Write([]byte("ok"))
+			},
+		),
+	)
+	t.Cleanup(up.Close)
+
+	const cooldown = 20 * time.Millisecond
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, WithCircuitBreaker(1, cooldown))
+	serv.breakers.get(up.URL).record(false)
+	time.Sleep(2 * cooldown)
+
+	send := func(name, deadline string) int {
+		body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+		req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body))
+		if deadline != "" {
+			req.Header.Set(DeadlineHeader, deadline)
+		}
+		resp, err := serv.app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("TestCircuitBreakerDeadlineProbe(%s): %s", name, err)
+		}
+		return resp.StatusCode
+	}
+
+	// The request that tests the agent baker runs out of the client's deadline, which says nothing about it.
+	slow.Store(true)
+	if got := send("deadline", "50ms"); got != fiber.StatusGatewayTimeout {
+		t.Fatalf("TestCircuitBreakerDeadlineProbe(deadline): got status %d, want %d", got, fiber.StatusGatewayTimeout)
+	}
+	if got := serv.breakers.get(up.URL).current(); got != breakerOpen {
+		t.Errorf("TestCircuitBreakerDeadlineProbe(deadline): got breaker state %s, want open", got)
+	}
+
+	// So the next request tests it instead, rather than every request being rejected for good.
+	slow.Store(false)
+	if got := send("after", ""); got != fiber.StatusOK {
+		t.Errorf("TestCircuitBreakerDeadlineProbe(after): got status %d, want %d", got, fiber.StatusOK)
+	}
+	if got := serv.breakers.get(up.URL).current(); got != breakerClosed {
+		t.Errorf("TestCircuitBreakerDeadlineProbe(after): got breaker state %s, want closed", got)
+	}
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(versions.Mapping{}, WithCircuitBreaker(0, time.Second)); err == nil {
+		t.Errorf("TestWithCircuitBreaker: got err == nil for a 0 threshold, want err != nil")
+	}
+	if _, err := New(versions.Mapping{}, WithCircuitBreaker(1, 0)); err == nil {
+		t.Errorf("TestWithCircuitBreaker: got err == nil for a 0 cooldown, want err != nil")
+	}
+}
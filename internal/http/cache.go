@@ -0,0 +1,135 @@
+package http
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+// CacheHeader is the HTTP response header that says if a response came from the cache set up with
+// WithResponseCache(). It is "hit" or "miss" and is only set on the endpoints that are cached.
+const CacheHeader = "X-BakedBaker-Cache"
+
+// cachedEndpoints are the endpoints whose responses WithResponseCache() caches. They only look things
+// up, so the same request to the same version gets the same answer.
+var cachedEndpoints = []string{"/getlatestsigimageconfig", "/getdistrosigimageconfig"}
+
+// WithResponseCache caches successful responses to the sig image config endpoints for ttl, so that
+// an identical request to the same version is answered without sending it to the agent baker.
+// Requests are identical if they are for the same endpoint and version, after versions.Latest is
+// resolved, and have the same body. Responses from before the versions changed, such as by
+// versions.Mapping.Refresh() restarting a version with a new binary, are not used. At most
+// maxEntries responses are kept, the least recently used are dropped first. Responses that are
+// streamed are not cached.
+func WithResponseCache(maxEntries int, ttl time.Duration) Option {
+	return func(s *Server) error {
+		if maxEntries < 1 {
+			return fmt.Errorf("response cache max entries must be at least 1, was %d", maxEntries)
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("response cache ttl must be positive, was %v", ttl)
+		}
+		s.cache = newResponseCache(maxEntries, ttl, s.clock)
+		return nil
+	}
+}
+
+// cacheKey identifies identical requests.
+type cacheKey struct {
+	// gen is the versions.Mapping.Generation() the version was resolved in.
+	gen      uint64
+	version  versions.Version
+	endpoint string
+	// sum is the SHA-256 of the body sent to the agent baker.
+	sum [sha256.Size]byte
+}
+
+// newCacheKey returns the cacheKey of a request with body to endpoint for version v, which must
+// not be versions.Latest, resolved in generation gen of the mapping.
+func newCacheKey(gen uint64, v versions.Version, endpoint string, body []byte) cacheKey {
+	return cacheKey{gen: gen, version: v, endpoint: endpoint, sum: sha256.Sum256(body)}
+}
+
+// cacheEntry is a response in the responseCache.
+type cacheEntry struct {
+	key     cacheKey
+	res     forwardResult
+	expires time.Time
+}
+
+// responseCache is an LRU cache of agent baker responses whose entries expire after a TTL.
+// A nil *responseCache caches nothing.
+type responseCache struct {
+	max int
+	ttl time.Duration
+	// clock is what entries expire by.
+	clock clock.Clock
+
+	mu sync.Mutex
+	// lru holds *cacheEntry, the most recently used at the front.
+	lru *list.List
+	m   map[cacheKey]*list.Element
+}
+
+func newResponseCache(maxEntries int, ttl time.Duration, c clock.Clock) *responseCache {
+	return &responseCache{max: maxEntries, ttl: ttl, clock: c, lru: list.New(), m: map[cacheKey]*list.Element{}}
+}
+
+// get returns the response cached for key. The returned forwardResult can be changed by the caller.
+func (r *responseCache) get(key cacheKey) (forwardResult, bool) {
+	if r == nil {
+		return forwardResult{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.m[key]
+	if !ok {
+		return forwardResult{}, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if r.clock.Now().After(entry.expires) {
+		r.lru.Remove(e)
+		delete(r.m, key)
+		return forwardResult{}, false
+	}
+	r.lru.MoveToFront(e)
+
+	res := entry.res
+	// The body we send may be changed on the way out, such as by compression, so every hit gets its own.
+	res.Body = bytes.Clone(entry.res.Body)
+	return res, true
+}
+
+// put caches res for key, dropping the least recently used response if the cache is full. Only
+// responses that are a 200 OK and were not streamed are cached.
+func (r *responseCache) put(key cacheKey, res forwardResult) {
+	if r == nil || res.Status != fiber.StatusOK || res.stream != nil {
+		return
+	}
+	res.Body = bytes.Clone(res.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := &cacheEntry{key: key, res: res, expires: r.clock.Now().Add(r.ttl)}
+	if e, ok := r.m[key]; ok {
+		e.Value = entry
+		r.lru.MoveToFront(e)
+		return
+	}
+	r.m[key] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.max {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.m, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,181 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestWithResponseCache(t *testing.T) {
+	t.Parallel()
+
+	// The agent baker answers with how many requests it has had, so a cached answer is easy to spot.
+	var calls atomic.Int32
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				if r.URL.Path == upstreamHealthPath {
+					return
+				}
+				n := calls.Add(1)
+				fmt.Fprintf(w, `{"call":%d}`, n)
+			},
+		),
+	)
+	t.Cleanup(up.Close)
+
+	m := genMapping{fakeMapping: fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL}, gen: &atomic.Uint64{}}
+	serv := newTestServer(t, nil, WithResponseCache(10, time.Hour))
+	serv.mapping = m
+
+	const westus = `{"Region":"westus"}`
+	steps := []struct {
+		name string
+		// refresh replaces the versions before the request, as a restart with a new binary would.
+		refresh   bool
+		path      string
+		body      string
+		wantCache string
+		wantBody  string
+		wantCalls int32
+	}{
+		{name: "First request", path: "/getlatestsigimageconfig", body: westus, wantCache: "miss", wantBody: `{"call":1}`, wantCalls: 1},
+		{name: "Identical request", path: "/getlatestsigimageconfig", body: westus, wantCache: "hit", wantBody: `{"call":1}`, wantCalls: 1},
+		{
+			name:      "Same request for the version latest resolves to",
+			path:      "/getlatestsigimageconfig",
+			body:      `{"ABVersion":"1.0.0","Req":` + westus + `}`,
+			wantCache: "hit",
+			wantBody:  `{"call":1}`,
+			wantCalls: 1,
+		},
+		{name: "Different body", path: "/getlatestsigimageconfig", body: `{"Region":"eastus"}`, wantCache: "miss", wantBody: `{"call":2}`, wantCalls: 2},
+		{name: "Different endpoint", path: "/getdistrosigimageconfig", body: westus, wantCache: "miss", wantBody: `{"call":3}`, wantCalls: 3},
+		{name: "Different endpoint again", path: "/getdistrosigimageconfig", body: westus, wantCache: "hit", wantBody: `{"call":3}`, wantCalls: 3},
+		{
+			name:      "After the versions changed",
+			refresh:   true,
+			path:      "/getdistrosigimageconfig",
+			body:      westus,
+			wantCache: "miss",
+			wantBody:  `{"call":4}`,
+			wantCalls: 4,
+		},
+		{name: "Identical request after the versions changed", path: "/getdistrosigimageconfig", body: westus, wantCache: "hit", wantBody: `{"call":4}`, wantCalls: 4},
+	}
+
+	for _, step := range steps {
+		if step.refresh {
+			m.refresh(fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL})
+		}
+		req := httptest.NewRequest("POST", step.path, strings.NewReader(step.body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestWithResponseCache(%s): %s", step.name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestWithResponseCache(%s): got status %d, want %d", step.name, resp.StatusCode, fiber.StatusOK)
+		}
+		if got := resp.Header.Get(CacheHeader); got != step.wantCache {
+			t.Errorf("TestWithResponseCache(%s): got %s header %q, want %q", step.name, CacheHeader, got, step.wantCache)
+		}
+		if got := resp.Header.Get(ResolvedVersionHeader); got != "1.0.0" {
+			t.Errorf("TestWithResponseCache(%s): got %s header %q, want 1.0.0", step.name, ResolvedVersionHeader, got)
+		}
+		if string(b) != step.wantBody {
+			t.Errorf("TestWithResponseCache(%s): got body %s, want %s", step.name, b, step.wantBody)
+		}
+		if got := calls.Load(); got != step.wantCalls {
+			t.Errorf("TestWithResponseCache(%s): agent baker got %d requests, want %d", step.name, got, step.wantCalls)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	t.Parallel()
+
+	ok := func(body string) forwardResult {
+		return forwardResult{Status: fiber.StatusOK, Body: []byte(body)}
+	}
+	a := newCacheKey(0, "1.0.0", "/getlatestsigimageconfig", []byte("a"))
+	b := newCacheKey(0, "1.0.0", "/getlatestsigimageconfig", []byte("b"))
+	c := newCacheKey(0, "1.0.0", "/getlatestsigimageconfig", []byte("c"))
+
+	// The least recently used entry is dropped when the cache is full.
+	r := newResponseCache(2, time.Hour, clock.Real{})
+	r.put(a, ok("a"))
+	r.put(b, ok("b"))
+	r.get(a)
+	r.put(c, ok("c"))
+	if _, hit := r.get(b); hit {
+		t.Errorf("TestResponseCache: got a hit for the least recently used entry, want it dropped")
+	}
+	for _, k := range []cacheKey{a, c} {
+		if _, hit := r.get(k); !hit {
+			t.Errorf("TestResponseCache: got a miss for an entry that should be kept")
+		}
+	}
+	if got := r.lru.Len(); got != 2 {
+		t.Errorf("TestResponseCache: got %d entries, want 2", got)
+	}
+
+	// Changing what get() returns doesn't change the cache.
+	res, _ := r.get(a)
+	res.Body[0] = 'x'
+	if res, _ := r.get(a); string(res.Body) != "a" {
+		t.Errorf("TestResponseCache: got cached body %q, want %q", res.Body, "a")
+	}
+
+	// Errors are not cached.
+	r.put(b, forwardResult{Status: fiber.StatusInternalServerError, Body: []byte("b")})
+	if _, hit := r.get(b); hit {
+		t.Errorf("TestResponseCache: got a hit for a 500, want it not cached")
+	}
+
+	// Entries expire.
+	fake := clock.NewFake(time.Now())
+	r = newResponseCache(2, time.Minute, fake)
+	r.put(a, ok("a"))
+	fake.Advance(59 * time.Second)
+	if _, hit := r.get(a); !hit {
+		t.Errorf("TestResponseCache: got a miss for an entry before it expired")
+	}
+	fake.Advance(2 * time.Second)
+	if _, hit := r.get(a); hit {
+		t.Errorf("TestResponseCache: got a hit for an expired entry")
+	}
+	if got := r.lru.Len(); got != 0 {
+		t.Errorf("TestResponseCache: got %d entries after expiry, want 0", got)
+	}
+}
+
+func TestWithResponseCacheBad(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		max  int
+		ttl  time.Duration
+	}{
+		{name: "No entries", max: 0, ttl: time.Minute},
+		{name: "No ttl", max: 10, ttl: 0},
+	}
+
+	for _, test := range tests {
+		if _, err := New(versions.Mapping{}, WithResponseCache(test.max, test.ttl)); err == nil {
+			t.Errorf("TestWithResponseCacheBad(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+// CanaryKeyHeader is the HTTP header a client can set to choose what decides if its requests for
+// versions.Latest go to a canary version, see WithCanary(). Requests with the same key always go to the
+// same version. Without it, the client's IP address is the key.
+const CanaryKeyHeader = "X-BakedBaker-Canary-Key"
+
+// canary is a version that gets percent of the requests for versions.Latest.
+type canary struct {
+	version versions.Version
+	percent int
+}
+
+// WithCanary sends percent of the requests for versions.Latest to version v instead of the version
+// Latest points to, which lets a new version take a little real traffic before it becomes Latest.
+// Which requests go to v is decided by a hash of the CanaryKeyHeader, or the client IP if that isn't
+// set, so a client keeps getting the same version. This can be used more than once for several canaries,
+// whose percentages must not add up to more than 100. Requests for v itself are not affected, nor are
+// requests for Latest while v isn't one of our versions.
+func WithCanary(v versions.Version, percent int) Option {
+	return func(s *Server) error {
+		if v == "" || v == versions.Latest {
+			return fmt.Errorf("canary version must be a concrete version, was %q", v)
+		}
+		if percent < 1 || percent > 100 {
+			return fmt.Errorf("canary version(%s) percent must be between 1 and 100, was %d", v, percent)
+		}
+		total := percent
+		for _, c := range s.canaries {
+			if c.version == v {
+				return fmt.Errorf("canary version(%s) is set more than once", v)
+			}
+			total += c.percent
+		}
+		if total > 100 {
+			return fmt.Errorf("canary version(%s) makes the canary percentages add up to %d, more than 100", v, total)
+		}
+		s.canaries = append(s.canaries, canary{version: v, percent: percent})
+		return nil
+	}
+}
+
+// canaryKey returns the key that decides which canary, if any, the request in c goes to.
+func canaryKey(c *fiber.Ctx) string {
+	if key := c.Get(CanaryKeyHeader); key != "" {
+		return key
+	}
+	return c.IP()
+}
+
+// route returns the version a request for ver with the canary key should go to. This is ver, unless
+// ver is versions.Latest and key falls in a canary's share of the requests.
+func (s *Server) route(ver versions.Version, key string) versions.Version {
+	if ver != versions.Latest || len(s.canaries) == 0 {
+		return ver
+	}
+
+	// Each key lands in one of 100 buckets, the canaries take the first ones and Latest has the rest.
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	bucket := int(h.Sum32() % 100)
+	for _, c := range s.canaries {
+		if bucket < c.percent {
+			if !s.mapping.Has(c.version) {
+				return ver
+			}
+			return c.version
+		}
+		bucket -= c.percent
+	}
+	return ver
+}
@@ -0,0 +1,155 @@
+package http
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestWithCanary(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		canaries []canary
+		wantErr  bool
+	}{
+		{name: "One canary", canaries: []canary{{"1.1.0", 10}}},
+		{name: "All of latest", canaries: []canary{{"1.1.0", 100}}},
+		{name: "Several canaries", canaries: []canary{{"1.1.0", 10}, {"1.2.0", 90}}},
+		{name: "Error: no version", canaries: []canary{{"", 10}}, wantErr: true},
+		{name: "Error: latest", canaries: []canary{{versions.Latest, 10}}, wantErr: true},
+		{name: "Error: no percent", canaries: []canary{{"1.1.0", 0}}, wantErr: true},
+		{name: "Error: over 100 percent", canaries: []canary{{"1.1.0", 101}}, wantErr: true},
+		{name: "Error: set twice", canaries: []canary{{"1.1.0", 10}, {"1.1.0", 10}}, wantErr: true},
+		{name: "Error: adds up to over 100", canaries: []canary{{"1.1.0", 60}, {"1.2.0", 50}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		var options []Option
+		for _, c := range test.canaries {
+			options = append(options, WithCanary(c.version, c.percent))
+		}
+		_, err := New(versions.Mapping{}, options...)
+		switch {
+		case err == nil && test.wantErr:
+			t.Errorf("TestWithCanary(%s): got err == nil, want err != nil", test.name)
+		case err != nil && !test.wantErr:
+			t.Errorf("TestWithCanary(%s): got err == %s, want err == nil", test.name, err)
+		}
+	}
+}
+
+func TestCanarySplit(t *testing.T) {
+	t.Parallel()
+
+	const keys = 10000
+
+	tests := []struct {
+		name     string
+		mapping  fakeMapping
+		canaries []canary
+		// want is the share of the keys each version should get, in percent.
+		want map[versions.Version]float64
+	}{
+		{
+			name:    "No canary",
+			mapping: fakeMapping{"1.0.0": "a", "1.1.0": "b", versions.Latest: "a"},
+			want:    map[versions.Version]float64{versions.Latest: 100},
+		},
+		{
+			name:     "One canary",
+			mapping:  fakeMapping{"1.0.0": "a", "1.1.0": "b", versions.Latest: "a"},
+			canaries: []canary{{"1.1.0", 10}},
+			want:     map[versions.Version]float64{versions.Latest: 90, "1.1.0": 10},
+		},
+		{
+			name:     "Two canaries",
+			mapping:  fakeMapping{"1.0.0": "a", "1.1.0": "b", "1.2.0": "c", versions.Latest: "a"},
+			canaries: []canary{{"1.1.0", 5}, {"1.2.0", 25}},
+			want:     map[versions.Version]float64{versions.Latest: 70, "1.1.0": 5, "1.2.0": 25},
+		},
+		{
+			name:     "Canary we don't have",
+			mapping:  fakeMapping{"1.0.0": "a", versions.Latest: "a"},
+			canaries: []canary{{"1.1.0", 10}},
+			want:     map[versions.Version]float64{versions.Latest: 100},
+		},
+	}
+
+	for _, test := range tests {
+		var options []Option
+		for _, c := range test.canaries {
+			options = append(options, WithCanary(c.version, c.percent))
+		}
+		serv := newTestServer(t, test.mapping, options...)
+
+		got := map[versions.Version]int{}
+		for i := 0; i < keys; i++ {
+			got[serv.route(versions.Latest, fmt.Sprintf("client-%d", i))]++
+		}
+		for v, share := range test.want {
+			// Hashing isn't perfectly even, 1.5 percentage points is over 4 standard deviations at 10000 keys.
+			if gotShare := float64(got[v]) * 100 / keys; math.Abs(gotShare-share) > 1.5 {
+				t.Errorf("TestCanarySplit(%s): version(%s) got %.1f%% of requests, want %.1f%%", test.name, v, gotShare, share)
+			}
+		}
+		for v := range got {
+			if _, ok := test.want[v]; !ok {
+				t.Errorf("TestCanarySplit(%s): version(%s) got %d requests, want none", test.name, v, got[v])
+			}
+		}
+
+		// Only requests for Latest are split.
+		if got := serv.route("1.0.0", "client-0"); got != "1.0.0" {
+			t.Errorf("TestCanarySplit(%s): got a request for 1.0.0 routed to %s", test.name, got)
+		}
+	}
+}
+
+func TestCanarySticky(t *testing.T) {
+	t.Parallel()
+
+	old := newStubUpstream(t, `{}`)
+	canaryUp := newStubUpstream(t, `{}`)
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": old.URL, "1.1.0": canaryUp.URL, versions.Latest: old.URL},
+		WithCanary("1.1.0", 50),
+	)
+
+	// With a 50% canary, some of these keys go to each version.
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		var first string
+		for j := 0; j < 5; j++ {
+			req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(`{"ABVersion":"latest","Req":{"Region":"westus"}}`))
+			req.Header.Set(CanaryKeyHeader, key)
+			resp, err := serv.app.Test(req)
+			if err != nil {
+				t.Fatalf("TestCanarySticky: %s", err)
+			}
+			if resp.StatusCode != fiber.StatusOK {
+				t.Fatalf("TestCanarySticky: got status %d, want %d", resp.StatusCode, fiber.StatusOK)
+			}
+			got := resp.Header.Get(ResolvedVersionHeader)
+			if j == 0 {
+				first = got
+				seen[got] = true
+				continue
+			}
+			if got != first {
+				t.Errorf("TestCanarySticky: key(%s) went to %s and then %s, want the same version every time", key, first, got)
+			}
+		}
+	}
+	if !seen["1.0.0"] || !seen["1.1.0"] {
+		t.Errorf("TestCanarySticky: got requests served by %v, want both 1.0.0 and 1.1.0", seen)
+	}
+}
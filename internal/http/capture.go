@@ -0,0 +1,173 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+)
+
+// redacted replaces the values of redacted fields in a capture.
+const redacted = "REDACTED"
+
+// WithCapture writes every request sent to an agent baker, and what it answered, to w. This is for
+// debugging behavior that only some versions have. Each exchange is a line of JSON, see captureEntry,
+// which has the body that was sent, before any WithRequestTransform(), so the request can be replayed
+// against the same version and go through the same transforms.
+// The values of object members named in redact, such as "ClientSecret", are replaced with "REDACTED"
+// at any depth of the request and response bodies. A body that isn't JSON can't be searched for them,
+// so it is replaced with "REDACTED" as a whole. Responses that are streamed are recorded without
+// their body and responses from the WithResponseCache() cache are not recorded.
+func WithCapture(w io.Writer, redact ...string) Option {
+	return func(s *Server) error {
+		if w == nil {
+			return fmt.Errorf("capture writer cannot be nil")
+		}
+		fields := make(map[string]bool, len(redact))
+		for _, f := range redact {
+			if f == "" {
+				return fmt.Errorf("capture redact field cannot be empty")
+			}
+			fields[f] = true
+		}
+		s.capture = &capture{w: w, redact: fields}
+		return nil
+	}
+}
+
+// captureEntry is an exchange with an agent baker, as written by WithCapture().
+type captureEntry struct {
+	Time time.Time `json:"time"`
+	// Version is the version the request was sent to, never versions.Latest.
+	Version versions.Version `json:"version"`
+	// Endpoint is the route that handled the request, Path is the path sent to the agent baker.
+	Endpoint string `json:"endpoint"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	// Request is the body sent to the agent baker, before any WithRequestTransform() changed it.
+	Request jsontext.Value `json:"request,omitempty"`
+	// Status is the status the agent baker answered with. It is 0 if it didn't answer.
+	Status int `json:"status,omitzero"`
+	// Response is the body the agent baker answered with. A body that isn't JSON is a JSON string,
+	// which is "REDACTED" if fields are redacted. The same goes for Request.
+	Response jsontext.Value `json:"response,omitempty"`
+	// Streamed is set if the response was streamed to the client, so Response is empty.
+	Streamed bool `json:"streamed,omitzero"`
+	// Error is why the agent baker didn't answer.
+	Error string `json:"error,omitempty"`
+}
+
+// capture writes captureEntry lines for WithCapture(). A nil *capture records nothing.
+type capture struct {
+	// mu keeps the lines of concurrent requests from being interleaved.
+	mu sync.Mutex
+	w  io.Writer
+	// redact are the names of the object members whose values are redacted.
+	redact map[string]bool
+}
+
+// record writes an entry for req, which was handled by endpoint and sent to version v, where the
+// agent baker answered with res or didn't answer because of err. body is recorded as the request body,
+// which is req.Body before any WithRequestTransform(). Failing to write is logged, as the request
+// itself was fine.
+func (c *capture) record(log *slog.Logger, v versions.Version, endpoint string, body []byte, req upstreamRequest, res forwardResult, err error) {
+	if c == nil {
+		return
+	}
+
+	entry := captureEntry{
+		Time:     time.Now().UTC(),
+		Version:  v,
+		Endpoint: endpoint,
+		Method:   req.Method,
+		Path:     req.Path,
+		Request:  c.value(body),
+		Status:   res.Status,
+		Streamed: res.stream != nil,
+	}
+	if res.stream == nil {
+		entry.Response = c.value(res.Body)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Warn("could not encode a capture entry", "version", v, "endpoint", endpoint, "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.w.Write(line); err != nil {
+		log.Warn("could not write a capture entry", "version", v, "endpoint", endpoint, "err", err)
+	}
+}
+
+// value returns b as a JSON value with its redacted fields replaced. A b that isn't JSON is
+// returned as a JSON string, unless fields are redacted. We can't find the fields in it then,
+// so it is replaced with redacted as a whole.
+func (c *capture) value(b []byte) jsontext.Value {
+	if len(b) == 0 {
+		return nil
+	}
+	if !jsontext.Value(b).IsValid() {
+		if len(c.redact) > 0 {
+			s, _ := json.Marshal(redacted)
+			return s
+		}
+		s, _ := json.Marshal(string(b))
+		return s
+	}
+	if len(c.redact) == 0 {
+		return bytes.Clone(b)
+	}
+	v, err := redactJSON(b, c.redact)
+	if err != nil {
+		// b is valid JSON, so this doesn't happen. We still must not write what we couldn't redact.
+		s, _ := json.Marshal(redacted)
+		return s
+	}
+	return v
+}
+
+// redactJSON returns b, which must be valid JSON, with the values of object members named in fields
+// replaced with redacted. The order of members is kept.
+func redactJSON(b []byte, fields map[string]bool) (jsontext.Value, error) {
+	dec := jsontext.NewDecoder(bytes.NewReader(b))
+	out := &bytes.Buffer{}
+	enc := jsontext.NewEncoder(out)
+	for {
+		tok, err := dec.ReadToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := enc.WriteToken(tok); err != nil {
+			return nil, err
+		}
+
+		// Names are the odd numbered tokens in an object.
+		kind, n := dec.StackIndex(dec.StackDepth())
+		if kind != '{' || n%2 != 1 || !fields[tok.String()] {
+			continue
+		}
+		if err := dec.SkipValue(); err != nil {
+			return nil, err
+		}
+		if err := enc.WriteToken(jsontext.String(redacted)); err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimRight(out.Bytes(), "\n"), nil
+}
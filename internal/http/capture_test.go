@@ -0,0 +1,135 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestWithCapture(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{"SubscriptionID":"sub","TenantID":"tenant"}`)
+	out := &bytes.Buffer{}
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL},
+		WithCapture(out, "TenantID"),
+		// Replaying the capture runs the transforms again, so the capture must not have their changes.
+		WithRequestTransform("1.0.0", func(b []byte) ([]byte, error) {
+			return bytes.Replace(b, []byte(`"westus"`), []byte(`"eastus"`), 1), nil
+		}),
+	)
+
+	body := `{"ABVersion":"latest","Req":{"Region":"westus","TenantID":"tenant"}}`
+	resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("TestWithCapture: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("TestWithCapture: got status %d, want %d", resp.StatusCode, fiber.StatusOK)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("TestWithCapture: got %d capture entries, want 1:\n%s", len(lines), out)
+	}
+	var got captureEntry
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("TestWithCapture: could not decode the capture entry(%s): %s", lines[0], err)
+	}
+	if got.Time.IsZero() {
+		t.Errorf("TestWithCapture: capture entry has no time")
+	}
+	got.Time = got.Time.UTC().Truncate(0)
+
+	want := captureEntry{
+		Time:     got.Time,
+		Version:  "1.0.0",
+		Endpoint: "/getlatestsigimageconfig",
+		Method:   "POST",
+		Path:     "/getlatestsigimageconfig",
+		Request:  []byte(`{"Region":"westus","TenantID":"REDACTED"}`),
+		Status:   fiber.StatusOK,
+		Response: []byte(`{"SubscriptionID":"sub","TenantID":"REDACTED"}`),
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("TestWithCapture: -want/+got:\n%s", diff)
+	}
+	// Only the capture is redacted, not what is sent.
+	if !strings.Contains(up.lastBody(), `"TenantID":"tenant"`) || !strings.Contains(up.lastBody(), `"eastus"`) {
+		t.Errorf("TestWithCapture: the agent baker got %s, want the unredacted, transformed request", up.lastBody())
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	t.Parallel()
+
+	fields := map[string]bool{"Secret": true}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "Top level", in: `{"Secret":"s","Other":"o"}`, want: `{"Secret":"REDACTED","Other":"o"}`},
+		{name: "Nested object value", in: `{"A":{"Secret":{"x":[1,2]}}}`, want: `{"A":{"Secret":"REDACTED"}}`},
+		{name: "In an array", in: `[{"Secret":1},{"Other":2}]`, want: `[{"Secret":"REDACTED"},{"Other":2}]`},
+		{name: "Values are not names", in: `{"Other":"Secret","List":["Secret"]}`, want: `{"Other":"Secret","List":["Secret"]}`},
+		{name: "Not an object", in: `"Secret"`, want: `"Secret"`},
+	}
+
+	for _, test := range tests {
+		got, err := redactJSON([]byte(test.in), fields)
+		if err != nil {
+			t.Errorf("TestRedactJSON(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("TestRedactJSON(%s): got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCaptureValue(t *testing.T) {
+	t.Parallel()
+
+	c := &capture{w: io.Discard}
+	if got := string(c.value([]byte("not json"))); got != `"not json"` {
+		t.Errorf("TestCaptureValue: got %s for a body that isn't JSON, want it as a JSON string", got)
+	}
+	if got := c.value(nil); got != nil {
+		t.Errorf("TestCaptureValue: got %s for an empty body, want nil", got)
+	}
+
+	// A body that isn't JSON can't be searched for the redacted fields, so none of it is kept.
+	c = &capture{w: io.Discard, redact: map[string]bool{"ClientSecret": true}}
+	if got := string(c.value([]byte("ClientSecret=hunter2"))); got != `"`+redacted+`"` {
+		t.Errorf("TestCaptureValue: got %s for a body that isn't JSON with redaction on, want %q", got, redacted)
+	}
+}
+
+func TestWithCaptureBad(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		option Option
+	}{
+		{name: "Nil writer", option: WithCapture(nil)},
+		{name: "Empty redact field", option: WithCapture(io.Discard, "")},
+	}
+
+	for _, test := range tests {
+		if _, err := New(versions.Mapping{}, test.option); err == nil {
+			t.Errorf("TestWithCaptureBad(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+}
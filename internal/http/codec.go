@@ -0,0 +1,342 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/gofiber/fiber/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MIMEApplicationMsgpack is the content type for MessagePack bodies. Clients can send requests
+// in MessagePack by setting the Content-Type header to this and can ask for MessagePack responses
+// by setting the Accept header to this.
+const MIMEApplicationMsgpack = "application/msgpack"
+
+// codec converts between an encoding a client uses and JSON, which is what agent bakers use.
+// Request bodies are converted to JSON before we look at them, so nothing past the edge
+// of the Server needs to know what encoding the client used.
+type codec interface {
+	// contentType is the MIME type of the encoding.
+	contentType() string
+	// toJSON converts b from this encoding to JSON. b is from the client, so if converting it means decoding
+	// it, bodies nested deeper than maxBodyDepth must be rejected first, and what was decoded is encoded with
+	// wc. The JSON it returns is checked by versionedRequest() before it is decoded.
+	toJSON(b []byte, wc WrapperCodec) ([]byte, error)
+	// fromJSON converts JSON in b to this encoding.
+	fromJSON(b []byte) ([]byte, error)
+}
+
+// codecs are the codecs we support. The first is the default.
+var codecs = []codec{jsonCodec{}, msgpackCodec{}}
+
+// requestContentType returns the media type of the request's Content-Type, without parameters such as charset.
+func requestContentType(c *fiber.Ctx) string {
+	return strings.TrimSpace(strings.Split(c.Get(fiber.HeaderContentType), ";")[0])
+}
+
+// requestCodec returns the codec for the body of the request, based on its Content-Type.
+// If the Content-Type isn't one we know, we assume JSON. checkContentType() rejects those for
+// requests with a body.
+func requestCodec(c *fiber.Ctx) codec {
+	ct := requestContentType(c)
+	for _, cd := range codecs {
+		if strings.EqualFold(ct, cd.contentType()) {
+			return cd
+		}
+	}
+	return codecs[0]
+}
+
+// responseCodec returns the codec to use for the response, based on the Accept header.
+// If the client accepts anything, the response uses the same codec as the request.
+func responseCodec(c *fiber.Ctx) codec {
+	in := requestCodec(c)
+	offers := []string{in.contentType()}
+	for _, cd := range codecs {
+		if cd != in {
+			offers = append(offers, cd.contentType())
+		}
+	}
+
+	accepted := c.Accepts(offers...)
+	for _, cd := range codecs {
+		if accepted == cd.contentType() {
+			return cd
+		}
+	}
+	return in
+}
+
+// checkContentType returns a 415 Unsupported Media Type error if the request has a body and its
+// Content-Type isn't the content type of one of our codecs. A body without a Content-Type is JSON,
+// which is what clients that predate codecs send. Only the endpoints we have handlers for are checked.
+func checkContentType(c *fiber.Ctx) error {
+	ct := requestContentType(c)
+	if ct == "" || len(c.Body()) == 0 {
+		return nil
+	}
+	supported := make([]string, 0, len(codecs))
+	for _, cd := range codecs {
+		if strings.EqualFold(ct, cd.contentType()) {
+			return nil
+		}
+		supported = append(supported, cd.contentType())
+	}
+	return fiber.NewError(
+		fiber.StatusUnsupportedMediaType,
+		fmt.Sprintf("Content-Type %s is not supported, use one of: %s", ct, strings.Join(supported, ", ")),
+	)
+}
+
+// jsonBody returns the body of the request as JSON, which is encoded with wc if the client sent another
+// encoding. Callers must have called checkContentType().
+func jsonBody(c *fiber.Ctx, wc WrapperCodec) ([]byte, error) {
+	body := c.Body()
+	if len(body) == 0 {
+		return body, nil
+	}
+	b, err := requestCodec(c).toJSON(body, wc)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the %s body: %w", requestCodec(c).contentType(), err)
+	}
+	return b, nil
+}
+
+// WrapperCodec encodes and decodes the JSON of request bodies. It decodes the bodies the Server unwraps: the
+// VersionedReq wrapper and the request in it, or the request if it has no wrapper. The Server has checked
+// that those are JSON that is no deeper than it accepts, and decodes each once. It encodes the bodies that
+// clients sent in another encoding, such as MessagePack, once they have been decoded. By default, the
+// Server uses the json package, see WithWrapperCodec().
+type WrapperCodec interface {
+	// Unmarshal decodes b into v, which is a pointer. If strict is set, b must not have fields that v does not.
+	// A jsontext.Value field must be decoded as its encoded bytes, unchanged.
+	Unmarshal(b []byte, v any, strict bool) error
+	// Marshal encodes v as JSON.
+	Marshal(v any) ([]byte, error)
+}
+
+// WithWrapperCodec sets the WrapperCodec that encodes and decodes request bodies, such as to use another
+// JSON package.
+func WithWrapperCodec(wc WrapperCodec) Option {
+	return func(s *Server) error {
+		if wc == nil {
+			return fmt.Errorf("WithWrapperCodec() requires a WrapperCodec")
+		}
+		s.wrapper = wc
+		return nil
+	}
+}
+
+// jsonWrapperCodec is the default WrapperCodec.
+type jsonWrapperCodec struct{}
+
+// Unmarshal implements WrapperCodec.Unmarshal().
+func (jsonWrapperCodec) Unmarshal(b []byte, v any, strict bool) error {
+	if strict {
+		return json.Unmarshal(b, v, json.RejectUnknownMembers(true))
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Marshal implements WrapperCodec.Marshal().
+func (jsonWrapperCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// jsonCodec is the codec for JSON. It doesn't need to convert anything, so its bodies are first decoded,
+// and their depth checked, by versionedRequest().
+type jsonCodec struct{}
+
+func (jsonCodec) contentType() string                             { return fiber.MIMEApplicationJSON }
+func (jsonCodec) toJSON(b []byte, _ WrapperCodec) ([]byte, error) { return b, nil }
+func (jsonCodec) fromJSON(b []byte) ([]byte, error)               { return b, nil }
+
+// msgpackCodec is the codec for MessagePack.
+type msgpackCodec struct{}
+
+func (msgpackCodec) contentType() string { return MIMEApplicationMsgpack }
+
+// toJSON implements codec.toJSON(). The msgpack package decodes nested values by recursing, so a body
+// nested deeply enough overflows the stack, which can't be recovered from. Bodies nested deeper than
+// maxBodyDepth are rejected before they are decoded.
+func (msgpackCodec) toJSON(b []byte, wc WrapperCodec) ([]byte, error) {
+	if err := checkMsgpackDepth(b); err != nil {
+		return nil, err
+	}
+	var v any
+	if err := msgpack.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return wc.Marshal(v)
+}
+
+func (msgpackCodec) fromJSON(b []byte) ([]byte, error) {
+	v, err := jsonToAny(jsontext.Value(b))
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(v)
+}
+
+// checkMsgpackDepth returns an error if b does not start with a whole MessagePack value or the value is
+// nested deeper than maxBodyDepth. It walks the value without recursing, so it finds out before reading
+// any deeper. Anything after the value is left to the decoder.
+func checkMsgpackDepth(b []byte) error {
+	// remaining holds how many values are left to read at each level, the first being the one top value.
+	remaining := []uint64{1}
+	pos := 0
+	// length reads a big-endian length of size bytes at pos.
+	length := func(size int) (uint64, error) {
+		if len(b)-pos < size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		var n uint64
+		for _, c := range b[pos : pos+size] {
+			n = n<<8 | uint64(c)
+		}
+		pos += size
+		return n, nil
+	}
+
+	for len(remaining) > 0 {
+		last := len(remaining) - 1
+		if remaining[last] == 0 {
+			remaining = remaining[:last]
+			continue
+		}
+		remaining[last]--
+
+		if pos >= len(b) {
+			return io.ErrUnexpectedEOF
+		}
+		c := b[pos]
+		pos++
+
+		var (
+			// skip is the number of bytes of the value after its code and any length.
+			skip uint64
+			// items is the number of values in an array or map, counting keys and values of a map.
+			items     uint64
+			container bool
+			err       error
+		)
+		switch {
+		case c <= 0x7f, c >= 0xe0, c == 0xc0, c == 0xc2, c == 0xc3:
+			// Fixints, nil and bools are just their code.
+		case c >= 0x80 && c <= 0x8f:
+			items, container = 2*uint64(c&0x0f), true
+		case c >= 0x90 && c <= 0x9f:
+			items, container = uint64(c&0x0f), true
+		case c >= 0xa0 && c <= 0xbf:
+			skip = uint64(c & 0x1f)
+		case c == 0xcc, c == 0xd0:
+			skip = 1
+		case c == 0xcd, c == 0xd1:
+			skip = 2
+		case c == 0xca, c == 0xce, c == 0xd2:
+			skip = 4
+		case c == 0xcb, c == 0xcf, c == 0xd3:
+			skip = 8
+		case c >= 0xd4 && c <= 0xd8:
+			// fixext 1, 2, 4, 8 and 16, after a type byte.
+			skip = 1 + 1<<(c-0xd4)
+		case c == 0xc4, c == 0xd9:
+			skip, err = length(1)
+		case c == 0xc5, c == 0xda:
+			skip, err = length(2)
+		case c == 0xc6, c == 0xdb:
+			skip, err = length(4)
+		case c == 0xc7, c == 0xc8, c == 0xc9:
+			// ext 8, 16 and 32 have a type byte after the length.
+			skip, err = length(1 << (c - 0xc7))
+			skip++
+		case c == 0xdc:
+			items, err = length(2)
+			container = true
+		case c == 0xdd:
+			items, err = length(4)
+			container = true
+		case c == 0xde:
+			items, err = length(2)
+			items, container = 2*items, true
+		case c == 0xdf:
+			items, err = length(4)
+			items, container = 2*items, true
+		default:
+			return fmt.Errorf("invalid MessagePack code 0x%x", c)
+		}
+		if err != nil {
+			return err
+		}
+
+		if uint64(len(b)-pos) < skip {
+			return io.ErrUnexpectedEOF
+		}
+		pos += int(skip)
+		if container {
+			remaining = append(remaining, items)
+			if len(remaining)-1 > maxBodyDepth {
+				return fmt.Errorf("request body is nested more than %d levels deep", maxBodyDepth)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonToAny decodes JSON into the types it holds. Unlike decoding into an any with json.Unmarshal,
+// integers are kept as integers instead of becoming float64s, so they are encoded as integers.
+func jsonToAny(v jsontext.Value) (any, error) {
+	v = bytes.TrimSpace(v)
+	switch v.Kind() {
+	case '{':
+		var m map[string]jsontext.Value
+		if err := json.Unmarshal(v, &m); err != nil {
+			return nil, err
+		}
+		out := make(map[string]any, len(m))
+		for k, mv := range m {
+			a, err := jsonToAny(mv)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = a
+		}
+		return out, nil
+	case '[':
+		var l []jsontext.Value
+		if err := json.Unmarshal(v, &l); err != nil {
+			return nil, err
+		}
+		out := make([]any, len(l))
+		for i, lv := range l {
+			a, err := jsonToAny(lv)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = a
+		}
+		return out, nil
+	case '0':
+		s := string(v)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return u, nil
+		}
+		return strconv.ParseFloat(s, 64)
+	case '"', 't', 'f', 'n':
+		var a any
+		if err := json.Unmarshal(v, &a); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("invalid JSON: %q", v)
+}
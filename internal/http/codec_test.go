@@ -0,0 +1,463 @@
+package http
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestMsgpackForwarding(t *testing.T) {
+	t.Parallel()
+
+	const upResp = `{"ImageID":"img","Count":3,"Ratio":0.5,"Tags":["a","b"]}`
+
+	up := newStubUpstream(t, upResp)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL})
+
+	reqBody, err := msgpack.Marshal(
+		map[string]any{
+			"ABVersion": "1.0.0",
+			"Req":       map[string]any{"Region": "westus", "NewField": []any{1, 2, 3}},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		accept      string
+		wantMsgpack bool
+	}{
+		{name: "No Accept mirrors the request", wantMsgpack: true},
+		{name: "Accept msgpack", accept: MIMEApplicationMsgpack, wantMsgpack: true},
+		{name: "Accept JSON", accept: fiber.MIMEApplicationJSON},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/getlatestsigimageconfig", bytes.NewReader(reqBody))
+		req.Header.Set(fiber.HeaderContentType, MIMEApplicationMsgpack)
+		if test.accept != "" {
+			req.Header.Set(fiber.HeaderAccept, test.accept)
+		}
+
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestMsgpackForwarding(%s): %s", test.name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("TestMsgpackForwarding(%s): got status %d, want %d: %s", test.name, resp.StatusCode, fiber.StatusOK, b)
+		}
+
+		// The upstream must get the .Req as JSON.
+		var gotUp, wantUp any
+		if err := json.Unmarshal([]byte(up.lastBody()), &gotUp); err != nil {
+			t.Fatalf("TestMsgpackForwarding(%s): upstream got a body that isn't JSON(%s): %s", test.name, up.lastBody(), err)
+		}
+		json.Unmarshal([]byte(`{"Region":"westus","NewField":[1,2,3]}`), &wantUp)
+		if diff := pretty.Compare(wantUp, gotUp); diff != "" {
+			t.Errorf("TestMsgpackForwarding(%s): upstream body -want/+got:\n%s", test.name, diff)
+		}
+
+		if !test.wantMsgpack {
+			if string(b) != upResp {
+				t.Errorf("TestMsgpackForwarding(%s): got response %s, want %s", test.name, b, upResp)
+			}
+			continue
+		}
+
+		if got := resp.Header.Get(fiber.HeaderContentType); got != MIMEApplicationMsgpack {
+			t.Errorf("TestMsgpackForwarding(%s): got Content-Type %q, want %q", test.name, got, MIMEApplicationMsgpack)
+		}
+		var got map[string]any
+		if err := msgpack.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestMsgpackForwarding(%s): response is not msgpack: %s", test.name, err)
+		}
+		want := map[string]any{"ImageID": "img", "Count": int8(3), "Ratio": 0.5, "Tags": []any{"a", "b"}}
+		if diff := pretty.Compare(want, got); diff != "" {
+			t.Errorf("TestMsgpackForwarding(%s): response -want/+got:\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestMsgpackBadBody(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL})
+
+	req := httptest.NewRequest("POST", "/getlatestsigimageconfig", bytes.NewReader([]byte{0xc1}))
+	req.Header.Set(fiber.HeaderContentType, MIMEApplicationMsgpack)
+	resp, err := serv.app.Test(req)
+	if err != nil {
+		t.Fatalf("TestMsgpackBadBody: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("TestMsgpackBadBody: got status %d, want %d", resp.StatusCode, fiber.StatusBadRequest)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL})
+
+	const body = `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+	msgpackBody, err := msgpack.Marshal(map[string]any{"ABVersion": "1.0.0", "Req": map[string]any{"Region": "westus"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        []byte
+		wantStatus  int
+	}{
+		{name: "JSON", path: "/getlatestsigimageconfig", contentType: fiber.MIMEApplicationJSON, body: []byte(body), wantStatus: fiber.StatusOK},
+		{name: "JSON with a charset", path: "/getlatestsigimageconfig", contentType: "application/json; charset=utf-8", body: []byte(body), wantStatus: fiber.StatusOK},
+		{name: "No Content-Type is JSON", path: "/getlatestsigimageconfig", body: []byte(body), wantStatus: fiber.StatusOK},
+		{name: "MessagePack", path: "/getlatestsigimageconfig", contentType: MIMEApplicationMsgpack, body: msgpackBody, wantStatus: fiber.StatusOK},
+		{name: "Text", path: "/getlatestsigimageconfig", contentType: fiber.MIMETextPlain, body: []byte(body), wantStatus: fiber.StatusUnsupportedMediaType},
+		{name: "Form", path: "/getlatestsigimageconfig", contentType: fiber.MIMEApplicationForm, body: []byte("Region=westus"), wantStatus: fiber.StatusUnsupportedMediaType},
+		{name: "Text to a generic endpoint is not checked", path: "/some/other/endpoint", contentType: fiber.MIMETextPlain, body: []byte(body), wantStatus: fiber.StatusOK},
+		{name: "No body is not checked", method: "GET", path: "/some/other/endpoint", contentType: fiber.MIMETextPlain, wantStatus: fiber.StatusOK},
+	}
+
+	for _, test := range tests {
+		method := test.method
+		if method == "" {
+			method = "POST"
+		}
+		req := httptest.NewRequest(method, test.path, bytes.NewReader(test.body))
+		if test.contentType != "" {
+			req.Header.Set(fiber.HeaderContentType, test.contentType)
+		}
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestContentType(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.wantStatus {
+			b, _ := io.ReadAll(resp.Body)
+			t.Errorf("TestContentType(%s): got status %d, want %d: %s", test.name, resp.StatusCode, test.wantStatus, b)
+			continue
+		}
+		if test.wantStatus != fiber.StatusUnsupportedMediaType {
+			continue
+		}
+		var got errorResp
+		if err := json.UnmarshalRead(resp.Body, &got); err != nil {
+			t.Fatalf("TestContentType(%s): %s", test.name, err)
+		}
+		if !strings.Contains(got.Error, fiber.MIMEApplicationJSON) || !strings.Contains(got.Error, MIMEApplicationMsgpack) {
+			t.Errorf("TestContentType(%s): got error %q, want it to list the supported content types", test.name, got.Error)
+		}
+	}
+}
+
+// stdWrapperCodec is a WrapperCodec that uses encoding/json, rather than the json package the Server uses.
+type stdWrapperCodec struct{}
+
+func (stdWrapperCodec) Marshal(v any) ([]byte, error) {
+	return stdjson.Marshal(v)
+}
+
+func (stdWrapperCodec) Unmarshal(b []byte, v any, strict bool) error {
+	dec := stdjson.NewDecoder(bytes.NewReader(b))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+func TestWrapperCodec(t *testing.T) {
+	t.Parallel()
+
+	type Config struct {
+		Type string
+	}
+	type Other struct {
+		Other int
+	}
+
+	wc := stdWrapperCodec{}
+	encode := func(v any) []byte {
+		b, err := wc.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	config := encode(Config{Type: "test"})
+	other := encode(Other{Other: 1})
+
+	tests := []struct {
+		name    string
+		body    []byte
+		hdrVer  versions.Version
+		strict  bool
+		wantVer versions.Version
+		wantRaw []byte
+		err     bool
+	}{
+		{
+			name:    "Raw request is for latest",
+			body:    config,
+			wantVer: versions.Latest,
+			wantRaw: config,
+		},
+		{
+			name:    "Raw request with a version header",
+			body:    config,
+			hdrVer:  "2.0.0",
+			wantVer: "2.0.0",
+			wantRaw: config,
+		},
+		{
+			name:    "Versioned request",
+			body:    encode(versionedReq{ABVersion: "1.0.0", Req: config}),
+			hdrVer:  "2.0.0",
+			wantVer: "1.0.0",
+			wantRaw: config,
+		},
+		{
+			name: "Error: ABVersion is set, but Req is not",
+			body: encode(versionedReq{ABVersion: "1.0.0"}),
+			err:  true,
+		},
+		{
+			name: "Error: Req is set, but ABVersion is not",
+			body: encode(versionedReq{Req: config}),
+			err:  true,
+		},
+		{
+			name:   "Error: Strict request is not a Config",
+			body:   encode(versionedReq{ABVersion: "1.0.0", Req: other}),
+			strict: true,
+			err:    true,
+		},
+		{
+			name: "Error: Request is not a Config",
+			body: other,
+			err:  true,
+		},
+		{
+			name: "Error: Body can't be decoded",
+			body: []byte("unknown"),
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := versionedRequest[Config](wc, test.body, test.hdrVer, test.strict, nil)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestWrapperCodec(%s): got err == nil, want err != nil", test.name)
+			continue
+		case !test.err && err != nil:
+			t.Errorf("TestWrapperCodec(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+
+		if got.ver != test.wantVer {
+			t.Errorf("TestWrapperCodec(%s): got version %s, want %s", test.name, got.ver, test.wantVer)
+		}
+		if got.req != (Config{Type: "test"}) {
+			t.Errorf("TestWrapperCodec(%s): got config %+v, want %+v", test.name, got.req, Config{Type: "test"})
+		}
+		if !bytes.Equal(got.raw, test.wantRaw) {
+			t.Errorf("TestWrapperCodec(%s): got raw %s, want %s", test.name, got.raw, test.wantRaw)
+		}
+	}
+}
+
+// countingWrapperCodec is the default WrapperCodec, counting the bodies it encodes and decodes.
+type countingWrapperCodec struct {
+	jsonWrapperCodec
+	encoded, decoded *atomic.Int64
+}
+
+func (c countingWrapperCodec) Marshal(v any) ([]byte, error) {
+	c.encoded.Add(1)
+	return c.jsonWrapperCodec.Marshal(v)
+}
+
+func (c countingWrapperCodec) Unmarshal(b []byte, v any, strict bool) error {
+	c.decoded.Add(1)
+	return c.jsonWrapperCodec.Unmarshal(b, v, strict)
+}
+
+func TestWithWrapperCodec(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(versions.Mapping{}, WithWrapperCodec(nil)); err == nil {
+		t.Errorf("TestWithWrapperCodec(nil): got err == nil, want err != nil")
+	}
+
+	msgpackBody, err := msgpack.Marshal(map[string]any{"ABVersion": "1.0.0", "Req": map[string]any{"Region": "westus"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		// wantEncoded and wantDecoded are how many bodies the WrapperCodec must encode and decode.
+		wantEncoded, wantDecoded int64
+	}{
+		{
+			name:        "Raw request is decoded once",
+			contentType: fiber.MIMEApplicationJSON,
+			body:        `{"Region":"westus"}`,
+			wantDecoded: 1,
+		},
+		{
+			name:        "Versioned request decodes the wrapper and the request in it",
+			contentType: fiber.MIMEApplicationJSON,
+			body:        `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`,
+			wantDecoded: 2,
+		},
+		{
+			name:        "MessagePack is encoded to JSON",
+			contentType: MIMEApplicationMsgpack,
+			body:        string(msgpackBody),
+			wantEncoded: 1,
+			wantDecoded: 2,
+		},
+	}
+
+	up := newStubUpstream(t, `{}`)
+	for _, test := range tests {
+		wc := countingWrapperCodec{encoded: &atomic.Int64{}, decoded: &atomic.Int64{}}
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL}, WithWrapperCodec(wc))
+
+		req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(test.body))
+		req.Header.Set(fiber.HeaderContentType, test.contentType)
+		req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestWithWrapperCodec(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestWithWrapperCodec(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+		}
+		if got := wc.encoded.Load(); got != test.wantEncoded {
+			t.Errorf("TestWithWrapperCodec(%s): got %d bodies encoded by the WrapperCodec, want %d", test.name, got, test.wantEncoded)
+		}
+		if got := wc.decoded.Load(); got != test.wantDecoded {
+			t.Errorf("TestWithWrapperCodec(%s): got %d bodies decoded by the WrapperCodec, want %d", test.name, got, test.wantDecoded)
+		}
+	}
+}
+
+func TestCheckMsgpackDepth(t *testing.T) {
+	t.Parallel()
+
+	// nested returns depth arrays, each holding the next, around 1.
+	nested := func(depth int) any {
+		var v any = 1
+		for i := 0; i < depth; i++ {
+			v = []any{v}
+		}
+		return v
+	}
+	mustMarshal := func(v any) []byte {
+		b, err := msgpack.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	big := make([]any, 70000)
+	for i := range big {
+		big[i] = i
+	}
+	every := mustMarshal(
+		map[string]any{
+			"ints":    []any{0, -1, -100, 200, -200, 70000, -70000, 1 << 40, -1 << 40, uint64(1 << 63)},
+			"floats":  []any{float32(1.5), 2.5},
+			"strings": []any{"", "short", strings.Repeat("s", 300), strings.Repeat("s", 70000)},
+			"bytes":   []any{[]byte("b"), bytes.Repeat([]byte("b"), 300), bytes.Repeat([]byte("b"), 70000)},
+			"other":   []any{nil, true, false, time.Unix(1, 1)},
+			"array":   big,
+		},
+	)
+
+	tests := []struct {
+		name string
+		body []byte
+		err  bool
+	}{
+		{name: "Every kind of value", body: every},
+		{name: "Nested to the limit", body: mustMarshal(nested(maxBodyDepth))},
+		{name: "Trailing bytes are left to the decoder", body: append(mustMarshal(1), 1)},
+		{name: "Error: nested past the limit", body: mustMarshal(nested(maxBodyDepth + 1)), err: true},
+		{name: "Error: deeply nested arrays", body: bytes.Repeat([]byte{0x91}, 1<<20), err: true},
+		{name: "Error: deeply nested maps", body: bytes.Repeat([]byte{0x81, 0xa1, 'k'}, 1<<10), err: true},
+		{name: "Error: empty", body: nil, err: true},
+		{name: "Error: truncated", body: every[:len(every)-1], err: true},
+		{name: "Error: array longer than the body", body: []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0x01}, err: true},
+		{name: "Error: string longer than the body", body: []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}, err: true},
+		{name: "Error: never used code", body: []byte{0xc1}, err: true},
+	}
+
+	for _, test := range tests {
+		err := checkMsgpackDepth(test.body)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestCheckMsgpackDepth(%s): got err == nil, want err != nil", test.name)
+		case err != nil && !test.err:
+			t.Errorf("TestCheckMsgpackDepth(%s): got err == %s, want err == nil", test.name, err)
+		}
+	}
+}
+
+func TestMsgpackDeeplyNestedBody(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL})
+
+	// Decoding this by recursing would overflow the stack, which kills the process.
+	body := append([]byte{0x82, 0xa9}, "ABVersion"...)
+	body = append(body, 0xa5)
+	body = append(body, "1.0.0"...)
+	body = append(body, 0xa3, 'R', 'e', 'q')
+	body = append(body, bytes.Repeat([]byte{0x91}, 3<<20)...)
+	body = append(body, 0xc0)
+
+	req := httptest.NewRequest("POST", "/getlatestsigimageconfig", bytes.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, MIMEApplicationMsgpack)
+	resp, err := serv.app.Test(req)
+	if err != nil {
+		t.Fatalf("TestMsgpackDeeplyNestedBody: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("TestMsgpackDeeplyNestedBody: got status %d, want %d", resp.StatusCode, fiber.StatusBadRequest)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(b), "nested") {
+		t.Errorf("TestMsgpackDeeplyNestedBody: got error %s, want it to say the body is too deeply nested", b)
+	}
+	if up.lastBody() != "" {
+		t.Errorf("TestMsgpackDeeplyNestedBody: the body was sent to the agent baker")
+	}
+}
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+)
+
+// WithCompression turns compressing responses on or off. It is on by default. Some clients, or proxies
+// between us and them, mishandle compressed responses, and they can turn it off. Off also turns off
+// WithZstd().
+func WithCompression(on bool) Option {
+	return func(s *Server) error {
+		s.noCompress = !on
+		return nil
+	}
+}
+
+// WithCompressionMinSize stops responses smaller than n bytes from being compressed, as compressing
+// them costs more than it saves. Whatever n is, gzip, deflate and brotli are not used for responses
+// under 200 bytes. Responses that are streamed from an agent baker are of unknown size and are
+// compressed as before.
+func WithCompressionMinSize(n int) Option {
+	return func(s *Server) error {
+		if n < 0 {
+			return fmt.Errorf("compression min size must not be negative, was %d", n)
+		}
+		s.compressMin = n
+		return nil
+	}
+}
+
+// WithCompressionLevel sets how hard gzip, deflate and brotli work to make responses small, trading
+// CPU for bandwidth. The default is compress.LevelDefault. Use WithZstd() to set the level of zstd,
+// and WithCompression() to turn compression off.
+func WithCompressionLevel(level compress.Level) Option {
+	return func(s *Server) error {
+		if level < compress.LevelDefault || level > compress.LevelBestCompression {
+			return fmt.Errorf("compression level must be between %d and %d, was %d", compress.LevelDefault, compress.LevelBestCompression, level)
+		}
+		s.compressLevel = level
+		return nil
+	}
+}
+
+// compressor returns the fiber compress middleware, which compresses responses with brotli, gzip or
+// deflate, whichever the client prefers. Its Next hook skips it for clients that get zstd from
+// compressFilter() and for clients that ask for server-sent events, as it would hold events back
+// until it had enough to compress.
+func (s *Server) compressor() fiber.Handler {
+	return compress.New(
+		compress.Config{
+			Level: s.compressLevel,
+			Next: func(c *fiber.Ctx) bool {
+				return acceptsEvents(c.Get(fiber.HeaderAccept)) || s.zstd != nil && acceptsZstd(c.Get(fiber.HeaderAcceptEncoding))
+			},
+		},
+	)
+}
+
+// compressFilter returns the middleware that runs between compressor() and the handler. The Next hook
+// of compressor() only sees the request, so after the handler this keeps compressor() from compressing
+// responses that are under WithCompressionMinSize() or are server-sent events the client didn't ask for,
+// by hiding the client's Accept-Encoding from it. If WithZstd() was used, it compresses responses for
+// clients that accept zstd.
+func (s *Server) compressFilter() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		resp := c.Response()
+		// Reading the size of a streamed body would read the stream, which is what streaming avoids.
+		if isEventStream(&resp.Header) || !resp.IsBodyStream() && len(resp.Body()) < s.compressMin {
+			c.Request().Header.Del(fiber.HeaderAcceptEncoding)
+			return nil
+		}
+		if s.zstd == nil || !acceptsZstd(c.Get(fiber.HeaderAcceptEncoding)) {
+			return nil
+		}
+		c.Vary(fiber.HeaderAcceptEncoding)
+		// A streamed body would have to be read here to compress it, which is what streaming avoids.
+		if resp.IsBodyStream() || len(resp.Header.ContentEncoding()) > 0 || len(resp.Body()) == 0 {
+			return nil
+		}
+		// EncodeAll is safe to use from many requests at once.
+		resp.SetBodyRaw(s.zstd.EncodeAll(resp.Body(), nil))
+		resp.Header.SetContentEncoding("zstd")
+		return nil
+	}
+}
+
+// acceptsEvents reports if the Accept header value accept asks for server-sent events.
+func acceptsEvents(accept string) bool {
+	for _, mt := range strings.Split(accept, ",") {
+		mt, _, _ = strings.Cut(mt, ";")
+		if strings.EqualFold(strings.TrimSpace(mt), mimeEventStream) {
+			return true
+		}
+	}
+	return false
+}
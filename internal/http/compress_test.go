@@ -0,0 +1,182 @@
+package http
+
+import (
+	"compress/gzip"
+	"io"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+)
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	// This is 1313 bytes, which is big enough that the fiber compress middleware compresses it.
+	want := `{"Images":"` + strings.Repeat("ubuntu-22.04,", 100) + `"}`
+	up := newStubUpstream(t, want)
+
+	tests := []struct {
+		name         string
+		options      []Option
+		accept       string
+		wantEncoding string
+	}{
+		{
+			name:         "On by default",
+			accept:       "gzip",
+			wantEncoding: "gzip",
+		},
+		{
+			name:         "Turned on",
+			options:      []Option{WithCompression(true)},
+			accept:       "gzip",
+			wantEncoding: "gzip",
+		},
+		{
+			name:    "Turned off",
+			options: []Option{WithCompression(false)},
+			accept:  "gzip, br",
+		},
+		{
+			name:    "Turned off with zstd",
+			options: []Option{WithCompression(false), WithZstd(3)},
+			accept:  "zstd, gzip",
+		},
+		{
+			name:         "Response at the min size",
+			options:      []Option{WithCompressionMinSize(len(want))},
+			accept:       "gzip",
+			wantEncoding: "gzip",
+		},
+		{
+			name:    "Response under the min size",
+			options: []Option{WithCompressionMinSize(len(want) + 1)},
+			accept:  "gzip",
+		},
+		{
+			name:    "Response under the min size with zstd",
+			options: []Option{WithCompressionMinSize(len(want) + 1), WithZstd(3)},
+			accept:  "zstd",
+		},
+		{
+			name:         "Best speed",
+			options:      []Option{WithCompressionLevel(compress.LevelBestSpeed)},
+			accept:       "gzip",
+			wantEncoding: "gzip",
+		},
+		{
+			name:         "Best compression",
+			options:      []Option{WithCompressionLevel(compress.LevelBestCompression)},
+			accept:       "gzip",
+			wantEncoding: "gzip",
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, test.options...)
+
+		body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+		req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderAcceptEncoding, test.accept)
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestCompression(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestCompression(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+			continue
+		}
+		if got := resp.Header.Get(fiber.HeaderContentEncoding); got != test.wantEncoding {
+			t.Errorf("TestCompression(%s): got Content-Encoding %q, want %q", test.name, got, test.wantEncoding)
+			continue
+		}
+
+		var r io.Reader = resp.Body
+		if test.wantEncoding == "gzip" {
+			if r, err = gzip.NewReader(resp.Body); err != nil {
+				t.Errorf("TestCompression(%s): could not read the gzip body: %s", test.name, err)
+				continue
+			}
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("TestCompression(%s): could not read the body: %s", test.name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("TestCompression(%s): got body %s, want %s", test.name, got, want)
+		}
+	}
+}
+
+func TestCompressionEvents(t *testing.T) {
+	t.Parallel()
+
+	// This is big enough to compress, were it not events.
+	events := strings.Repeat("data: ubuntu-22.04\n\n", 100)
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				w.Header().Set(fiber.HeaderContentType, mimeEventStream)
+				io.WriteString(w, events)
+			},
+		),
+	)
+	t.Cleanup(up.Close)
+
+	tests := []struct {
+		name   string
+		accept string
+	}{
+		{name: "Client asks for events", accept: mimeEventStream},
+		{name: "Client asks for anything", accept: "*/*"},
+		{name: "Client does not say"},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, fakeMapping{versions.Latest: up.URL})
+
+		req := httptest.NewRequest("GET", "/events", nil)
+		req.Header.Set(fiber.HeaderAcceptEncoding, "gzip, br")
+		if test.accept != "" {
+			req.Header.Set(fiber.HeaderAccept, test.accept)
+		}
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestCompressionEvents(%s): %s", test.name, err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if enc := resp.Header.Get(fiber.HeaderContentEncoding); enc != "" {
+			t.Errorf("TestCompressionEvents(%s): got Content-Encoding %q, want none", test.name, enc)
+		}
+		if string(got) != events {
+			t.Errorf("TestCompressionEvents(%s): got body %q, want the events", test.name, got)
+		}
+	}
+}
+
+func TestCompressionOptionsBad(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		option Option
+	}{
+		{name: "Negative min size", option: WithCompressionMinSize(-1)},
+		{name: "Disabled level", option: WithCompressionLevel(compress.LevelDisabled)},
+		{name: "Level too high", option: WithCompressionLevel(compress.LevelBestCompression + 1)},
+	}
+
+	for _, test := range tests {
+		if err := test.option(&Server{}); err == nil {
+			t.Errorf("TestCompressionOptionsBad(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+// upstreamQueueWait is how long a request waits for a version that is at its concurrency limit
+// before it gets a 503.
+const upstreamQueueWait = 250 * time.Millisecond
+
+// WithMaxUpstreamConcurrency limits the requests being sent to each agent baker version at once to n,
+// so that a burst of clients can't open more connections than a version can handle. The limit is
+// shared by a version's replicas. A request over the limit waits briefly for another to finish and
+// gets a 503 if none does. A stream of server-sent events only counts until its headers arrive, as it
+// can last for as long as the client listens.
+func WithMaxUpstreamConcurrency(n int) Option {
+	return func(s *Server) error {
+		if n < 1 {
+			return fmt.Errorf("max upstream concurrency must be at least 1, was %d", n)
+		}
+		s.upstreamLimits = &upstreamLimits{max: n, wait: upstreamQueueWait, m: map[versions.Version]chan struct{}{}}
+		return nil
+	}
+}
+
+// upstreamLimits is a semaphore for each agent baker version. A nil *upstreamLimits never limits,
+// which is what is used when WithMaxUpstreamConcurrency() is not.
+type upstreamLimits struct {
+	max  int
+	wait time.Duration
+
+	mu sync.Mutex
+	m  map[versions.Version]chan struct{}
+}
+
+// get returns the semaphore for version v, creating it if needed.
+func (l *upstreamLimits) get(v versions.Version) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sem, ok := l.m[v]
+	if !ok {
+		sem = make(chan struct{}, l.max)
+		l.m[v] = sem
+	}
+	return sem
+}
+
+// acquire takes a slot for a request to version v, which must not be versions.Latest. It waits for
+// a slot until l.wait passes or ctx is done. If it gets one, the caller must call release once the
+// request to the agent baker is finished.
+func (l *upstreamLimits) acquire(ctx context.Context, v versions.Version) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	sem := l.get(v)
+	release = func() { <-sem }
+	// Don't pay for a timer if there is a free slot.
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil, fiber.NewError(
+		fiber.StatusServiceUnavailable,
+		fmt.Sprintf("agent baker version(%s) has %d requests in flight, try again later", v, l.max),
+	)
+}
@@ -0,0 +1,202 @@
+package http
+
+import (
+	"context"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestWithMaxUpstreamConcurrency(t *testing.T) {
+	t.Parallel()
+
+	const limit = 2
+	const clients = 5
+
+	// The agent baker holds every request until release is closed and records how many it has at once.
+	release := make(chan struct{})
+	var cur, most atomic.Int64
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				n := cur.Add(1)
+				defer cur.Add(-1)
+				for {
+					m := most.Load()
+					if n <= m || most.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				<-release
+				w.Write([]byte(`{"ok":true}`))
+			},
+		),
+	)
+	t.Cleanup(up.Close)
+
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL}, WithMaxUpstreamConcurrency(limit))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestWithMaxUpstreamConcurrency: %s", err)
+	}
+	go serv.Serve(l)
+	t.Cleanup(func() { serv.Shutdown(context.Background()) })
+
+	// Half ask for latest, which shares the limit of the version it resolves to.
+	statuses := make(chan int, clients)
+	wg := sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+		if i%2 == 0 {
+			body = `{"Region":"westus"}`
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := nethttp.Post("http://"+l.Addr().String()+"/getlatestsigimageconfig", fiber.MIMEApplicationJSON, strings.NewReader(body))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	// The requests over the limit give up waiting while the agent baker still holds the others.
+	got := map[int]int{}
+	for i := 0; i < clients-limit; i++ {
+		select {
+		case code := <-statuses:
+			got[code]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("TestWithMaxUpstreamConcurrency: requests over the limit did not get an answer")
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for code := range statuses {
+		got[code]++
+	}
+
+	if got[fiber.StatusOK] != limit || got[fiber.StatusServiceUnavailable] != clients-limit {
+		t.Errorf("TestWithMaxUpstreamConcurrency: got statuses %v, want %d of 200 and %d of 503", got, limit, clients-limit)
+	}
+	if m := most.Load(); m != limit {
+		t.Errorf("TestWithMaxUpstreamConcurrency: agent baker had %d requests at once, want %d", m, limit)
+	}
+}
+
+func TestMaxUpstreamConcurrencyEvents(t *testing.T) {
+	t.Parallel()
+
+	// The agent baker sends one event and then keeps the stream open until the test ends.
+	done := make(chan struct{})
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				if r.URL.Path != "/events" {
+					w.Write([]byte(`{"ok":true}`))
+					return
+				}
+				w.Header().Set(fiber.HeaderContentType, mimeEventStream)
+				w.Write([]byte("data: one\n\n"))
+				w.(nethttp.Flusher).Flush()
+				select {
+				case <-done:
+				case <-r.Context().Done():
+				}
+			},
+		),
+	)
+	t.Cleanup(up.Close)
+
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL}, WithMaxUpstreamConcurrency(1))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestMaxUpstreamConcurrencyEvents: %s", err)
+	}
+	go serv.Serve(l)
+	t.Cleanup(func() { serv.app.Shutdown() })
+	// The stream must end before the server can shut down.
+	t.Cleanup(func() { close(done) })
+
+	events, err := nethttp.Get("http://" + l.Addr().String() + "/events")
+	if err != nil {
+		t.Fatalf("TestMaxUpstreamConcurrencyEvents: %s", err)
+	}
+	defer events.Body.Close()
+	if _, err := events.Body.Read(make([]byte, 16)); err != nil {
+		t.Fatalf("TestMaxUpstreamConcurrencyEvents: could not read the first event: %s", err)
+	}
+
+	// The open stream must not hold the version's only slot.
+	body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+	resp, err := nethttp.Post("http://"+l.Addr().String()+"/getlatestsigimageconfig", fiber.MIMEApplicationJSON, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("TestMaxUpstreamConcurrencyEvents: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("TestMaxUpstreamConcurrencyEvents: got status %d while an event stream was open, want %d", resp.StatusCode, fiber.StatusOK)
+	}
+}
+
+func TestUpstreamLimitsAcquire(t *testing.T) {
+	t.Parallel()
+
+	l := &upstreamLimits{max: 1, wait: time.Hour, m: map[versions.Version]chan struct{}{}}
+	release, err := l.acquire(context.Background(), "1.0.0")
+	if err != nil {
+		t.Fatalf("TestUpstreamLimitsAcquire: got err == %s, want err == nil", err)
+	}
+
+	// Other versions have their own limit.
+	other, err := l.acquire(context.Background(), "1.1.0")
+	if err != nil {
+		t.Fatalf("TestUpstreamLimitsAcquire: other version: got err == %s, want err == nil", err)
+	}
+	other()
+
+	// A full version waits for ctx, not for the queue wait.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := l.acquire(ctx, "1.0.0"); err == nil {
+		t.Errorf("TestUpstreamLimitsAcquire: got err == nil for a full version, want err != nil")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("TestUpstreamLimitsAcquire: took %v, want it to stop when ctx is done", took)
+	}
+
+	// A waiting request gets the slot when it is released.
+	time.AfterFunc(50*time.Millisecond, release)
+	again, err := l.acquire(context.Background(), "1.0.0")
+	if err != nil {
+		t.Fatalf("TestUpstreamLimitsAcquire: got err == %s after release, want err == nil", err)
+	}
+	again()
+
+	// nil never limits.
+	var none *upstreamLimits
+	if _, err := none.acquire(context.Background(), "1.0.0"); err != nil {
+		t.Errorf("TestUpstreamLimitsAcquire: nil limits: got err == %s, want err == nil", err)
+	}
+}
+
+func TestWithMaxUpstreamConcurrencyBad(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(versions.Mapping{}, WithMaxUpstreamConcurrency(0)); err == nil {
+		t.Errorf("TestWithMaxUpstreamConcurrencyBad: got err == nil, want err != nil")
+	}
+}
@@ -0,0 +1,186 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the content of a config file given to NewFromConfig(). Every field is optional.
+type fileConfig struct {
+	// UpstreamTimeout is used for WithUpstreamTimeout().
+	UpstreamTimeout duration `json:"upstreamTimeout,omitempty" yaml:"upstreamTimeout"`
+	// ReadTimeout is used for WithReadTimeout().
+	ReadTimeout duration `json:"readTimeout,omitempty" yaml:"readTimeout"`
+	// EndpointTimeouts is used for WithEndpointTimeouts().
+	EndpointTimeouts map[string]duration `json:"endpointTimeouts,omitempty" yaml:"endpointTimeouts"`
+	// BodyLimit is used for WithBodyLimit().
+	BodyLimit int `json:"bodyLimit,omitempty" yaml:"bodyLimit"`
+	// TLS is used for WithTLS().
+	TLS *tlsFileConfig `json:"tls,omitempty" yaml:"tls"`
+	// AdminToken is used for WithAdminToken().
+	AdminToken string `json:"adminToken,omitempty" yaml:"adminToken"`
+	// RateLimit is used for WithRateLimit().
+	RateLimit *rateLimitFileConfig `json:"rateLimit,omitempty" yaml:"rateLimit"`
+	// LogLevel is the level of the logger, such as "DEBUG" or "INFO".
+	LogLevel string `json:"logLevel,omitempty" yaml:"logLevel"`
+	// ForwardHeaders is used for WithForwardHeaders().
+	ForwardHeaders []string `json:"forwardHeaders,omitempty" yaml:"forwardHeaders"`
+	// HealthPolicy is parsed with ParseHealthPolicy() and used for WithHealthPolicy().
+	HealthPolicy string `json:"healthPolicy,omitempty" yaml:"healthPolicy"`
+	// Canaries are each used for WithCanary().
+	Canaries []canaryFileConfig `json:"canaries,omitempty" yaml:"canaries"`
+}
+
+// tlsFileConfig is the "tls" section of a config file.
+type tlsFileConfig struct {
+	CertFile string `json:"certFile" yaml:"certFile"`
+	KeyFile  string `json:"keyFile" yaml:"keyFile"`
+}
+
+// rateLimitFileConfig is the "rateLimit" section of a config file.
+type rateLimitFileConfig struct {
+	Max    int      `json:"max" yaml:"max"`
+	Window duration `json:"window" yaml:"window"`
+}
+
+// canaryFileConfig is an entry in the "canaries" section of a config file.
+type canaryFileConfig struct {
+	Version versions.Version `json:"version" yaml:"version"`
+	Percent int              `json:"percent" yaml:"percent"`
+}
+
+// duration is a time.Duration that is written in config files as a string, such as "30s".
+type duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// NewFromConfig creates a new Server with the settings in the config file at path, which is JSON if it
+// ends in ".json" or YAML if it ends in ".yaml" or ".yml". Keys we don't know are an error, so that a
+// misspelled setting isn't silently ignored. options are applied before the config file's settings,
+// so the config file wins if both set the same thing.
+//
+// If the config file sets logLevel, the Server logs to stderr at that level instead of using
+// a logger from WithLogger(). If there is an admin token, the level can be changed with /admin/loglevel.
+func NewFromConfig(path string, mapping versions.Mapping, options ...Option) (*Server, error) {
+	fc, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := fc.options()
+	if err != nil {
+		return nil, fmt.Errorf("config file(%s) is invalid: %w", path, err)
+	}
+	return New(mapping, append(options, opts...)...)
+}
+
+// readConfig reads the config file at path.
+func readConfig(path string) (fileConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("could not read config file(%s): %w", path, err)
+	}
+
+	var fc fileConfig
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(b, &fc, json.RejectUnknownMembers(true))
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		// An empty YAML file has no documents, which is an empty config.
+		if err = dec.Decode(&fc); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	default:
+		return fileConfig{}, fmt.Errorf("config file(%s) must end in .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("could not decode config file(%s): %w", path, err)
+	}
+	return fc, nil
+}
+
+// options returns the Options for the settings in the config file. The Options validate the values
+// when they are applied.
+func (fc fileConfig) options() ([]Option, error) {
+	var opts []Option
+
+	if fc.UpstreamTimeout != 0 {
+		opts = append(opts, WithUpstreamTimeout(time.Duration(fc.UpstreamTimeout)))
+	}
+	if fc.ReadTimeout != 0 {
+		opts = append(opts, WithReadTimeout(time.Duration(fc.ReadTimeout)))
+	}
+	if len(fc.EndpointTimeouts) > 0 {
+		timeouts := make(map[string]time.Duration, len(fc.EndpointTimeouts))
+		for path, d := range fc.EndpointTimeouts {
+			timeouts[path] = time.Duration(d)
+		}
+		opts = append(opts, WithEndpointTimeouts(timeouts))
+	}
+	if fc.BodyLimit != 0 {
+		opts = append(opts, WithBodyLimit(fc.BodyLimit))
+	}
+	if fc.TLS != nil {
+		opts = append(opts, WithTLS(fc.TLS.CertFile, fc.TLS.KeyFile))
+	}
+	if fc.AdminToken != "" {
+		opts = append(opts, WithAdminToken(fc.AdminToken))
+	}
+	if fc.RateLimit != nil {
+		opts = append(opts, WithRateLimit(fc.RateLimit.Max, time.Duration(fc.RateLimit.Window)))
+	}
+	if fc.ForwardHeaders != nil {
+		opts = append(opts, WithForwardHeaders(fc.ForwardHeaders...))
+	}
+	if fc.HealthPolicy != "" {
+		p, err := ParseHealthPolicy(fc.HealthPolicy)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithHealthPolicy(p))
+	}
+	for _, c := range fc.Canaries {
+		opts = append(opts, WithCanary(c.Version, c.Percent))
+	}
+	if fc.LogLevel != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(fc.LogLevel)); err != nil {
+			return nil, fmt.Errorf("logLevel(%s) is not a log level: %w", fc.LogLevel, err)
+		}
+		level := &slog.LevelVar{}
+		level.Set(l)
+		opts = append(
+			opts,
+			WithLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))),
+			// This replaces a level from WithLogLevel(), which would no longer be the level of our logger.
+			// The level can only be changed with /admin/loglevel, so this needs an admin token from
+			// the config file or an earlier Option.
+			func(s *Server) error {
+				if s.adminToken != "" {
+					s.logLevel = level
+				}
+				return nil
+			},
+		)
+	}
+	return opts, nil
+}
@@ -0,0 +1,301 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// writeFile writes content to name in dir and returns the path.
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+
+	fp := filepath.Join(dir, name)
+	if err := os.WriteFile(fp, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fp
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key to dir and returns their paths.
+func writeCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bakedbaker-test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = writeFile(t, dir, "cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyFile = writeFile(t, dir, "key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+func TestNewFromConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir)
+
+	jsonConf := fmt.Sprintf(
+		`{
+			"upstreamTimeout": "5s",
+			"readTimeout": "10s",
+			"endpointTimeouts": {"/getnodebootstrapdata": "1m"},
+			"bodyLimit": 1024,
+			"tls": {"certFile": %q, "keyFile": %q},
+			"adminToken": "secret",
+			"rateLimit": {"max": 100, "window": "1m"},
+			"logLevel": "DEBUG",
+			"canaries": [{"version": "1.1.0", "percent": 5}],
+			"forwardHeaders": ["X-Request-Id"],
+			"healthPolicy": "quorum:60"
+		}`,
+		certFile, keyFile,
+	)
+	yamlConf := fmt.Sprintf(
+		`
+upstreamTimeout: 5s
+readTimeout: 10s
+endpointTimeouts:
+  /getnodebootstrapdata: 1m
+bodyLimit: 1024
+tls:
+  certFile: %s
+  keyFile: %s
+adminToken: secret
+rateLimit:
+  max: 100
+  window: 1m
+logLevel: DEBUG
+canaries:
+  - version: 1.1.0
+    percent: 5
+forwardHeaders:
+  - X-Request-Id
+healthPolicy: quorum:60
+`,
+		certFile, keyFile,
+	)
+
+	tests := []struct {
+		name string
+		file string
+		conf string
+	}{
+		{name: "JSON", file: "config.json", conf: jsonConf},
+		{name: "YAML", file: "config.yaml", conf: yamlConf},
+		{name: "YML", file: "config.yml", conf: yamlConf},
+	}
+
+	for _, test := range tests {
+		fp := writeFile(t, t.TempDir(), test.file, []byte(test.conf))
+		serv, err := NewFromConfig(fp, versions.Mapping{})
+		if err != nil {
+			t.Errorf("TestNewFromConfig(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+
+		if serv.upstreamTimeout != 5*time.Second {
+			t.Errorf("TestNewFromConfig(%s): got upstream timeout %v, want 5s", test.name, serv.upstreamTimeout)
+		}
+		if diff := pretty.Compare(map[string]bool{fiber.HeaderContentType: true, "X-Request-Id": true}, serv.forwardHeaders); diff != "" {
+			t.Errorf("TestNewFromConfig(%s): forward headers -want/+got:\n%s", test.name, diff)
+		}
+		if serv.healthPolicy != HealthQuorum(60) {
+			t.Errorf("TestNewFromConfig(%s): got health policy %s, want quorum:60", test.name, serv.healthPolicy)
+		}
+		if serv.readTimeout != 10*time.Second {
+			t.Errorf("TestNewFromConfig(%s): got read timeout %v, want 10s", test.name, serv.readTimeout)
+		}
+		if got := serv.timeout("/getnodebootstrapdata"); got != time.Minute {
+			t.Errorf("TestNewFromConfig(%s): got endpoint timeout %v, want 1m", test.name, got)
+		}
+		if serv.bodyLimit != 1024 {
+			t.Errorf("TestNewFromConfig(%s): got body limit %d, want 1024", test.name, serv.bodyLimit)
+		}
+		if serv.tlsConfig == nil {
+			t.Errorf("TestNewFromConfig(%s): TLS is not configured", test.name)
+		}
+		if serv.adminToken != "secret" {
+			t.Errorf("TestNewFromConfig(%s): got admin token %q, want secret", test.name, serv.adminToken)
+		}
+		if serv.rateMax != 100 || serv.rateWindow != time.Minute {
+			t.Errorf("TestNewFromConfig(%s): got rate limit %d per %v, want 100 per 1m", test.name, serv.rateMax, serv.rateWindow)
+		}
+		if !serv.log.Enabled(context.Background(), slog.LevelDebug) || serv.logLevel == nil {
+			t.Errorf("TestNewFromConfig(%s): debug logging is not on or can't be changed", test.name)
+		}
+		if len(serv.canaries) != 1 || serv.canaries[0] != (canary{version: "1.1.0", percent: 5}) {
+			t.Errorf("TestNewFromConfig(%s): got canaries %+v, want 1.1.0 at 5%%", test.name, serv.canaries)
+		}
+	}
+}
+
+func TestNewFromConfigBehavior(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir)
+	conf := fmt.Sprintf(
+		`{
+			"bodyLimit": 64,
+			"tls": {"certFile": %q, "keyFile": %q},
+			"adminToken": "secret",
+			"rateLimit": {"max": 2, "window": "1m"}
+		}`,
+		certFile, keyFile,
+	)
+	serv, err := NewFromConfig(writeFile(t, dir, "config.json", []byte(conf)), versions.Mapping{})
+	if err != nil {
+		t.Fatalf("TestNewFromConfigBehavior: got err == %s, want err == nil", err)
+	}
+	up := newStubUpstream(t, `{}`)
+	serv.mapping = fakeMapping{"1.0.0": up.URL}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(l)
+	t.Cleanup(func() { serv.app.Shutdown() })
+
+	// The certificate is self-signed, so we trust it directly.
+	pool := x509.NewCertPool()
+	pem, _ := os.ReadFile(certFile)
+	pool.AppendCertsFromPEM(pem)
+	client := &nethttp.Client{Transport: &nethttp.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	url := "https://" + l.Addr().String()
+
+	do := func(method, path, body string) int {
+		req := httptest.NewRequest(method, url+path, strings.NewReader(body))
+		req.RequestURI = ""
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("TestNewFromConfigBehavior: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The body over the limit is rejected before it reaches the rate limiter, so 2 requests count.
+	if got := do("POST", "/getlatestsigimageconfig", `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`); got != fiber.StatusOK {
+		t.Errorf("TestNewFromConfigBehavior: got status %d over TLS, want %d", got, fiber.StatusOK)
+	}
+	if got := do("POST", "/getlatestsigimageconfig", strings.Repeat(" ", 128)); got != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("TestNewFromConfigBehavior: got status %d for a body over the limit, want %d", got, fiber.StatusRequestEntityTooLarge)
+	}
+	if got := do("GET", "/admin/status", ""); got != fiber.StatusUnauthorized {
+		t.Errorf("TestNewFromConfigBehavior: got status %d for admin without a token, want %d", got, fiber.StatusUnauthorized)
+	}
+	if got := do("GET", "/info", ""); got != fiber.StatusTooManyRequests {
+		t.Errorf("TestNewFromConfigBehavior: got status %d over the rate limit, want %d", got, fiber.StatusTooManyRequests)
+	}
+	if got := do("GET", "/healthz", ""); got != fiber.StatusOK {
+		t.Errorf("TestNewFromConfigBehavior: got status %d for /healthz over the rate limit, want %d", got, fiber.StatusOK)
+	}
+}
+
+func TestNewFromConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		file string
+		conf string
+	}{
+		{name: "Unknown JSON key", file: "config.json", conf: `{"upstreamTimeout": "5s", "bodyLimt": 10}`},
+		{name: "Unknown YAML key", file: "config.yaml", conf: "upstreamTimeout: 5s\nbodyLimt: 10\n"},
+		{name: "Unknown nested key", file: "config.json", conf: `{"rateLimit": {"max": 1, "window": "1s", "burst": 2}}`},
+		{name: "Unknown extension", file: "config.toml", conf: `upstreamTimeout = "5s"`},
+		{name: "Bad duration", file: "config.json", conf: `{"upstreamTimeout": "soon"}`},
+		{name: "Bad log level", file: "config.yaml", conf: "logLevel: LOUD\n"},
+		{name: "Bad body limit", file: "config.json", conf: `{"bodyLimit": -1}`},
+		{name: "Missing TLS files", file: "config.json", conf: `{"tls": {"certFile": "/missing/cert.pem", "keyFile": "/missing/key.pem"}}`},
+		{name: "Bad rate limit", file: "config.yaml", conf: "rateLimit:\n  max: 0\n  window: 1m\n"},
+		{name: "Bad health policy", file: "config.json", conf: `{"healthPolicy": "most"}`},
+	}
+
+	for _, test := range tests {
+		fp := writeFile(t, t.TempDir(), test.file, []byte(test.conf))
+		if _, err := NewFromConfig(fp, versions.Mapping{}); err == nil {
+			t.Errorf("TestNewFromConfigErrors(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+
+	if _, err := NewFromConfig(filepath.Join(t.TempDir(), "missing.json"), versions.Mapping{}); err == nil {
+		t.Errorf("TestNewFromConfigErrors(Missing file): got err == nil, want err != nil")
+	}
+}
+
+func TestNewFromConfigLogLevel(t *testing.T) {
+	t.Parallel()
+
+	fp := writeFile(t, t.TempDir(), "config.yaml", []byte("logLevel: WARN\n"))
+	callerLevel := &slog.LevelVar{}
+
+	tests := []struct {
+		name      string
+		options   []Option
+		wantLevel bool
+	}{
+		{name: "No admin token, the level can't be changed"},
+		{
+			name:      "Admin token from an Option replaces the level from WithLogLevel",
+			options:   []Option{WithAdminToken("secret"), WithLogLevel(callerLevel)},
+			wantLevel: true,
+		},
+	}
+
+	for _, test := range tests {
+		serv, err := NewFromConfig(fp, versions.Mapping{}, test.options...)
+		if err != nil {
+			t.Errorf("TestNewFromConfigLogLevel(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+		if serv.log.Enabled(context.Background(), slog.LevelInfo) {
+			t.Errorf("TestNewFromConfigLogLevel(%s): info logging is on, want the config's WARN level", test.name)
+		}
+		switch {
+		case !test.wantLevel && serv.logLevel != nil:
+			t.Errorf("TestNewFromConfigLogLevel(%s): level can be changed, want it not to be", test.name)
+		case test.wantLevel && (serv.logLevel == nil || serv.logLevel == callerLevel || serv.logLevel.Level() != slog.LevelWarn):
+			t.Errorf("TestNewFromConfigLogLevel(%s): got level %v, want the config's WARN level", test.name, serv.logLevel)
+		}
+	}
+}
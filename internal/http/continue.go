@@ -0,0 +1,38 @@
+package http
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// continueHandler decides if a request with an "Expect: 100-continue" header gets a 100 Continue, which
+// tells the client to send the body. A request we would reject anyway, because its body is over the
+// body limit or it is for an endpoint that needs the admin token and doesn't have it, gets a 417
+// Expectation Failed instead, before the client sends a body we would throw away. The connection is
+// then closed, as a client may send the body anyway.
+func (s *Server) continueHandler(h *fasthttp.RequestHeader) bool {
+	if s.mayContinue(h) {
+		return true
+	}
+	h.SetConnectionClose()
+	return false
+}
+
+// mayContinue reports if the request with headers h can be handled once we read its body.
+func (s *Server) mayContinue(h *fasthttp.RequestHeader) bool {
+	// This is -1 for a chunked body, which we can only check as it arrives.
+	if h.ContentLength() > s.app.Config().BodyLimit {
+		return false
+	}
+
+	path, _, _ := strings.Cut(string(h.RequestURI()), "?")
+	needsToken := strings.HasPrefix(path, "/admin/") || (s.pprof && strings.HasPrefix(path, pprofPrefix+"/"))
+	if s.adminToken == "" || !needsToken {
+		return true
+	}
+	token, ok := bytes.CutPrefix(h.Peek(fasthttp.HeaderAuthorization), []byte("Bearer "))
+	return ok && subtle.ConstantTimeCompare(token, []byte(s.adminToken)) == 1
+}
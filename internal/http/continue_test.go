@@ -0,0 +1,152 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+)
+
+func TestExpectContinue(t *testing.T) {
+	t.Parallel()
+
+	const limit = 1024
+	up := newStubUpstream(t, `{"ok":true}`)
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL},
+		WithBodyLimit(limit),
+		WithAdminToken("secret"),
+	)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestExpectContinue: %s", err)
+	}
+	go serv.Serve(l)
+	t.Cleanup(func() { serv.Shutdown(context.Background()) })
+
+	small := `{"Region":"westus"}`
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		body   string
+		// size is the Content-Length sent. If 0, it is the length of body.
+		size int
+		// want is the status of the first response. If it is 100, body is sent and wantFinal is the status after.
+		want      int
+		wantFinal int
+	}{
+		{
+			name:      "Body within the limit continues",
+			method:    "POST",
+			path:      "/getlatestsigimageconfig",
+			body:      small,
+			want:      nethttp.StatusContinue,
+			wantFinal: nethttp.StatusOK,
+		},
+		{
+			name:   "Body over the limit is rejected before it is sent",
+			method: "POST",
+			path:   "/getnodebootstrapdata",
+			size:   10 * limit,
+			want:   nethttp.StatusExpectationFailed,
+		},
+		{
+			name:   "Admin endpoint without the token is rejected before the body is sent",
+			method: "POST",
+			path:   "/admin/loglevel",
+			body:   `{"level":"DEBUG"}`,
+			want:   nethttp.StatusExpectationFailed,
+		},
+		{
+			name:      "Admin endpoint with the token continues",
+			method:    "POST",
+			path:      "/admin/loglevel",
+			header:    "Authorization: Bearer secret\r\n",
+			body:      `{"level":"DEBUG"}`,
+			want:      nethttp.StatusContinue,
+			wantFinal: nethttp.StatusNotFound, // WithLogLevel() wasn't used, so there is no handler.
+		},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("TestExpectContinue(%s): %s", test.name, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+
+		size := test.size
+		if size == 0 {
+			size = len(test.body)
+		}
+		fmt.Fprintf(
+			conn,
+			"%s %s HTTP/1.1\r\nHost: bb\r\nContent-Type: application/json\r\nContent-Length: %d\r\nExpect: 100-continue\r\n%s\r\n",
+			test.method, test.path, size, test.header,
+		)
+
+		// Nothing of the body has been sent, so this is the answer to the headers alone.
+		got, err := readStatus(r)
+		if err != nil {
+			t.Errorf("TestExpectContinue(%s): %s", test.name, err)
+			conn.Close()
+			continue
+		}
+		if got != test.want {
+			t.Errorf("TestExpectContinue(%s): got status %d, want %d", test.name, got, test.want)
+			conn.Close()
+			continue
+		}
+		if got != nethttp.StatusContinue {
+			conn.Close()
+			continue
+		}
+
+		io.WriteString(conn, test.body)
+		resp, err := nethttp.ReadResponse(r, nil)
+		if err != nil {
+			t.Errorf("TestExpectContinue(%s): could not read the final response: %s", test.name, err)
+			conn.Close()
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.wantFinal {
+			t.Errorf("TestExpectContinue(%s): got final status %d, want %d", test.name, resp.StatusCode, test.wantFinal)
+		}
+		conn.Close()
+	}
+}
+
+// readStatus reads the status line and headers of a response from r and returns the status code.
+// Unlike net/http, it doesn't skip a 100 Continue.
+func readStatus(r *bufio.Reader) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("could not read the status line: %w", err)
+	}
+	var proto string
+	var code int
+	if _, err := fmt.Sscanf(line, "%s %d", &proto, &code); err != nil {
+		return 0, fmt.Errorf("bad status line(%q): %w", line, err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, fmt.Errorf("could not read the headers: %w", err)
+		}
+		if strings.TrimSpace(line) == "" {
+			return code, nil
+		}
+	}
+}
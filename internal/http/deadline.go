@@ -0,0 +1,57 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+// DeadlineHeader is the header a client sets to say when it stops waiting for an answer, either as an
+// RFC 3339 time, such as "2024-05-01T10:00:00.5Z", or as a duration from when we got the request, such
+// as "1.5s". The request to the agent baker is bounded by it, and a request that doesn't get an answer
+// in time gets a 504 Gateway Timeout. A deadline later than the upstream timeout doesn't extend it.
+// A header that is neither is ignored with a warning.
+const DeadlineHeader = "X-Request-Deadline"
+
+// parseDeadline parses v, the value of the DeadlineHeader of a request we got at now.
+func parseDeadline(v string, now time.Time) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if d, err := time.ParseDuration(v); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("%s(%s) is a negative duration", DeadlineHeader, v)
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s(%s) is not an RFC 3339 time or a duration", DeadlineHeader, v)
+	}
+	return t, nil
+}
+
+// deadline returns a context that is done at the deadline in c's DeadlineHeader. If there is no
+// header, or it can't be parsed, the context has no deadline.
+func (s *Server) deadline(c *fiber.Ctx) (context.Context, context.CancelFunc) {
+	v := c.Get(DeadlineHeader)
+	if v == "" {
+		return context.WithCancel(context.Background())
+	}
+	t, err := parseDeadline(v, time.Now())
+	if err != nil {
+		s.log.Warn("ignoring the request deadline", "path", c.Path(), "err", err)
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), t)
+}
+
+// deadlineError is returned when a request's deadline passes before the agent baker for version v answers.
+func deadlineError(v versions.Version) error {
+	return fiber.NewError(
+		fiber.StatusGatewayTimeout,
+		fmt.Sprintf("agent baker version(%s) did not answer before the %s", v, DeadlineHeader),
+	)
+}
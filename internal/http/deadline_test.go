@@ -0,0 +1,144 @@
+package http
+
+import (
+	"log/slog"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestParseDeadline(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		v    string
+		want time.Time
+		err  bool
+	}{
+		{name: "Duration", v: "1.5s", want: now.Add(1500 * time.Millisecond)},
+		{name: "Zero duration", v: "0s", want: now},
+		{name: "RFC 3339 time", v: "2024-05-01T10:00:02Z", want: now.Add(2 * time.Second)},
+		{name: "RFC 3339 time with fractions and an offset", v: " 2024-05-01T12:00:00.25+02:00 ", want: now.Add(250 * time.Millisecond)},
+		{name: "Error: negative duration", v: "-1s", err: true},
+		{name: "Error: a number", v: "100", err: true},
+		{name: "Error: not a time", v: "soon", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseDeadline(test.v, now)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestParseDeadline(%s): got err == nil, want err != nil", test.name)
+			continue
+		case err != nil && !test.err:
+			t.Errorf("TestParseDeadline(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("TestParseDeadline(%s): got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// newSlowUpstream returns an agent baker that doesn't answer until the test ends. calls counts the
+// requests it got.
+func newSlowUpstream(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	release := make(chan struct{})
+	s := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				calls.Add(1)
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+				w.Write([]byte(`{}`))
+			},
+		),
+	)
+	t.Cleanup(
+		func() {
+			close(release)
+			s.Close()
+		},
+	)
+	return s
+}
+
+func TestRequestDeadline(t *testing.T) {
+	t.Parallel()
+
+	const body = `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+
+	tests := []struct {
+		name     string
+		path     string
+		deadline string
+		// called is if the agent baker should get the request.
+		called bool
+	}{
+		{name: "Near-expired duration", path: "/getlatestsigimageconfig", deadline: "50ms", called: true},
+		{name: "Near-expired duration on the generic route", path: "/some/new/endpoint", deadline: "50ms", called: true},
+		{name: "Time that passed", path: "/getlatestsigimageconfig", deadline: time.Now().Add(-time.Minute).Format(time.RFC3339)},
+	}
+
+	for _, test := range tests {
+		calls := &atomic.Int32{}
+		up := newSlowUpstream(t, calls)
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, WithUpstreamTimeout(30*time.Second))
+
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(body))
+		req.Header.Set(DeadlineHeader, test.deadline)
+		// The generic route only reads the version from the header.
+		req.Header.Set(VersionHeader, "1.0.0")
+		start := time.Now()
+		resp, err := serv.app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("TestRequestDeadline(%s): %s", test.name, err)
+		}
+		took := time.Since(start)
+
+		if resp.StatusCode != fiber.StatusGatewayTimeout {
+			t.Errorf("TestRequestDeadline(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusGatewayTimeout)
+		}
+		if took > 5*time.Second {
+			t.Errorf("TestRequestDeadline(%s): took %s to answer, want it to answer at the deadline", test.name, took)
+		}
+		if got := calls.Load() > 0; got != test.called {
+			t.Errorf("TestRequestDeadline(%s): got agent baker called == %v, want %v", test.name, got, test.called)
+		}
+	}
+}
+
+func TestRequestDeadlineMalformed(t *testing.T) {
+	t.Parallel()
+
+	capture := &captureHandler{}
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, WithLogger(slog.New(capture)))
+
+	req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(`{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`))
+	req.Header.Set(DeadlineHeader, "soon")
+	resp, err := serv.app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("TestRequestDeadlineMalformed: got status %d, want %d", resp.StatusCode, fiber.StatusOK)
+	}
+	if capture.attrs("ignoring the request deadline") == nil {
+		t.Errorf("TestRequestDeadlineMalformed: got no warning about the malformed %s", DeadlineHeader)
+	}
+}
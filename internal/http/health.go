@@ -0,0 +1,607 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gostdlib/concurrency/prim/wait"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// defaultHealthCacheTTL is how long the result of probing the agent bakers is used before probing again.
+	defaultHealthCacheTTL = 2 * time.Second
+	// probeTimeout is how long we wait for an agent baker to answer a probe.
+	probeTimeout = 2 * time.Second
+	// upstreamHealthPath is the path on an agent baker that we probe.
+	upstreamHealthPath = "/healthz"
+	// versionsPollInterval is how often scheduled probes check if the versions changed, such as by
+	// versions.Mapping.Refresh(), so that they probe the versions there are now.
+	versionsPollInterval = time.Second
+)
+
+// HealthPolicy decides if /ready passes when some agent baker versions are not ready. A version is not ready
+// if any of its replicas failed its last probe. The default is HealthAll().
+type HealthPolicy struct {
+	// kind is what the policy requires. The zero value is healthAll.
+	kind healthPolicyKind
+	// percent is the percent of versions that must be ready for healthQuorum.
+	percent int
+}
+
+// healthPolicyKind is what a HealthPolicy requires.
+type healthPolicyKind int
+
+const (
+	// healthAll requires every version to be ready.
+	healthAll healthPolicyKind = iota
+	// healthQuorum requires a percent of the versions to be ready.
+	healthQuorum
+	// healthLatest requires the version versions.Latest points to to be ready.
+	healthLatest
+)
+
+// HealthAll is the HealthPolicy where /ready passes only if every version is ready. This is the default.
+func HealthAll() HealthPolicy {
+	return HealthPolicy{kind: healthAll}
+}
+
+// HealthQuorum is the HealthPolicy where /ready passes if at least percent of the versions are ready,
+// rounding up. percent must be between 1 and 100.
+func HealthQuorum(percent int) HealthPolicy {
+	return HealthPolicy{kind: healthQuorum, percent: percent}
+}
+
+// HealthLatest is the HealthPolicy where /ready passes if the version versions.Latest points to is ready,
+// whatever the state of the other versions.
+func HealthLatest() HealthPolicy {
+	return HealthPolicy{kind: healthLatest}
+}
+
+// ParseHealthPolicy parses a HealthPolicy in the form String() returns: "all", "latest" or "quorum:<percent>",
+// such as "quorum:60".
+func ParseHealthPolicy(s string) (HealthPolicy, error) {
+	switch s {
+	case "all":
+		return HealthAll(), nil
+	case "latest":
+		return HealthLatest(), nil
+	}
+	if v, ok := strings.CutPrefix(s, "quorum:"); ok {
+		percent, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+		if err != nil {
+			return HealthPolicy{}, fmt.Errorf("health policy(%s) has a quorum that is not a number", s)
+		}
+		p := HealthQuorum(percent)
+		return p, p.validate()
+	}
+	return HealthPolicy{}, fmt.Errorf("health policy(%s) is not all, latest or quorum:<percent>", s)
+}
+
+// String implements fmt.Stringer.
+func (p HealthPolicy) String() string {
+	switch p.kind {
+	case healthQuorum:
+		return "quorum:" + strconv.Itoa(p.percent)
+	case healthLatest:
+		return "latest"
+	}
+	return "all"
+}
+
+// validate returns an error if p can't be used.
+func (p HealthPolicy) validate() error {
+	if p.kind == healthQuorum && (p.percent < 1 || p.percent > 100) {
+		return fmt.Errorf("health policy(%s) must have a quorum between 1 and 100 percent", p)
+	}
+	return nil
+}
+
+// passes reports if /ready passes under p. all is every version, including the ones that failed to start or are
+// starting but not versions.Latest, latest is the version versions.Latest points to and notReady are the versions
+// that are not ready.
+func (p HealthPolicy) passes(all []versions.Version, latest versions.Version, notReady map[versions.Version]string) bool {
+	switch p.kind {
+	case healthQuorum:
+		ready := 0
+		for _, v := range all {
+			if _, ok := notReady[v]; !ok {
+				ready++
+			}
+		}
+		return ready*100 >= p.percent*len(all)
+	case healthLatest:
+		if latest == versions.Latest {
+			return false
+		}
+		_, ok := notReady[latest]
+		return !ok
+	}
+	return len(notReady) == 0
+}
+
+// WithHealthPolicy sets what /ready requires to pass. By default, HealthAll(), every version must be ready.
+// With many versions, where one being down is tolerable, HealthQuorum() or HealthLatest() keep a single
+// version from taking the Server out of service. /ready still lists every version that is not ready.
+func WithHealthPolicy(p HealthPolicy) Option {
+	return func(s *Server) error {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		s.healthPolicy = p
+		return nil
+	}
+}
+
+// readyResp is the JSON body returned by the /ready endpoint.
+type readyResp struct {
+	// Ready is true if the agent baker versions that can be reached pass the HealthPolicy.
+	Ready bool `json:"ready"`
+	// Policy is the HealthPolicy that decided Ready.
+	Policy string `json:"policy"`
+	// NotReady maps versions with a replica that cannot be reached to the reason.
+	NotReady map[versions.Version]string `json:"notReady,omitempty"`
+	// Breakers maps agent baker addresses to the state of their circuit breaker, if it is not closed.
+	Breakers map[string]string `json:"breakers,omitempty"`
+}
+
+// healthDetailResp is the JSON body returned by the /health/detail endpoint.
+type healthDetailResp struct {
+	// Ready is true if every agent baker version passed its last probe.
+	Ready bool `json:"ready"`
+	// Versions holds the result of the last probe of each agent baker version.
+	Versions map[versions.Version]versionDetail `json:"versions"`
+}
+
+// versionDetail is the result of the last probe of an agent baker version.
+type versionDetail struct {
+	// Ready is true if every replica of the version passed its last probe.
+	Ready bool `json:"ready"`
+	// Latest is true if requests for versions.Latest are sent to this version.
+	Latest bool `json:"latest,omitempty"`
+	// State is the versions.State of the version. Only a version that is "ready" has replicas to probe.
+	State string `json:"state"`
+	// LatencyMS is how long the slowest replica took to answer its last probe, in milliseconds.
+	LatencyMS float64 `json:"latencyMs"`
+	// Error is why the replicas that failed their last probe are not ready, or why the version isn't.
+	Error string `json:"error,omitempty"`
+	// Replicas is the result of the last probe of each replica, ordered by address.
+	Replicas []replicaDetail `json:"replicas"`
+}
+
+// replicaDetail is the result of the last probe of an agent baker replica.
+type replicaDetail struct {
+	// Addr is the address of the replica.
+	Addr string `json:"addr"`
+	// Ready is true if the replica passed its last probe.
+	Ready bool `json:"ready"`
+	// LatencyMS is how long the replica took to answer its last probe, in milliseconds.
+	LatencyMS float64 `json:"latencyMs"`
+	// Error is why the replica failed its last probe.
+	Error string `json:"error,omitempty"`
+	// Checked is when the last probe finished. It is not set if the replica hasn't been probed.
+	Checked *time.Time `json:"checked,omitempty"`
+}
+
+// instance is a single agent baker replica of a version.
+type instance struct {
+	version versions.Version
+	base    string
+}
+
+// versionHealth is the result of probing an agent baker instance.
+type versionHealth struct {
+	// Err is the reason the instance is not healthy. If nil, the instance is healthy.
+	Err error
+	// Checked is when the probe finished.
+	Checked time.Time
+	// Latency is how long the probe took.
+	Latency time.Duration
+}
+
+// healthCache caches the result of probing the agent bakers so that calls to /ready don't
+// cause a probe of every agent baker on every call. The first call probes the agent bakers
+// and waits for the result. After that, callers get the cached result and if it is older than the
+// TTL a single probe is started in the background to refresh it. If the probes are scheduled
+// (see WithHealthProbeInterval()), results are only refreshed by store().
+type healthCache struct {
+	ttl   time.Duration
+	probe func(ctx context.Context) map[instance]versionHealth
+	// clock is what the age of the results is measured with.
+	clock clock.Clock
+	// scheduled is set if the versions are probed on their own schedules, so the TTL is not used.
+	scheduled bool
+
+	mu         sync.Mutex
+	checked    time.Time
+	results    map[instance]versionHealth
+	refreshing bool
+	// gen is the generation of the mapping that the scheduled probes are for, see reset().
+	gen uint64
+	// metrics records the results of the scheduled probes.
+	metrics *metrics
+}
+
+// health returns the last probe result for every instance. The returned map must not be modified.
+func (h *healthCache) health(ctx context.Context) map[instance]versionHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// We have never probed, so we don't have an answer to give. Concurrent callers
+	// wait on the lock and share this result.
+	if h.checked.IsZero() {
+		h.results = h.probe(ctx)
+		h.checked = h.clock.Now()
+		return h.results
+	}
+
+	h.refreshIfStale()
+	return h.results
+}
+
+// healthy reports if inst passed its last probe. This is called for every request, so it never waits
+// for a probe. An instance that hasn't been probed yet is healthy. If the results are older than the TTL,
+// or there are none, a probe is started in the background.
+func (h *healthCache) healthy(inst instance) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.refreshIfStale()
+	vh, ok := h.results[inst]
+	return !ok || vh.Err == nil
+}
+
+// refreshIfStale starts a refresh in the background if the results are older than the TTL and
+// the probes aren't scheduled. h.mu must be held.
+func (h *healthCache) refreshIfStale() {
+	if h.scheduled || h.refreshing || h.clock.Now().Sub(h.checked) < h.ttl {
+		return
+	}
+	h.refreshing = true
+	go h.refresh()
+}
+
+// store replaces the results for the instances of version v with results, which is the
+// scheduled probe of v in generation gen of the mapping. If the scheduled probes have since been
+// reset() for another generation, results are dropped and it returns false.
+func (h *healthCache) store(gen uint64, v versions.Version, results map[instance]versionHealth) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if gen != h.gen {
+		return false
+	}
+
+	// Callers of health() may still be reading the old map, so it is copied instead of changed.
+	merged := make(map[instance]versionHealth, len(h.results)+len(results))
+	for inst, vh := range h.results {
+		if inst.version != v {
+			merged[inst] = vh
+		}
+	}
+	for inst, vh := range results {
+		merged[inst] = vh
+	}
+	h.results = merged
+	h.checked = h.clock.Now()
+	// This is under h.mu, so a reset() can't drop the version in between.
+	h.metrics.probed(results)
+	return true
+}
+
+// reset is called when the scheduled probes start probing insts, the instances of generation gen of
+// the mapping. The results of instances that are not in insts are dropped, and so are results that
+// probes of other generations store() later, as those instances may be gone.
+func (h *healthCache) reset(gen uint64, insts []instance) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Callers of health() may still be reading the old map, so it is copied instead of changed.
+	kept := make(map[instance]versionHealth, len(insts))
+	for _, inst := range insts {
+		if vh, ok := h.results[inst]; ok {
+			kept[inst] = vh
+		}
+	}
+	h.results = kept
+	h.gen = gen
+
+	vers := make(map[versions.Version]bool, len(insts))
+	for _, inst := range insts {
+		vers[inst.version] = true
+	}
+	h.metrics.keepReady(vers)
+}
+
+// refresh probes the agent bakers and stores the results.
+func (h *healthCache) refresh() {
+	results := h.probe(context.Background())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.results = results
+	h.checked = h.clock.Now()
+	h.refreshing = false
+}
+
+// notReady returns the versions that have an instance that is not healthy, mapped to the reason.
+func (h *healthCache) notReady(ctx context.Context) map[versions.Version]string {
+	reasons := map[versions.Version][]string{}
+	for inst, vh := range h.health(ctx) {
+		if vh.Err != nil {
+			reasons[inst.version] = append(reasons[inst.version], fmt.Sprintf("%s: %s", inst.base, vh.Err))
+		}
+	}
+
+	notReady := make(map[versions.Version]string, len(reasons))
+	for v, r := range reasons {
+		sort.Strings(r)
+		notReady[v] = strings.Join(r, "; ")
+	}
+	return notReady
+}
+
+// versionNotReady returns why vs, a version that is not ready, is not.
+func versionNotReady(vs versions.VersionStatus) string {
+	if vs.Err != nil {
+		return fmt.Sprintf("version is %s: %s", vs.State, vs.Err)
+	}
+	return fmt.Sprintf("version is %s", vs.State)
+}
+
+// healthDetail is a handler for the /health/detail endpoint. It reports the last probe of every agent
+// baker replica for dashboards. It uses the same cached probes as /ready, but always returns a 200 OK, as
+// it is meant to be read, not to decide if we get traffic. Use /ready for that.
+func (s *Server) healthDetail(c *fiber.Ctx) error {
+	health := s.health.health(c.Context())
+
+	resp := healthDetailResp{Ready: true, Versions: map[versions.Version]versionDetail{}}
+	for _, vs := range s.mapping.Status() {
+		v := vs.Version
+		vd := versionDetail{Ready: true, Latest: vs.Latest, State: vs.State.String(), Replicas: make([]replicaDetail, 0, len(vs.Replicas))}
+		// A version that failed or is still starting has no replicas to probe.
+		if !vs.Ready {
+			vd.Ready = false
+			vd.Error = versionNotReady(vs)
+			resp.Ready = false
+			resp.Versions[v] = vd
+			continue
+		}
+
+		var errs []string
+		for _, rs := range vs.Replicas {
+			base := rs.Addr
+			rd := replicaDetail{Addr: base, Ready: true}
+			vh, ok := health[instance{version: v, base: base}]
+			switch {
+			case !ok:
+				rd.Ready = false
+				rd.Error = "not probed yet"
+			case vh.Err != nil:
+				rd.Ready = false
+				rd.Error = vh.Err.Error()
+			}
+			if ok {
+				rd.LatencyMS = float64(vh.Latency) / float64(time.Millisecond)
+				rd.Checked = &vh.Checked
+			}
+
+			if !rd.Ready {
+				vd.Ready = false
+				errs = append(errs, fmt.Sprintf("%s: %s", base, rd.Error))
+			}
+			vd.LatencyMS = max(vd.LatencyMS, rd.LatencyMS)
+			vd.Replicas = append(vd.Replicas, rd)
+		}
+		sort.Slice(vd.Replicas, func(i, j int) bool { return vd.Replicas[i].Addr < vd.Replicas[j].Addr })
+		sort.Strings(errs)
+		vd.Error = strings.Join(errs, "; ")
+
+		resp.Ready = resp.Ready && vd.Ready
+		resp.Versions[v] = vd
+	}
+	return c.JSON(resp)
+}
+
+// latest returns the version a request for ver goes to with WithHealthyLatest(). This is ver, unless
+// ver is versions.Latest and no replica of the version it points to is healthy. Then it is the highest
+// healthy version below that one, or a 503 if there is none.
+func (s *Server) latest(ver versions.Version) (versions.Version, error) {
+	if !s.healthyLatest || ver != versions.Latest {
+		return ver, nil
+	}
+	resolved := s.mapping.Resolve(ver)
+	all := s.mapping.All()
+	if resolved == versions.Latest || s.versionHealthy(resolved, all[resolved]) {
+		return ver, nil
+	}
+
+	lower := make([]versions.Version, 0, len(all))
+	for v := range all {
+		if v == versions.Latest || !v.Less(resolved) || (s.minVersion != "" && v.Less(s.minVersion)) {
+			continue
+		}
+		lower = append(lower, v)
+	}
+	sort.Slice(lower, func(i, j int) bool { return lower[j].Less(lower[i]) })
+	for _, v := range lower {
+		if s.versionHealthy(v, all[v]) {
+			s.log.Debug("latest is unhealthy, using a lower version", "latest", resolved, "version", v)
+			return v, nil
+		}
+	}
+	return "", fiber.NewError(
+		fiber.StatusServiceUnavailable,
+		fmt.Sprintf("agent baker version(%s) that latest points to is unhealthy and there is no healthy version below it", resolved),
+	)
+}
+
+// versionHealthy reports if any of bases, the replicas of version v, is healthy.
+func (s *Server) versionHealthy(v versions.Version, bases []string) bool {
+	for _, base := range bases {
+		if s.health.healthy(instance{version: v, base: base}) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe probes every agent baker instance and returns the result for each.
+func (s *Server) probe(ctx context.Context) map[instance]versionHealth {
+	var insts []instance
+	for v, bases := range s.mapping.All() {
+		// Latest is an alias of another version, which is already being probed.
+		if v == versions.Latest {
+			continue
+		}
+		for _, base := range bases {
+			insts = append(insts, instance{version: v, base: base})
+		}
+	}
+	results := s.probeInstances(ctx, insts)
+
+	// These are all the versions there are now, so others are gone.
+	vers := make(map[versions.Version]bool, len(insts))
+	for _, inst := range insts {
+		vers[inst.version] = true
+	}
+	s.metrics.probed(results)
+	s.metrics.keepReady(vers)
+	return results
+}
+
+// probeInstances probes insts at the same time and returns the result for each.
+func (s *Server) probeInstances(ctx context.Context, insts []instance) map[instance]versionHealth {
+	mu := sync.Mutex{}
+	results := make(map[instance]versionHealth, len(insts))
+
+	g := wait.Group{}
+	for _, inst := range insts {
+		inst := inst
+
+		g.Go(
+			ctx,
+			func(ctx context.Context) error {
+				start := s.clock.Now()
+				err := probeUpstream(inst.base, s.insecureSkipVerify, s.proxy)
+				end := s.clock.Now()
+				vh := versionHealth{Err: err, Checked: end, Latency: end.Sub(start)}
+
+				mu.Lock()
+				results[inst] = vh
+				mu.Unlock()
+				return nil
+			},
+		)
+	}
+	g.Wait(ctx)
+
+	return results
+}
+
+// startProbing starts probing each agent baker version on its own schedule until ctx is done.
+// When the versions change, which is checked every versionsPollInterval, the schedules are started
+// again for the versions there are now. See WithHealthProbeInterval().
+func (s *Server) startProbing(ctx context.Context) {
+	gen := s.mapping.Generation()
+	stop := s.scheduleProbes(ctx, gen)
+
+	go func() {
+		for {
+			t := s.clock.NewTimer(versionsPollInterval)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				stop()
+				return
+			case <-t.C():
+			}
+
+			if next := s.mapping.Generation(); next != gen {
+				stop()
+				gen = next
+				stop = s.scheduleProbes(ctx, gen)
+			}
+		}
+	}()
+}
+
+// scheduleProbes starts a probeSchedule() for each version of generation gen of the mapping and
+// returns a func that stops them. The results of instances that are no longer in the mapping are dropped.
+func (s *Server) scheduleProbes(ctx context.Context, gen uint64) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+
+	// The generation is read before the versions, so if they changed in between, gen is old and
+	// the next check starts the schedules again.
+	byVersion := map[versions.Version][]instance{}
+	var all []instance
+	for v, bases := range s.mapping.All() {
+		// Latest is an alias of another version, which is already being probed.
+		if v == versions.Latest {
+			continue
+		}
+		for _, base := range bases {
+			inst := instance{version: v, base: base}
+			byVersion[v] = append(byVersion[v], inst)
+			all = append(all, inst)
+		}
+	}
+
+	s.health.reset(gen, all)
+	for v, insts := range byVersion {
+		go s.probeSchedule(ctx, gen, v, insts)
+	}
+	return cancel
+}
+
+// probeSchedule probes insts, the instances of version v in generation gen of the mapping, about once
+// every probe interval until ctx is done. The first probe is at a random point in the first interval and
+// every wait after that is the interval plus or minus up to 10%, so that versions stay spread out.
+func (s *Server) probeSchedule(ctx context.Context, gen uint64, v versions.Version, insts []instance) {
+	delay := time.Duration(rand.Int63n(int64(s.probeInterval)))
+	for {
+		t := s.clock.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+
+		s.health.store(gen, v, s.probeInstances(ctx, insts))
+
+		spread := s.probeInterval / 5
+		delay = s.probeInterval - spread/2
+		if spread > 0 {
+			delay += time.Duration(rand.Int63n(int64(spread)))
+		}
+	}
+}
+
+// probeUpstream returns an error if the agent baker at base does not answer its health
+// endpoint with a 200 OK. proxy is as for upstreamAgent().
+func probeUpstream(base string, insecureSkipVerify bool, proxy fasthttp.DialFunc) error {
+	agent, err := upstreamAgent(fiber.MethodGet, base, upstreamHealthPath, insecureSkipVerify, proxy)
+	if err != nil {
+		return err
+	}
+	agent = agent.Timeout(probeTimeout)
+
+	status, _, errs := agent.Bytes()
+	if len(errs) > 0 {
+		return fmt.Errorf("could not reach the agent baker: %w", errs[0])
+	}
+	if status != fiber.StatusOK {
+		return fmt.Errorf("the agent baker returned status code: %d", status)
+	}
+	return nil
+}
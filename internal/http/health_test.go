@@ -0,0 +1,1069 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// fakeAgentEnv makes the test binary run as an agent baker, see fakeAgent().
+const fakeAgentEnv = "BAKEDBAKER_TEST_FAKE_AGENT"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeAgentEnv) != "" {
+		fakeAgent()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeAgent serves as an agent baker that answers every request with a 200 OK, on the -host and -port
+// it is started with. Tests that need versions.Mapping to start real processes use the test binary
+// as the agent baker, see writeFakeAgent().
+func fakeAgent() {
+	flags := flag.NewFlagSet("agentbaker", flag.ExitOnError)
+	port := flags.String("port", "", "")
+	host := flags.String("host", "", "")
+	// tag changes the launch config of a version, so that versions.Mapping.Refresh() restarts it.
+	flags.String("tag", "", "")
+	flags.Parse(os.Args[1:])
+
+	err := nethttp.ListenAndServe(
+		net.JoinHostPort(*host, *port),
+		nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {}),
+	)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// writeFakeAgent writes version v to dir, as versions.WithBinaryDir() expects, with the test binary as its
+// agent baker, started with -tag tag.
+func writeFakeAgent(t *testing.T, dir string, v versions.Version, tag string) {
+	t.Helper()
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdir := filepath.Join(dir, v.String())
+	if err := os.MkdirAll(vdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(vdir, "agentbaker")
+	if _, err := os.Lstat(bin); err != nil {
+		if err := os.Symlink(self, bin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	launch := `{"flags": ["-tag", "` + tag + `"], "env": {"` + fakeAgentEnv + `": "1"}}`
+	if err := os.WriteFile(filepath.Join(vdir, "launch.json"), []byte(launch), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newFakeAgentMapping starts the versions that writeFakeAgent() wrote to dir and returns their Mapping,
+// which can be refreshed. They are stopped when the test ends.
+func newFakeAgentMapping(t *testing.T, dir string) versions.Mapping {
+	t.Helper()
+
+	// Ports are picked from a free one, as the default 8080 may be in use.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	m, err := versions.New(
+		context.Background(),
+		versions.WithBinaryDir(dir),
+		versions.WithStablePorts(base),
+		versions.WithStartTimeout(30*time.Second),
+		versions.WithWorkDir(t.TempDir()),
+	)
+	if err != nil {
+		t.Fatalf("could not start the versions: %s", err)
+	}
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+	return m
+}
+
+// newUnhealthyUpstream returns an agent baker stand-in that fails every request.
+func newUnhealthyUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				w.WriteHeader(nethttp.StatusInternalServerError)
+			},
+		),
+	)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestHealthzAndReady(t *testing.T) {
+	t.Parallel()
+
+	healthy := newStubUpstream(t, "ok")
+	unhealthy := newUnhealthyUpstream(t)
+
+	tests := []struct {
+		name         string
+		mapping      fakeMapping
+		wantReady    int
+		wantNotReady []versions.Version
+	}{
+		{
+			name:      "All versions are up",
+			mapping:   fakeMapping{"1.0.0": healthy.URL, "1.1.0": healthy.URL, versions.Latest: healthy.URL},
+			wantReady: fiber.StatusOK,
+		},
+		{
+			name:         "A version is down",
+			mapping:      fakeMapping{"1.0.0": healthy.URL, "1.1.0": unhealthy.URL, versions.Latest: unhealthy.URL},
+			wantReady:    fiber.StatusServiceUnavailable,
+			wantNotReady: []versions.Version{"1.1.0"},
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, test.mapping)
+
+		// Liveness does not depend on the agent bakers.
+		resp, err := serv.app.Test(httptest.NewRequest("GET", "/healthz", nil))
+		if err != nil {
+			t.Fatalf("TestHealthzAndReady(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestHealthzAndReady(%s): got /healthz status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+		}
+
+		resp, err = serv.app.Test(httptest.NewRequest("GET", "/ready", nil))
+		if err != nil {
+			t.Fatalf("TestHealthzAndReady(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.wantReady {
+			t.Errorf("TestHealthzAndReady(%s): got /ready status %d, want %d", test.name, resp.StatusCode, test.wantReady)
+		}
+
+		var got readyResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestHealthzAndReady(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if got.Ready != (test.wantReady == fiber.StatusOK) {
+			t.Errorf("TestHealthzAndReady(%s): got .Ready == %v", test.name, got.Ready)
+		}
+		if len(got.NotReady) != len(test.wantNotReady) {
+			t.Errorf("TestHealthzAndReady(%s): got .NotReady == %v, want versions %v", test.name, got.NotReady, test.wantNotReady)
+		}
+		for _, v := range test.wantNotReady {
+			if got.NotReady[v] == "" {
+				t.Errorf("TestHealthzAndReady(%s): version(%s) was not reported as not ready", test.name, v)
+			}
+		}
+	}
+}
+
+func TestHealthCacheCoalesces(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, "ok")
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, WithHealthCacheTTL(time.Hour))
+
+	for i := 0; i < 20; i++ {
+		resp, err := serv.app.Test(httptest.NewRequest("GET", "/ready", nil))
+		if err != nil {
+			t.Fatalf("TestHealthCacheCoalesces: %s", err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("TestHealthCacheCoalesces: got status %d, want %d", resp.StatusCode, fiber.StatusOK)
+		}
+	}
+
+	if got := up.probes.Load(); got != 1 {
+		t.Errorf("TestHealthCacheCoalesces: got %d upstream probes, want 1", got)
+	}
+}
+
+func TestHealthCacheBackgroundRefresh(t *testing.T) {
+	t.Parallel()
+
+	probes := atomic.Int32{}
+	release := make(chan struct{})
+	fake := clock.NewFake(time.Now())
+	h := &healthCache{
+		ttl:   time.Second,
+		clock: fake,
+		probe: func(ctx context.Context) map[instance]versionHealth {
+			// The first probe is done on the request path, later ones block until released.
+			if probes.Add(1) > 1 {
+				<-release
+			}
+			return map[instance]versionHealth{{version: "1.0.0", base: "http://localhost:8080"}: {Checked: time.Now()}}
+		},
+	}
+
+	if got := h.health(context.Background()); len(got) != 1 {
+		t.Fatalf("TestHealthCacheBackgroundRefresh: first call got %v, want a result for 1.0.0", got)
+	}
+
+	// These calls see a stale result. They must return it without waiting on the probe, which
+	// is blocked, and must only start a single refresh.
+	fake.Advance(time.Second)
+	for i := 0; i < 10; i++ {
+		if got := h.health(context.Background()); len(got) != 1 {
+			t.Fatalf("TestHealthCacheBackgroundRefresh: got %v, want the cached result", got)
+		}
+	}
+	close(release)
+
+	if got := probes.Load(); got > 2 {
+		t.Errorf("TestHealthCacheBackgroundRefresh: got %d probes, want at most 2", got)
+	}
+}
+
+func TestHealthCacheTTL(t *testing.T) {
+	t.Parallel()
+
+	const ttl = time.Minute
+
+	probes := make(chan struct{}, 10)
+	fake := clock.NewFake(time.Now())
+	h := &healthCache{
+		ttl:   ttl,
+		clock: fake,
+		probe: func(ctx context.Context) map[instance]versionHealth {
+			probes <- struct{}{}
+			return map[instance]versionHealth{}
+		},
+	}
+
+	h.health(context.Background())
+	<-probes
+
+	// Until the TTL has passed on the clock, the result is used as is.
+	fake.Advance(ttl - time.Second)
+	h.health(context.Background())
+	h.healthy(instance{version: "1.0.0"})
+	select {
+	case <-probes:
+		t.Fatalf("TestHealthCacheTTL: probed before the TTL passed")
+	default:
+	}
+
+	fake.Advance(time.Second)
+	h.healthy(instance{version: "1.0.0"})
+	select {
+	case <-probes:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("TestHealthCacheTTL: did not probe once the TTL passed")
+	}
+}
+
+// replicaMapping is a fakeMapping where version 1.0.0, which is also latest, has several replicas.
+type replicaMapping struct {
+	fakeMapping
+	addrs []string
+	next  *atomic.Uint64
+}
+
+func newReplicaMapping(addrs ...string) replicaMapping {
+	return replicaMapping{fakeMapping: fakeMapping{"1.0.0": addrs[0]}, addrs: addrs, next: &atomic.Uint64{}}
+}
+
+func (r replicaMapping) All() map[versions.Version][]string {
+	return map[versions.Version][]string{"1.0.0": r.addrs, versions.Latest: r.addrs}
+}
+
+// Status reports 1.0.0 as ready and latest, with a replica at each of the addresses.
+func (r replicaMapping) Status() []versions.VersionStatus {
+	vs := versions.VersionStatus{Version: "1.0.0", Latest: true, State: versions.StateReady, Ready: true}
+	for _, addr := range r.addrs {
+		vs.Replicas = append(vs.Replicas, versions.ReplicaStatus{Addr: addr})
+	}
+	return []versions.VersionStatus{vs}
+}
+
+func (r replicaMapping) Resolve(v versions.Version) versions.Version {
+	if v == versions.Latest {
+		return "1.0.0"
+	}
+	return v
+}
+
+func (r replicaMapping) HealthyBase(v versions.Version, healthy func(addr string) bool) (string, error) {
+	if r.Resolve(v) != "1.0.0" {
+		return r.fakeMapping.HealthyBase(v, healthy)
+	}
+	for range r.addrs {
+		addr := r.addrs[(r.next.Add(1)-1)%uint64(len(r.addrs))]
+		if healthy == nil || healthy(addr) {
+			return addr, nil
+		}
+	}
+	return "", &versions.ErrVersionUnhealthy{Version: "1.0.0", Replicas: len(r.addrs)}
+}
+
+func TestHealthRouting(t *testing.T) {
+	t.Parallel()
+
+	// down fails health probes and counts the requests it gets, it is the replica traffic must avoid.
+	var failing atomic.Bool
+	var downCalls atomic.Int32
+	down := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				if r.URL.Path == upstreamHealthPath {
+					if failing.Load() {
+						w.WriteHeader(nethttp.StatusInternalServerError)
+					}
+					return
+				}
+				downCalls.Add(1)
+				w.Write([]byte("down"))
+			},
+		),
+	)
+	t.Cleanup(down.Close)
+	up := newStubUpstream(t, "up")
+
+	const ttl = 20 * time.Millisecond
+	serv := newTestServer(t, fakeMapping{}, WithHealthRouting(), WithHealthCacheTTL(ttl))
+	serv.mapping = newReplicaMapping(up.URL, down.URL)
+
+	send := func() (int, string) {
+		body := `{"ABVersion":"latest","Req":{"Region":"westus"}}`
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestHealthRouting: %s", err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// /ready waits for the first probe, so the requests after it know which replica is down.
+	failing.Store(true)
+	if _, err := serv.app.Test(httptest.NewRequest("GET", "/ready", nil)); err != nil {
+		t.Fatalf("TestHealthRouting: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		if status, body := send(); status != fiber.StatusOK || body != "up" {
+			t.Fatalf("TestHealthRouting: got status %d and body %q, want %d from the healthy replica", status, body, fiber.StatusOK)
+		}
+	}
+	if got := downCalls.Load(); got != 0 {
+		t.Errorf("TestHealthRouting: unhealthy replica got %d requests, want 0", got)
+	}
+
+	// Once its probe succeeds, the replica is back in rotation.
+	failing.Store(false)
+	for deadline := time.Now().Add(5 * time.Second); downCalls.Load() == 0; time.Sleep(ttl) {
+		if time.Now().After(deadline) {
+			t.Fatalf("TestHealthRouting: replica never got requests after it recovered")
+		}
+		send()
+	}
+}
+
+func TestHealthRoutingAllUnhealthy(t *testing.T) {
+	t.Parallel()
+
+	a, b := newUnhealthyUpstream(t), newUnhealthyUpstream(t)
+	serv := newTestServer(t, fakeMapping{}, WithHealthRouting(), WithHealthCacheTTL(time.Hour))
+	serv.mapping = newReplicaMapping(a.URL, b.URL)
+
+	if _, err := serv.app.Test(httptest.NewRequest("GET", "/ready", nil)); err != nil {
+		t.Fatalf("TestHealthRoutingAllUnhealthy: %s", err)
+	}
+	body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+	resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("TestHealthRoutingAllUnhealthy: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("TestHealthRoutingAllUnhealthy: got status %d, want %d", resp.StatusCode, fiber.StatusServiceUnavailable)
+	}
+}
+
+func TestWithHealthCacheTTL(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(versions.Mapping{}, WithHealthCacheTTL(0)); err == nil {
+		t.Errorf("TestWithHealthCacheTTL: got err == nil, want err != nil")
+	}
+}
+
+func TestHealthProbeSchedule(t *testing.T) {
+	t.Parallel()
+
+	const interval = 10 * time.Second
+	const step = 100 * time.Millisecond
+
+	ups := map[versions.Version]*stubUpstream{}
+	m := fakeMapping{}
+	for _, v := range []versions.Version{"1.0.0", "2.0.0", "3.0.0", "4.0.0"} {
+		ups[v] = newStubUpstream(t, `{}`)
+		m[v] = ups[v].URL
+	}
+	serv := newTestServer(t, m, WithHealthProbeInterval(interval))
+	fake := clock.NewFake(time.Now())
+	serv.clock = fake
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serv.startProbing(ctx)
+
+	// Every version's schedule waits on a timer, and so does the check for changed versions.
+	timers := len(ups) + 1
+
+	// firstTick is the step each version was first probed in.
+	firstTick := map[versions.Version]int{}
+	for tick := 1; tick <= int(interval/step); tick++ {
+		// Every version is waiting for its next probe, so all probes of the last tick are done.
+		fake.BlockUntil(timers)
+		fake.Advance(step)
+		fake.BlockUntil(timers)
+
+		for v, up := range ups {
+			if _, ok := firstTick[v]; !ok && up.probes.Load() > 0 {
+				firstTick[v] = tick
+			}
+		}
+	}
+
+	if len(firstTick) != len(ups) {
+		t.Fatalf("TestHealthProbeSchedule: got first probes %v, want every version probed in the first interval", firstTick)
+	}
+	ticks := map[int]bool{}
+	for _, tick := range firstTick {
+		ticks[tick] = true
+	}
+	if len(ticks) == 1 {
+		t.Errorf("TestHealthProbeSchedule: got first probes %v, want versions probed at different times", firstTick)
+	}
+
+	// The probes are what the health cache has, it doesn't probe on its own.
+	health := serv.health.health(ctx)
+	for v := range ups {
+		vh, ok := health[instance{version: v, base: m[v]}]
+		if !ok || vh.Err != nil {
+			t.Errorf("TestHealthProbeSchedule(%s): got health %+v (found %v), want a healthy result", v, vh, ok)
+		}
+	}
+
+	// Every version keeps being probed, about once an interval.
+	for tick := 0; tick < int(interval/step)+int(interval/10/step); tick++ {
+		fake.BlockUntil(timers)
+		fake.Advance(step)
+	}
+	fake.BlockUntil(timers)
+	for v, up := range ups {
+		if got := up.probes.Load(); got < 2 {
+			t.Errorf("TestHealthProbeSchedule(%s): got %d probes after two intervals, want at least 2", v, got)
+		}
+	}
+}
+
+func TestHealthProbesRefresh(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFakeAgent(t, dir, "1.0.0", "a")
+	writeFakeAgent(t, dir, "1.1.0", "a")
+	writeFakeAgent(t, dir, "1.2.0", "a")
+	m := newFakeAgentMapping(t, dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serv, err := New(m, WithHealthProbeInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv.startProbing(ctx)
+
+	// probedAll waits until every replica there is now, and only those, passed a probe.
+	probedAll := func(name string) {
+		t.Helper()
+
+		var want []instance
+		for v, bases := range m.All() {
+			for _, base := range bases {
+				if v != versions.Latest {
+					want = append(want, instance{version: v, base: base})
+				}
+			}
+		}
+		sortInstances(want)
+		var health map[instance]versionHealth
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			health = serv.health.health(ctx)
+			if len(health) != len(want) {
+				continue
+			}
+			ok := true
+			for _, inst := range want {
+				if vh, found := health[inst]; !found || vh.Err != nil {
+					ok = false
+				}
+			}
+			if ok {
+				break
+			}
+		}
+		if diff := pretty.Compare(want, healthInstances(health)); diff != "" {
+			t.Fatalf("TestHealthProbesRefresh(%s): probed replicas -want/+got:\n%s", name, diff)
+		}
+
+		resp, err := serv.app.Test(httptest.NewRequest("GET", "/ready", nil))
+		if err != nil {
+			t.Fatalf("TestHealthProbesRefresh(%s): %s", name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			b, _ := io.ReadAll(resp.Body)
+			t.Errorf("TestHealthProbesRefresh(%s): got /ready status %d, want %d: %s", name, resp.StatusCode, fiber.StatusOK, b)
+		}
+	}
+
+	probedAll("start")
+
+	// 1.1.0 is stopped, 1.2.0 gets new ports and 1.3.0 is new. None of the old replicas may be
+	// probed, or their failures would keep /ready failing, and the new replicas must be probed.
+	old := m.All()["1.2.0"]
+	if err := os.RemoveAll(filepath.Join(dir, "1.1.0")); err != nil {
+		t.Fatal(err)
+	}
+	writeFakeAgent(t, dir, "1.2.0", "b")
+	writeFakeAgent(t, dir, "1.3.0", "a")
+	delta, err := m.Refresh(ctx)
+	if err != nil {
+		t.Fatalf("TestHealthProbesRefresh: could not refresh: %s", err)
+	}
+	if len(delta.Removed) != 1 || len(delta.Restarted) != 1 || len(delta.Added) != 1 {
+		t.Fatalf("TestHealthProbesRefresh: got delta %+v, want one version removed, restarted and added", delta)
+	}
+	if slices.Equal(old, m.All()["1.2.0"]) {
+		t.Fatalf("TestHealthProbesRefresh: restarted version(1.2.0) kept its replicas %v", old)
+	}
+
+	probedAll("refreshed")
+}
+
+// healthInstances returns the instances in health, sorted.
+func healthInstances(health map[instance]versionHealth) []instance {
+	insts := make([]instance, 0, len(health))
+	for inst := range health {
+		insts = append(insts, inst)
+	}
+	sortInstances(insts)
+	return insts
+}
+
+// sortInstances sorts insts by version, then base.
+func sortInstances(insts []instance) {
+	sort.Slice(
+		insts,
+		func(i, j int) bool {
+			if insts[i].version != insts[j].version {
+				return insts[i].version < insts[j].version
+			}
+			return insts[i].base < insts[j].base
+		},
+	)
+}
+
+func TestWithHealthProbeInterval(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(versions.Mapping{}, WithHealthProbeInterval(0)); err == nil {
+		t.Errorf("TestWithHealthProbeInterval: got err == nil, want err != nil")
+	}
+}
+
+func TestHealthDetail(t *testing.T) {
+	t.Parallel()
+
+	healthy := newStubUpstream(t, "ok")
+	unhealthy := newUnhealthyUpstream(t)
+	const down = "the agent baker returned status code: 500"
+
+	replicas := newReplicaMapping(unhealthy.URL, healthy.URL)
+
+	tests := []struct {
+		name    string
+		mapping mapper
+		want    healthDetailResp
+	}{
+		{
+			name:    "Mix of healthy and unhealthy versions",
+			mapping: fakeMapping{"1.0.0": healthy.URL, "1.1.0": unhealthy.URL, versions.Latest: healthy.URL},
+			want: healthDetailResp{
+				Ready: false,
+				Versions: map[versions.Version]versionDetail{
+					"1.0.0": {
+						Ready:    true,
+						Latest:   true,
+						State:    "ready",
+						Replicas: []replicaDetail{{Addr: healthy.URL, Ready: true}},
+					},
+					"1.1.0": {
+						State:    "ready",
+						Error:    unhealthy.URL + ": " + down,
+						Replicas: []replicaDetail{{Addr: unhealthy.URL, Error: down}},
+					},
+				},
+			},
+		},
+		{
+			name:    "A replica is down",
+			mapping: replicas,
+			want: healthDetailResp{
+				Versions: map[versions.Version]versionDetail{
+					"1.0.0": {
+						Latest: true,
+						State:  "ready",
+						Error:  unhealthy.URL + ": " + down,
+						Replicas: sortReplicas(
+							[]replicaDetail{
+								{Addr: healthy.URL, Ready: true},
+								{Addr: unhealthy.URL, Error: down},
+							},
+						),
+					},
+				},
+			},
+		},
+		{
+			name: "Versions that failed or are starting",
+			mapping: downMapping{
+				fakeMapping: fakeMapping{"1.0.0": healthy.URL, versions.Latest: healthy.URL},
+				down: []versions.VersionStatus{
+					{Version: "1.1.0", State: versions.StateFailed, Err: errors.New("no such binary")},
+					{Version: "1.2.0", State: versions.StateStarting},
+				},
+			},
+			want: healthDetailResp{
+				Versions: map[versions.Version]versionDetail{
+					"1.0.0": {
+						Ready:    true,
+						Latest:   true,
+						State:    "ready",
+						Replicas: []replicaDetail{{Addr: healthy.URL, Ready: true}},
+					},
+					"1.1.0": {State: "failed", Error: "version is failed: no such binary", Replicas: []replicaDetail{}},
+					"1.2.0": {State: "starting", Error: "version is starting", Replicas: []replicaDetail{}},
+				},
+			},
+		},
+		{
+			name:    "All versions are up",
+			mapping: fakeMapping{"1.0.0": healthy.URL, versions.Latest: healthy.URL},
+			want: healthDetailResp{
+				Ready: true,
+				Versions: map[versions.Version]versionDetail{
+					"1.0.0": {
+						Ready:    true,
+						Latest:   true,
+						State:    "ready",
+						Replicas: []replicaDetail{{Addr: healthy.URL, Ready: true}},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, nil)
+		serv.mapping = test.mapping
+
+		resp, err := serv.app.Test(httptest.NewRequest("GET", "/health/detail", nil))
+		if err != nil {
+			t.Fatalf("TestHealthDetail(%s): %s", test.name, err)
+		}
+		// Unlike /ready, this is always a 200 OK.
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestHealthDetail(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+		}
+
+		var got healthDetailResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestHealthDetail(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+
+		// Every replica was probed, so they all have a latency and a time, but we can't know what they are.
+		for v, vd := range got.Versions {
+			for i, rd := range vd.Replicas {
+				if rd.Checked == nil || rd.Checked.IsZero() {
+					t.Errorf("TestHealthDetail(%s): version(%s) replica(%s) has no .Checked", test.name, v, rd.Addr)
+				}
+				if rd.LatencyMS <= 0 || rd.LatencyMS > vd.LatencyMS {
+					t.Errorf("TestHealthDetail(%s): version(%s) replica(%s) has .LatencyMS %v, version has %v", test.name, v, rd.Addr, rd.LatencyMS, vd.LatencyMS)
+				}
+				vd.Replicas[i].Checked = nil
+				vd.Replicas[i].LatencyMS = 0
+			}
+			vd.LatencyMS = 0
+			got.Versions[v] = vd
+		}
+		if diff := pretty.Compare(test.want, got); diff != "" {
+			t.Errorf("TestHealthDetail(%s): -want/+got:\n%s", test.name, diff)
+		}
+	}
+}
+
+// sortReplicas sorts r by address, which is how /health/detail orders them.
+func sortReplicas(r []replicaDetail) []replicaDetail {
+	sort.Slice(r, func(i, j int) bool { return r[i].Addr < r[j].Addr })
+	return r
+}
+
+func TestNotReadyPerInstance(t *testing.T) {
+	t.Parallel()
+
+	h := &healthCache{
+		ttl:   time.Hour,
+		clock: clock.Real{},
+		probe: func(ctx context.Context) map[instance]versionHealth {
+			return map[instance]versionHealth{
+				{version: "1.0.0", base: "http://localhost:8080"}: {},
+				{version: "1.0.0", base: "http://localhost:8081"}: {Err: errors.New("down")},
+				{version: "1.1.0", base: "http://localhost:8082"}: {},
+			}
+		},
+	}
+
+	want := map[versions.Version]string{"1.0.0": "http://localhost:8081: down"}
+	if diff := pretty.Compare(want, h.notReady(context.Background())); diff != "" {
+		t.Errorf("TestNotReadyPerInstance: -want/+got:\n%s", diff)
+	}
+}
+
+func TestHealthyLatest(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		// healthy are the versions that pass their health probes, the others fail them.
+		healthy []versions.Version
+		// latest is the version Latest points to.
+		latest  versions.Version
+		options []Option
+		ver     versions.Version
+		// wantVer is the version that serves the request. If empty, the request must fail with wantStatus.
+		wantVer    versions.Version
+		wantStatus int
+	}{
+		{
+			name:    "Latest is healthy",
+			healthy: []versions.Version{"1.0.0", "2.0.0", "3.0.0"},
+			latest:  "3.0.0",
+			options: []Option{WithHealthyLatest()},
+			ver:     versions.Latest,
+			wantVer: "3.0.0",
+		},
+		{
+			name:    "Latest is unhealthy, next version is used",
+			healthy: []versions.Version{"1.0.0", "2.0.0"},
+			latest:  "3.0.0",
+			options: []Option{WithHealthyLatest()},
+			ver:     versions.Latest,
+			wantVer: "2.0.0",
+		},
+		{
+			name:    "Falls back past unhealthy versions",
+			healthy: []versions.Version{"1.0.0"},
+			latest:  "3.0.0",
+			options: []Option{WithHealthyLatest()},
+			ver:     versions.Latest,
+			wantVer: "1.0.0",
+		},
+		{
+			name:    "Versions above latest are not used",
+			healthy: []versions.Version{"1.0.0", "3.0.0"},
+			latest:  "2.0.0",
+			options: []Option{WithHealthyLatest()},
+			ver:     versions.Latest,
+			wantVer: "1.0.0",
+		},
+		{
+			name:       "Versions below the min version are not used",
+			healthy:    []versions.Version{"1.0.0"},
+			latest:     "3.0.0",
+			options:    []Option{WithHealthyLatest(), WithMinVersion("2.0.0")},
+			ver:        versions.Latest,
+			wantStatus: fiber.StatusServiceUnavailable,
+		},
+		{
+			name:       "Nothing is healthy",
+			latest:     "3.0.0",
+			options:    []Option{WithHealthyLatest()},
+			ver:        versions.Latest,
+			wantStatus: fiber.StatusServiceUnavailable,
+		},
+		{
+			name:       "Requests that name a version are not moved",
+			healthy:    []versions.Version{"1.0.0", "2.0.0"},
+			latest:     "3.0.0",
+			options:    []Option{WithHealthyLatest()},
+			ver:        "3.0.0",
+			wantStatus: fiber.StatusBadGateway,
+		},
+		{
+			name:       "Off by default",
+			healthy:    []versions.Version{"1.0.0", "2.0.0"},
+			latest:     "3.0.0",
+			ver:        versions.Latest,
+			wantStatus: fiber.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		fm := fakeMapping{}
+		for _, v := range []versions.Version{"1.0.0", "2.0.0", "3.0.0"} {
+			if slices.Contains(test.healthy, v) {
+				fm[v] = newStubUpstream(t, v.String()).URL
+			} else {
+				fm[v] = newUnhealthyUpstream(t).URL
+			}
+		}
+		fm[versions.Latest] = fm[test.latest]
+		serv := newTestServer(t, fakeMapping{}, append(test.options, WithHealthCacheTTL(time.Hour))...)
+		serv.mapping = fm
+
+		// /ready waits for the first probe, so the request after it knows which versions are unhealthy.
+		if _, err := serv.app.Test(httptest.NewRequest("GET", "/ready", nil)); err != nil {
+			t.Fatalf("TestHealthyLatest(%s): %s", test.name, err)
+		}
+
+		body := `{"ABVersion":"` + test.ver.String() + `","Req":{"Region":"westus"}}`
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestHealthyLatest(%s): %s", test.name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if test.wantVer == "" {
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("TestHealthyLatest(%s): got status %d, want %d: %s", test.name, resp.StatusCode, test.wantStatus, b)
+			}
+			continue
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestHealthyLatest(%s): got status %d, want %d: %s", test.name, resp.StatusCode, fiber.StatusOK, b)
+			continue
+		}
+		if string(b) != test.wantVer.String() {
+			t.Errorf("TestHealthyLatest(%s): request went to version %s, want %s", test.name, b, test.wantVer)
+		}
+		if got := resp.Header.Get(ResolvedVersionHeader); got != test.wantVer.String() {
+			t.Errorf("TestHealthyLatest(%s): got %s %s, want %s", test.name, ResolvedVersionHeader, got, test.wantVer)
+		}
+	}
+}
+
+// downMapping is a fakeMapping with versions that are not ready. Like a versions.Mapping, these are
+// in Status() but not in All(), as they have no agent bakers to send requests to.
+type downMapping struct {
+	fakeMapping
+	down []versions.VersionStatus
+}
+
+func (d downMapping) Status() []versions.VersionStatus {
+	statuses := append(d.fakeMapping.Status(), d.down...)
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses
+}
+
+func TestReadyVersionDown(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, "ok")
+	serv := newTestServer(t, nil)
+	serv.mapping = downMapping{
+		fakeMapping: fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL},
+		down: []versions.VersionStatus{
+			{Version: "1.1.0", State: versions.StateFailed},
+			{Version: "1.2.0", State: versions.StateStarting},
+		},
+	}
+
+	resp, err := serv.app.Test(httptest.NewRequest("GET", "/ready", nil))
+	if err != nil {
+		t.Fatalf("TestReadyVersionDown: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("TestReadyVersionDown: got status %d, want %d", resp.StatusCode, fiber.StatusServiceUnavailable)
+	}
+
+	var got readyResp
+	b, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("TestReadyVersionDown: could not decode response(%s): %s", b, err)
+	}
+	want := map[versions.Version]string{"1.1.0": "version is failed", "1.2.0": "version is starting"}
+	if diff := pretty.Compare(want, got.NotReady); diff != "" {
+		t.Errorf("TestReadyVersionDown: .NotReady -want/+got:\n%s", diff)
+	}
+}
+
+func TestHealthPolicy(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, "ok")
+	down := newUnhealthyUpstream(t)
+
+	// Four versions with latest at 1.3.0. With one down 75% are ready, with two down 50% are.
+	oneDown := fakeMapping{"1.0.0": up.URL, "1.1.0": down.URL, "1.2.0": up.URL, "1.3.0": up.URL, versions.Latest: up.URL}
+	twoDown := fakeMapping{"1.0.0": down.URL, "1.1.0": down.URL, "1.2.0": up.URL, "1.3.0": up.URL, versions.Latest: up.URL}
+	latestDown := fakeMapping{"1.0.0": up.URL, "1.1.0": up.URL, "1.2.0": up.URL, "1.3.0": down.URL, versions.Latest: down.URL}
+	allUp := fakeMapping{"1.0.0": up.URL, "1.1.0": up.URL, versions.Latest: up.URL}
+
+	// One version is up and nine failed to start, which is 10% of them.
+	var nineFailed []versions.VersionStatus
+	for i := 1; i <= 9; i++ {
+		nineFailed = append(nineFailed, versions.VersionStatus{Version: versions.Version(fmt.Sprintf("1.%d.0", i)), State: versions.StateFailed})
+	}
+
+	tests := []struct {
+		name    string
+		options []Option
+		mapping fakeMapping
+		// down are versions that are not ready, which are not in mapping, see downMapping.
+		down       []versions.VersionStatus
+		wantPolicy string
+		wantReady  bool
+	}{
+		{name: "Default with all up", mapping: allUp, wantPolicy: "all", wantReady: true},
+		{name: "Default with one down", mapping: oneDown, wantPolicy: "all"},
+		{name: "All with one down", options: []Option{WithHealthPolicy(HealthAll())}, mapping: oneDown, wantPolicy: "all"},
+		{name: "Quorum met", options: []Option{WithHealthPolicy(HealthQuorum(75))}, mapping: oneDown, wantPolicy: "quorum:75", wantReady: true},
+		{name: "Quorum not met", options: []Option{WithHealthPolicy(HealthQuorum(75))}, mapping: twoDown, wantPolicy: "quorum:75"},
+		{name: "Quorum of half", options: []Option{WithHealthPolicy(HealthQuorum(50))}, mapping: twoDown, wantPolicy: "quorum:50", wantReady: true},
+		{name: "Quorum with latest down", options: []Option{WithHealthPolicy(HealthQuorum(75))}, mapping: latestDown, wantPolicy: "quorum:75", wantReady: true},
+		{
+			name:       "Quorum counts versions that failed to start",
+			options:    []Option{WithHealthPolicy(HealthQuorum(60))},
+			mapping:    fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL},
+			down:       nineFailed,
+			wantPolicy: "quorum:60",
+		},
+		{name: "Latest up, others down", options: []Option{WithHealthPolicy(HealthLatest())}, mapping: twoDown, wantPolicy: "latest", wantReady: true},
+		{name: "Latest down, others up", options: []Option{WithHealthPolicy(HealthLatest())}, mapping: latestDown, wantPolicy: "latest"},
+		{
+			name:       "Latest with no latest",
+			options:    []Option{WithHealthPolicy(HealthLatest())},
+			mapping:    fakeMapping{"1.0.0": up.URL},
+			wantPolicy: "latest",
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, test.mapping, test.options...)
+		if test.down != nil {
+			serv.mapping = downMapping{fakeMapping: test.mapping, down: test.down}
+		}
+
+		resp, err := serv.app.Test(httptest.NewRequest("GET", "/ready", nil))
+		if err != nil {
+			t.Fatalf("TestHealthPolicy(%s): %s", test.name, err)
+		}
+		wantStatus := fiber.StatusServiceUnavailable
+		if test.wantReady {
+			wantStatus = fiber.StatusOK
+		}
+		if resp.StatusCode != wantStatus {
+			t.Errorf("TestHealthPolicy(%s): got status %d, want %d", test.name, resp.StatusCode, wantStatus)
+		}
+
+		var got readyResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestHealthPolicy(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if got.Ready != test.wantReady {
+			t.Errorf("TestHealthPolicy(%s): got .Ready == %v, want %v", test.name, got.Ready, test.wantReady)
+		}
+		if got.Policy != test.wantPolicy {
+			t.Errorf("TestHealthPolicy(%s): got .Policy == %q, want %q", test.name, got.Policy, test.wantPolicy)
+		}
+		// The versions that are down are listed even if the policy passes.
+		for v, base := range test.mapping {
+			if _, listed := got.NotReady[v]; v != versions.Latest && listed != (base == down.URL) {
+				t.Errorf("TestHealthPolicy(%s): version(%s) listed as not ready == %v, want %v", test.name, v, listed, !listed)
+			}
+		}
+	}
+}
+
+func TestParseHealthPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		in   string
+		want HealthPolicy
+		err  bool
+	}{
+		{name: "All", in: "all", want: HealthAll()},
+		{name: "Latest", in: "latest", want: HealthLatest()},
+		{name: "Quorum", in: "quorum:60", want: HealthQuorum(60)},
+		{name: "Quorum with a percent sign", in: "quorum:60%", want: HealthQuorum(60)},
+		{name: "Quorum of 0", in: "quorum:0", err: true},
+		{name: "Quorum over 100", in: "quorum:101", err: true},
+		{name: "Quorum that is not a number", in: "quorum:most", err: true},
+		{name: "Unknown policy", in: "some", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseHealthPolicy(test.in)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestParseHealthPolicy(%s): got err == nil, want err != nil", test.name)
+			continue
+		case err != nil && !test.err:
+			t.Errorf("TestParseHealthPolicy(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+		if got != test.want {
+			t.Errorf("TestParseHealthPolicy(%s): got %s, want %s", test.name, got, test.want)
+		}
+		// String() gives back what parses to the same policy.
+		if again, err := ParseHealthPolicy(got.String()); err != nil || again != got {
+			t.Errorf("TestParseHealthPolicy(%s): String() == %q does not parse back to %s", test.name, got, got)
+		}
+	}
+}
+
+func TestWithHealthPolicyBad(t *testing.T) {
+	t.Parallel()
+
+	for _, percent := range []int{-1, 0, 101} {
+		if _, err := New(versions.Mapping{}, WithHealthPolicy(HealthQuorum(percent))); err == nil {
+			t.Errorf("TestWithHealthPolicyBad(%d): got err == nil, want err != nil", percent)
+		}
+	}
+}
@@ -1,9 +1,28 @@
 package http
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/gofiber/fiber/v2"
 	"github.com/kylelemons/godebug/pretty"
 )
 
@@ -21,10 +40,23 @@ func TestVersionedRequest(t *testing.T) {
 	tests := []struct {
 		name       string
 		body       []byte
+		hdrVer     versions.Version
+		strict     bool
 		wantConfig Config
 		wantVer    string
+		wantRaw    string
 		err        bool
 	}{
+		{
+			name: "Error: Whitespace body",
+			body: []byte(" \n "),
+			err:  true,
+		},
+		{
+			name: "Error: null body",
+			body: []byte(`null`),
+			err:  true,
+		},
 		{
 			name: "Error: Bad JSON",
 			body: []byte(`{`),
@@ -44,6 +76,54 @@ func TestVersionedRequest(t *testing.T) {
 			name:    "Non-versioned request, has Config so we should get versioned.latest",
 			body:    []byte(`{"Type": "test", "Data": "data"}`),
 			wantVer: versions.Latest.String(),
+			wantRaw: `{"Type": "test", "Data": "data"}`,
+			wantConfig: Config{
+				Type: "test",
+				Data: "data",
+			},
+		},
+		{
+			name:    "Non-versioned request with a version header",
+			body:    []byte(`{"Type": "test", "Data": "data"}`),
+			hdrVer:  "1.0.0",
+			wantVer: "1.0.0",
+			wantRaw: `{"Type": "test", "Data": "data"}`,
+			wantConfig: Config{
+				Type: "test",
+				Data: "data",
+			},
+		},
+		{
+			name:    "Versioned request with a conflicting version header uses the ABVersion",
+			body:    []byte(`{"ABVersion":"1.0.0","Req":{"Type": "test", "Data": "data"}}`),
+			hdrVer:  "2.0.0",
+			wantVer: "1.0.0",
+			wantRaw: `{"Type": "test", "Data": "data"}`,
+			wantConfig: Config{
+				Type: "test",
+				Data: "data",
+			},
+		},
+		{
+			name: "Error: Deeply nested arrays",
+			body: []byte(strings.Repeat("[", 100000) + strings.Repeat("]", 100000)),
+			err:  true,
+		},
+		{
+			name: "Error: Deeply nested inside Req",
+			body: []byte(`{"ABVersion":"1.0.0","Req":{"Type":` + strings.Repeat(`{"a":`, 1000) + `1` + strings.Repeat("}", 1000) + `}}`),
+			err:  true,
+		},
+		{
+			name: "Error: ABVersion is set, but Req is null",
+			body: []byte(`{"ABVersion":"1.0.0","Req":null}`),
+			err:  true,
+		},
+		{
+			name:    "Nested names called Req are not the VersionedReq",
+			body:    []byte(`{"Type": "test", "Data": "data", "Extra": {"Req": {"ABVersion": "1.0.0"}}}`),
+			wantVer: versions.Latest.String(),
+			wantRaw: `{"Type": "test", "Data": "data", "Extra": {"Req": {"ABVersion": "1.0.0"}}}`,
 			wantConfig: Config{
 				Type: "test",
 				Data: "data",
@@ -58,6 +138,40 @@ func TestVersionedRequest(t *testing.T) {
 			name:    "Versioned request, has Config and sets the ABVersion",
 			body:    []byte(`{"ABVersion":"1.0.0","Req":{"Type": "test", "Data": "data"}}`),
 			wantVer: "1.0.0",
+			wantRaw: `{"Type": "test", "Data": "data"}`,
+			wantConfig: Config{
+				Type: "test",
+				Data: "data",
+			},
+		},
+		{
+			name:    "Unknown fields are allowed if not strict",
+			body:    []byte(`{"Type": "test", "Data": "data", "Other": 1}`),
+			wantVer: versions.Latest.String(),
+			wantRaw: `{"Type": "test", "Data": "data", "Other": 1}`,
+			wantConfig: Config{
+				Type: "test",
+				Data: "data",
+			},
+		},
+		{
+			name:   "Error: Strict non-versioned request has an unknown field",
+			body:   []byte(`{"Type": "test", "Data": "data", "Other": 1}`),
+			strict: true,
+			err:    true,
+		},
+		{
+			name:   "Error: Strict versioned request has an unknown field",
+			body:   []byte(`{"ABVersion":"1.0.0","Req":{"Type": "test", "Other": 1}}`),
+			strict: true,
+			err:    true,
+		},
+		{
+			name:    "Strict versioned request only has known fields",
+			body:    []byte(`{"ABVersion":"1.0.0","Req":{"Type": "test", "Data": "data"}}`),
+			strict:  true,
+			wantVer: "1.0.0",
+			wantRaw: `{"Type": "test", "Data": "data"}`,
 			wantConfig: Config{
 				Type: "test",
 				Data: "data",
@@ -66,7 +180,7 @@ func TestVersionedRequest(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		gotVer, gotConfig, err := versionedRequest[Config](test.body)
+		got, err := versionedRequest[Config](jsonWrapperCodec{}, test.body, test.hdrVer, test.strict, nil)
 		switch {
 		case test.err && err == nil:
 			t.Errorf("TestVersionedRequest(%s): got err == nil, want err != nil", test.name)
@@ -78,11 +192,1755 @@ func TestVersionedRequest(t *testing.T) {
 			continue
 		}
 
-		if gotVer.String() != test.wantVer {
-			t.Errorf("TestVersionedRequest(%s): got version %s, want %s", test.name, gotVer, test.wantVer)
+		if got.ver.String() != test.wantVer {
+			t.Errorf("TestVersionedRequest(%s): got version %s, want %s", test.name, got.ver, test.wantVer)
 		}
-		if diff := pretty.Compare(test.wantConfig, gotConfig); diff != "" {
+		if diff := pretty.Compare(test.wantConfig, got.req); diff != "" {
 			t.Errorf("TestVersionedRequest(%s): -want/+got:\n%s", test.name, diff)
 		}
+		if string(got.raw) != test.wantRaw {
+			t.Errorf("TestVersionedRequest(%s): got raw %s, want %s", test.name, got.raw, test.wantRaw)
+		}
+	}
+}
+
+// fakeMapping implements mapper with a static map of versions to stub upstreams.
+type fakeMapping map[versions.Version]string
+
+func (f fakeMapping) All() map[versions.Version][]string {
+	all := map[versions.Version][]string{}
+	for v, base := range f {
+		all[v] = []string{base}
+	}
+	return all
+}
+
+// Has reports if v has a stub upstream.
+func (f fakeMapping) Has(v versions.Version) bool {
+	_, ok := f[v]
+	return ok
+}
+
+// Resolve resolves versions.Latest to the version that has the same stub upstream.
+func (f fakeMapping) Resolve(v versions.Version) versions.Version {
+	if v != versions.Latest {
+		return v
+	}
+	for ver, base := range f {
+		if ver != versions.Latest && base == f[versions.Latest] {
+			return ver
+		}
+	}
+	return v
+}
+
+// Generation is always 0, as the versions of a fakeMapping are not replaced.
+func (f fakeMapping) Generation() uint64 {
+	return 0
+}
+
+// HealthyBase returns the stub upstream for v, unless healthy reports it is down.
+func (f fakeMapping) HealthyBase(v versions.Version, healthy func(addr string) bool) (string, error) {
+	if base, ok := f[v]; ok {
+		if healthy != nil && !healthy(base) {
+			return "", &versions.ErrVersionUnhealthy{Version: f.Resolve(v), Replicas: 1}
+		}
+		return base, nil
+	}
+
+	avail := make([]versions.Version, 0, len(f))
+	for v := range f {
+		avail = append(avail, v)
+	}
+	sort.Slice(avail, func(i, j int) bool { return avail[i] < avail[j] })
+	if v == versions.Latest {
+		return "", &versions.ErrNoLatest{Available: avail}
+	}
+	return "", &versions.ErrVersionNotFound{Version: v, Available: avail}
+}
+
+// Supports reports that every version serves every endpoint.
+func (f fakeMapping) Supports(versions.Version, string) bool {
+	return true
+}
+
+// Status reports every version as ready, with one replica at its stub upstream.
+func (f fakeMapping) Status() []versions.VersionStatus {
+	statuses := []versions.VersionStatus{}
+	for v, base := range f {
+		if v == versions.Latest {
+			continue
+		}
+		statuses = append(
+			statuses,
+			versions.VersionStatus{
+				Version:  v,
+				Latest:   base == f[versions.Latest],
+				State:    versions.StateReady,
+				Ready:    true,
+				Replicas: []versions.ReplicaStatus{{Addr: base}},
+			},
+		)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses
+}
+
+// stubUpstream is an agent baker stand-in that records the last request body it received.
+type stubUpstream struct {
+	*httptest.Server
+
+	// probes counts requests to the health endpoint.
+	probes atomic.Int32
+
+	mu     sync.Mutex
+	method string
+	path   string
+	header nethttp.Header
+	body   []byte
+}
+
+func newStubUpstream(t *testing.T, resp string) *stubUpstream {
+	t.Helper()
+
+	s := &stubUpstream{}
+	s.Server = httptest.NewServer(s.handler(resp))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTLSStubUpstream is like newStubUpstream, but the stub is served over https with a self-signed certificate.
+func newTLSStubUpstream(t *testing.T, resp string) *stubUpstream {
+	t.Helper()
+
+	s := &stubUpstream{}
+	s.Server = httptest.NewTLSServer(s.handler(resp))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubUpstream) handler(resp string) nethttp.Handler {
+	return nethttp.HandlerFunc(
+		func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			if r.URL.Path == upstreamHealthPath {
+				s.probes.Add(1)
+			}
+			b, _ := io.ReadAll(r.Body)
+			s.mu.Lock()
+			s.method = r.Method
+			s.path = r.URL.Path
+			s.header = r.Header.Clone()
+			s.body = b
+			s.mu.Unlock()
+			w.Write([]byte(resp))
+		},
+	)
+}
+
+func (s *stubUpstream) lastMethod() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.method
+}
+
+func (s *stubUpstream) lastPath() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.path
+}
+
+func (s *stubUpstream) lastHeader() nethttp.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.header
+}
+
+func (s *stubUpstream) lastBody() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return string(s.body)
+}
+
+// newTestServer returns a Server that routes to the stub upstreams in m.
+func newTestServer(t *testing.T, m fakeMapping, options ...Option) *Server {
+	t.Helper()
+
+	serv, err := New(versions.Mapping{}, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv.mapping = m
+	return serv
+}
+
+func TestForwardPreservesUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	// NewField does not exist in datamodel.GetLatestSigImageConfigRequest, but a newer agent baker might use it.
+	const inner = `{"SubscriptionID":"sub","Region":"westus","NewField":{"Nested":[1,2,3]}}`
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "Versioned request",
+			body: `{"ABVersion":"1.0.0","Req":` + inner + `}`,
+		},
+		{
+			name: "Non-versioned request",
+			body: inner,
+		},
+	}
+
+	for _, test := range tests {
+		up := newStubUpstream(t, `{}`)
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL})
+
+		req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(test.body))
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestForwardPreservesUnknownFields(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestForwardPreservesUnknownFields(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+			continue
+		}
+		if got := up.lastBody(); got != inner {
+			t.Errorf("TestForwardPreservesUnknownFields(%s): upstream got body %s, want %s", test.name, got, inner)
+		}
+	}
+}
+
+func TestVersionNotFound(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, "1.1.0": up.URL})
+
+	body := `{"ABVersion":"9.9.9","Req":{"Region":"westus"}}`
+	req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body))
+	resp, err := serv.app.Test(req)
+	if err != nil {
+		t.Fatalf("TestVersionNotFound: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("TestVersionNotFound: got status %d, want %d", resp.StatusCode, fiber.StatusNotFound)
+	}
+
+	var got errorResp
+	b, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("TestVersionNotFound: could not decode response(%s): %s", b, err)
+	}
+	want := []versions.Version{"1.0.0", "1.1.0"}
+	if diff := pretty.Compare(want, got.Available); diff != "" {
+		t.Errorf("TestVersionNotFound: available versions -want/+got:\n%s", diff)
+	}
+	if got.Error == "" {
+		t.Errorf("TestVersionNotFound: got empty error message")
+	}
+}
+
+func TestNoLatest(t *testing.T) {
+	t.Parallel()
+
+	// Like a Mapping where the only version is a prerelease and WithStableLatest() is used.
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0-rc.1": up.URL})
+
+	req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(`{"Region":"westus"}`))
+	resp, err := serv.app.Test(req)
+	if err != nil {
+		t.Fatalf("TestNoLatest: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusServiceUnavailable {
+		t.Errorf("TestNoLatest: got status %d, want %d", resp.StatusCode, fiber.StatusServiceUnavailable)
+	}
+
+	var got errorResp
+	b, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("TestNoLatest: could not decode response(%s): %s", b, err)
+	}
+	if diff := pretty.Compare([]versions.Version{"1.0.0-rc.1"}, got.Available); diff != "" {
+		t.Errorf("TestNoLatest: available versions -want/+got:\n%s", diff)
+	}
+	if !strings.Contains(got.Error, "latest") {
+		t.Errorf("TestNoLatest: got error %q, want it to say there is no latest version", got.Error)
+	}
+}
+
+// stateMapping is a fakeMapping where some versions are known but not ready.
+type stateMapping struct {
+	fakeMapping
+	states map[versions.Version]versions.State
+}
+
+func (s stateMapping) HealthyBase(v versions.Version, healthy func(addr string) bool) (string, error) {
+	if st, ok := s.states[v]; ok {
+		return "", &versions.ErrVersionNotReady{Version: v, State: st}
+	}
+	return s.fakeMapping.HealthyBase(v, healthy)
+}
+
+func TestVersionNotReady(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+
+	tests := []struct {
+		name           string
+		ver            versions.Version
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{
+			name:           "Version is starting",
+			ver:            "1.1.0",
+			wantStatus:     fiber.StatusServiceUnavailable,
+			wantRetryAfter: "5",
+		},
+		{
+			name:       "Version failed to start",
+			ver:        "1.2.0",
+			wantStatus: fiber.StatusServiceUnavailable,
+		},
+		{
+			name:       "Version is unknown",
+			ver:        "9.9.9",
+			wantStatus: fiber.StatusNotFound,
+		},
+		{
+			name:       "Version is ready",
+			ver:        "1.0.0",
+			wantStatus: fiber.StatusOK,
+		},
+	}
+
+	serv := newTestServer(t, fakeMapping{})
+	serv.mapping = stateMapping{
+		fakeMapping: fakeMapping{"1.0.0": up.URL},
+		states:      map[versions.Version]versions.State{"1.1.0": versions.StateStarting, "1.2.0": versions.StateFailed},
+	}
+
+	for _, test := range tests {
+		body := `{"ABVersion":"` + test.ver.String() + `","Req":{"Region":"westus"}}`
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestVersionNotReady(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("TestVersionNotReady(%s): got status %d, want %d", test.name, resp.StatusCode, test.wantStatus)
+		}
+		if got := resp.Header.Get(fiber.HeaderRetryAfter); got != test.wantRetryAfter {
+			t.Errorf("TestVersionNotReady(%s): got Retry-After %q, want %q", test.name, got, test.wantRetryAfter)
+		}
+	}
+}
+
+func TestGenericForwarding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		method      string
+		header      versions.Version
+		contentType string
+		body        string
+		wantVer     versions.Version
+	}{
+		{
+			name:    "Version in the header",
+			method:  "POST",
+			header:  "1.0.0",
+			body:    `{"Some":"thing"}`,
+			wantVer: "1.0.0",
+		},
+		{
+			name:    "No version is latest",
+			method:  "POST",
+			body:    `{"Some":"thing"}`,
+			wantVer: versions.Latest,
+		},
+		{
+			name:    "A wrapper is not unwrapped",
+			method:  "POST",
+			body:    `{"ABVersion":"1.0.0","Req":{"Some":"thing"}}`,
+			wantVer: versions.Latest,
+		},
+		{
+			name:    "No body",
+			method:  "GET",
+			wantVer: versions.Latest,
+		},
+		{
+			name:    "PUT keeps its method",
+			method:  "PUT",
+			header:  "1.0.0",
+			body:    `{"Some":"thing"}`,
+			wantVer: "1.0.0",
+		},
+		{
+			name:    "DELETE keeps its method",
+			method:  "DELETE",
+			wantVer: versions.Latest,
+		},
+		{
+			name:    "PATCH keeps its method",
+			method:  "PATCH",
+			body:    `{"Some":"thing"}`,
+			wantVer: versions.Latest,
+		},
+		{
+			name:        "Text is passed through",
+			method:      "POST",
+			header:      "1.0.0",
+			contentType: fiber.MIMETextPlain,
+			body:        "some thing",
+			wantVer:     "1.0.0",
+		},
+		{
+			name:        "JSON that isn't an object is passed through",
+			method:      "POST",
+			contentType: fiber.MIMEApplicationJSON,
+			body:        `["some", "thing"]`,
+			wantVer:     versions.Latest,
+		},
+	}
+
+	for _, test := range tests {
+		// Each upstream responds with its version so we can tell where the request went.
+		old := newStubUpstream(t, "1.0.0")
+		latest := newStubUpstream(t, versions.Latest.String())
+		serv := newTestServer(t, fakeMapping{"1.0.0": old.URL, versions.Latest: latest.URL})
+
+		up := latest
+		if test.wantVer == "1.0.0" {
+			up = old
+		}
+
+		req := httptest.NewRequest(test.method, "/somenewendpoint", strings.NewReader(test.body))
+		if test.header != "" {
+			req.Header.Set(VersionHeader, test.header.String())
+		}
+		if test.contentType != "" {
+			req.Header.Set(fiber.HeaderContentType, test.contentType)
+		}
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestGenericForwarding(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestGenericForwarding(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+			continue
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if string(b) != test.wantVer.String() {
+			t.Errorf("TestGenericForwarding(%s): response came from the wrong version: %s", test.name, b)
+		}
+		if got := up.lastPath(); got != "/somenewendpoint" {
+			t.Errorf("TestGenericForwarding(%s): upstream got path %s, want /somenewendpoint", test.name, got)
+		}
+		if got := up.lastMethod(); got != test.method {
+			t.Errorf("TestGenericForwarding(%s): upstream got method %s, want %s", test.name, got, test.method)
+		}
+		if got := up.lastBody(); got != test.body {
+			t.Errorf("TestGenericForwarding(%s): upstream got body %s, want %s", test.name, got, test.body)
+		}
+		if test.contentType == "" {
+			continue
+		}
+		if got := up.lastHeader().Get(fiber.HeaderContentType); got != test.contentType {
+			t.Errorf("TestGenericForwarding(%s): upstream got Content-Type %q, want %q", test.name, got, test.contentType)
+		}
+	}
+}
+
+func TestVersionHeader(t *testing.T) {
+	t.Parallel()
+
+	const inner = `{"Region":"westus"}`
+
+	tests := []struct {
+		name    string
+		body    string
+		header  string
+		wantVer versions.Version
+		// typedOnly is set if only the routes we have handlers for read the version from the body.
+		typedOnly bool
+	}{
+		{
+			name:    "Header only",
+			body:    inner,
+			header:  "1.0.0",
+			wantVer: "1.0.0",
+		},
+		{
+			name:      "Wrapper only",
+			body:      `{"ABVersion":"1.0.0","Req":` + inner + `}`,
+			wantVer:   "1.0.0",
+			typedOnly: true,
+		},
+		{
+			name:      "Wrapper and header conflict, wrapper wins",
+			body:      `{"ABVersion":"1.0.0","Req":` + inner + `}`,
+			header:    "2.0.0",
+			wantVer:   "1.0.0",
+			typedOnly: true,
+		},
+		{
+			name:    "Neither is latest",
+			body:    inner,
+			wantVer: versions.Latest,
+		},
+	}
+
+	for _, test := range tests {
+		fm := fakeMapping{}
+		for _, v := range []versions.Version{"1.0.0", "2.0.0", versions.Latest} {
+			fm[v] = newStubUpstream(t, v.String()).URL
+		}
+		serv := newTestServer(t, fm)
+
+		paths := []string{"/getlatestsigimageconfig", "/somenewendpoint"}
+		if test.typedOnly {
+			paths = paths[:1]
+		}
+		for _, path := range paths {
+			req := httptest.NewRequest("POST", path, strings.NewReader(test.body))
+			if test.header != "" {
+				req.Header.Set(VersionHeader, test.header)
+			}
+			resp, err := serv.app.Test(req)
+			if err != nil {
+				t.Fatalf("TestVersionHeader(%s, %s): %s", test.name, path, err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != fiber.StatusOK {
+				t.Errorf("TestVersionHeader(%s, %s): got status %d, want %d: %s", test.name, path, resp.StatusCode, fiber.StatusOK, b)
+				continue
+			}
+			if string(b) != test.wantVer.String() {
+				t.Errorf("TestVersionHeader(%s, %s): request went to version %s, want %s", test.name, path, b, test.wantVer)
+			}
+		}
+	}
+}
+
+func TestRequireExplicitVersion(t *testing.T) {
+	t.Parallel()
+
+	const inner = `{"Region":"westus"}`
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		header  string
+		require bool
+		// wantVer is the version the request goes to. If empty, it must be rejected with a 400.
+		wantVer versions.Version
+		// typedOnly is set if only the routes we have handlers for read the version from the body.
+		typedOnly bool
+	}{
+		{name: "No version is latest by default", method: "POST", body: inner, wantVer: versions.Latest},
+		{name: "No body is latest by default", method: "GET", wantVer: versions.Latest},
+		{name: "Error: No version", method: "POST", body: inner, require: true},
+		{name: "Error: No body or version", method: "GET", require: true},
+		{name: "Header", method: "POST", body: inner, header: "1.0.0", require: true, wantVer: "1.0.0"},
+		{name: "Header without a body", method: "GET", header: "1.0.0", require: true, wantVer: "1.0.0"},
+		{name: "Wrapper", method: "POST", body: `{"ABVersion":"1.0.0","Req":` + inner + `}`, require: true, wantVer: "1.0.0", typedOnly: true},
+		{name: "Latest by name", method: "POST", body: inner, header: "latest", require: true, wantVer: versions.Latest},
+	}
+
+	for _, test := range tests {
+		fm := fakeMapping{}
+		for _, v := range []versions.Version{"1.0.0", versions.Latest} {
+			fm[v] = newStubUpstream(t, v.String()).URL
+		}
+		var options []Option
+		if test.require {
+			options = append(options, WithRequireExplicitVersion())
+		}
+		serv := newTestServer(t, fm, options...)
+
+		paths := []string{"/getlatestsigimageconfig", "/somenewendpoint"}
+		if test.body == "" {
+			paths = paths[1:]
+		}
+		if test.typedOnly {
+			paths = paths[:1]
+		}
+		for _, path := range paths {
+			req := httptest.NewRequest(test.method, path, strings.NewReader(test.body))
+			if test.header != "" {
+				req.Header.Set(VersionHeader, test.header)
+			}
+			resp, err := serv.app.Test(req)
+			if err != nil {
+				t.Fatalf("TestRequireExplicitVersion(%s, %s): %s", test.name, path, err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			if test.wantVer == "" {
+				if resp.StatusCode != fiber.StatusBadRequest {
+					t.Errorf("TestRequireExplicitVersion(%s, %s): got status %d, want %d", test.name, path, resp.StatusCode, fiber.StatusBadRequest)
+				}
+				continue
+			}
+			if resp.StatusCode != fiber.StatusOK {
+				t.Errorf("TestRequireExplicitVersion(%s, %s): got status %d, want %d: %s", test.name, path, resp.StatusCode, fiber.StatusOK, b)
+				continue
+			}
+			if string(b) != test.wantVer.String() {
+				t.Errorf("TestRequireExplicitVersion(%s, %s): request went to version %s, want %s", test.name, path, b, test.wantVer)
+			}
+		}
+	}
+}
+
+func TestResolvedVersionHeader(t *testing.T) {
+	t.Parallel()
+
+	v1, v2 := newStubUpstream(t, "1.0.0"), newStubUpstream(t, "2.0.0")
+	serv := newTestServer(t, fakeMapping{"1.0.0": v1.URL, "2.0.0": v2.URL, versions.Latest: v2.URL})
+
+	tests := []struct {
+		name string
+		path string
+		ver  string
+		want string
+	}{
+		{name: "Latest", path: "/getlatestsigimageconfig", ver: "latest", want: "2.0.0"},
+		{name: "Concrete version", path: "/getlatestsigimageconfig", ver: "1.0.0", want: "1.0.0"},
+		{name: "Latest on a generic endpoint", path: "/somenewendpoint", ver: "latest", want: "2.0.0"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(`{"Region":"westus"}`))
+		req.Header.Set(VersionHeader, test.ver)
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestResolvedVersionHeader(%s): %s", test.name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestResolvedVersionHeader(%s): got status %d, want %d: %s", test.name, resp.StatusCode, fiber.StatusOK, b)
+			continue
+		}
+		if got := resp.Header.Get(ResolvedVersionHeader); got != test.want {
+			t.Errorf("TestResolvedVersionHeader(%s): got header %q, want %q", test.name, got, test.want)
+		}
+		if string(b) != test.want {
+			t.Errorf("TestResolvedVersionHeader(%s): request went to version %s, want %s", test.name, b, test.want)
+		}
+	}
+}
+
+func TestStaticMapping(t *testing.T) {
+	t.Parallel()
+
+	v1, v2 := newStubUpstream(t, "1.0.0"), newStubUpstream(t, "1.1.0")
+	m, err := versions.NewStatic(map[versions.Version]string{"1.0.0": v1.URL, "1.1.0": v2.URL})
+	if err != nil {
+		t.Fatalf("TestStaticMapping: %s", err)
+	}
+	serv, err := New(m)
+	if err != nil {
+		t.Fatalf("TestStaticMapping: %s", err)
+	}
+
+	tests := []struct {
+		ver  string
+		want string
+	}{
+		{ver: "1.0.0", want: "1.0.0"},
+		{ver: "1.1.0", want: "1.1.0"},
+		{ver: "latest", want: "1.1.0"},
+	}
+
+	for _, test := range tests {
+		body := `{"ABVersion":"` + test.ver + `","Req":{"Region":"westus"}}`
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestStaticMapping(%s): %s", test.ver, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestStaticMapping(%s): got status %d, want %d: %s", test.ver, resp.StatusCode, fiber.StatusOK, b)
+			continue
+		}
+		if string(b) != test.want {
+			t.Errorf("TestStaticMapping(%s): request went to version %s, want %s", test.ver, b, test.want)
+		}
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{versions.Latest: up.URL})
+
+	bodies := []string{"", "   \n\t", "null", " null "}
+	paths := []string{"/getnodebootstrapdata", "/getlatestsigimageconfig", "/getdistrosigimageconfig"}
+
+	for _, body := range bodies {
+		for _, path := range paths {
+			req := httptest.NewRequest("POST", path, strings.NewReader(body))
+			resp, err := serv.app.Test(req)
+			if err != nil {
+				t.Fatalf("TestEmptyBody(%q, %s): %s", body, path, err)
+			}
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("TestEmptyBody(%q, %s): got status %d, want %d", body, path, resp.StatusCode, fiber.StatusBadRequest)
+			}
+
+			var got errorResp
+			b, _ := io.ReadAll(resp.Body)
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("TestEmptyBody(%q, %s): could not decode response(%s): %s", body, path, b, err)
+			}
+			if got.Error != errEmptyBody.Error() {
+				t.Errorf("TestEmptyBody(%q, %s): got error %q, want %q", body, path, got.Error, errEmptyBody)
+			}
+		}
+	}
+}
+
+func TestForwardTLS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		options []Option
+		want    int
+	}{
+		{
+			name: "Self-signed certificate is rejected by default",
+			want: fiber.StatusInternalServerError,
+		},
+		{
+			name:    "Self-signed certificate is accepted with WithInsecureSkipVerify",
+			options: []Option{WithInsecureSkipVerify()},
+			want:    fiber.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		up := newTLSStubUpstream(t, "tls")
+		if !strings.HasPrefix(up.URL, "https://") {
+			t.Fatalf("TestForwardTLS(%s): stub is not using TLS: %s", test.name, up.URL)
+		}
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, test.options...)
+
+		body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestForwardTLS(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.want {
+			t.Errorf("TestForwardTLS(%s): got status %d, want %d", test.name, resp.StatusCode, test.want)
+			continue
+		}
+		if test.want != fiber.StatusOK {
+			continue
+		}
+		if got := up.lastBody(); got != `{"Region":"westus"}` {
+			t.Errorf("TestForwardTLS(%s): upstream got body %s", test.name, got)
+		}
+	}
+}
+
+func TestWithMinVersion(t *testing.T) {
+	t.Parallel()
+
+	old := newStubUpstream(t, `{}`)
+	at := newStubUpstream(t, `{}`)
+	newer := newStubUpstream(t, `{}`)
+
+	tests := []struct {
+		name       string
+		mapping    fakeMapping
+		ver        versions.Version
+		wantStatus int
+	}{
+		{
+			name:       "Below the minimum",
+			mapping:    fakeMapping{"1.0.0": old.URL, "1.1.0": at.URL},
+			ver:        "1.0.0",
+			wantStatus: fiber.StatusGone,
+		},
+		{
+			name:       "Unknown version below the minimum",
+			mapping:    fakeMapping{"1.0.0": old.URL, "1.1.0": at.URL},
+			ver:        "0.9.0",
+			wantStatus: fiber.StatusNotFound,
+		},
+		{
+			name:       "At the minimum",
+			mapping:    fakeMapping{"1.0.0": old.URL, "1.1.0": at.URL},
+			ver:        "1.1.0",
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name:       "Above the minimum",
+			mapping:    fakeMapping{"1.0.0": old.URL, "1.1.0": at.URL, "1.2.0": newer.URL},
+			ver:        "1.2.0",
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name:       "Latest resolves above the minimum",
+			mapping:    fakeMapping{"1.0.0": old.URL, "1.2.0": newer.URL, versions.Latest: newer.URL},
+			ver:        versions.Latest,
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name:       "Latest resolves below the minimum",
+			mapping:    fakeMapping{"1.0.0": old.URL, versions.Latest: old.URL},
+			ver:        versions.Latest,
+			wantStatus: fiber.StatusGone,
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, test.mapping, WithMinVersion("1.1.0"))
+
+		body := `{"ABVersion":"` + test.ver.String() + `","Req":{"Region":"westus"}}`
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestWithMinVersion(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("TestWithMinVersion(%s): got status %d, want %d", test.name, resp.StatusCode, test.wantStatus)
+		}
+		if test.wantStatus != fiber.StatusGone {
+			continue
+		}
+
+		var got errorResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestWithMinVersion(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if !strings.Contains(got.Error, "1.1.0") {
+			t.Errorf("TestWithMinVersion(%s): got error %q, want it to name the minimum version", test.name, got.Error)
+		}
+	}
+
+	if _, err := New(versions.Mapping{}, WithMinVersion(versions.Latest)); err == nil {
+		t.Errorf("TestWithMinVersion: got err == nil for a minimum of latest, want err != nil")
+	}
+}
+
+// gatedMapping is a fakeMapping whose versions only serve the endpoints listed for them.
+// Versions that are not in endpoints serve every endpoint.
+type gatedMapping struct {
+	fakeMapping
+	endpoints map[versions.Version][]string
+}
+
+func (g gatedMapping) Supports(v versions.Version, endpoint string) bool {
+	eps, ok := g.endpoints[v]
+	return !ok || slices.Contains(eps, endpoint)
+}
+
+func TestUpstreamStatus(t *testing.T) {
+	t.Parallel()
+
+	const problem = `{"error":"Region is required","field":"Region"}`
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				switch r.Header.Get("X-Answer") {
+				case "422":
+					w.Header().Set(fiber.HeaderContentType, "application/problem+json")
+					w.WriteHeader(nethttp.StatusUnprocessableEntity)
+					w.Write([]byte(problem))
+				case "503":
+					w.WriteHeader(nethttp.StatusServiceUnavailable)
+					w.Write([]byte("overloaded"))
+				default:
+					w.Write([]byte(`{"ok":true}`))
+				}
+			},
+		),
+	)
+	t.Cleanup(up.Close)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL})
+
+	tests := []struct {
+		name            string
+		answer          string
+		wantStatus      int
+		wantBody        string
+		wantContentType string
+	}{
+		{name: "Success", wantStatus: fiber.StatusOK, wantBody: `{"ok":true}`},
+		{name: "Client error is passed on", answer: "422", wantStatus: fiber.StatusUnprocessableEntity, wantBody: problem, wantContentType: "application/problem+json"},
+		{name: "Server error is a bad gateway", answer: "503", wantStatus: fiber.StatusBadGateway},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(`{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`))
+		req.Header.Set("X-Answer", test.answer)
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestUpstreamStatus(%s): %s", test.name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("TestUpstreamStatus(%s): got status %d, want %d: %s", test.name, resp.StatusCode, test.wantStatus, b)
+			continue
+		}
+		if test.wantBody != "" && string(b) != test.wantBody {
+			t.Errorf("TestUpstreamStatus(%s): got body %s, want %s", test.name, b, test.wantBody)
+		}
+		if test.wantContentType != "" && resp.Header.Get(fiber.HeaderContentType) != test.wantContentType {
+			t.Errorf("TestUpstreamStatus(%s): got Content-Type %s, want %s", test.name, resp.Header.Get(fiber.HeaderContentType), test.wantContentType)
+		}
+		if test.wantStatus != fiber.StatusBadGateway {
+			continue
+		}
+		var got errorResp
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestUpstreamStatus(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if !strings.Contains(got.Error, "503") {
+			t.Errorf("TestUpstreamStatus(%s): got error %q, want it to name the agent baker's status", test.name, got.Error)
+		}
+	}
+}
+
+func TestUnsupportedEndpoint(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{})
+	serv.mapping = gatedMapping{
+		fakeMapping: fakeMapping{"1.0.0": up.URL, "1.1.0": up.URL, versions.Latest: up.URL},
+		endpoints:   map[versions.Version][]string{"1.0.0": {"/getnodebootstrapdata", "/getlatestsigimageconfig"}},
+	}
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{
+			name: "Bootstrap data is supported",
+			path: "/getnodebootstrapdata",
+			body: `{"ABVersion":"1.0.0","Req":{"TenantID":"tenant"}}`,
+			want: fiber.StatusOK,
+		},
+		{
+			name: "Latest sig image config is supported",
+			path: "/getlatestsigimageconfig",
+			body: `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`,
+			want: fiber.StatusOK,
+		},
+		{
+			name: "Distro sig image config is not supported",
+			path: "/getdistrosigimageconfig",
+			body: `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`,
+			want: fiber.StatusNotImplemented,
+		},
+		{
+			name: "Version without a list supports every endpoint",
+			path: "/getdistrosigimageconfig",
+			body: `{"ABVersion":"1.1.0","Req":{"Region":"westus"}}`,
+			want: fiber.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		before := up.lastPath()
+		resp, err := serv.app.Test(httptest.NewRequest("POST", test.path, strings.NewReader(test.body)))
+		if err != nil {
+			t.Fatalf("TestUnsupportedEndpoint(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.want {
+			t.Errorf("TestUnsupportedEndpoint(%s): got status %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+		if test.want != fiber.StatusNotImplemented {
+			continue
+		}
+
+		var got errorResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestUnsupportedEndpoint(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if !strings.Contains(got.Error, "1.0.0") || !strings.Contains(got.Error, test.path) {
+			t.Errorf("TestUnsupportedEndpoint(%s): got error %q, want it to name the version and endpoint", test.name, got.Error)
+		}
+		if up.lastPath() != before {
+			t.Errorf("TestUnsupportedEndpoint(%s): the request was sent to the agent baker", test.name)
+		}
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	t.Parallel()
+
+	notFound := httptest.NewServer(nethttp.NotFoundHandler())
+	t.Cleanup(notFound.Close)
+	up := newStubUpstream(t, `{}`)
+	closed := httptest.NewServer(nethttp.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		mapping mapper
+		options []Option
+		// wantStatus is the status when we couldn't ask an agent baker, in which case the error must say so.
+		wantStatus int
+	}{
+		{
+			name:       "Agent baker does not know the endpoint",
+			mapping:    fakeMapping{versions.Latest: notFound.URL},
+			wantStatus: fiber.StatusNotFound,
+		},
+		{
+			name:       "Generic forwarding is off",
+			mapping:    fakeMapping{versions.Latest: up.URL},
+			options:    []Option{WithoutGenericForwarding()},
+			wantStatus: fiber.StatusNotFound,
+		},
+		{
+			name:       "No latest version",
+			mapping:    fakeMapping{"1.0.0": up.URL},
+			wantStatus: fiber.StatusServiceUnavailable,
+		},
+		{
+			name:       "Latest version is down",
+			mapping:    fakeMapping{versions.Latest: closed.URL},
+			wantStatus: fiber.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, nil, test.options...)
+		serv.mapping = test.mapping
+
+		resp, err := serv.app.Test(httptest.NewRequest("GET", "/nonsense", nil))
+		if err != nil {
+			t.Fatalf("TestUnknownRoute(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("TestUnknownRoute(%s): got status %d, want %d", test.name, resp.StatusCode, test.wantStatus)
+		}
+
+		var got errorResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestUnknownRoute(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if !strings.Contains(got.Error, "/nonsense") {
+			t.Errorf("TestUnknownRoute(%s): got error %q, want it to name the path", test.name, got.Error)
+		}
+		asked := !strings.Contains(got.Error, "no agent baker could be asked")
+		if asked != (test.wantStatus == fiber.StatusNotFound) {
+			t.Errorf("TestUnknownRoute(%s): got error %q, want it to say if an agent baker was asked", test.name, got.Error)
+		}
+		// This must not look like a version that wasn't found.
+		if test.wantStatus == fiber.StatusNotFound && len(got.Available) != 0 {
+			t.Errorf("TestUnknownRoute(%s): got .Available == %v, want it empty", test.name, got.Available)
+		}
+		for _, want := range []string{"POST /getnodebootstrapdata", "POST /getlatestsigimageconfig", "GET /ready"} {
+			found := false
+			for _, e := range got.Endpoints {
+				found = found || e == want
+			}
+			if !found {
+				t.Errorf("TestUnknownRoute(%s): got .Endpoints == %v, want it to have %s", test.name, got.Endpoints, want)
+			}
+		}
+	}
+
+	if got := up.lastPath(); got != "" {
+		t.Errorf("TestUnknownRoute: request was forwarded with generic forwarding off, upstream got path %s", got)
+	}
+}
+
+func TestDeeplyNestedBody(t *testing.T) {
+	t.Parallel()
+
+	msgpackBody := append([]byte{0x82, 0xa9}, "ABVersion"...)
+	msgpackBody = append(append(msgpackBody, 0xa5), "1.0.0"...)
+	msgpackBody = append(msgpackBody, 0xa3, 'R', 'e', 'q')
+	msgpackBody = append(append(msgpackBody, bytes.Repeat([]byte{0x91}, 1<<20)...), 0xc0)
+
+	// Every codec in codecs needs a test, as each decodes the bodies in its encoding.
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{
+			name:        "JSON",
+			contentType: fiber.MIMEApplicationJSON,
+			body:        []byte(`{"ABVersion":"1.0.0","Req":` + strings.Repeat("[", 1<<20) + strings.Repeat("]", 1<<20) + `}`),
+		},
+		{name: "MessagePack", contentType: MIMEApplicationMsgpack, body: msgpackBody},
+	}
+
+	tested := map[string]bool{}
+	for _, test := range tests {
+		tested[test.contentType] = true
+
+		up := newStubUpstream(t, `{}`)
+		serv := newTestServer(t, fakeMapping{versions.Latest: up.URL, "1.0.0": up.URL})
+
+		req := httptest.NewRequest("POST", "/getlatestsigimageconfig", bytes.NewReader(test.body))
+		req.Header.Set(fiber.HeaderContentType, test.contentType)
+		req.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestDeeplyNestedBody(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("TestDeeplyNestedBody(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusBadRequest)
+		}
+
+		var got errorResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestDeeplyNestedBody(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if !strings.Contains(got.Error, "nested") {
+			t.Errorf("TestDeeplyNestedBody(%s): got error %q, want it to say the body is too deeply nested", test.name, got.Error)
+		}
+		if up.lastBody() != "" {
+			t.Errorf("TestDeeplyNestedBody(%s): the body was sent to the agent baker", test.name)
+		}
+	}
+	for _, cd := range codecs {
+		if !tested[cd.contentType()] {
+			t.Errorf("TestDeeplyNestedBody: codec for %s has no test", cd.contentType())
+		}
+	}
+}
+
+func TestEndpointTimeouts(t *testing.T) {
+	t.Parallel()
+
+	const latency = 300 * time.Millisecond
+
+	slow := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				time.Sleep(latency)
+				w.Write([]byte("slow"))
+			},
+		),
+	)
+	t.Cleanup(slow.Close)
+
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": slow.URL},
+		WithUpstreamTimeout(latency/3),
+		WithEndpointTimeouts(map[string]time.Duration{"/getnodebootstrapdata": 10 * latency}),
+	)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{
+			name: "Bootstrap data has a larger budget",
+			path: "/getnodebootstrapdata",
+			body: `{"ABVersion":"1.0.0","Req":{"TenantID":"tenant"}}`,
+			want: fiber.StatusOK,
+		},
+		{
+			name: "Sig image config uses the default and times out",
+			path: "/getlatestsigimageconfig",
+			body: `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`,
+			want: fiber.StatusGatewayTimeout,
+		},
+	}
+
+	for _, test := range tests {
+		resp, err := serv.app.Test(httptest.NewRequest("POST", test.path, strings.NewReader(test.body)), -1)
+		if err != nil {
+			t.Fatalf("TestEndpointTimeouts(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.want {
+			b, _ := io.ReadAll(resp.Body)
+			t.Errorf("TestEndpointTimeouts(%s): got status %d, want %d: %s", test.name, resp.StatusCode, test.want, b)
+		}
+	}
+}
+
+func TestTimeoutOptions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		options []Option
+		err     bool
+	}{
+		{name: "Valid timeouts", options: []Option{WithUpstreamTimeout(time.Second), WithEndpointTimeouts(map[string]time.Duration{"/x": time.Second})}},
+		{name: "Error: zero upstream timeout", options: []Option{WithUpstreamTimeout(0)}, err: true},
+		{name: "Valid read timeout", options: []Option{WithReadTimeout(time.Second)}},
+		{name: "Error: zero read timeout", options: []Option{WithReadTimeout(0)}, err: true},
+		{name: "Error: path without a slash", options: []Option{WithEndpointTimeouts(map[string]time.Duration{"x": time.Second})}, err: true},
+		{name: "Error: negative endpoint timeout", options: []Option{WithEndpointTimeouts(map[string]time.Duration{"/x": -time.Second})}, err: true},
+	}
+
+	for _, test := range tests {
+		_, err := New(versions.Mapping{}, test.options...)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestTimeoutOptions(%s): got err == nil, want err != nil", test.name)
+		case err != nil && !test.err:
+			t.Errorf("TestTimeoutOptions(%s): got err == %s, want err == nil", test.name, err)
+		}
+	}
+}
+
+// panicMapping is a fakeMapping that panics when asked for an address.
+type panicMapping struct {
+	fakeMapping
+}
+
+func (p panicMapping) HealthyBase(v versions.Version, healthy func(addr string) bool) (string, error) {
+	panic("mapping is broken")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	t.Parallel()
+
+	capture := &captureHandler{}
+	serv, err := New(versions.Mapping{}, WithLogger(slog.New(capture)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv.mapping = panicMapping{}
+
+	body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+	resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("TestPanicRecovery: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusInternalServerError {
+		t.Errorf("TestPanicRecovery: got status %d, want %d", resp.StatusCode, fiber.StatusInternalServerError)
+	}
+
+	var got errorResp
+	b, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("TestPanicRecovery: could not decode response(%s): %s", b, err)
+	}
+	if got.Error == "" || strings.Contains(got.Error, "mapping is broken") {
+		t.Errorf("TestPanicRecovery: got error %q, want a generic error", got.Error)
+	}
+
+	attrs := capture.attrs("handler panicked")
+	if attrs == nil {
+		t.Fatalf("TestPanicRecovery: panic was not logged")
+	}
+	if got := attrs["panic"].String(); got != "mapping is broken" {
+		t.Errorf("TestPanicRecovery: got logged panic %q, want %q", got, "mapping is broken")
+	}
+	if got := attrs["stack"].String(); !strings.Contains(got, "HealthyBase") {
+		t.Errorf("TestPanicRecovery: logged stack does not include the panicking function:\n%s", got)
+	}
+}
+
+func TestUpstreamGzip(t *testing.T) {
+	t.Parallel()
+
+	// The stub decodes gzipped bodies and echoes the body with the encoding it was sent with.
+	up := httptest.NewServer(
+		nethttp.HandlerFunc(
+			func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				var body io.Reader = r.Body
+				enc := r.Header.Get(fiber.HeaderContentEncoding)
+				if enc == "gzip" {
+					zr, err := gzip.NewReader(r.Body)
+					if err != nil {
+						w.WriteHeader(nethttp.StatusBadRequest)
+						return
+					}
+					body = zr
+				}
+				b, _ := io.ReadAll(body)
+				w.Write([]byte(enc + ":" + string(b)))
+			},
+		),
+	)
+	t.Cleanup(up.Close)
+
+	const req = `{"Region":"westus"}`
+	gzipped := func(s string) []byte {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name       string
+		options    []Option
+		body       []byte
+		clientGzip bool
+		want       string
+	}{
+		{
+			name: "Bodies are not compressed by default",
+			body: []byte(`{"ABVersion":"1.0.0","Req":` + req + `}`),
+			want: ":" + req,
+		},
+		{
+			name:    "Bodies are compressed with WithUpstreamGzip",
+			options: []Option{WithUpstreamGzip(0)},
+			body:    []byte(`{"ABVersion":"1.0.0","Req":` + req + `}`),
+			want:    "gzip:" + req,
+		},
+		{
+			name:    "Bodies smaller than the minimum are not compressed",
+			options: []Option{WithUpstreamGzip(1024)},
+			body:    []byte(`{"ABVersion":"1.0.0","Req":` + req + `}`),
+			want:    ":" + req,
+		},
+		{
+			name:       "A gzipped client body is sent decoded",
+			body:       gzipped(`{"ABVersion":"1.0.0","Req":` + req + `}`),
+			clientGzip: true,
+			want:       ":" + req,
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, test.options...)
+
+		r := httptest.NewRequest("POST", "/getlatestsigimageconfig", bytes.NewReader(test.body))
+		if test.clientGzip {
+			r.Header.Set(fiber.HeaderContentEncoding, "gzip")
+		}
+		resp, err := serv.app.Test(r)
+		if err != nil {
+			t.Fatalf("TestUpstreamGzip(%s): %s", test.name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestUpstreamGzip(%s): got status %d, want %d: %s", test.name, resp.StatusCode, fiber.StatusOK, b)
+			continue
+		}
+		if string(b) != test.want {
+			t.Errorf("TestUpstreamGzip(%s): upstream got %q, want %q", test.name, b, test.want)
+		}
+	}
+
+	if _, err := New(versions.Mapping{}, WithUpstreamGzip(-1)); err == nil {
+		t.Errorf("TestUpstreamGzip: got err == nil for a negative minimum, want err != nil")
+	}
+}
+
+func TestRequestTransform(t *testing.T) {
+	t.Parallel()
+
+	oldUp := newStubUpstream(t, `{}`)
+	newUp := newStubUpstream(t, `{}`)
+
+	// Version 1.1.0 wants an extra field that clients don't send.
+	addZone := func(body []byte) ([]byte, error) {
+		var m map[string]any
+		if err := json.Unmarshal(body, &m); err != nil {
+			return nil, err
+		}
+		m["Zone"] = "1"
+		return json.Marshal(m, json.Deterministic(true))
+	}
+
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": oldUp.URL, "1.1.0": newUp.URL, versions.Latest: newUp.URL},
+		WithRequestTransform("1.1.0", addZone),
+	)
+
+	tests := []struct {
+		name     string
+		body     string
+		up       *stubUpstream
+		wantBody string
+	}{
+		{
+			name:     "Version without a transform gets the request as is",
+			body:     `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`,
+			up:       oldUp,
+			wantBody: `{"Region":"westus"}`,
+		},
+		{
+			name:     "Version with a transform gets the transformed request",
+			body:     `{"ABVersion":"1.1.0","Req":{"Region":"westus"}}`,
+			up:       newUp,
+			wantBody: `{"Region":"westus","Zone":"1"}`,
+		},
+		{
+			name:     "Latest uses the transform of the version it points to",
+			body:     `{"Region":"westus"}`,
+			up:       newUp,
+			wantBody: `{"Region":"westus","Zone":"1"}`,
+		},
+	}
+
+	for _, test := range tests {
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(test.body)))
+		if err != nil {
+			t.Fatalf("TestRequestTransform(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestRequestTransform(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+			continue
+		}
+		if got := test.up.lastBody(); got != test.wantBody {
+			t.Errorf("TestRequestTransform(%s): upstream got body %s, want %s", test.name, got, test.wantBody)
+		}
+	}
+}
+
+func TestRequestTransformError(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": up.URL},
+		WithRequestTransform("1.0.0", func([]byte) ([]byte, error) { return nil, errors.New("no region") }),
+	)
+
+	body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+	resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("TestRequestTransformError: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("TestRequestTransformError: got status %d, want %d", resp.StatusCode, fiber.StatusBadRequest)
+	}
+	if up.lastBody() != "" {
+		t.Errorf("TestRequestTransformError: the request was sent to the agent baker")
+	}
+
+	for _, o := range []Option{WithRequestTransform(versions.Latest, func(b []byte) ([]byte, error) { return b, nil }), WithRequestTransform("1.0.0", nil)} {
+		if _, err := New(versions.Mapping{}, o); err == nil {
+			t.Errorf("TestRequestTransformError: got err == nil for a bad option, want err != nil")
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{"ok":true}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL})
+
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("TestServe: %s", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- serv.Serve(l) }()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+	resp, err := nethttp.Post("http://127.0.0.1:"+port+"/getlatestsigimageconfig", fiber.MIMEApplicationJSON, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("TestServe: %s", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("TestServe: got status %d, want %d", resp.StatusCode, fiber.StatusOK)
+	}
+	if string(got) != `{"ok":true}` {
+		t.Errorf("TestServe: got body %s, want the agent baker's response", got)
+	}
+	if b := up.lastBody(); !strings.Contains(b, "westus") {
+		t.Errorf("TestServe: agent baker got %s, want the request", b)
+	}
+
+	if err := serv.app.Shutdown(); err != nil {
+		t.Fatalf("TestServe: could not shut down: %s", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("TestServe: got err == %s from Serve, want err == nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("TestServe: Serve did not return after shutdown")
+	}
+}
+
+func TestSlowBody(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{"ok":true}`)
+	const timeout = 300 * time.Millisecond
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, WithReadTimeout(timeout))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestSlowBody: %s", err)
+	}
+	go serv.Serve(l)
+	t.Cleanup(func() { serv.app.Shutdown() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("TestSlowBody: %s", err)
+	}
+	defer conn.Close()
+
+	// The headers arrive right away, but only the start of the body ever does.
+	body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+	start := time.Now()
+	fmt.Fprintf(conn, "POST /getlatestsigimageconfig HTTP/1.1\r\nHost: bb\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body[:10])
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("TestSlowBody: could not read the response: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusRequestTimeout {
+		t.Errorf("TestSlowBody: got status %d, want %d", resp.StatusCode, fiber.StatusRequestTimeout)
+	}
+	if took := time.Since(start); took < timeout || took > timeout+2*time.Second {
+		t.Errorf("TestSlowBody: got a response after %v, want one after about %v", took, timeout)
+	}
+	if b := up.lastBody(); b != "" {
+		t.Errorf("TestSlowBody: agent baker got %s, want nothing", b)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		grace time.Duration
+		// release is when the agent baker answers, after Shutdown() is called.
+		release time.Duration
+		err     bool
+	}{
+		{name: "Request finishes within the grace period", grace: 5 * time.Second, release: 200 * time.Millisecond},
+		{name: "Error: Request outlives the grace period", grace: 200 * time.Millisecond, release: 2 * time.Second, err: true},
+	}
+
+	for _, test := range tests {
+		release := make(chan struct{})
+		up := httptest.NewServer(
+			nethttp.HandlerFunc(
+				func(w nethttp.ResponseWriter, r *nethttp.Request) {
+					<-release
+					w.Write([]byte(`{"ok":true}`))
+				},
+			),
+		)
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL})
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("TestShutdownDrains(%s): %s", test.name, err)
+		}
+		served := make(chan error, 1)
+		go func() { served <- serv.Serve(l) }()
+
+		status := make(chan int, 1)
+		go func() {
+			body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+			resp, err := nethttp.Post("http://"+l.Addr().String()+"/getlatestsigimageconfig", fiber.MIMEApplicationJSON, strings.NewReader(body))
+			if err != nil {
+				status <- 0
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		for start := time.Now(); serv.InFlight() != 1; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("TestShutdownDrains(%s): the request never got to the server", test.name)
+			}
+		}
+
+		time.AfterFunc(test.release, func() { close(release) })
+		ctx, cancel := context.WithTimeout(context.Background(), test.grace)
+		err = serv.Shutdown(ctx)
+		cancel()
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestShutdownDrains(%s): got err == nil, want err != nil", test.name)
+		case !test.err && err != nil:
+			t.Errorf("TestShutdownDrains(%s): got err == %s, want err == nil", test.name, err)
+		}
+
+		if !test.err {
+			if got := serv.InFlight(); got != 0 {
+				t.Errorf("TestShutdownDrains(%s): got %d requests in flight after Shutdown(), want 0", test.name, got)
+			}
+			if got := <-status; got != fiber.StatusOK {
+				t.Errorf("TestShutdownDrains(%s): got status %d for the drained request, want %d", test.name, got, fiber.StatusOK)
+			}
+		}
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Errorf("TestShutdownDrains(%s): got err == %s from Serve, want err == nil", test.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("TestShutdownDrains(%s): Serve did not return after Shutdown", test.name)
+		}
+		if test.err {
+			// The request is still answered once the agent baker is released.
+			<-status
+		}
+		up.Close()
+	}
+}
+
+func TestListenAndServeBadAddr(t *testing.T) {
+	t.Parallel()
+
+	serv := newTestServer(t, fakeMapping{})
+	if err := serv.ListenAndServe("not-an-address"); err == nil {
+		t.Errorf("TestListenAndServeBadAddr: got err == nil, want err != nil")
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	t.Parallel()
+
+	// This is a valid body for /getlatestsigimageconfig, but not for /getnodebootstrapdata.
+	sigBody := `{"ABVersion":"1.0.0","Req":{"Region":"westus","Distro":"ubuntu","TenantID":"tenant"}}`
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		strict     []string
+		wantStatus int
+		wantErr    string
+	}{
+		{
+			name:       "Wrong endpoint is forwarded if not strict",
+			path:       "/getnodebootstrapdata",
+			body:       sigBody,
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name:       "Error: Wrong endpoint is rejected if strict",
+			path:       "/getnodebootstrapdata",
+			body:       sigBody,
+			strict:     []string{"/getnodebootstrapdata"},
+			wantStatus: fiber.StatusBadRequest,
+			wantErr:    "NodeBootstrappingConfiguration",
+		},
+		{
+			name:       "Strictness is per endpoint",
+			path:       "/getdistrosigimageconfig",
+			body:       `{"ABVersion":"1.0.0","Req":{"Region":"westus","NewField":1}}`,
+			strict:     []string{"/getnodebootstrapdata"},
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name:       "Right endpoint is accepted if strict",
+			path:       "/getlatestsigimageconfig",
+			body:       `{"ABVersion":"1.0.0","Req":{"Region":"westus","Distro":"ubuntu"}}`,
+			strict:     []string{"/getlatestsigimageconfig"},
+			wantStatus: fiber.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		up := newStubUpstream(t, `{}`)
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, WithStrictDecoding(test.strict...))
+
+		resp, err := serv.app.Test(httptest.NewRequest("POST", test.path, strings.NewReader(test.body)))
+		if err != nil {
+			t.Fatalf("TestStrictDecoding(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("TestStrictDecoding(%s): got status %d, want %d", test.name, resp.StatusCode, test.wantStatus)
+			continue
+		}
+		if test.wantErr == "" {
+			continue
+		}
+		var got errorResp
+		b, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestStrictDecoding(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if !strings.Contains(got.Error, test.wantErr) {
+			t.Errorf("TestStrictDecoding(%s): got error %q, want it to mention %q", test.name, got.Error, test.wantErr)
+		}
+		if up.lastBody() != "" {
+			t.Errorf("TestStrictDecoding(%s): rejected request was forwarded", test.name)
+		}
+	}
+}
+
+func TestWithStrictDecoding(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New(versions.Mapping{}, WithStrictDecoding("/unknown")); err == nil {
+		t.Errorf("TestWithStrictDecoding: got err == nil, want err != nil for an endpoint without a request type")
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL})
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantAllow string
+	}{
+		{name: "GET bootstrap data", method: "GET", path: "/getnodebootstrapdata", wantAllow: "POST"},
+		{name: "PUT latest sig image config", method: "PUT", path: "/getlatestsigimageconfig", wantAllow: "POST"},
+		{name: "DELETE distro sig image config", method: "DELETE", path: "/getdistrosigimageconfig", wantAllow: "POST"},
+		{name: "POST healthz", method: "POST", path: "/healthz", wantAllow: "GET, HEAD"},
+		{name: "POST ready", method: "POST", path: "/ready", wantAllow: "GET, HEAD"},
+		{name: "PATCH info", method: "PATCH", path: "/info", wantAllow: "GET, HEAD"},
+	}
+
+	for _, test := range tests {
+		resp, err := serv.app.Test(httptest.NewRequest(test.method, test.path, nil))
+		if err != nil {
+			t.Fatalf("TestMethodNotAllowed(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusMethodNotAllowed {
+			t.Errorf("TestMethodNotAllowed(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusMethodNotAllowed)
+		}
+		if got := resp.Header.Get(fiber.HeaderAllow); got != test.wantAllow {
+			t.Errorf("TestMethodNotAllowed(%s): got Allow %q, want %q", test.name, got, test.wantAllow)
+		}
+		if up.lastPath() != "" {
+			t.Errorf("TestMethodNotAllowed(%s): request was forwarded to the agent baker", test.name)
+		}
+	}
+
+	// Paths we don't know are still forwarded, whatever the method.
+	resp, err := serv.app.Test(httptest.NewRequest("GET", "/getsomethingnew", nil))
+	if err != nil {
+		t.Fatalf("TestMethodNotAllowed: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusOK || up.lastPath() != "/getsomethingnew" {
+		t.Errorf("TestMethodNotAllowed: got status %d and upstream path %q, want an unknown path forwarded", resp.StatusCode, up.lastPath())
 	}
 }
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"runtime"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+// buildVersion is the version of this build of bakedbaker. This is set at build time with:
+//
+//	go build -ldflags "-X github.com/element-of-surprise/bakedbaker/internal/http.buildVersion=<version>"
+var buildVersion = "dev"
+
+// infoResp is the JSON body returned by the /info endpoint.
+type infoResp struct {
+	// Build is the version of this build of bakedbaker.
+	Build string `json:"build"`
+	// Go is the version of Go bakedbaker was built with.
+	Go string `json:"go"`
+	// Latest is the version that requests for versions.Latest are sent to.
+	Latest versions.Version `json:"latest,omitempty"`
+	// Versions maps each agent baker version that is ready to the addresses of its agent bakers.
+	Versions map[versions.Version][]string `json:"versions"`
+}
+
+// info is a handler for the /info endpoint. It describes this build of bakedbaker and the agent baker
+// versions it serves.
+func (s *Server) info(c *fiber.Ctx) error {
+	resp := infoResp{
+		Build:    buildVersion,
+		Go:       runtime.Version(),
+		Versions: s.mapping.All(),
+	}
+	if latest := s.mapping.Resolve(versions.Latest); latest != versions.Latest {
+		resp.Latest = latest
+	}
+	// Latest is in .Latest, so listing its addresses again only adds noise.
+	delete(resp.Versions, versions.Latest)
+
+	return c.JSON(resp)
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"io"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// TestInfo is not parallel because it changes buildVersion.
+func TestInfo(t *testing.T) {
+	old := buildVersion
+	buildVersion = "v1.2.3-test"
+	t.Cleanup(func() { buildVersion = old })
+
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": "http://localhost:8080", "1.1.0": "http://localhost:8081", versions.Latest: "http://localhost:8081"},
+	)
+
+	resp, err := serv.app.Test(httptest.NewRequest("GET", "/info", nil))
+	if err != nil {
+		t.Fatalf("TestInfo: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("TestInfo: got status %d, want %d", resp.StatusCode, fiber.StatusOK)
+	}
+
+	var got infoResp
+	b, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("TestInfo: could not decode response(%s): %s", b, err)
+	}
+
+	want := infoResp{
+		Build:  "v1.2.3-test",
+		Go:     runtime.Version(),
+		Latest: "1.1.0",
+		Versions: map[versions.Version][]string{
+			"1.0.0": {"http://localhost:8080"},
+			"1.1.0": {"http://localhost:8081"},
+		},
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("TestInfo: -want/+got:\n%s", diff)
+	}
+}
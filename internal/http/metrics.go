@@ -0,0 +1,204 @@
+package http
+
+import (
+	"sync"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus metrics for the Server. A nil *metrics records nothing,
+// which is what is used when metrics are not enabled.
+type metrics struct {
+	reg *prometheus.Registry
+
+	reqSize    *prometheus.HistogramVec
+	respSize   *prometheus.HistogramVec
+	breakers   *prometheus.GaugeVec
+	probeFails *prometheus.CounterVec
+	ready      *prometheus.GaugeVec
+
+	// status returns the status of each version in the mapping.
+	status func() []versions.VersionStatus
+
+	mu sync.Mutex
+	// readyVersions are the versions that ready has a series for.
+	readyVersions map[versions.Version]bool
+}
+
+// restartCollector reports how many times the replicas of each version were restarted, either because
+// they exited or by a refresh. The versions package keeps the count, so it is read from the mapping
+// whenever the metrics are gathered.
+type restartCollector struct {
+	status func() []versions.VersionStatus
+	desc   *prometheus.Desc
+}
+
+// Describe implements prometheus.Collector.
+func (r restartCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.desc
+}
+
+// Collect implements prometheus.Collector.
+func (r restartCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, vs := range r.status() {
+		n := 0
+		for _, rs := range vs.Replicas {
+			n += rs.Restarts
+		}
+		ch <- prometheus.MustNewConstMetric(r.desc, prometheus.CounterValue, float64(n), vs.Version.String())
+	}
+}
+
+// bodySizeBuckets are the histogram buckets for body sizes, 256 bytes to 16 MiB.
+var bodySizeBuckets = prometheus.ExponentialBuckets(256, 4, 9)
+
+// newMetrics creates our metrics and registers them with reg. status is how the restarts of
+// each version, and which versions failed to start, are read.
+func newMetrics(reg *prometheus.Registry, status func() []versions.VersionStatus) (*metrics, error) {
+	m := &metrics{
+		reg:           reg,
+		status:        status,
+		readyVersions: map[versions.Version]bool{},
+		reqSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "bakedbaker",
+				Name:      "request_body_bytes",
+				Help:      "Size of request bodies sent to agent baker.",
+				Buckets:   bodySizeBuckets,
+			},
+			[]string{"version", "endpoint"},
+		),
+		respSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "bakedbaker",
+				Name:      "response_body_bytes",
+				Help:      "Size of response bodies received from agent baker.",
+				Buckets:   bodySizeBuckets,
+			},
+			[]string{"version", "endpoint"},
+		),
+		breakers: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "bakedbaker",
+				Name:      "circuit_breaker_state",
+				Help:      "State of the circuit breaker for an agent baker: 0 is closed, 1 is open, 2 is half-open.",
+			},
+			[]string{"upstream"},
+		),
+		probeFails: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "bakedbaker",
+				Name:      "version_probe_failures_total",
+				Help:      "Health probes of an agent baker replica that failed, by version.",
+			},
+			[]string{"version"},
+		),
+		ready: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "bakedbaker",
+				Name:      "version_ready",
+				Help:      "1 if every replica of an agent baker version passed its last health probe, otherwise 0.",
+			},
+			[]string{"version"},
+		),
+	}
+	restarts := restartCollector{
+		status: status,
+		desc: prometheus.NewDesc(
+			"bakedbaker_version_restarts_total",
+			"Times the replicas of an agent baker version were restarted.",
+			[]string{"version"},
+			nil,
+		),
+	}
+
+	for _, c := range []prometheus.Collector{m.reqSize, m.respSize, m.breakers, m.probeFails, m.ready, restarts} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// bodySizes records the size of a request sent to an agent baker and of its response.
+func (m *metrics) bodySizes(ver versions.Version, endpoint string, req, resp int) {
+	if m == nil {
+		return
+	}
+	m.reqSize.WithLabelValues(ver.String(), endpoint).Observe(float64(req))
+	m.respSize.WithLabelValues(ver.String(), endpoint).Observe(float64(resp))
+}
+
+// breakerState records the state of the circuit breaker for the upstream at base.
+func (m *metrics) breakerState(base string, state breakerState) {
+	if m == nil {
+		return
+	}
+	m.breakers.WithLabelValues(base).Set(float64(state))
+}
+
+// probed records results, which are health probes of every replica of the versions in them.
+func (m *metrics) probed(results map[instance]versionHealth) {
+	if m == nil {
+		return
+	}
+	ready := map[versions.Version]bool{}
+	for inst, vh := range results {
+		if _, ok := ready[inst.version]; !ok {
+			ready[inst.version] = true
+		}
+		if vh.Err != nil {
+			ready[inst.version] = false
+			m.probeFails.WithLabelValues(inst.version.String()).Inc()
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for v, r := range ready {
+		m.readyVersions[v] = true
+		g := m.ready.WithLabelValues(v.String())
+		if r {
+			g.Set(1)
+		} else {
+			g.Set(0)
+		}
+	}
+}
+
+// keepReady deletes the version_ready series of the versions that are not in vers, which are every version
+// there is now, so that versions that were removed, such as by versions.Mapping.Refresh(), are not reported.
+// Versions that failed to start have no agent bakers to probe, so they are not in vers, but they are
+// reported as not ready.
+func (m *metrics) keepReady(vers map[versions.Version]bool) {
+	if m == nil {
+		return
+	}
+	failed := map[versions.Version]bool{}
+	for _, vs := range m.status() {
+		if vs.State == versions.StateFailed {
+			failed[vs.Version] = true
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for v := range m.readyVersions {
+		if !vers[v] && !failed[v] {
+			m.ready.DeleteLabelValues(v.String())
+			delete(m.readyVersions, v)
+		}
+	}
+	for v := range failed {
+		m.readyVersions[v] = true
+		m.ready.WithLabelValues(v.String()).Set(0)
+	}
+}
+
+// handler returns a handler that serves the metrics in the Prometheus format.
+func (m *metrics) handler() func(*fiber.Ctx) error {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+}
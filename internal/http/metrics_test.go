@@ -0,0 +1,350 @@
+package http
+
+import (
+	"context"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// captureHandler is a slog.Handler that records every log record.
+type captureHandler struct {
+	// level is the minimum level recorded. If nil, everything is recorded.
+	level *slog.LevelVar
+
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (c *captureHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return c.level == nil || l >= c.level.Level()
+}
+func (c *captureHandler) WithAttrs([]slog.Attr) slog.Handler { return c }
+func (c *captureHandler) WithGroup(string) slog.Handler      { return c }
+
+func (c *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = append(c.records, r.Clone())
+	return nil
+}
+
+// attrs returns the attributes of the first record with msg.
+func (c *captureHandler) attrs(msg string) map[string]slog.Value {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range c.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := map[string]slog.Value{}
+		r.Attrs(
+			func(a slog.Attr) bool {
+				attrs[a.Key] = a.Value
+				return true
+			},
+		)
+		return attrs
+	}
+	return nil
+}
+
+// count returns the number of records with msg.
+func (c *captureHandler) count(msg string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, r := range c.records {
+		if r.Message == msg {
+			n++
+		}
+	}
+	return n
+}
+
+// histogram returns the sample count and sum of the histogram called name in reg.
+func histogram(t *testing.T, reg *prometheus.Registry, name string) (uint64, float64) {
+	t.Helper()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		var count uint64
+		var sum float64
+		for _, m := range f.GetMetric() {
+			count += m.GetHistogram().GetSampleCount()
+			sum += m.GetHistogram().GetSampleSum()
+		}
+		return count, sum
+	}
+	return 0, 0
+}
+
+func TestBodySizes(t *testing.T) {
+	t.Parallel()
+
+	const (
+		inner    = `{"Region":"westus"}`
+		respBody = `{"some":"response body"}`
+	)
+
+	up := newStubUpstream(t, respBody)
+	capture := &captureHandler{}
+	reg := prometheus.NewRegistry()
+	serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, WithLogger(slog.New(capture)), WithMetrics(reg))
+
+	body := `{"ABVersion":"1.0.0","Req":` + inner + `}`
+	resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("TestBodySizes: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("TestBodySizes: got status %d, want %d", resp.StatusCode, fiber.StatusOK)
+	}
+
+	attrs := capture.attrs("forwarded request")
+	if attrs == nil {
+		t.Fatalf("TestBodySizes: forwarded request was not logged")
+	}
+	if got := attrs["reqBytes"].Int64(); got != int64(len(inner)) {
+		t.Errorf("TestBodySizes: logged reqBytes %d, want %d", got, len(inner))
+	}
+	if got := attrs["respBytes"].Int64(); got != int64(len(respBody)) {
+		t.Errorf("TestBodySizes: logged respBytes %d, want %d", got, len(respBody))
+	}
+	if got := attrs["version"].String(); got != "1.0.0" {
+		t.Errorf("TestBodySizes: logged version %s, want 1.0.0", got)
+	}
+
+	tests := []struct {
+		metric string
+		want   int
+	}{
+		{"bakedbaker_request_body_bytes", len(inner)},
+		{"bakedbaker_response_body_bytes", len(respBody)},
+	}
+	for _, test := range tests {
+		count, sum := histogram(t, reg, test.metric)
+		if count != 1 || sum != float64(test.want) {
+			t.Errorf("TestBodySizes(%s): got count %d sum %v, want count 1 sum %d", test.metric, count, sum, test.want)
+		}
+	}
+
+	// The metrics are served at /metrics.
+	resp, err = serv.app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if err != nil {
+		t.Fatalf("TestBodySizes: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("TestBodySizes: got /metrics status %d, want %d", resp.StatusCode, fiber.StatusOK)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, "latest")
+	serv := newTestServer(t, fakeMapping{versions.Latest: up.URL})
+
+	// Without metrics, /metrics is not ours and is forwarded like any other unknown path.
+	resp, err := serv.app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if err != nil {
+		t.Fatalf("TestMetricsDisabled: %s", err)
+	}
+	if got := up.lastPath(); got != "/metrics" || resp.StatusCode != fiber.StatusOK {
+		t.Errorf("TestMetricsDisabled: /metrics was not forwarded to agent baker")
+	}
+}
+
+func TestVersionMetrics(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, "up")
+	down := newUnhealthyUpstream(t)
+	reg := prometheus.NewRegistry()
+	serv := newTestServer(t, fakeMapping{}, WithMetrics(reg))
+	m := fakeMapping{"1.0.0": up.URL, "1.1.0": down.URL}
+	serv.mapping = m
+
+	for i := 0; i < 2; i++ {
+		serv.probe(context.Background())
+	}
+
+	tests := []struct {
+		name   string
+		metric prometheus.Collector
+		want   float64
+	}{
+		{name: "Failures of a healthy version", metric: serv.metrics.probeFails.WithLabelValues("1.0.0"), want: 0},
+		{name: "Failures of an unhealthy version", metric: serv.metrics.probeFails.WithLabelValues("1.1.0"), want: 2},
+		{name: "Healthy version is ready", metric: serv.metrics.ready.WithLabelValues("1.0.0"), want: 1},
+		{name: "Unhealthy version is not ready", metric: serv.metrics.ready.WithLabelValues("1.1.0"), want: 0},
+	}
+	for _, test := range tests {
+		if got := testutil.ToFloat64(test.metric); got != test.want {
+			t.Errorf("TestVersionMetrics(%s): got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// A version that recovers is ready again.
+	serv.mapping = fakeMapping{"1.1.0": up.URL}
+	serv.probe(context.Background())
+	if got := testutil.ToFloat64(serv.metrics.ready.WithLabelValues("1.1.0")); got != 1 {
+		t.Errorf("TestVersionMetrics(recovered): got ready %v, want 1", got)
+	}
+
+	// 1.0.0 is no longer in the mapping, so it is no longer reported.
+	const readyHelp = `
+# HELP bakedbaker_version_ready 1 if every replica of an agent baker version passed its last health probe, otherwise 0.
+# TYPE bakedbaker_version_ready gauge
+`
+	want := readyHelp + `bakedbaker_version_ready{version="1.1.0"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "bakedbaker_version_ready"); err != nil {
+		t.Errorf("TestVersionMetrics(removed): %s", err)
+	}
+
+	// The same goes for scheduled probes, whose probes from before the versions changed are not recorded.
+	results := map[instance]versionHealth{{version: "1.1.0", base: up.URL}: {}}
+	serv.health.reset(1, nil)
+	if serv.health.store(0, "1.1.0", results) {
+		t.Errorf("TestVersionMetrics(scheduled): stored the probe of an old generation")
+	}
+	if got := testutil.CollectAndCount(serv.metrics.ready); got != 0 {
+		t.Errorf("TestVersionMetrics(scheduled): got %d version_ready series, want 0", got)
+	}
+	if !serv.health.store(1, "1.1.0", results) {
+		t.Errorf("TestVersionMetrics(scheduled): did not store the probe of the current generation")
+	}
+	if got := testutil.CollectAndCount(serv.metrics.ready); got != 1 {
+		t.Errorf("TestVersionMetrics(scheduled): got %d version_ready series, want 1", got)
+	}
+
+	// A version that failed to start has nothing to probe, but it is not ready.
+	serv.mapping = downMapping{
+		fakeMapping: fakeMapping{"1.1.0": up.URL},
+		down:        []versions.VersionStatus{{Version: "1.2.0", State: versions.StateFailed}},
+	}
+	serv.probe(context.Background())
+	want = readyHelp + `bakedbaker_version_ready{version="1.1.0"} 1
+bakedbaker_version_ready{version="1.2.0"} 0
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "bakedbaker_version_ready"); err != nil {
+		t.Errorf("TestVersionMetrics(failed): %s", err)
+	}
+}
+
+func TestRestartMetrics(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFakeAgent(t, dir, "1.0.0", "a")
+	writeFakeAgent(t, dir, "1.1.0", "a")
+	m := newFakeAgentMapping(t, dir)
+
+	reg := prometheus.NewRegistry()
+	if _, err := New(m, WithMetrics(reg)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restarts are read from the mapping each time the metrics are gathered, so they follow refreshes.
+	const restartsHelp = `
+# HELP bakedbaker_version_restarts_total Times the replicas of an agent baker version were restarted.
+# TYPE bakedbaker_version_restarts_total counter
+`
+	steps := []struct {
+		name string
+		// tag is the new -tag of version 1.1.0, which changes its launch config so a refresh restarts it.
+		tag string
+		// kill is a version whose process is killed, which its supervisor restarts.
+		kill versions.Version
+		want string
+	}{
+		{
+			name: "No restarts",
+			want: `bakedbaker_version_restarts_total{version="1.0.0"} 0
+bakedbaker_version_restarts_total{version="1.1.0"} 0
+`,
+		},
+		{
+			name: "Restarted",
+			tag:  "b",
+			want: `bakedbaker_version_restarts_total{version="1.0.0"} 0
+bakedbaker_version_restarts_total{version="1.1.0"} 1
+`,
+		},
+		{
+			name: "Restarted again",
+			tag:  "c",
+			want: `bakedbaker_version_restarts_total{version="1.0.0"} 0
+bakedbaker_version_restarts_total{version="1.1.0"} 2
+`,
+		},
+		{
+			name: "Killed",
+			kill: "1.0.0",
+			want: `bakedbaker_version_restarts_total{version="1.0.0"} 1
+bakedbaker_version_restarts_total{version="1.1.0"} 2
+`,
+		},
+	}
+
+	for _, step := range steps {
+		if step.tag != "" {
+			writeFakeAgent(t, dir, "1.1.0", step.tag)
+			if _, err := m.Refresh(context.Background()); err != nil {
+				t.Fatalf("TestRestartMetrics(%s): could not refresh: %s", step.name, err)
+			}
+		}
+		if step.kill != "" {
+			killVersion(t, m, step.kill)
+		}
+		// A killed process is restarted after a backoff, so the count may take a moment to move.
+		var err error
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			err = testutil.GatherAndCompare(reg, strings.NewReader(restartsHelp+step.want), "bakedbaker_version_restarts_total")
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			t.Errorf("TestRestartMetrics(%s): %s", step.name, err)
+		}
+	}
+}
+
+// killVersion kills the processes of version v in m.
+func killVersion(t *testing.T, m versions.Mapping, v versions.Version) {
+	t.Helper()
+
+	for _, vs := range m.Status() {
+		if vs.Version != v {
+			continue
+		}
+		for _, rs := range vs.Replicas {
+			p, err := os.FindProcess(rs.PID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Kill(); err != nil {
+				t.Fatalf("could not kill replica %s of version(%s): %s", rs.Addr, v, err)
+			}
+		}
+	}
+}
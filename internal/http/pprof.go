@@ -0,0 +1,31 @@
+package http
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+)
+
+// pprofPrefix is where the pprof endpoints are served.
+const pprofPrefix = "/debug/pprof"
+
+// WithPprof serves the net/http/pprof endpoints under /debug/pprof. Like the /admin endpoints,
+// requests to them must have the admin token, so this requires WithAdminToken().
+func WithPprof() Option {
+	return func(s *Server) error {
+		s.pprof = true
+		return nil
+	}
+}
+
+// registerPprof adds the /debug/pprof endpoints to app if they are enabled. If they are not, requests
+// for them get a 404 instead of being forwarded to an agent baker.
+func (s *Server) registerPprof(app *fiber.App) {
+	if !s.pprof {
+		app.All(pprofPrefix+"/*", s.unknownRoute)
+		return
+	}
+
+	debug := app.Group(pprofPrefix, s.adminAuth())
+	debug.Use(pprof.New())
+	debug.All("/*", s.unknownRoute)
+}
@@ -0,0 +1,69 @@
+package http
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestPprof(t *testing.T) {
+	t.Parallel()
+
+	const token = "secret"
+
+	up := newStubUpstream(t, `{}`)
+
+	tests := []struct {
+		name    string
+		options []Option
+		token   string
+		want    int
+	}{
+		{
+			name: "Disabled by default",
+			want: fiber.StatusNotFound,
+		},
+		{
+			name:    "Disabled with only an admin token",
+			options: []Option{WithAdminToken(token)},
+			token:   token,
+			want:    fiber.StatusNotFound,
+		},
+		{
+			name:    "Enabled with the admin token",
+			options: []Option{WithAdminToken(token), WithPprof()},
+			token:   token,
+			want:    fiber.StatusOK,
+		},
+		{
+			name:    "Enabled without the admin token",
+			options: []Option{WithAdminToken(token), WithPprof()},
+			want:    fiber.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL}, test.options...)
+
+		req := httptest.NewRequest("GET", "/debug/pprof/cmdline", nil)
+		if test.token != "" {
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+test.token)
+		}
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestPprof(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != test.want {
+			t.Errorf("TestPprof(%s): got status %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+	}
+
+	if up.lastPath() != "" {
+		t.Errorf("TestPprof: a pprof request was forwarded to the agent baker")
+	}
+	if _, err := New(versions.Mapping{}, WithPprof()); err == nil {
+		t.Errorf("TestPprof: got err == nil for WithPprof() without WithAdminToken(), want err != nil")
+	}
+}
@@ -0,0 +1,227 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"strings"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/gofiber/fiber/v2"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// maxCaptureLine is the longest line of a capture file that Replay() reads.
+const maxCaptureLine = 64 << 20
+
+// ReplayReport is what Replay() found, by the version the requests were recorded against.
+type ReplayReport map[versions.Version]*VersionReplay
+
+// VersionReplay is how the replayed requests that were recorded against a version went.
+type VersionReplay struct {
+	// Matched is how many requests were answered as they were when recorded.
+	Matched int
+	// Skipped is how many requests couldn't be compared, because the agent baker didn't answer
+	// or streamed its answer when they were recorded.
+	Skipped int
+	// Mismatches are the requests that were answered differently.
+	Mismatches []ReplayMismatch
+}
+
+// ReplayMismatch is a replayed request that was answered differently than when it was recorded.
+type ReplayMismatch struct {
+	// Line is the line of the capture the request is on.
+	Line   int
+	Method string
+	Path   string
+	// Diff is how the answer differs, -recorded/+replayed.
+	Diff string
+}
+
+// Mismatched returns how many requests in the report were answered differently.
+func (r ReplayReport) Mismatched() int {
+	n := 0
+	for _, vr := range r {
+		n += len(vr.Mismatches)
+	}
+	return n
+}
+
+// String implements fmt.Stringer. This lists every version with its counts, followed by its mismatches.
+func (r ReplayReport) String() string {
+	vers := make([]versions.Version, 0, len(r))
+	for v := range r {
+		vers = append(vers, v)
+	}
+	versions.SortVersions(vers)
+
+	b := &strings.Builder{}
+	for _, v := range vers {
+		vr := r[v]
+		fmt.Fprintf(b, "%s: %d matched, %d mismatched, %d skipped\n", v, vr.Matched, len(vr.Mismatches), vr.Skipped)
+		for _, m := range vr.Mismatches {
+			fmt.Fprintf(b, "  line %d: %s %s\n", m.Line, m.Method, m.Path)
+			for _, l := range strings.Split(strings.TrimRight(m.Diff, "\n"), "\n") {
+				fmt.Fprintf(b, "    %s\n", l)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Replay sends the requests in capture, a file written by WithCapture(), to the BB server at target, such
+// as "http://localhost:8080", and compares the answers with the recorded ones. This is for checking
+// a new agent baker version against recorded traffic. Requests go to the version they were recorded
+// against, unless version is set, in which case they all go to version. The report is always keyed
+// by the recorded version.
+//
+// A recorded 200 OK or 4xx, which BB passes on as is, matches the same status with the same JSON, where
+// the order of object members and the values of redacted members don't matter. Any other recorded
+// status is the agent baker failing, which BB answers with a 502, so it matches any 5xx. Redacted request
+// members are sent as "REDACTED", so requests whose answer depends on them will not match.
+func Replay(ctx context.Context, capture io.Reader, target string, version versions.Version) (ReplayReport, error) {
+	target = strings.TrimRight(target, "/")
+	report := ReplayReport{}
+
+	scanner := bufio.NewScanner(capture)
+	scanner.Buffer(nil, maxCaptureLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry captureEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("capture line(%d) is not a capture entry: %w", line, err)
+		}
+
+		vr := report[entry.Version]
+		if vr == nil {
+			vr = &VersionReplay{}
+			report[entry.Version] = vr
+		}
+		if entry.Status == 0 || entry.Streamed {
+			vr.Skipped++
+			continue
+		}
+
+		sendTo := entry.Version
+		if version != "" {
+			sendTo = version
+		}
+		status, body, err := replayRequest(ctx, target, sendTo, entry)
+		if err != nil {
+			return nil, fmt.Errorf("capture line(%d) could not be replayed: %w", line, err)
+		}
+		if diff := compareReplay(entry, status, body); diff != "" {
+			vr.Mismatches = append(vr.Mismatches, ReplayMismatch{Line: line, Method: entry.Method, Path: entry.Path, Diff: diff})
+			continue
+		}
+		vr.Matched++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the capture: %w", err)
+	}
+	return report, nil
+}
+
+// replayRequest sends the request in entry to the BB server at target for version v and returns the answer.
+func replayRequest(ctx context.Context, target string, v versions.Version, entry captureEntry) (int, []byte, error) {
+	var body io.Reader
+	if len(entry.Request) > 0 {
+		// A body that wasn't JSON was recorded as a JSON string.
+		raw := []byte(entry.Request)
+		if entry.Request.Kind() == '"' {
+			var s string
+			if err := json.Unmarshal(entry.Request, &s); err != nil {
+				return 0, nil, err
+			}
+			raw = []byte(s)
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	req, err := nethttp.NewRequestWithContext(ctx, entry.Method, target+entry.Path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set(VersionHeader, v.String())
+	if body != nil {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+
+	resp, err := nethttp.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, b, nil
+}
+
+// compareReplay returns how the status and body of a replayed answer differ from the answer
+// recorded in entry, or the empty string if they match.
+func compareReplay(entry captureEntry, status int, body []byte) string {
+	passedOn := entry.Status == fiber.StatusOK || (entry.Status >= 400 && entry.Status < 500)
+	switch {
+	case !passedOn && status >= 500:
+		return ""
+	case !passedOn || status != entry.Status:
+		return fmt.Sprintf("-status %d\n+status %d\n", entry.Status, status)
+	}
+
+	want := decodeAny(entry.Response)
+	got := decodeAny(jsontext.Value(body))
+	return pretty.Compare(want, maskRedacted(want, got))
+}
+
+// decodeAny decodes b into an any. A b that isn't JSON is returned as a string.
+func decodeAny(b jsontext.Value) any {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	return v
+}
+
+// maskRedacted returns got with the values that are redacted in want replaced with redacted, so that
+// redacted members compare as equal.
+func maskRedacted(want, got any) any {
+	switch w := want.(type) {
+	case string:
+		if w == redacted {
+			return redacted
+		}
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return got
+		}
+		masked := make(map[string]any, len(g))
+		for k, v := range g {
+			masked[k] = maskRedacted(w[k], v)
+		}
+		return masked
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			return got
+		}
+		masked := make([]any, len(g))
+		for i, v := range g {
+			if i < len(w) {
+				v = maskRedacted(w[i], v)
+			}
+			masked[i] = v
+		}
+		return masked
+	}
+	return got
+}
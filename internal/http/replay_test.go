@@ -0,0 +1,175 @@
+package http
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// replayCapture is a capture of requests to the agent bakers served by newReplayServer.
+const replayCapture = `{"version":"1.0.0","endpoint":"/getlatestsigimageconfig","method":"POST","path":"/getlatestsigimageconfig","request":{"Region":"westus"},"status":200,"response":{"TenantID":"tenant","SubscriptionID":"sub"}}
+{"version":"1.0.0","endpoint":"/getlatestsigimageconfig","method":"POST","path":"/getlatestsigimageconfig","request":{"Region":"westus"},"status":200,"response":{"SubscriptionID":"sub","TenantID":"REDACTED"}}
+{"version":"1.0.0","endpoint":"/getlatestsigimageconfig","method":"POST","path":"/getlatestsigimageconfig","request":{"Region":"westus"},"status":200,"response":{"SubscriptionID":"old","TenantID":"tenant"}}
+{"version":"1.0.0","endpoint":"/getlatestsigimageconfig","method":"POST","path":"/getlatestsigimageconfig","request":{"Region":"westus"},"status":200,"streamed":true}
+
+{"version":"2.0.0","endpoint":"/getlatestsigimageconfig","method":"POST","path":"/getlatestsigimageconfig","request":{"Region":"westus"},"status":200,"response":{"SubscriptionID":"other"}}
+{"version":"2.0.0","endpoint":"/getlatestsigimageconfig","method":"POST","path":"/getlatestsigimageconfig","request":{"Region":"westus"},"status":500,"response":"boom"}
+{"version":"2.0.0","endpoint":"/getlatestsigimageconfig","method":"POST","path":"/getlatestsigimageconfig","request":{"Region":"westus"},"error":"connection refused"}
+`
+
+// newReplayServer serves a BB server with versions 1.0.0 and 2.0.0, which answer differently,
+// and returns its URL.
+func newReplayServer(t *testing.T) string {
+	t.Helper()
+
+	up1 := newStubUpstream(t, `{"SubscriptionID":"sub","TenantID":"tenant"}`)
+	up2 := newStubUpstream(t, `{"SubscriptionID":"other"}`)
+	serv := newTestServer(t, fakeMapping{"1.0.0": up1.URL, "2.0.0": up2.URL, versions.Latest: up2.URL})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(l)
+	t.Cleanup(func() { serv.Shutdown(context.Background()) })
+	return "http://" + l.Addr().String()
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+
+	target := newReplayServer(t)
+
+	tests := []struct {
+		name    string
+		version versions.Version
+		// want is the number of matched, mismatched and skipped requests and the lines of the mismatches.
+		want map[versions.Version][]int
+	}{
+		{
+			name: "To the recorded version",
+			want: map[versions.Version][]int{
+				"1.0.0": {2, 1, 1, 3},
+				"2.0.0": {1, 1, 1, 7},
+			},
+		},
+		{
+			name:    "To another version",
+			version: "2.0.0",
+			want: map[versions.Version][]int{
+				"1.0.0": {0, 3, 1, 1, 2, 3},
+				"2.0.0": {1, 1, 1, 7},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		report, err := Replay(context.Background(), strings.NewReader(replayCapture), target, test.version)
+		if err != nil {
+			t.Errorf("TestReplay(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+
+		got := map[versions.Version][]int{}
+		for v, vr := range report {
+			counts := []int{vr.Matched, len(vr.Mismatches), vr.Skipped}
+			for _, m := range vr.Mismatches {
+				counts = append(counts, m.Line)
+				if m.Diff == "" {
+					t.Errorf("TestReplay(%s): mismatch on line %d has no diff", test.name, m.Line)
+				}
+			}
+			got[v] = counts
+		}
+		if diff := pretty.Compare(test.want, got); diff != "" {
+			t.Errorf("TestReplay(%s): -want/+got:\n%s\n%s", test.name, diff, report)
+		}
+	}
+}
+
+func TestReplayReport(t *testing.T) {
+	t.Parallel()
+
+	target := newReplayServer(t)
+	report, err := Replay(context.Background(), strings.NewReader(replayCapture), target, "")
+	if err != nil {
+		t.Fatalf("TestReplayReport: %s", err)
+	}
+
+	if got := report.Mismatched(); got != 2 {
+		t.Errorf("TestReplayReport: got %d mismatched, want 2", got)
+	}
+
+	got := report.String()
+	for _, want := range []string{
+		"1.0.0: 2 matched, 1 mismatched, 1 skipped",
+		"2.0.0: 1 matched, 1 mismatched, 1 skipped",
+		"line 3: POST /getlatestsigimageconfig",
+		`- SubscriptionID: "old",`,
+		`+ SubscriptionID: "sub",`,
+		"line 7: POST /getlatestsigimageconfig",
+		"-status 500",
+		"+status 200",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("TestReplayReport: got report:\n%s\nwant it to contain %q", got, want)
+		}
+	}
+
+	// Versions are listed by precedence, not as strings.
+	got = ReplayReport{"1.10.0": {}, "1.9.0": {}}.String()
+	if i, j := strings.Index(got, "1.9.0:"), strings.Index(got, "1.10.0:"); i > j {
+		t.Errorf("TestReplayReport: got report:\n%s\nwant 1.9.0 before 1.10.0", got)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	t.Parallel()
+
+	target := newReplayServer(t)
+
+	tests := []struct {
+		name    string
+		capture string
+		target  string
+	}{
+		{name: "Not a capture", capture: "not json\n", target: target},
+		{name: "Server isn't there", capture: replayCapture, target: "http://127.0.0.1:1"},
+	}
+
+	for _, test := range tests {
+		if _, err := Replay(context.Background(), strings.NewReader(test.capture), test.target, ""); err == nil {
+			t.Errorf("TestReplayErrors(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+}
+
+func TestCompareReplay(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		entry     captureEntry
+		status    int
+		body      string
+		wantMatch bool
+	}{
+		{name: "Same JSON", entry: captureEntry{Status: 200, Response: []byte(`{"a":1,"b":2}`)}, status: 200, body: `{"b":2,"a":1}`, wantMatch: true},
+		{name: "Different JSON", entry: captureEntry{Status: 200, Response: []byte(`{"a":1}`)}, status: 200, body: `{"a":2}`},
+		{name: "Redacted member", entry: captureEntry{Status: 200, Response: []byte(`{"a":"REDACTED"}`)}, status: 200, body: `{"a":"secret"}`, wantMatch: true},
+		{name: "Same client error", entry: captureEntry{Status: 422, Response: []byte(`{"error":"bad"}`)}, status: 422, body: `{"error":"bad"}`, wantMatch: true},
+		{name: "Different client error", entry: captureEntry{Status: 422, Response: []byte(`{"error":"bad"}`)}, status: 400, body: `{"error":"bad"}`},
+		{name: "Agent baker failure is a bad gateway", entry: captureEntry{Status: 500, Response: []byte(`"boom"`)}, status: 502, body: `{"error":"x"}`, wantMatch: true},
+		{name: "Agent baker failure now succeeds", entry: captureEntry{Status: 500, Response: []byte(`"boom"`)}, status: 200, body: `{}`},
+	}
+
+	for _, test := range tests {
+		diff := compareReplay(test.entry, test.status, []byte(test.body))
+		if got := diff == ""; got != test.wantMatch {
+			t.Errorf("TestCompareReplay(%s): got match == %v, want %v, diff:\n%s", test.name, got, test.wantMatch, diff)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+// WithResolutionCache caches what each version clients ask for resolves to, such as the version Latest
+// points to and if it is below WithMinVersion(), instead of working it out again for every request.
+// The cache is dropped whenever the versions change, see versions.Mapping.Generation(). Versions that
+// are not in the Mapping are not cached, so clients asking for versions we don't have can't grow it.
+func WithResolutionCache() Option {
+	return func(s *Server) error {
+		s.resolutions = &atomic.Pointer[resolutionCache]{}
+		return nil
+	}
+}
+
+// resolution is what a version that a client asked for resolves to. A request works it out once, so
+// that every step of the request sees the same version even if the versions change while it runs.
+type resolution struct {
+	// ver is the version the request is for, after canaries and WithHealthyLatest() are applied.
+	ver versions.Version
+	// resolved is the version that ver resolves to, see versions.Mapping.Resolve().
+	resolved versions.Version
+	// gen is the versions.Mapping.Generation() that this was worked out in.
+	gen uint64
+	// gone is the error for a version below WithMinVersion(). If nil, the version is supported.
+	gone error
+}
+
+// resolutionCache holds the resolutions of the versions of one generation of the mapping.
+type resolutionCache struct {
+	gen uint64
+	// m is a map of versions.Version to resolution.
+	m sync.Map
+}
+
+// resolve returns the resolution of ver. With WithResolutionCache(), it is cached until the versions change.
+func (s *Server) resolve(ver versions.Version) resolution {
+	// The generation is read before the mapping, so that nothing older than it is cached under it.
+	gen := s.mapping.Generation()
+	if s.resolutions == nil {
+		return s.newResolution(gen, ver)
+	}
+
+	cache := s.resolutions.Load()
+	if cache == nil || cache.gen != gen {
+		// If requests race to replace it, the resolutions the losers cache are lost, which is fine.
+		cache = &resolutionCache{gen: gen}
+		s.resolutions.Store(cache)
+	}
+	if r, ok := cache.m.Load(ver); ok {
+		return r.(resolution)
+	}
+
+	r := s.newResolution(gen, ver)
+	if s.mapping.Has(ver) {
+		cache.m.Store(ver, r)
+	}
+	return r
+}
+
+// newResolution works out the resolution of ver from the mapping, which is at generation gen.
+func (s *Server) newResolution(gen uint64, ver versions.Version) resolution {
+	r := resolution{ver: ver, resolved: s.mapping.Resolve(ver), gen: gen}
+	// A version we don't have is a 404 from base(), even if it is below the minimum.
+	if s.minVersion == "" || r.resolved == versions.Latest || !s.mapping.Has(ver) {
+		return r
+	}
+	if r.resolved.Less(s.minVersion) {
+		r.gone = fiber.NewError(
+			fiber.StatusGone,
+			fmt.Sprintf("agent baker version(%s) is no longer supported, the minimum version is %s", r.resolved, s.minVersion),
+		)
+	}
+	return r
+}
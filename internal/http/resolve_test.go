@@ -0,0 +1,151 @@
+package http
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+)
+
+// genMapping is a fakeMapping whose versions can be replaced, like versions.Mapping.Refresh() does.
+type genMapping struct {
+	fakeMapping
+	gen *atomic.Uint64
+}
+
+func (g genMapping) Generation() uint64 {
+	return g.gen.Load()
+}
+
+// refresh replaces the versions of g with m.
+func (g genMapping) refresh(m fakeMapping) {
+	for v := range g.fakeMapping {
+		delete(g.fakeMapping, v)
+	}
+	for v, base := range m {
+		g.fakeMapping[v] = base
+	}
+	g.gen.Add(1)
+}
+
+func TestResolutionCache(t *testing.T) {
+	t.Parallel()
+
+	const body = `{"ABVersion":"latest","Req":{"Region":"westus"}}`
+
+	one, eleven := newStubUpstream(t, `{}`), newStubUpstream(t, `{}`)
+	m := genMapping{
+		fakeMapping: fakeMapping{"1.0.0": one.URL, versions.Latest: one.URL},
+		gen:         &atomic.Uint64{},
+	}
+	serv := newTestServer(t, nil, WithResolutionCache(), WithMinVersion("1.0.0"))
+	serv.mapping = m
+
+	// resolved sends a request for Latest and returns the version that answered it.
+	resolved := func(name string) string {
+		resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("TestResolutionCache(%s): %s", name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("TestResolutionCache(%s): got status %d, want %d", name, resp.StatusCode, fiber.StatusOK)
+		}
+		return resp.Header.Get(ResolvedVersionHeader)
+	}
+
+	if got := resolved("start"); got != "1.0.0" {
+		t.Errorf("TestResolutionCache(start): got latest == %s, want 1.0.0", got)
+	}
+
+	// Changing the versions without a new generation can't be seen, which shows the resolution is cached.
+	m.fakeMapping["1.1.0"] = eleven.URL
+	m.fakeMapping[versions.Latest] = eleven.URL
+	if got := resolved("same generation"); got != "1.0.0" {
+		t.Errorf("TestResolutionCache(same generation): got latest == %s, want the cached 1.0.0", got)
+	}
+	// The request goes to the version it was resolved to, not to where Latest points now.
+	if got := eleven.lastPath(); got != "" {
+		t.Errorf("TestResolutionCache(same generation): request resolved to 1.0.0 was sent to 1.1.0")
+	}
+
+	m.refresh(fakeMapping{"1.0.0": one.URL, "1.1.0": eleven.URL, versions.Latest: eleven.URL})
+	if got := resolved("add"); got != "1.1.0" {
+		t.Errorf("TestResolutionCache(add): got latest == %s, want 1.1.0", got)
+	}
+	if got := serv.resolve("1.1.0").resolved; got != "1.1.0" {
+		t.Errorf("TestResolutionCache(add): got version(1.1.0) resolved to %s, want 1.1.0", got)
+	}
+
+	m.refresh(fakeMapping{"1.0.0": one.URL, versions.Latest: one.URL})
+	if got := resolved("remove"); got != "1.0.0" {
+		t.Errorf("TestResolutionCache(remove): got latest == %s, want 1.0.0", got)
+	}
+	if _, err := serv.base(serv.resolve("1.1.0")); err == nil {
+		t.Errorf("TestResolutionCache(remove): got err == nil for removed version(1.1.0), want err != nil")
+	}
+
+	// Versions we don't have are not cached.
+	serv.resolve("9.9.9")
+	if _, ok := serv.resolutions.Load().m.Load(versions.Version("9.9.9")); ok {
+		t.Errorf("TestResolutionCache(missing version): version(9.9.9) was cached")
+	}
+}
+
+func TestResolutionCacheMinVersion(t *testing.T) {
+	t.Parallel()
+
+	m := fakeMapping{"1.0.0": "http://localhost:1", "2.0.0": "http://localhost:2", versions.Latest: "http://localhost:2"}
+	serv := newTestServer(t, m, WithResolutionCache(), WithMinVersion("2.0.0"))
+
+	// The cached answer is the same as the first.
+	for i := 0; i < 2; i++ {
+		if _, err := serv.base(serv.resolve("1.0.0")); err == nil || err.(*fiber.Error).Code != fiber.StatusGone {
+			t.Errorf("TestResolutionCacheMinVersion(try %d): got err == %v, want a %d", i, err, fiber.StatusGone)
+		}
+		if _, err := serv.base(serv.resolve(versions.Latest)); err != nil {
+			t.Errorf("TestResolutionCacheMinVersion(try %d): got err == %s for latest, want err == nil", i, err)
+		}
+	}
+}
+
+// BenchmarkResolve measures routing a request for Latest, with a minimum version, to its agent baker.
+func BenchmarkResolve(b *testing.B) {
+	urls := map[versions.Version]string{}
+	for i := 0; i < 20; i++ {
+		urls[versions.Version(fmt.Sprintf("1.%d.0", i))] = fmt.Sprintf("http://localhost:%d", 8080+i)
+	}
+	m, err := versions.NewStatic(urls)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarks := []struct {
+		name    string
+		options []Option
+	}{
+		{name: "Uncached"},
+		{name: "Cached", options: []Option{WithResolutionCache()}},
+	}
+
+	for _, bm := range benchmarks {
+		serv, err := New(m, append(bm.options, WithMinVersion("1.5.0"))...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(
+			bm.name,
+			func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := serv.base(serv.resolve(versions.Latest)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			},
+		)
+	}
+}
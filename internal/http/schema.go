@@ -0,0 +1,105 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+
+	"github.com/go-json-experiment/json"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// WithSchemas validates the bodies of requests to the endpoints in schemas against a JSON Schema before
+// they are forwarded, so that a body that is JSON but not something agent baker can use fails without a
+// round trip. schemas maps endpoint paths, such as "/getnodebootstrapdata", to their schema. The schema is
+// applied to the request without the VersionedReq wrapper. A request that doesn't validate gets a 400
+// listing what is wrong. Schemas can only refer to themselves, other documents are not loaded.
+func WithSchemas(schemas map[string][]byte) Option {
+	return func(s *Server) error {
+		m := make(map[string]*jsonschema.Schema, len(schemas))
+		for path, doc := range schemas {
+			if !slices.Contains(typedEndpoints, path) {
+				return fmt.Errorf("schema path(%s) must be one of %v", path, typedEndpoints)
+			}
+			schema, err := compileSchema(path, doc)
+			if err != nil {
+				return err
+			}
+			m[path] = schema
+		}
+		s.schemas = m
+		return nil
+	}
+}
+
+// compileSchema compiles doc, the schema for the endpoint at path.
+func compileSchema(path string, doc []byte) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	// Without this, a $ref could make us read files or fetch URLs.
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("schema can't refer to %s, only to itself", url)
+	}
+
+	url := "bakedbaker://schemas" + path
+	if err := c.AddResource(url, bytes.NewReader(doc)); err != nil {
+		return nil, fmt.Errorf("schema for path(%s) is not valid JSON: %w", path, err)
+	}
+	schema, err := c.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("schema for path(%s) did not compile: %w", path, err)
+	}
+	return schema, nil
+}
+
+// schemaError is returned when a request body does not validate against the schema for its endpoint.
+type schemaError struct {
+	// path is the endpoint the request was for.
+	path string
+	// violations describe each way the body doesn't match the schema, sorted.
+	violations []string
+}
+
+// Error implements the error interface.
+func (e *schemaError) Error() string {
+	return fmt.Sprintf("request body does not match the schema for %s", e.path)
+}
+
+// validateSchema validates body, a request to the endpoint at path, against schema. If body doesn't
+// match, a *schemaError is returned.
+func validateSchema(schema *jsonschema.Schema, path string, body []byte) error {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("could not decode the request body for schema validation: %w", err)
+	}
+
+	err := schema.Validate(v)
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return fmt.Errorf("could not validate the request body: %w", err)
+	}
+	se := &schemaError{path: path}
+	se.violations = violations(ve, se.violations)
+	sort.Strings(se.violations)
+	return se
+}
+
+// violations appends a description of every leaf of ve to v. The leaves are the actual problems, the
+// rest only say which part of the schema they were found under.
+func violations(ve *jsonschema.ValidationError, v []string) []string {
+	if len(ve.Causes) == 0 {
+		loc := ve.InstanceLocation
+		if loc == "" {
+			loc = "/"
+		}
+		return append(v, fmt.Sprintf("%s: %s", loc, ve.Message))
+	}
+	for _, c := range ve.Causes {
+		v = violations(c, v)
+	}
+	return v
+}
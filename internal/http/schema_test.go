@@ -0,0 +1,114 @@
+package http
+
+import (
+	_ "embed"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/go-json-experiment/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+//go:embed testdata/sigimageconfig.schema.json
+var sigImageConfigSchema []byte
+
+func TestWithSchemas(t *testing.T) {
+	t.Parallel()
+
+	up := newStubUpstream(t, `{"ok":true}`)
+
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		wantStatus     int
+		wantViolations []string
+	}{
+		{
+			name:       "Valid document",
+			path:       "/getlatestsigimageconfig",
+			body:       `{"SubscriptionID":"sub","Region":"westus"}`,
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name:       "Valid document in a VersionedReq",
+			path:       "/getlatestsigimageconfig",
+			body:       `{"ABVersion":"1.0.0","Req":{"SubscriptionID":"sub","Region":"westus"}}`,
+			wantStatus: fiber.StatusOK,
+		},
+		{
+			name:           "Invalid document",
+			path:           "/getlatestsigimageconfig",
+			body:           `{"Region":""}`,
+			wantStatus:     fiber.StatusBadRequest,
+			wantViolations: []string{"/: missing properties: 'SubscriptionID'", "/Region: length must be >= 1, but got 0"},
+		},
+		{
+			name:           "Invalid document in a VersionedReq",
+			path:           "/getlatestsigimageconfig",
+			body:           `{"ABVersion":"1.0.0","Req":{"SubscriptionID":"sub","Region":3}}`,
+			wantStatus:     fiber.StatusBadRequest,
+			wantViolations: []string{"/Region: expected string, but got number"},
+		},
+		{
+			name:       "Endpoint without a schema is not validated",
+			path:       "/getdistrosigimageconfig",
+			body:       `{"Region":"westus"}`,
+			wantStatus: fiber.StatusOK,
+		},
+	}
+
+	serv := newTestServer(
+		t,
+		fakeMapping{"1.0.0": up.URL, versions.Latest: up.URL},
+		WithSchemas(map[string][]byte{"/getlatestsigimageconfig": sigImageConfigSchema}),
+	)
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestWithSchemas(%s): %s", test.name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != test.wantStatus {
+			t.Errorf("TestWithSchemas(%s): got status %d, want %d: %s", test.name, resp.StatusCode, test.wantStatus, b)
+			continue
+		}
+		if test.wantStatus == fiber.StatusOK {
+			continue
+		}
+
+		var got errorResp
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("TestWithSchemas(%s): could not decode response(%s): %s", test.name, b, err)
+		}
+		if diff := pretty.Compare(test.wantViolations, got.Violations); diff != "" {
+			t.Errorf("TestWithSchemas(%s): violations -want/+got:\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestWithSchemasErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		schemas map[string][]byte
+	}{
+		{name: "Path we don't know the type of", schemas: map[string][]byte{"/other": sigImageConfigSchema}},
+		{name: "Schema is not JSON", schemas: map[string][]byte{"/getlatestsigimageconfig": []byte(`{`)}},
+		{name: "Schema is not a schema", schemas: map[string][]byte{"/getlatestsigimageconfig": []byte(`{"type": 3}`)}},
+		{name: "Schema refers to a file", schemas: map[string][]byte{"/getlatestsigimageconfig": []byte(`{"$ref": "file:///etc/passwd"}`)}},
+	}
+
+	for _, test := range tests {
+		if _, err := New(versions.Mapping{}, WithSchemas(test.schemas)); err == nil {
+			t.Errorf("TestWithSchemasErrors(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package http
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// WithServerTiming adds a Server-Timing header to the responses of requests that are forwarded to an
+// agent baker, with how long each phase of handling them took. Like the "handler phases" log, this is only
+// done while the Server logs at debug level, so it costs nothing otherwise.
+func WithServerTiming() Option {
+	return func(s *Server) error {
+		s.serverTiming = true
+		return nil
+	}
+}
+
+// Phases of handling a forwarded request, as they are named in the logs and the Server-Timing header.
+const (
+	// phaseDecode is reading the body and unwrapping the version from it, see versionedRequest().
+	phaseDecode = "decode"
+	// phaseRoute is deciding on the version and agent baker the request goes to.
+	phaseRoute = "route"
+	// phaseTransform is re-encoding the body for the version, see WithRequestTransform().
+	phaseTransform = "transform"
+	// phaseUpstream is sending the request to the agent baker and handing its response to the client.
+	phaseUpstream = "upstream"
+)
+
+// phase is how long a phase took.
+type phase struct {
+	name string
+	dur  time.Duration
+}
+
+// phaseTimer records how long each phase of a handler takes. A nil *phaseTimer records nothing.
+type phaseTimer struct {
+	last   time.Time
+	phases []phase
+}
+
+// phaseTimer returns a phaseTimer for c that started now, or nil if we don't log at debug level.
+func (s *Server) phaseTimer(c *fiber.Ctx) *phaseTimer {
+	if !s.log.Enabled(c.Context(), slog.LevelDebug) {
+		return nil
+	}
+	return &phaseTimer{last: time.Now(), phases: make([]phase, 0, 4)}
+}
+
+// done records that the phase name ended now. It started when the one before it ended.
+func (p *phaseTimer) done(name string) {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	p.phases = append(p.phases, phase{name: name, dur: now.Sub(p.last)})
+	p.last = now
+}
+
+// serverTiming returns the phases as a Server-Timing header value, with durations in milliseconds.
+func (p *phaseTimer) serverTiming() string {
+	var b strings.Builder
+	for i, ph := range p.phases {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(ph.name)
+		b.WriteString(";dur=")
+		b.WriteString(strconv.FormatFloat(float64(ph.dur)/float64(time.Millisecond), 'f', 3, 64))
+	}
+	return b.String()
+}
+
+// reportPhases logs the phases p recorded for c and, if WithServerTiming() is set, adds them to the response.
+// A request that failed reports the phases it finished. This must be called before the handler returns.
+func (s *Server) reportPhases(c *fiber.Ctx, p *phaseTimer) {
+	if p == nil || len(p.phases) == 0 {
+		return
+	}
+	attrs := make([]any, 0, 2+2*len(p.phases))
+	attrs = append(attrs, "path", c.Path())
+	for _, ph := range p.phases {
+		attrs = append(attrs, ph.name, ph.dur)
+	}
+	s.log.Debug("handler phases", attrs...)
+	if s.serverTiming {
+		c.Set(fiber.HeaderServerTiming, p.serverTiming())
+	}
+}
@@ -0,0 +1,110 @@
+package http
+
+import (
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestServerTiming(t *testing.T) {
+	t.Parallel()
+
+	const body = `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+	allPhases := []string{phaseDecode, phaseRoute, phaseTransform, phaseUpstream}
+
+	tests := []struct {
+		name   string
+		level  slog.Level
+		timing bool
+		path   string
+		want   []string
+	}{
+		{
+			name:   "Debug level",
+			level:  slog.LevelDebug,
+			timing: true,
+			path:   "/getlatestsigimageconfig",
+			want:   allPhases,
+		},
+		{
+			name:   "Debug level on the generic route",
+			level:  slog.LevelDebug,
+			timing: true,
+			path:   "/some/new/endpoint",
+			// Bodies to the generic route are sent as they are, so there is nothing to decode or transform.
+			want: []string{phaseRoute, phaseUpstream},
+		},
+		{
+			name:   "Info level",
+			level:  slog.LevelInfo,
+			timing: true,
+			path:   "/getlatestsigimageconfig",
+		},
+		{
+			name:  "Debug level without WithServerTiming",
+			level: slog.LevelDebug,
+			path:  "/getlatestsigimageconfig",
+		},
+	}
+
+	for _, test := range tests {
+		up := newStubUpstream(t, `{}`)
+		log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: test.level}))
+		options := []Option{WithLogger(log)}
+		if test.timing {
+			options = append(options, WithServerTiming())
+		}
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, options...)
+
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(body))
+		req.Header.Set(VersionHeader, "1.0.0")
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestServerTiming(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestServerTiming(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+			continue
+		}
+
+		var got []string
+		if h := resp.Header.Get(fiber.HeaderServerTiming); h != "" {
+			for _, metric := range strings.Split(h, ", ") {
+				name, dur, ok := strings.Cut(metric, ";")
+				if !ok || !strings.HasPrefix(dur, "dur=") {
+					t.Errorf("TestServerTiming(%s): got metric %q, want name;dur=<ms>", test.name, metric)
+				}
+				got = append(got, name)
+			}
+		}
+		if diff := pretty.Compare(test.want, got); diff != "" {
+			t.Errorf("TestServerTiming(%s): phases: -want/+got:\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestServerTimingOnError(t *testing.T) {
+	t.Parallel()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	serv := newTestServer(t, fakeMapping{"1.0.0": "http://127.0.0.1:1"}, WithLogger(log), WithServerTiming())
+
+	// 9.9.9 doesn't exist, so the request fails while it is routed, after it was decoded.
+	body := `{"ABVersion":"9.9.9","Req":{"Region":"westus"}}`
+	resp, err := serv.app.Test(httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("TestServerTimingOnError: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("TestServerTimingOnError: got status %d, want %d", resp.StatusCode, fiber.StatusNotFound)
+	}
+	h := resp.Header.Get(fiber.HeaderServerTiming)
+	if !strings.HasPrefix(h, phaseDecode+";dur=") || strings.Contains(h, phaseUpstream) {
+		t.Errorf("TestServerTimingOnError: got Server-Timing %q, want only the %s phase", h, phaseDecode)
+	}
+}
@@ -0,0 +1,422 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/versions"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// unixScheme is the scheme of an agent baker address that is a unix socket, such as "unix:///run/ab.sock".
+const unixScheme = "unix://"
+
+// upstreamAgent returns a fiber.Agent that sends a request with method to path on the agent baker at base.
+// base can be an http or https URL, or a unix socket address starting with unixScheme. Requests over a
+// unix socket are still HTTP requests, they are just dialed over the socket. If proxy is set, it dials
+// the agent baker unless it is on a loopback address or a unix socket, see WithUpstreamProxy().
+func upstreamAgent(method, base, path string, insecureSkipVerify bool, proxy fasthttp.DialFunc) (*fiber.Agent, error) {
+	sock, isUnix := strings.CutPrefix(base, unixScheme)
+	if isUnix {
+		if sock == "" {
+			return nil, fmt.Errorf("agent baker address(%s) has no socket path", base)
+		}
+		// The host is only used for the Host header.
+		base = "http://localhost"
+	}
+
+	agent := newAgent(method, base+path)
+	if err := agent.Parse(); err != nil {
+		fiber.ReleaseAgent(agent)
+		return nil, fmt.Errorf("could not parse the agent baker URL: %w", err)
+	}
+	// These must come after .Parse(), which creates the client they set.
+	switch {
+	case isUnix:
+		agent.HostClient.Dial = func(string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		}
+	case proxy != nil && !isLoopback(agent.HostClient.Addr):
+		agent.HostClient.Dial = proxy
+	}
+	if insecureSkipVerify {
+		agent = agent.InsecureSkipVerify()
+	}
+	return agent, nil
+}
+
+// isLoopback reports if addr, a host with an optional port, is localhost or a loopback IP.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// newAgent returns a fiber.Agent that sends a request with method to url. Unlike fiber.Post()
+// and friends, this works for any method.
+func newAgent(method, url string) *fiber.Agent {
+	agent := fiber.AcquireAgent()
+	agent.Request().Header.SetMethod(method)
+	agent.Request().SetRequestURI(url)
+	return agent
+}
+
+// connWatch records if an agent baker connection broke or was closed while we were reading from it, which
+// is usually the agent baker crashing. fasthttp ends a body that is cut short as if it were complete, for
+// both Content-Length and chunked responses, so this is how we tell a truncated response from a whole one.
+type connWatch struct {
+	// failed is set if a read failed with an error other than io.EOF.
+	failed atomic.Bool
+	// eof is set if a read found that the agent baker closed the connection.
+	eof atomic.Bool
+	// conn is the last connection dialed, nil until then.
+	conn atomic.Pointer[watchedConn]
+}
+
+// watch causes the connections agent dials to report to w. It must be called after agent.Parse().
+// Each agent has its own client, so w only sees the connections of this agent's request.
+func (w *connWatch) watch(agent *fiber.Agent) {
+	dial := agent.HostClient.Dial
+	if dial == nil {
+		dial = fasthttp.Dial
+	}
+	agent.HostClient.Dial = func(addr string) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		wc := &watchedConn{Conn: conn, w: w}
+		w.conn.Store(wc)
+		return wc, nil
+	}
+}
+
+// truncated reports if the response was cut short. A response is only read until its framing says it ends,
+// so with a Content-Length or chunked body, a closed connection means that bytes it expected never came.
+func (w *connWatch) truncated() bool {
+	return w.failed.Load() || w.eof.Load()
+}
+
+// received is called when doUpstream() returns a response. A body with neither a Content-Length nor chunks
+// ends when the agent baker closes the connection, and fasthttp has read all of it by then. fasthttp fails
+// the request if a Content-Length or chunked body it read is cut short by a closed connection, so any
+// io.EOF so far was the end of a body, not a truncation.
+func (w *connWatch) received() {
+	w.eof.Store(false)
+}
+
+// noDeadline removes the read deadline doUpstream() set on the connection, so that the rest of the
+// response can take as long as the agent baker likes.
+func (w *connWatch) noDeadline() error {
+	conn := w.conn.Load()
+	if conn == nil {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// watchedConn is a net.Conn that tells its connWatch when a read fails or finds the connection closed.
+type watchedConn struct {
+	net.Conn
+	w *connWatch
+}
+
+// Read implements io.Reader.
+func (c *watchedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	switch {
+	case err == io.EOF:
+		c.w.eof.Store(true)
+	case err != nil:
+		c.w.failed.Store(true)
+	}
+	return n, err
+}
+
+// truncatedError is returned when an agent baker closes the connection before its response is complete.
+func truncatedError(v versions.Version) error {
+	return fiber.NewError(
+		fiber.StatusBadGateway,
+		fmt.Sprintf("agent baker version(%s) closed the connection before its response was complete", v),
+	)
+}
+
+// streamThreshold is the response size above which an agent baker's response is streamed to the client
+// instead of being read into memory first. Responses without a Content-Length are always streamed.
+const streamThreshold = 1 << 20
+
+// doUpstream sends the request in agent, which is released. The body of the returned response is not read,
+// it is a stream that is read by calling .Body() or with .BodyStream(). The caller must release the
+// response with fasthttp.ReleaseResponse(), which closes the stream. timeout is a read deadline on the
+// connection: it covers the headers and, for a body left unread, every read of the body after them,
+// until connWatch.noDeadline() removes it. So a streamed response must arrive whole within timeout.
+func doUpstream(agent *fiber.Agent, timeout time.Duration) (*fasthttp.Response, error) {
+	defer fiber.ReleaseAgent(agent)
+
+	// Bodies larger than this are left unread for the caller to stream, smaller ones are read into memory.
+	agent.HostClient.MaxResponseBodySize = streamThreshold
+	resp := fasthttp.AcquireResponse()
+	resp.StreamBody = true
+	if err := agent.HostClient.DoTimeout(agent.Request(), resp, timeout); err != nil {
+		fasthttp.ReleaseResponse(resp)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// mimeEventStream is the content type of server-sent events.
+const mimeEventStream = "text/event-stream"
+
+// isEventStream reports if h is the header of a response of server-sent events. These are sent to the
+// client as each event arrives, and the agent baker may take as long as it likes between events.
+func isEventStream(h *fasthttp.ResponseHeader) bool {
+	mt, _, _ := strings.Cut(string(h.ContentType()), ";")
+	return strings.EqualFold(strings.TrimSpace(mt), mimeEventStream)
+}
+
+// shouldStream reports if resp, which must be from doUpstream(), is large enough or of unknown size
+// and so should be streamed to the client.
+func shouldStream(resp *fasthttp.Response) bool {
+	n := resp.Header.ContentLength()
+	return n < 0 || n > streamThreshold
+}
+
+// responseStream is the body of an agent baker response that is being streamed to the client.
+// fasthttp closes it once it has been sent, which releases the response.
+type responseStream struct {
+	resp *fasthttp.Response
+	// conn watches the connection resp is read from.
+	conn *connWatch
+	// truncated is set if the agent baker closed the connection before the whole body was read.
+	truncated bool
+	// n is the number of bytes read so far.
+	n int
+	// done is called with the number of bytes read when the stream is closed.
+	done func(n int)
+	// release is called when the stream is closed, if set.
+	release func()
+	// onRead is called before what was read is sent to the client, if set.
+	onRead func()
+}
+
+// Read implements io.Reader.
+func (r *responseStream) Read(b []byte) (int, error) {
+	n, err := r.resp.BodyStream().Read(b)
+	r.n += n
+	if n > 0 && r.onRead != nil {
+		r.onRead()
+	}
+	// The status and headers have been sent, so the best we can do is fail the stream. fasthttp then
+	// closes the client connection without ending the body, so the client can tell it is incomplete
+	// instead of getting a short body that looks whole.
+	if err == io.EOF && r.conn.truncated() {
+		r.truncated = true
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (r *responseStream) Close() error {
+	fasthttp.ReleaseResponse(r.resp)
+	if r.done != nil {
+		r.done(r.n)
+	}
+	if r.release != nil {
+		r.release()
+	}
+	return nil
+}
+
+var _ io.ReadCloser = (*responseStream)(nil)
+
+// upstreamRequest is a client request to forward to an agent baker.
+type upstreamRequest struct {
+	// Version is the version Base is for.
+	Version versions.Version
+	// Base is the address of the agent baker, see upstreamAgent().
+	Base string
+	// Method and Path are what the client sent, the agent baker gets the same.
+	Method string
+	Path   string
+	// Header holds the client's request headers, which are sent to the agent baker. It is not changed.
+	Header *fasthttp.RequestHeader
+	// Body is the JSON body to send.
+	Body []byte
+	// ConvertedIn is set if Body was converted to JSON from what the client sent, so the Content-Type
+	// is changed to JSON.
+	ConvertedIn bool
+	// ConvertOut is set if the response will be converted from JSON to what the client wants, so we
+	// ask the agent baker for JSON. Responses that are converted are never streamed.
+	ConvertOut bool
+	// Deadline is from the client's DeadlineHeader. If it is sooner than the upstream timeout, we wait
+	// for the agent baker until then instead. If zero, there is none.
+	Deadline time.Time
+}
+
+// forwardResult is what an agent baker answered to an upstreamRequest.
+type forwardResult struct {
+	// Version is the version the request was sent to.
+	Version versions.Version
+	// URL is where the request was sent.
+	URL string
+	// Status is the status code the agent baker returned.
+	Status int
+	// Header is a copy of the agent baker's response headers.
+	Header *fasthttp.ResponseHeader
+	// Body is the response body. It is nil if the response is streamed.
+	Body []byte
+	// ReqBytes is the size of the request body, before any gzip.
+	ReqBytes int
+	// RespBytes is the size of Body, or the Content-Length of a streamed response, which is -1 if unknown.
+	RespBytes int
+	// Duration is how long the agent baker took to answer. For a streamed response, this is until the headers.
+	Duration time.Duration
+
+	// stream is the body of a streamed response. It must be sent to the client or closed.
+	stream *responseStream
+}
+
+// forwardUpstream sends req to its agent baker and returns what the agent baker answered. Any status
+// the agent baker returns is a forwardResult, errors are for requests that didn't get an answer.
+// A 200 OK with a large JSON body that isn't converted is streamed instead of read into memory, as is
+// a 200 OK of server-sent events, which are never converted.
+func (s *Server) forwardUpstream(req upstreamRequest) (forwardResult, error) {
+	res := forwardResult{Version: req.Version, URL: req.Base + req.Path, ReqBytes: len(req.Body)}
+
+	// The client's deadline can shorten how long we wait, but not lengthen it.
+	timeout := s.timeout(req.Path)
+	byDeadline := false
+	if !req.Deadline.IsZero() {
+		if left := time.Until(req.Deadline); left < timeout {
+			timeout, byDeadline = left, true
+		}
+	}
+	if timeout <= 0 {
+		return res, deadlineError(req.Version)
+	}
+
+	// The agent baker gets the same method the client used.
+	agent, err := upstreamAgent(req.Method, req.Base, req.Path, s.insecureSkipVerify, s.proxy)
+	if err != nil {
+		return res, err
+	}
+	// This comes after everything that can fail without asking the agent baker, as a request allow() lets
+	// through must tell the breaker how the agent baker did.
+	if !s.breakers.allow(req.Base) {
+		fiber.ReleaseAgent(agent)
+		return res, fiber.NewError(
+			fiber.StatusServiceUnavailable,
+			fmt.Sprintf("agent baker version(%s) is failing, its circuit breaker is open", req.Version),
+		)
+	}
+	conn := &connWatch{}
+	conn.watch(agent)
+	if req.Header != nil {
+		req.Header.VisitAll(func(key, value []byte) {
+			// fasthttp sets this from the body we send, which may not be the body we received.
+			if string(key) == fiber.HeaderContentLength {
+				return
+			}
+			// The body we send is decoded, fiber undoes any encoding the client used.
+			if string(key) == fiber.HeaderContentEncoding {
+				return
+			}
+			if s.forwardHeaders != nil && !s.forwardHeaders[string(key)] {
+				return
+			}
+			// TODO: consider using unsafe to avoid the string conversion.
+			// Would need to test that this is safe, because fasthttp might do something funky.
+			agent.Request().Header.Add(string(key), string(value))
+		})
+	}
+	// Agent bakers only speak JSON, whatever the client sent or wants back.
+	if req.ConvertedIn {
+		agent.Request().Header.SetContentType(fiber.MIMEApplicationJSON)
+	}
+	if req.ConvertOut {
+		agent.Request().Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	}
+	body := req.Body
+	if s.gzipMin >= 0 && len(body) >= s.gzipMin {
+		body = fasthttp.AppendGzipBytes(nil, body)
+		agent.Request().Header.Set(fiber.HeaderContentEncoding, "gzip")
+	}
+	agent = agent.Body(body)
+
+	start := time.Now()
+	resp, err := doUpstream(agent, timeout)
+	timedOut := errors.Is(err, fasthttp.ErrTimeout)
+	// An agent baker that doesn't beat a client's short deadline isn't failing, but we didn't find out
+	// that it works either.
+	switch {
+	case timedOut && byDeadline:
+		s.breakers.release(req.Base)
+	case s.breakers != nil:
+		state := s.breakers.record(req.Base, err == nil && resp.StatusCode() < fiber.StatusInternalServerError)
+		s.metrics.breakerState(req.Base, state)
+	}
+	if err != nil {
+		if timedOut && byDeadline {
+			return res, deadlineError(req.Version)
+		}
+		if timedOut {
+			return res, fiber.NewError(
+				fiber.StatusGatewayTimeout,
+				fmt.Sprintf("agent baker version(%s) did not answer within %v", req.Version, s.timeout(req.Path)),
+			)
+		}
+		if conn.truncated() {
+			return res, truncatedError(req.Version)
+		}
+		return res, fmt.Errorf("could not send the request to the agent: %w", err)
+	}
+
+	conn.received()
+
+	res.Status = resp.StatusCode()
+	res.Header = &fasthttp.ResponseHeader{}
+	resp.Header.CopyTo(res.Header)
+
+	// Large responses that don't need converting are sent as they arrive instead of being held in memory.
+	// Events are sent as they arrive whatever the client wants, as there is nothing to convert them to.
+	events := isEventStream(&resp.Header)
+	if res.Status == fiber.StatusOK && (events || !req.ConvertOut && shouldStream(resp)) {
+		// The timeout still limits reading the rest of a large body, but the agent baker sends events
+		// for as long as it likes.
+		if events {
+			if err := conn.noDeadline(); err != nil {
+				fasthttp.ReleaseResponse(resp)
+				return res, fmt.Errorf("could not remove the deadline on the agent baker connection: %w", err)
+			}
+		}
+		res.Duration = time.Since(start)
+		res.RespBytes = resp.Header.ContentLength()
+		res.stream = &responseStream{resp: resp, conn: conn}
+		return res, nil
+	}
+
+	// Body() copies, so that resp can be released. It reads any rest of the body that doUpstream() left
+	// unread, and if that fails it returns the error text as the body, so we must check conn instead.
+	res.Body = append([]byte(nil), resp.Body()...)
+	fasthttp.ReleaseResponse(resp)
+	if conn.truncated() {
+		res.Body = nil
+		return res, truncatedError(req.Version)
+	}
+	res.Duration = time.Since(start)
+	res.RespBytes = len(res.Body)
+	return res, nil
+}
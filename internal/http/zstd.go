@@ -0,0 +1,44 @@
+package http
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// WithZstd compresses responses with zstd at level, which is 1 (fastest) to 22 (smallest), for clients whose
+// Accept-Encoding includes zstd. Other clients get gzip, deflate or brotli as before. Responses that
+// are streamed from an agent baker are not compressed with zstd.
+func WithZstd(level int) Option {
+	return func(s *Server) error {
+		if level < 1 || level > 22 {
+			return fmt.Errorf("zstd level must be between 1 and 22, was %d", level)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		if err != nil {
+			return fmt.Errorf("could not create zstd encoder: %w", err)
+		}
+		s.zstd = enc
+		return nil
+	}
+}
+
+// acceptsZstd reports if the Accept-Encoding header value accept allows zstd.
+func acceptsZstd(accept string) bool {
+	for _, enc := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "zstd") {
+			continue
+		}
+		// zstd;q=0 means the client does not want zstd.
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
+}
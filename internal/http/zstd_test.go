@@ -0,0 +1,129 @@
+package http
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestZstd(t *testing.T) {
+	t.Parallel()
+
+	// This is big enough that the fiber compress middleware compresses it.
+	want := `{"Images":"` + strings.Repeat("ubuntu-22.04,", 100) + `"}`
+	up := newStubUpstream(t, want)
+
+	tests := []struct {
+		name         string
+		options      []Option
+		accept       string
+		wantEncoding string
+	}{
+		{
+			name:         "Client accepts zstd",
+			options:      []Option{WithZstd(3)},
+			accept:       "gzip, zstd",
+			wantEncoding: "zstd",
+		},
+		{
+			name:         "Client accepts zstd with a quality",
+			options:      []Option{WithZstd(19)},
+			accept:       "zstd;q=0.5, gzip;q=1.0",
+			wantEncoding: "zstd",
+		},
+		{
+			name:         "Client does not accept zstd",
+			options:      []Option{WithZstd(3)},
+			accept:       "gzip",
+			wantEncoding: "gzip",
+		},
+		{
+			name:         "Client refuses zstd",
+			options:      []Option{WithZstd(3)},
+			accept:       "zstd;q=0, gzip",
+			wantEncoding: "gzip",
+		},
+		{
+			name:         "zstd is off",
+			accept:       "zstd, gzip",
+			wantEncoding: "gzip",
+		},
+	}
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	for _, test := range tests {
+		serv := newTestServer(t, fakeMapping{"1.0.0": up.URL}, test.options...)
+
+		body := `{"ABVersion":"1.0.0","Req":{"Region":"westus"}}`
+		req := httptest.NewRequest("POST", "/getlatestsigimageconfig", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderAcceptEncoding, test.accept)
+		resp, err := serv.app.Test(req)
+		if err != nil {
+			t.Fatalf("TestZstd(%s): %s", test.name, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("TestZstd(%s): got status %d, want %d", test.name, resp.StatusCode, fiber.StatusOK)
+			continue
+		}
+		if got := resp.Header.Get(fiber.HeaderContentEncoding); got != test.wantEncoding {
+			t.Errorf("TestZstd(%s): got Content-Encoding %q, want %q", test.name, got, test.wantEncoding)
+			continue
+		}
+		if test.wantEncoding != "zstd" {
+			continue
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		got, err := dec.DecodeAll(b, nil)
+		if err != nil {
+			t.Errorf("TestZstd(%s): could not decode the zstd body: %s", test.name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("TestZstd(%s): got body %s, want %s", test.name, got, want)
+		}
+	}
+}
+
+func TestWithZstd(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []int{0, 23} {
+		if err := WithZstd(level)(&Server{}); err == nil {
+			t.Errorf("TestWithZstd(%d): got err == nil, want err != nil", level)
+		}
+	}
+}
+
+func TestAcceptsZstd(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "gzip, br", want: false},
+		{accept: "zstd", want: true},
+		{accept: "gzip, ZSTD", want: true},
+		{accept: "zstd;q=0.1", want: true},
+		{accept: "zstd; q=0", want: false},
+		{accept: "zstd;q=bad", want: false},
+		{accept: "zstdx", want: false},
+	}
+
+	for _, test := range tests {
+		if got := acceptsZstd(test.accept); got != test.want {
+			t.Errorf("TestAcceptsZstd(%q): got %v, want %v", test.accept, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// writeTimeout is how long we allow for writing an agent baker binary to disk.
+	writeTimeout = 30 * time.Second
+	// writeChunk is how much of a binary is written between checks that we haven't timed out.
+	writeChunk = 1 << 20
+)
+
+// binSource is an agent baker binary. The content is only read when the version is started, so discovering
+// versions does not hold every binary in memory.
+type binSource interface {
+	// open opens the binary for reading. The caller must close it.
+	open() (io.ReadCloser, error)
+}
+
+// fsBinary is a binary at path in fsys, such as the embedded binaries filesystem.
+type fsBinary struct {
+	fsys fs.FS
+	path string
+}
+
+// open implements binSource.open().
+func (b fsBinary) open() (io.ReadCloser, error) {
+	return b.fsys.Open(b.path)
+}
+
+// memBinary is a binary that is already in memory.
+type memBinary []byte
+
+// open implements binSource.open().
+func (b memBinary) open() (io.ReadCloser, error) {
+	return memReader{bytes.NewReader(b)}, nil
+}
+
+// memReader is a bytes.Reader that can be closed. It keeps ReadAt(), which
+// checkPlatform() uses to read headers without reading the whole binary.
+type memReader struct {
+	*bytes.Reader
+}
+
+// Close implements io.Closer.
+func (memReader) Close() error {
+	return nil
+}
+
+// primaryName is the name an agent baker binary is written to disk as, whatever it is called where it comes from.
+const primaryName = "agentbaker"
+
+// helperBin is an executable that ships with a version's agent baker and is written next to it,
+// so that the agent baker can find it in its working directory or on its PATH.
+type helperBin struct {
+	// name is the file name of the helper, which it is written as.
+	name string
+	bin  binSource
+}
+
+// findHelpers returns the helpers with names in the directory dir of fsys. Every helper must exist.
+func findHelpers(fsys fs.FS, dir string, names []string) ([]helperBin, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	helpers := make([]helperBin, 0, len(names))
+	for _, name := range names {
+		p := path.Join(dir, name)
+		if _, err := fs.Stat(fsys, p); err != nil {
+			return nil, fmt.Errorf("could not find helper(%s) at %s: %w", name, p, err)
+		}
+		helpers = append(helpers, helperBin{name: name, bin: fsBinary{fsys: fsys, path: p}})
+	}
+	return helpers, nil
+}
+
+// writeBinary copies bin to fp as an executable, a chunk at a time, so the binary is never held in
+// memory. The binary is written to a temporary file in the same directory and renamed into place,
+// so fp is either the complete binary or is left as it was. This also lets us replace a binary that
+// another replica is already running, which writing over it fails to do on some platforms. If
+// anything fails, the temporary file is removed.
+func writeBinary(ctx context.Context, v Version, fp string, bin binSource) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	r, err := bin.open()
+	if err != nil {
+		return fmt.Errorf("%w: could not open agentbaker binary for version(%v): %w", ErrExtract, v, err)
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(fp), filepath.Base(fp)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("%w: could not create agentbaker binary for version(%v) in %s: %w", ErrWrite, v, filepath.Dir(fp), err)
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("%w: could not write agentbaker binary for version(%v) to %s: %w", ErrWrite, v, tmp, err)
+		}
+		_, err := io.CopyN(f, r, writeChunk)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: could not write agentbaker binary for version(%v) to %s: %w", ErrWrite, v, tmp, err)
+		}
+	}
+	if err := f.Chmod(0755); err != nil {
+		return fmt.Errorf("%w: could not make agentbaker binary for version(%v) at %s executable: %w", ErrWrite, v, tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: could not write agentbaker binary for version(%v) to %s: %w", ErrWrite, v, tmp, err)
+	}
+	if err := os.Rename(tmp, fp); err != nil {
+		return fmt.Errorf("%w: could not move agentbaker binary for version(%v) to %s: %w", ErrWrite, v, fp, err)
+	}
+	return nil
+}
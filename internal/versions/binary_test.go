@@ -0,0 +1,102 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBinary(t *testing.T) {
+	t.Parallel()
+
+	bin := memBinary(bytes.Repeat([]byte("b"), 3*writeChunk+1))
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		// setup prepares dir and returns the path to write to.
+		setup func(t *testing.T, dir string) string
+		err   bool
+	}{
+		{
+			name:  "Success",
+			ctx:   context.Background(),
+			setup: func(t *testing.T, dir string) string { return filepath.Join(dir, "1.0.0") },
+		},
+		{
+			name: "Replaces an existing binary",
+			ctx:  context.Background(),
+			setup: func(t *testing.T, dir string) string {
+				fp := filepath.Join(dir, "1.0.0")
+				if err := os.WriteFile(fp, []byte("old"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				return fp
+			},
+		},
+		{
+			name:  "Error: Write is cancelled",
+			ctx:   cancelled,
+			setup: func(t *testing.T, dir string) string { return filepath.Join(dir, "1.0.0") },
+			err:   true,
+		},
+		{
+			name: "Error: Target can't be replaced",
+			ctx:  context.Background(),
+			setup: func(t *testing.T, dir string) string {
+				// A directory that isn't empty can't be replaced by a rename.
+				fp := filepath.Join(dir, "1.0.0")
+				if err := os.MkdirAll(filepath.Join(fp, "sub"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				return fp
+			},
+			err: true,
+		},
+		{
+			name:  "Error: Directory does not exist",
+			ctx:   context.Background(),
+			setup: func(t *testing.T, dir string) string { return filepath.Join(dir, "missing", "1.0.0") },
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		fp := test.setup(t, dir)
+
+		err := writeBinary(test.ctx, "1.0.0", fp, bin)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestWriteBinary(%s): got err == nil, want err != nil", test.name)
+		case !test.err && err != nil:
+			t.Errorf("TestWriteBinary(%s): got err == %s, want err == nil", test.name, err)
+		}
+
+		// No temporary files may be left behind, whether we failed or not.
+		tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+		if len(tmps) != 0 {
+			t.Errorf("TestWriteBinary(%s): left partial files behind: %v", test.name, tmps)
+		}
+		if err != nil {
+			continue
+		}
+
+		got, err := os.ReadFile(fp)
+		if err != nil {
+			t.Fatalf("TestWriteBinary(%s): %s", test.name, err)
+		}
+		if !bytes.Equal(got, bin) {
+			t.Errorf("TestWriteBinary(%s): binary on disk does not match", test.name)
+		}
+		fi, _ := os.Stat(fp)
+		if fi.Mode().Perm()&0100 == 0 {
+			t.Errorf("TestWriteBinary(%s): got mode %v, want it to be executable", test.name, fi.Mode())
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package versions
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// limits caps the resources an agent baker can use. This keeps an agent baker that misbehaves from
+// starving the host. Zero values are not limited. Limits are only supported on Linux, other platforms
+// log a warning and start the agent baker without them.
+type limits struct {
+	// Memory is the most address space, in bytes, the agent baker can have (RLIMIT_AS). It is rounded
+	// down to a whole KiB.
+	Memory uint64 `json:"memory,omitempty"`
+	// CPUSeconds is the most CPU time, in seconds, the agent baker can use (RLIMIT_CPU).
+	CPUSeconds uint64 `json:"cpuSeconds,omitempty"`
+	// Files is the most files the agent baker can have open (RLIMIT_NOFILE).
+	Files uint64 `json:"files,omitempty"`
+	// Cgroup is the absolute path of a cgroup v2 directory, such as "/sys/fs/cgroup/agentbaker",
+	// to start the agent baker in. The cgroup must already exist with the limits it should have.
+	Cgroup string `json:"cgroup,omitempty"`
+}
+
+// isZero reports if there are no limits.
+func (l limits) isZero() bool {
+	return l == limits{}
+}
+
+// validate validates the limits.
+func (l limits) validate() error {
+	if l.Cgroup != "" && !filepath.IsAbs(l.Cgroup) {
+		return fmt.Errorf("cgroup(%s) must be an absolute path", l.Cgroup)
+	}
+	return nil
+}
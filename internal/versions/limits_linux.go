@@ -0,0 +1,82 @@
+package versions
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// limitShell is the shell that sets the rlimits of a limited agent baker before running it.
+const limitShell = "/bin/sh"
+
+// startLimited starts cmd with the limits in l.
+//
+// The cgroup is set when the process is created. Go can't set rlimits for a child before it runs,
+// so cmd is run by a shell that sets them with ulimit and then execs the agent baker in its place.
+// The agent baker keeps the shell's pid and has its limits before it runs any of its own code.
+func startLimited(cmd *exec.Cmd, l limits, log *slog.Logger) error {
+	if l.isZero() {
+		return cmd.Start()
+	}
+
+	if l.Cgroup != "" {
+		cg, err := os.Open(l.Cgroup)
+		if err != nil {
+			return fmt.Errorf("could not open cgroup(%s): %w", l.Cgroup, err)
+		}
+		defer cg.Close()
+
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cg.Fd())
+	}
+
+	rlimits := []struct {
+		name     string
+		resource int
+		value    uint64
+		// flag is the ulimit flag for the limit, which takes value / unit.
+		flag string
+		unit uint64
+	}{
+		{name: "memory", resource: unix.RLIMIT_AS, value: l.Memory, flag: "-v", unit: 1024},
+		{name: "cpuSeconds", resource: unix.RLIMIT_CPU, value: l.CPUSeconds, flag: "-t", unit: 1},
+		{name: "files", resource: unix.RLIMIT_NOFILE, value: l.Files, flag: "-n", unit: 1},
+	}
+	var script []string
+	for _, rl := range rlimits {
+		if rl.value == 0 {
+			continue
+		}
+		// The shell can't report why a limit failed, so we catch the usual reason here: a child can't have
+		// a limit above our hard limit unless it is privileged.
+		cur := &unix.Rlimit{}
+		if err := unix.Getrlimit(rl.resource, cur); err != nil {
+			return fmt.Errorf("could not get the %s limit: %w", rl.name, err)
+		}
+		if rl.value > cur.Max && os.Geteuid() != 0 {
+			return fmt.Errorf("could not set the %s limit to %d: it is above our hard limit of %d", rl.name, rl.value, cur.Max)
+		}
+		// ulimit sets both the soft and hard limits when given neither -S nor -H.
+		script = append(script, fmt.Sprintf("ulimit %s %d", rl.flag, rl.value/rl.unit))
+	}
+	if len(script) > 0 {
+		// The shell's $0 and $@ are the agent baker's path and arguments.
+		script = append(script, `exec "$0" "$@"`)
+		cmd.Args = append([]string{limitShell, "-c", strings.Join(script, " && "), cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = limitShell
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Info("version limits", "pid", cmd.Process.Pid, "memory", l.Memory, "cpuSeconds", l.CPUSeconds, "files", l.Files, "cgroup", l.Cgroup)
+	return nil
+}
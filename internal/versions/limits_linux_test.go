@@ -0,0 +1,108 @@
+package versions
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestStartLimited(t *testing.T) {
+	t.Parallel()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The child reads its own limits as soon as it runs, so they must be set before it does.
+	out := &bytes.Buffer{}
+	cmd := exec.Command("cat", "/proc/self/limits")
+	cmd.Stdout = out
+	if err := startLimited(cmd, limits{Memory: 1 << 30, Files: 64, CPUSeconds: 3600}, log); err != nil {
+		t.Fatalf("TestStartLimited: %s", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("TestStartLimited: child failed: %s", err)
+	}
+
+	want := map[string]string{
+		"Max address space": strconv.Itoa(1 << 30),
+		"Max open files":    "64",
+		"Max cpu time":      "3600",
+	}
+	for name, limit := range want {
+		line := ""
+		for _, l := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(l, name) {
+				line = l
+				break
+			}
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, name))
+		if len(fields) < 2 {
+			t.Errorf("TestStartLimited: could not find limit %q in:\n%s", name, out)
+			continue
+		}
+		if fields[0] != limit || fields[1] != limit {
+			t.Errorf("TestStartLimited: got %q soft/hard limits %s/%s, want %s", name, fields[0], fields[1], limit)
+		}
+	}
+}
+
+func TestStartLimitedArgs(t *testing.T) {
+	t.Parallel()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The shell that sets the limits must pass the arguments on unchanged.
+	args := []string{"-n", "a b", `"$HOME"`, ""}
+	out := &bytes.Buffer{}
+	cmd := exec.Command("printf", append([]string{"[%s]"}, args...)...)
+	cmd.Stdout = out
+	if err := startLimited(cmd, limits{Files: 64}, log); err != nil {
+		t.Fatalf("TestStartLimitedArgs: %s", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("TestStartLimitedArgs: child failed: %s", err)
+	}
+
+	want := `[-n][a b]["$HOME"][]`
+	if out.String() != want {
+		t.Errorf("TestStartLimitedArgs: got %q, want %q", out, want)
+	}
+}
+
+func TestStartLimitedAboveHard(t *testing.T) {
+	t.Parallel()
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can raise its hard limits")
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cur := &unix.Rlimit{}
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, cur); err != nil {
+		t.Fatalf("TestStartLimitedAboveHard: %s", err)
+	}
+	cmd := exec.Command("true")
+	if err := startLimited(cmd, limits{Files: cur.Max + 1}, log); err == nil {
+		cmd.Wait()
+		t.Errorf("TestStartLimitedAboveHard: got err == nil, want err != nil")
+	}
+}
+
+func TestStartLimitedBadCgroup(t *testing.T) {
+	t.Parallel()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cmd := exec.Command("true")
+	if err := startLimited(cmd, limits{Cgroup: "/nonexistent/cgroup"}, log); err == nil {
+		cmd.Wait()
+		t.Errorf("TestStartLimitedBadCgroup: got err == nil, want err != nil")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package versions
+
+import (
+	"log/slog"
+	"os/exec"
+	"runtime"
+)
+
+// startLimited starts cmd. Limits are not supported on this platform, so if l has any we log a warning
+// and start cmd without them.
+func startLimited(cmd *exec.Cmd, l limits, log *slog.Logger) error {
+	if !l.isZero() {
+		log.Warn("resource limits are not supported on this platform, starting without them", "platform", runtime.GOOS)
+	}
+	return cmd.Start()
+}
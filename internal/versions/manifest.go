@@ -0,0 +1,151 @@
+package versions
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+
+	"github.com/go-json-experiment/json"
+)
+
+// manifestFile is the name of the optional manifest at the root of the binaries filesystem.
+const manifestFile = "manifest.json"
+
+// manifest describes the versions in the binaries filesystem. This allows setting the latest version
+// and attaching metadata to a version, which directory scanning cannot do.
+type manifest struct {
+	// Latest is the version that versions.Latest will route to. If empty, there is no latest alias.
+	Latest Version `json:"latest,omitempty"`
+	// Versions are the versions to start.
+	Versions []manifestEntry `json:"versions"`
+}
+
+// manifestEntry describes a single version in the manifest.
+type manifestEntry struct {
+	// Version is the agent baker version.
+	Version Version `json:"version"`
+	// Path is the path to the agent baker binary in the binaries filesystem. If empty,
+	// this is "<Version>/agentbaker".
+	Path string `json:"path,omitempty"`
+	// MinSupported is the oldest Kubernetes version this agent baker supports. This is informational.
+	MinSupported string `json:"minSupported,omitempty"`
+	// MaxSupported is the newest Kubernetes version this agent baker supports. This is informational.
+	MaxSupported string `json:"maxSupported,omitempty"`
+	// Platform is the GOOS/GOARCH the binary is for. If empty, this is detected from the binary.
+	Platform string `json:"platform,omitempty"`
+	// Deprecated indicates the version is going to be removed.
+	Deprecated bool `json:"deprecated,omitempty"`
+	// Launch configures how the version is started.
+	Launch launchConfig `json:"launch,omitempty"`
+}
+
+// readManifest reads the manifest from rdfs. If there is no manifest, this returns nil, nil.
+func readManifest(rdfs binFS) (*manifest, error) {
+	b, err := rdfs.ReadFile(manifestFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read %s: %w", manifestFile, err)
+	}
+
+	man := &manifest{}
+	if err := json.Unmarshal(b, man); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", manifestFile, err)
+	}
+	if err := man.validate(); err != nil {
+		return nil, fmt.Errorf("%s is invalid: %w", manifestFile, err)
+	}
+	return man, nil
+}
+
+// validate validates the manifest content. It does not check the binaries exist.
+func (m *manifest) validate() error {
+	seen := map[Version]bool{}
+	for _, e := range m.Versions {
+		if err := e.Version.validate(); err != nil {
+			return fmt.Errorf("version(%s) did not validate: %w", e.Version, err)
+		}
+		if e.Version == "" || e.Version == Latest {
+			return fmt.Errorf("version(%s) is not a valid version for a manifest entry", e.Version)
+		}
+		if err := e.Launch.validate(); err != nil {
+			return fmt.Errorf("version(%s) has a bad launch config: %w", e.Version, err)
+		}
+		if e.Launch.Binary != "" {
+			return fmt.Errorf("version(%s) sets launch.binary, use path in a manifest", e.Version)
+		}
+		if seen[e.Version] {
+			return fmt.Errorf("version(%s) is listed more than once", e.Version)
+		}
+		seen[e.Version] = true
+	}
+	if m.Latest != "" && !seen[m.Latest] {
+		return fmt.Errorf("latest is set to version(%s), which is not in the manifest", m.Latest)
+	}
+	return nil
+}
+
+// extract finds the binary for every version in the manifest. Binaries are not read until the
+// version is started. It is an error for a version to be missing its binary, unless skipMissing is
+// set, in which case the version is left out.
+func (m *manifest) extract(rdfs binFS, log *slog.Logger, skipMissing bool) ([]versionPath, error) {
+	verPaths := make([]versionPath, 0, len(m.Versions))
+	for _, e := range m.Versions {
+		binPath := e.Path
+		if binPath == "" {
+			binPath = path.Join(e.Version.String(), "agentbaker")
+		}
+
+		info, err := fs.Stat(rdfs, binPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			err = &MissingBinaryError{Version: e.Version, Path: binPath}
+			if skipMissing {
+				log.Warn("skipping version", "version", e.Version, "manifest", true, "err", err)
+				continue
+			}
+			return nil, fmt.Errorf("manifest %w", err)
+		case err != nil:
+			return nil, fmt.Errorf("manifest version(%s) does not have a binary at %s: %w", e.Version, binPath, err)
+		}
+		// Helpers are next to the binary, wherever that is.
+		helpers, err := findHelpers(rdfs, path.Dir(binPath), e.Launch.Helpers)
+		if err != nil {
+			return nil, fmt.Errorf("manifest version(%s): %w", e.Version, err)
+		}
+		var plat platform
+		if e.Platform != "" {
+			plat, err = parsePlatform(e.Platform)
+			if err != nil {
+				return nil, fmt.Errorf("manifest version(%s) has a bad platform: %w", e.Version, err)
+			}
+		}
+		log.Info(
+			"version discovered",
+			"version", e.Version,
+			"size", info.Size(),
+			"manifest", true,
+			"deprecated", e.Deprecated,
+			"latest", e.Version == m.Latest,
+		)
+		if e.Deprecated {
+			log.Warn("version is deprecated", "version", e.Version)
+		}
+
+		verPaths = append(
+			verPaths,
+			versionPath{
+				version:  e.Version,
+				bin:      fsBinary{fsys: rdfs, path: binPath},
+				helpers:  helpers,
+				launch:   e.Launch,
+				platform: plat,
+				latest:   e.Version == m.Latest,
+			},
+		)
+	}
+	return verPaths, nil
+}
@@ -0,0 +1,359 @@
+package versions
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"testing/fstest"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestExtractBinariesManifest(t *testing.T) {
+	t.Parallel()
+
+	bin := &fstest.MapFile{Data: []byte("binary")}
+
+	tests := []struct {
+		name string
+		fs   fstest.MapFS
+		want []versionPath
+		err  bool
+	}{
+		{
+			name: "Valid manifest",
+			fs: fstest.MapFS{
+				manifestFile: &fstest.MapFile{
+					Data: []byte(`{
+						"latest": "1.1.0",
+						"versions": [
+							{"version": "1.0.0", "deprecated": true},
+							{"version": "1.1.0", "path": "custom/ab", "launch": {"flags": ["-debug"]}}
+						]
+					}`),
+				},
+				"1.0.0/agentbaker": bin,
+				"custom/ab":        bin,
+				// Not in the manifest, so it is ignored.
+				"2.0.0/agentbaker": bin,
+			},
+			want: []versionPath{
+				{version: "1.0.0", bin: fsBinary{path: "1.0.0/agentbaker"}},
+				{version: "1.1.0", bin: fsBinary{path: "custom/ab"}, launch: launchConfig{Flags: []string{"-debug"}}, latest: true},
+			},
+		},
+		{
+			name: "Error: Manifest references a missing binary",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"versions": [{"version": "1.0.0"}, {"version": "1.1.0"}]}`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest latest is not a listed version",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"latest": "2.0.0", "versions": [{"version": "1.0.0"}]}`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest lists a version twice",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"versions": [{"version": "1.0.0"}, {"version": "1.0.0"}]}`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest is not valid JSON",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Scanning reads launch.json",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"scheme": "https", "flags": ["-tls"]}`)},
+			},
+			want: []versionPath{
+				{version: "1.0.0", bin: fsBinary{path: "1.0.0/agentbaker"}, launch: launchConfig{Scheme: "https", Flags: []string{"-tls"}}},
+			},
+		},
+		{
+			name: "Error: launch.json has a bad scheme",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"scheme": "ftp"}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Scanning reads the endpoints in launch.json",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"endpoints": ["/getnodebootstrapdata", "/getlatestsigimageconfig"]}`)},
+			},
+			want: []versionPath{
+				{
+					version: "1.0.0",
+					bin:     fsBinary{path: "1.0.0/agentbaker"},
+					launch:  launchConfig{Endpoints: []string{"/getnodebootstrapdata", "/getlatestsigimageconfig"}},
+				},
+			},
+		},
+		{
+			name: "Error: launch.json endpoint is not a path",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"endpoints": ["getnodebootstrapdata"]}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: launch.json lists an endpoint twice",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"endpoints": ["/getnodebootstrapdata", "/getnodebootstrapdata"]}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: launch.json has empty endpoints",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"endpoints": []}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: launch.json has a bad env name",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"env": {"A=B": "c"}}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest entry has a bad scheme",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"versions": [{"version": "1.0.0", "launch": {"scheme": "ftp"}}]}`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest entry serves https over a socket",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"versions": [{"version": "1.0.0", "launch": {"scheme": "https", "socket": "/run/ab.sock"}}]}`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest entry has a relative cgroup",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"versions": [{"version": "1.0.0", "launch": {"limits": {"cgroup": "agentbaker"}}}]}`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Scanning finds the binary and helpers from launch.json",
+			fs: fstest.MapFS{
+				"1.0.0/ab":          bin,
+				"1.0.0/helper":      bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"binary": "ab", "helpers": ["helper"]}`)},
+			},
+			want: []versionPath{
+				{
+					version: "1.0.0",
+					bin:     fsBinary{path: "1.0.0/ab"},
+					helpers: []helperBin{{name: "helper", bin: fsBinary{path: "1.0.0/helper"}}},
+					launch:  launchConfig{Binary: "ab", Helpers: []string{"helper"}},
+				},
+			},
+		},
+		{
+			name: "Manifest helpers are next to the binary",
+			fs: fstest.MapFS{
+				manifestFile: &fstest.MapFile{
+					Data: []byte(`{"versions": [{"version": "1.0.0", "path": "custom/ab", "launch": {"helpers": ["helper"]}}]}`),
+				},
+				"custom/ab":     bin,
+				"custom/helper": bin,
+			},
+			want: []versionPath{
+				{
+					version: "1.0.0",
+					bin:     fsBinary{path: "custom/ab"},
+					helpers: []helperBin{{name: "helper", bin: fsBinary{path: "custom/helper"}}},
+					launch:  launchConfig{Helpers: []string{"helper"}},
+				},
+			},
+		},
+		{
+			name: "Error: launch.json lists a missing helper",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"helpers": ["helper"]}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: launch.json helper is a path",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/sub/helper":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"helpers": ["sub/helper"]}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: launch.json helper has the name of the agent baker",
+			fs: fstest.MapFS{
+				"1.0.0/ab":          bin,
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"binary": "ab", "helpers": ["agentbaker"]}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: launch.json binary is missing",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"binary": "ab"}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: launch.json has a bad port",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker":  bin,
+				"1.0.0/launch.json": &fstest.MapFile{Data: []byte(`{"port": 70000}`)},
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest version is a path",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"versions": [{"version": "../../evil", "path": "1.0.0/agentbaker"}]}`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest version is absolute",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"versions": [{"version": "/tmp/evil", "path": "1.0.0/agentbaker"}]}`)},
+				"1.0.0/agentbaker": bin,
+			},
+			err: true,
+		},
+		{
+			name: "Error: Manifest entry sets binary",
+			fs: fstest.MapFS{
+				manifestFile:       &fstest.MapFile{Data: []byte(`{"versions": [{"version": "1.0.0", "launch": {"binary": "ab"}}]}`)},
+				"1.0.0/agentbaker": bin,
+				"1.0.0/ab":         bin,
+			},
+			err: true,
+		},
+		{
+			name: "No manifest falls back to scanning",
+			fs: fstest.MapFS{
+				"1.0.0/agentbaker": bin,
+				"1.1.0/agentbaker": bin,
+			},
+			want: []versionPath{
+				{version: "1.0.0", bin: fsBinary{path: "1.0.0/agentbaker"}},
+				{version: "1.1.0", bin: fsBinary{path: "1.1.0/agentbaker"}},
+			},
+		},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, test := range tests {
+		got, err := extractBinaries(test.fs, log, false)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestExtractBinariesManifest(%s): got err == nil, want err != nil", test.name)
+			continue
+		case !test.err && err != nil:
+			t.Errorf("TestExtractBinariesManifest(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+
+		// Binaries are read lazily from the filesystem they were found in.
+		for i, vp := range test.want {
+			if b, ok := vp.bin.(fsBinary); ok {
+				b.fsys = test.fs
+				test.want[i].bin = b
+			}
+			for j, h := range vp.helpers {
+				if b, ok := h.bin.(fsBinary); ok {
+					b.fsys = test.fs
+					test.want[i].helpers[j].bin = b
+				}
+			}
+		}
+		if diff := pretty.Compare(test.want, got); diff != "" {
+			t.Errorf("TestExtractBinariesManifest(%s): -want/+got:\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestNewMappingLatest(t *testing.T) {
+	t.Parallel()
+
+	m := newMapping(
+		[]versionPath{
+			{version: "1.0.0", addrs: []string{"http://localhost:8080"}},
+			{version: "1.1.0", addrs: []string{"http://localhost:8081"}, latest: true},
+		},
+	)
+	if got := m.Base(Latest); got != "http://localhost:8081" {
+		t.Errorf("TestNewMappingLatest: got latest base %s, want http://localhost:8081", got)
+	}
+}
+
+func TestMappingSupports(t *testing.T) {
+	t.Parallel()
+
+	m := newMapping(
+		[]versionPath{
+			{version: "1.0.0", addrs: []string{"http://localhost:8080"}},
+			{
+				version: "1.1.0",
+				addrs:   []string{"http://localhost:8081"},
+				launch:  launchConfig{Endpoints: []string{"/getnodebootstrapdata", "/getlatestsigimageconfig"}},
+				latest:  true,
+			},
+		},
+	)
+
+	tests := []struct {
+		name     string
+		version  Version
+		endpoint string
+		want     bool
+	}{
+		{name: "Version without endpoints serves everything", version: "1.0.0", endpoint: "/getdistrosigimageconfig", want: true},
+		{name: "Listed endpoint", version: "1.1.0", endpoint: "/getlatestsigimageconfig", want: true},
+		{name: "Endpoint that isn't listed", version: "1.1.0", endpoint: "/getdistrosigimageconfig", want: false},
+		{name: "Latest has the endpoints of its version", version: Latest, endpoint: "/getdistrosigimageconfig", want: false},
+		{name: "Unknown version", version: "2.0.0", endpoint: "/getdistrosigimageconfig", want: true},
+	}
+
+	for _, test := range tests {
+		if got := m.Supports(test.version, test.endpoint); got != test.want {
+			t.Errorf("TestMappingSupports(%s): got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
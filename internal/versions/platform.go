@@ -0,0 +1,186 @@
+package versions
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// platformFile is the name of an optional file next to an agent baker binary that declares the
+// platform the binary is for, in the form "<GOOS>/<GOARCH>". If it exists, the binary is not inspected.
+const platformFile = "platform"
+
+// platform is the GOOS/GOARCH of a binary.
+type platform struct {
+	OS   string
+	Arch string
+}
+
+// String returns the platform in "GOOS/GOARCH" form.
+func (p platform) String() string {
+	return p.OS + "/" + p.Arch
+}
+
+// parsePlatform parses a platform in the "GOOS/GOARCH" form.
+func parsePlatform(s string) (platform, error) {
+	goos, goarch, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok || goos == "" || goarch == "" {
+		return platform{}, fmt.Errorf("platform(%s) must be in the form GOOS/GOARCH", s)
+	}
+	return platform{OS: goos, Arch: goarch}, nil
+}
+
+// checkPlatform returns an error if the binary for vp cannot run on host. If vp has a declared
+// platform, that is used. Otherwise the binary's headers are inspected. Scripts are assumed to be runnable.
+func checkPlatform(vp versionPath, host platform) error {
+	plats := []platform{vp.platform}
+	if vp.platform == (platform{}) {
+		r, err := vp.bin.open()
+		if err != nil {
+			return fmt.Errorf("%w: binary for version(%s) could not be opened: %w", ErrExtract, vp.version, err)
+		}
+		defer r.Close()
+
+		ra, ok := r.(io.ReaderAt)
+		if !ok {
+			// Without random access, the headers can only be inspected by reading the binary in.
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("%w: binary for version(%s) could not be read: %w", ErrExtract, vp.version, err)
+			}
+			ra = bytes.NewReader(b)
+		}
+
+		magic := make([]byte, 2)
+		if _, err := ra.ReadAt(magic, 0); err == nil && string(magic) == "#!" {
+			return nil
+		}
+
+		plats, err = binaryPlatforms(ra)
+		if err != nil {
+			return fmt.Errorf("%w: binary for version(%s) could not be checked: %w", ErrSpawn, vp.version, err)
+		}
+	}
+
+	// A universal Mach-O binary runs on any of the platforms it has.
+	if slices.Contains(plats, host) {
+		return nil
+	}
+	names := make([]string, 0, len(plats))
+	for _, p := range plats {
+		names = append(names, p.String())
+	}
+	return fmt.Errorf("%w: binary for version(%s) targets %s but host is %s", ErrSpawn, vp.version, strings.Join(names, ", "), host)
+}
+
+// binaryPlatforms detects the platforms of an ELF, Mach-O or PE binary. Only a universal Mach-O
+// binary has more than one.
+func binaryPlatforms(r io.ReaderAt) ([]platform, error) {
+	if f, err := elf.NewFile(r); err == nil {
+		target := elfTarget{Machine: f.Machine, Class: f.Class, Data: f.Data}
+		return []platform{{OS: elfOS(f), Arch: archName(elfArch, target)}}, nil
+	}
+	if f, err := macho.NewFile(r); err == nil {
+		return []platform{{OS: "darwin", Arch: archName(machoArch, f.Cpu)}}, nil
+	}
+	if f, err := macho.NewFatFile(r); err == nil {
+		plats := make([]platform, 0, len(f.Arches))
+		for _, a := range f.Arches {
+			plats = append(plats, platform{OS: "darwin", Arch: archName(machoArch, a.Cpu)})
+		}
+		return plats, nil
+	}
+	if f, err := pe.NewFile(r); err == nil {
+		return []platform{{OS: "windows", Arch: archName(peArch, f.Machine)}}, nil
+	}
+	return nil, fmt.Errorf("not an ELF, Mach-O or PE binary")
+}
+
+// elfOS returns the GOOS of f. Linux, NetBSD and OpenBSD binaries all have the SYSV OS ABI, so a
+// binary with it is only for Linux if it doesn't have the note section a BSD marks its binaries with.
+func elfOS(f *elf.File) string {
+	switch f.OSABI {
+	case elf.ELFOSABI_NONE:
+		for _, sec := range f.Sections {
+			if goos, ok := elfNoteOS[sec.Name]; ok {
+				return goos
+			}
+		}
+		return "linux"
+	case elf.ELFOSABI_LINUX:
+		return "linux"
+	}
+	return archName(elfOSABI, f.OSABI)
+}
+
+// elfNoteOS maps the note sections that BSDs mark their binaries with to the GOOS.
+var elfNoteOS = map[string]string{
+	".note.netbsd.ident":  "netbsd",
+	".note.openbsd.ident": "openbsd",
+	".note.tag":           "freebsd",
+}
+
+// elfOSABI maps the OS ABIs of ELF binaries that are not SYSV or Linux to the GOOS.
+var elfOSABI = map[elf.OSABI]string{
+	elf.ELFOSABI_FREEBSD: "freebsd",
+	elf.ELFOSABI_NETBSD:  "netbsd",
+	elf.ELFOSABI_OPENBSD: "openbsd",
+	elf.ELFOSABI_SOLARIS: "solaris",
+}
+
+// archName returns the GOARCH for machine. If we don't know the machine, it returns a
+// description of it instead.
+func archName[K comparable](m map[K]string, machine K) string {
+	if arch, ok := m[machine]; ok {
+		return arch
+	}
+	return fmt.Sprintf("unknown(%v)", machine)
+}
+
+// elfTarget is what an ELF binary runs on. The machine alone doesn't say, as some machines are
+// used for both 32 and 64 bit or both byte orders, such as ppc64 and ppc64le.
+type elfTarget struct {
+	Machine elf.Machine
+	Class   elf.Class
+	Data    elf.Data
+}
+
+// String implements fmt.Stringer.
+func (e elfTarget) String() string {
+	return fmt.Sprintf("%s %s %s", e.Machine, e.Class, e.Data)
+}
+
+var elfArch = map[elfTarget]string{
+	{elf.EM_X86_64, elf.ELFCLASS64, elf.ELFDATA2LSB}:    "amd64",
+	{elf.EM_AARCH64, elf.ELFCLASS64, elf.ELFDATA2LSB}:   "arm64",
+	{elf.EM_386, elf.ELFCLASS32, elf.ELFDATA2LSB}:       "386",
+	{elf.EM_ARM, elf.ELFCLASS32, elf.ELFDATA2LSB}:       "arm",
+	{elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2MSB}:     "ppc64",
+	{elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2LSB}:     "ppc64le",
+	{elf.EM_S390, elf.ELFCLASS64, elf.ELFDATA2MSB}:      "s390x",
+	{elf.EM_RISCV, elf.ELFCLASS64, elf.ELFDATA2LSB}:     "riscv64",
+	{elf.EM_MIPS, elf.ELFCLASS32, elf.ELFDATA2MSB}:      "mips",
+	{elf.EM_MIPS, elf.ELFCLASS32, elf.ELFDATA2LSB}:      "mipsle",
+	{elf.EM_MIPS, elf.ELFCLASS64, elf.ELFDATA2MSB}:      "mips64",
+	{elf.EM_MIPS, elf.ELFCLASS64, elf.ELFDATA2LSB}:      "mips64le",
+	{elf.EM_LOONGARCH, elf.ELFCLASS64, elf.ELFDATA2LSB}: "loong64",
+}
+
+var machoArch = map[macho.Cpu]string{
+	macho.CpuAmd64: "amd64",
+	macho.CpuArm64: "arm64",
+	macho.Cpu386:   "386",
+	macho.CpuArm:   "arm",
+}
+
+var peArch = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+	pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+	pe.IMAGE_FILE_MACHINE_I386:  "386",
+	pe.IMAGE_FILE_MACHINE_ARMNT: "arm",
+}
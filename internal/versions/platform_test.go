@@ -0,0 +1,305 @@
+package versions
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeELF returns the header of a little-endian, 64 bit Linux ELF binary for machine.
+func fakeELF(t *testing.T, machine elf.Machine) []byte {
+	t.Helper()
+
+	return fakeELFFile(t, elfFile{machine: machine, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB})
+}
+
+// elfFile describes a fake ELF binary.
+type elfFile struct {
+	machine elf.Machine
+	class   elf.Class
+	data    elf.Data
+	osabi   elf.OSABI
+	// sections are the names of empty sections in the binary.
+	sections []string
+}
+
+// fakeELFFile returns an ELF binary with the headers of f and its sections.
+func fakeELFFile(t *testing.T, f elfFile) []byte {
+	t.Helper()
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if f.data == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+
+	// The section names follow the file header, then come the section headers: the null section,
+	// f.sections and the section of the names.
+	names := []byte{0}
+	nameOffs := make([]uint32, 0, len(f.sections)+1)
+	for _, name := range append(f.sections, ".shstrtab") {
+		nameOffs = append(nameOffs, uint32(len(names)))
+		names = append(names, name+"\x00"...)
+	}
+	hdrSize, secSize := 64, 64
+	if f.class == elf.ELFCLASS32 {
+		hdrSize, secSize = 52, 40
+	}
+	shoff := hdrSize + len(names)
+	shnum := len(nameOffs) + 1
+
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(f.class)
+	ident[elf.EI_DATA] = byte(f.data)
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	ident[elf.EI_OSABI] = byte(f.osabi)
+
+	buf := &bytes.Buffer{}
+	write := func(v any) {
+		if err := binary.Write(buf, order, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.class == elf.ELFCLASS32 {
+		write(elf.Header32{
+			Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(f.machine), Version: uint32(elf.EV_CURRENT),
+			Shoff: uint32(shoff), Ehsize: uint16(hdrSize), Phentsize: 32, Shentsize: uint16(secSize),
+			Shnum: uint16(shnum), Shstrndx: uint16(shnum - 1),
+		})
+	} else {
+		write(elf.Header64{
+			Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(f.machine), Version: uint32(elf.EV_CURRENT),
+			Shoff: uint64(shoff), Ehsize: uint16(hdrSize), Phentsize: 56, Shentsize: uint16(secSize),
+			Shnum: uint16(shnum), Shstrndx: uint16(shnum - 1),
+		})
+	}
+	buf.Write(names)
+
+	buf.Write(make([]byte, secSize))
+	for i, off := range nameOffs {
+		typ, size := elf.SHT_NOTE, 0
+		if i == len(nameOffs)-1 {
+			typ, size = elf.SHT_STRTAB, len(names)
+		}
+		if f.class == elf.ELFCLASS32 {
+			write(elf.Section32{Name: off, Type: uint32(typ), Off: uint32(hdrSize), Size: uint32(size)})
+		} else {
+			write(elf.Section64{Name: off, Type: uint32(typ), Off: uint64(hdrSize), Size: uint64(size)})
+		}
+	}
+	return buf.Bytes()
+}
+
+// fakeMachO returns the header of a Mach-O binary for cpu.
+func fakeMachO(t *testing.T, cpu macho.Cpu) []byte {
+	t.Helper()
+
+	h := macho.FileHeader{Magic: macho.Magic64, Cpu: cpu, Type: macho.TypeExec}
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(make([]byte, 4)) // Reserved field of 64 bit headers.
+	return buf.Bytes()
+}
+
+// fakeFatMachO returns a universal Mach-O binary with a binary for each of cpus.
+func fakeFatMachO(t *testing.T, cpus ...macho.Cpu) []byte {
+	t.Helper()
+
+	const align = 12
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, []uint32{macho.MagicFat, uint32(len(cpus))})
+	var bins [][]byte
+	off := uint32(1 << align)
+	for _, cpu := range cpus {
+		b := fakeMachO(t, cpu)
+		bins = append(bins, b)
+		h := macho.FatArchHeader{Cpu: cpu, Offset: off, Size: uint32(len(b)), Align: align}
+		if err := binary.Write(buf, binary.BigEndian, h); err != nil {
+			t.Fatal(err)
+		}
+		off += 1 << align
+	}
+	for _, b := range bins {
+		buf.Write(make([]byte, 1<<align-buf.Len()%(1<<align)))
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+// fakePE returns the header of a PE binary for machine.
+func fakePE(t *testing.T, machine uint16) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	if err := binary.Write(buf, binary.LittleEndian, pe.FileHeader{Machine: machine}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(make([]byte, 64)) // The reader expects the file to continue past the header.
+	return buf.Bytes()
+}
+
+func TestCheckPlatform(t *testing.T) {
+	t.Parallel()
+
+	linuxAMD64 := platform{OS: "linux", Arch: "amd64"}
+
+	tests := []struct {
+		name    string
+		vp      versionPath
+		host    platform
+		wantErr string
+	}{
+		{
+			name: "ELF binary matches host",
+			vp:   versionPath{version: "1.0.0", bin: memBinary(fakeELF(t, elf.EM_X86_64))},
+			host: linuxAMD64,
+		},
+		{
+			name:    "Error: ELF binary for another arch",
+			vp:      versionPath{version: "1.0.0", bin: memBinary(fakeELF(t, elf.EM_AARCH64))},
+			host:    linuxAMD64,
+			wantErr: "binary for version(1.0.0) targets linux/arm64 but host is linux/amd64",
+		},
+		{
+			name:    "Error: Mach-O binary on linux",
+			vp:      versionPath{version: "1.0.0", bin: memBinary(fakeMachO(t, macho.CpuArm64))},
+			host:    linuxAMD64,
+			wantErr: "binary for version(1.0.0) targets darwin/arm64 but host is linux/amd64",
+		},
+		{
+			name: "Mach-O binary matches host",
+			vp:   versionPath{version: "1.0.0", bin: memBinary(fakeMachO(t, macho.CpuArm64))},
+			host: platform{OS: "darwin", Arch: "arm64"},
+		},
+		{
+			name: "Big-endian ppc64",
+			vp: versionPath{
+				version: "1.0.0",
+				bin:     memBinary(fakeELFFile(t, elfFile{machine: elf.EM_PPC64, class: elf.ELFCLASS64, data: elf.ELFDATA2MSB})),
+			},
+			host: platform{OS: "linux", Arch: "ppc64"},
+		},
+		{
+			name:    "Error: Little-endian ppc64le on ppc64",
+			vp:      versionPath{version: "1.0.0", bin: memBinary(fakeELF(t, elf.EM_PPC64))},
+			host:    platform{OS: "linux", Arch: "ppc64"},
+			wantErr: "targets linux/ppc64le but host is linux/ppc64",
+		},
+		{
+			name: "Error: 32 bit riscv",
+			vp: versionPath{
+				version: "1.0.0",
+				bin:     memBinary(fakeELFFile(t, elfFile{machine: elf.EM_RISCV, class: elf.ELFCLASS32, data: elf.ELFDATA2LSB})),
+			},
+			host:    platform{OS: "linux", Arch: "riscv64"},
+			wantErr: "targets linux/unknown(EM_RISCV ELFCLASS32 ELFDATA2LSB)",
+		},
+		{
+			name: "Error: NetBSD binary with the SYSV OS ABI on linux",
+			vp: versionPath{
+				version: "1.0.0",
+				bin:     memBinary(fakeELFFile(t, elfFile{machine: elf.EM_X86_64, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, sections: []string{".note.netbsd.ident"}})),
+			},
+			host:    linuxAMD64,
+			wantErr: "targets netbsd/amd64 but host is linux/amd64",
+		},
+		{
+			name: "Error: FreeBSD binary on linux",
+			vp: versionPath{
+				version: "1.0.0",
+				bin:     memBinary(fakeELFFile(t, elfFile{machine: elf.EM_X86_64, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, osabi: elf.ELFOSABI_FREEBSD})),
+			},
+			host:    linuxAMD64,
+			wantErr: "targets freebsd/amd64 but host is linux/amd64",
+		},
+		{
+			name: "Linux binary with sections",
+			vp: versionPath{
+				version: "1.0.0",
+				bin:     memBinary(fakeELFFile(t, elfFile{machine: elf.EM_X86_64, class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, sections: []string{".note.go.buildid"}})),
+			},
+			host: linuxAMD64,
+		},
+		{
+			name: "Universal Mach-O binary has the host",
+			vp:   versionPath{version: "1.0.0", bin: memBinary(fakeFatMachO(t, macho.CpuAmd64, macho.CpuArm64))},
+			host: platform{OS: "darwin", Arch: "arm64"},
+		},
+		{
+			name:    "Error: Universal Mach-O binary without the host",
+			vp:      versionPath{version: "1.0.0", bin: memBinary(fakeFatMachO(t, macho.CpuAmd64, macho.Cpu386))},
+			host:    platform{OS: "darwin", Arch: "arm64"},
+			wantErr: "targets darwin/amd64, darwin/386 but host is darwin/arm64",
+		},
+		{
+			name:    "Error: PE binary on linux",
+			vp:      versionPath{version: "1.0.0", bin: memBinary(fakePE(t, pe.IMAGE_FILE_MACHINE_AMD64))},
+			host:    linuxAMD64,
+			wantErr: "binary for version(1.0.0) targets windows/amd64 but host is linux/amd64",
+		},
+		{
+			name:    "Error: Declared platform does not match",
+			vp:      versionPath{version: "1.0.0", bin: memBinary("anything"), platform: platform{OS: "darwin", Arch: "amd64"}},
+			host:    linuxAMD64,
+			wantErr: "binary for version(1.0.0) targets darwin/amd64 but host is linux/amd64",
+		},
+		{
+			name: "Declared platform is used instead of the binary",
+			vp:   versionPath{version: "1.0.0", bin: memBinary(fakeELF(t, elf.EM_AARCH64)), platform: linuxAMD64},
+			host: linuxAMD64,
+		},
+		{
+			name: "Scripts are not checked",
+			vp:   versionPath{version: "1.0.0", bin: memBinary("#!/bin/sh\nexit 0\n")},
+			host: linuxAMD64,
+		},
+		{
+			name:    "Error: Unknown binary format",
+			vp:      versionPath{version: "1.0.0", bin: memBinary("garbage")},
+			host:    linuxAMD64,
+			wantErr: "not an ELF, Mach-O or PE binary",
+		},
+	}
+
+	for _, test := range tests {
+		err := checkPlatform(test.vp, test.host)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("TestCheckPlatform(%s): got err == %s, want err == nil", test.name, err)
+		case test.wantErr != "" && err == nil:
+			t.Errorf("TestCheckPlatform(%s): got err == nil, want err containing %q", test.name, test.wantErr)
+		case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+			t.Errorf("TestCheckPlatform(%s): got err == %s, want err containing %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestCheckPlatformHost(t *testing.T) {
+	t.Parallel()
+
+	// The test binary was built for this host, so it must pass.
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skipf("cannot find the test binary: %s", err)
+	}
+
+	// Only the headers are read, as they would be from the embedded filesystem.
+	vp := versionPath{version: "1.0.0", bin: fsBinary{fsys: os.DirFS(filepath.Dir(exe)), path: filepath.Base(exe)}}
+	if err := checkPlatform(vp, platform{OS: runtime.GOOS, Arch: runtime.GOARCH}); err != nil {
+		t.Errorf("TestCheckPlatformHost: got err == %s, want err == nil", err)
+	}
+}
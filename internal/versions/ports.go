@@ -0,0 +1,201 @@
+package versions
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// firstPort is the first port handed out when ports are not stable.
+const firstPort = 8080
+
+// maxPort is the highest TCP port.
+const maxPort = 65535
+
+// WithStablePorts gives every replica a port that only depends on base, the sorted position of its
+// version among the versions being started and WithReplicas(). The first replica of the lowest version
+// gets base, its next replica base+1 and so on. So a version keeps its ports between restarts as long
+// as the same versions are started. A version with a port in its launch config uses that instead.
+// If a port is in use, a free port is used instead and a warning is logged.
+// Without this, ports are handed out from 8080 in the order replicas are started.
+func WithStablePorts(base int) Option {
+	return func(o *options) error {
+		if base < 1 || base > maxPort {
+			return fmt.Errorf("stable ports base(%d) must be between 1 and %d", base, maxPort)
+		}
+		o.basePort = int32(base)
+		return nil
+	}
+}
+
+// portPicker hands out the port each replica is started on.
+type portPicker struct {
+	// base is from WithStablePorts(). If 0, ports are handed out from next.
+	base     int32
+	replicas int
+	// index is the sorted position of each version.
+	index map[Version]int
+	next  atomic.Int32
+	// skipBusy skips ports that are in use when ports are handed out from next.
+	skipBusy bool
+	log      *slog.Logger
+}
+
+// newPortPicker returns a portPicker for verPaths.
+func newPortPicker(verPaths []versionPath, opts options) *portPicker {
+	vers := make([]Version, 0, len(verPaths))
+	for _, vp := range verPaths {
+		vers = append(vers, vp.version)
+	}
+	sort.Slice(vers, func(i, j int) bool { return vers[i].Less(vers[j]) })
+
+	p := &portPicker{
+		base:     opts.basePort,
+		replicas: opts.replicas,
+		index:    make(map[Version]int, len(vers)),
+		skipBusy: opts.skipBusyPorts,
+		log:      opts.log,
+	}
+	for i, v := range vers {
+		p.index[v] = i
+	}
+	p.next.Store(firstPort)
+	return p
+}
+
+// Ports returns the ports on this host that the agent bakers in infos, which must come from Discover(),
+// are started on with options, sorted. Agent bakers on a unix socket or another host have none. A port
+// that is in use when its agent baker starts is swapped for a free one, so these are the ports that
+// are asked for, which is what something else listening here must avoid.
+func Ports(infos []VersionInfo, options ...Option) ([]int, error) {
+	opts, err := newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	verPaths := make([]versionPath, 0, len(infos))
+	for _, info := range infos {
+		verPaths = append(verPaths, info.vp)
+	}
+	p := newPortPicker(verPaths, opts)
+	if err := p.validate(verPaths); err != nil {
+		return nil, err
+	}
+
+	var ports []int
+	for _, vp := range verPaths {
+		if vp.launch.Socket != "" || vp.launch.Host != "" {
+			continue
+		}
+		for r := 0; r < p.replicas; r++ {
+			want, ok := p.want(vp, r)
+			if !ok {
+				// Ports handed out in start order are the same set whatever the order.
+				want = p.next.Add(1) - 1
+				if want > maxPort {
+					return nil, fmt.Errorf("version(%s) has no port left, ports are handed out from %d and must be %d or below", vp.version, firstPort, maxPort)
+				}
+			}
+			ports = append(ports, int(want))
+		}
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// want returns the port replica r of vp asks for. ok is false if its port is handed out in start order.
+func (p *portPicker) want(vp versionPath, r int) (port int32, ok bool) {
+	switch {
+	case vp.launch.Port != 0:
+		return int32(vp.launch.Port + r), true
+	case p.base != 0:
+		return p.base + int32(p.index[vp.version]*p.replicas+r), true
+	}
+	return 0, false
+}
+
+// validate returns an error if a replica of a version in verPaths would ask for a port above 65535, or
+// if two versions that listen here would ask for the same port, such as a version with a port in its launch
+// config and the stable ports of another version. Ports handed out in start order are checked by port().
+func (p *portPicker) validate(verPaths []versionPath) error {
+	type portRange struct {
+		version     Version
+		first, last int32
+	}
+
+	var ranges []portRange
+	for _, vp := range verPaths {
+		first, ok := p.want(vp, 0)
+		if !ok {
+			continue
+		}
+		last, _ := p.want(vp, p.replicas-1)
+		if last > maxPort {
+			return fmt.Errorf("version(%s) would use ports %d to %d for %d replicas, ports must be %d or below", vp.version, first, last, p.replicas, maxPort)
+		}
+		// Agent bakers on a unix socket or another host don't take a port here.
+		if vp.launch.Socket != "" || vp.launch.Host != "" {
+			continue
+		}
+		for _, pr := range ranges {
+			if first <= pr.last && pr.first <= last {
+				return fmt.Errorf("version(%s) would use ports %d to %d, which overlap ports %d to %d of version(%s)", vp.version, first, last, pr.first, pr.last, pr.version)
+			}
+		}
+		ranges = append(ranges, portRange{version: vp.version, first: first, last: last})
+	}
+	return nil
+}
+
+// port returns the port for replica r of vp. It returns an error if the port handed out in start order
+// is above 65535, as validate() can't know those ahead of time.
+func (p *portPicker) port(vp versionPath, r int) (int32, error) {
+	want, ok := p.want(vp, r)
+	if !ok {
+		for {
+			port := p.next.Add(1) - 1
+			if port > maxPort {
+				return 0, fmt.Errorf("version(%s) has no port left, ports are handed out from %d and must be %d or below", vp.version, firstPort, maxPort)
+			}
+			if !p.skipBusy || port == maxPort || portFree(port) {
+				return port, nil
+			}
+		}
+	}
+
+	// We can only tell if a port is taken if the agent baker listens on it here.
+	if vp.launch.Socket != "" || vp.launch.Host != "" || portFree(want) {
+		return want, nil
+	}
+	got, err := freePort()
+	if err != nil {
+		p.log.Warn("port is in use and there is no free port, using it anyway", "version", vp.version, "port", want, "err", err)
+		return want, nil
+	}
+	p.log.Warn("port is in use, using a free port instead", "version", vp.version, "port", want, "freePort", got)
+	return got, nil
+}
+
+// portFree reports if nothing is listening on port on localhost. Something could start listening
+// on it before the agent baker does, which the agent baker failing to start tells us.
+func portFree(port int32) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(int(port))))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// freePort returns a port on localhost that nothing is listening on.
+func freePort() (int32, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return int32(l.Addr().(*net.TCPAddr).Port), nil
+}
@@ -0,0 +1,273 @@
+package versions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// portRecorder returns an Option that starts versions by recording the ports they are given.
+func portRecorder(mu *sync.Mutex, ports map[Version][]int32) Option {
+	return func(o *options) error {
+		o.start = func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			ports[vp.version] = append(ports[vp.version], port)
+			return fmt.Sprintf("http://localhost:%d", port), nil, nil
+		}
+		return nil
+	}
+}
+
+// freePorts returns the first of n free ports in a row. They are below the ephemeral range that
+// freePort() picks from, so the outgoing connections of other tests can't take them.
+func freePorts(t *testing.T, n int32) int32 {
+	t.Helper()
+
+next:
+	for base := int32(20000); base < 32000; base += n {
+		for p := base; p < base+n; p++ {
+			l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", p))
+			if err != nil {
+				continue next
+			}
+			l.Close()
+		}
+		return base
+	}
+	t.Fatalf("could not find %d free ports in a row", n)
+	return 0
+}
+
+func TestWithStablePorts(t *testing.T) {
+	t.Parallel()
+
+	base := freePorts(t, 6)
+
+	// The versions are found in a different order each time, which must not change their ports.
+	orders := [][]versionPath{
+		{{version: "1.0.0"}, {version: "1.1.0"}, {version: "2.0.0"}},
+		{{version: "2.0.0"}, {version: "1.0.0"}, {version: "1.1.0"}},
+	}
+
+	var got []map[Version][]int32
+	for _, verPaths := range orders {
+		mu := sync.Mutex{}
+		ports := map[Version][]int32{}
+		_, err := New(
+			context.Background(),
+			WithDiscoverer(fakeDiscoverer{verPaths: verPaths}),
+			WithStablePorts(int(base)),
+			WithReplicas(2),
+			WithConcurrency(3),
+			portRecorder(&mu, ports),
+		)
+		if err != nil {
+			t.Fatalf("TestWithStablePorts: got err == %s, want err == nil", err)
+		}
+		got = append(got, ports)
+	}
+
+	want := map[Version][]int32{
+		"1.0.0": {base, base + 1},
+		"1.1.0": {base + 2, base + 3},
+		"2.0.0": {base + 4, base + 5},
+	}
+	for i, ports := range got {
+		if diff := pretty.Compare(want, ports); diff != "" {
+			t.Errorf("TestWithStablePorts(call %d): -want/+got:\n%s", i, diff)
+		}
+	}
+}
+
+func TestWithStablePortsBadBase(t *testing.T) {
+	t.Parallel()
+
+	for _, base := range []int{0, 65536} {
+		if _, err := newOptions([]Option{WithStablePorts(base)}); err == nil {
+			t.Errorf("TestWithStablePortsBadBase(%d): got err == nil, want err != nil", base)
+		}
+	}
+}
+
+func TestPortPicker(t *testing.T) {
+	t.Parallel()
+
+	// A port something is already listening on.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	taken := int32(l.Addr().(*net.TCPAddr).Port)
+	free, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tests := []struct {
+		name  string
+		base  int32
+		vp    versionPath
+		want  int32
+		avoid int32
+	}{
+		{name: "Sequential", vp: versionPath{version: "1.0.0"}, want: firstPort},
+		{name: "Stable", base: free, vp: versionPath{version: "1.0.0"}, want: free},
+		{name: "Launch config port wins", base: 40000, vp: versionPath{version: "1.0.0", launch: launchConfig{Port: int(free)}}, want: free},
+		{name: "Port in use falls back to a free port", base: taken, vp: versionPath{version: "1.0.0"}, avoid: taken},
+		{
+			name: "Port on another host is not checked",
+			base: taken,
+			vp:   versionPath{version: "1.0.0", launch: launchConfig{Host: "10.0.0.5"}},
+			want: taken,
+		},
+	}
+
+	for _, test := range tests {
+		p := newPortPicker([]versionPath{test.vp}, options{basePort: test.base, replicas: 1, log: log})
+		got, err := p.port(test.vp, 0)
+		if err != nil {
+			t.Errorf("TestPortPicker(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+		switch {
+		case test.avoid != 0 && got == test.avoid:
+			t.Errorf("TestPortPicker(%s): got port %d, which is in use", test.name, got)
+		case test.avoid == 0 && got != test.want:
+			t.Errorf("TestPortPicker(%s): got port %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPortPickerSkipBusy(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	busy := int32(l.Addr().(*net.TCPAddr).Port)
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	vp := versionPath{version: "1.0.0"}
+	for _, skip := range []bool{false, true} {
+		p := newPortPicker([]versionPath{vp}, options{replicas: 1, skipBusyPorts: skip, log: log})
+		p.next.Store(busy)
+		got, err := p.port(vp, 0)
+		if err != nil {
+			t.Fatalf("TestPortPickerSkipBusy(skip == %v): got err == %s, want err == nil", skip, err)
+		}
+		if (got == busy) == skip {
+			t.Errorf("TestPortPickerSkipBusy(skip == %v): got port %d, busy port is %d", skip, got, busy)
+		}
+	}
+}
+
+func TestPorts(t *testing.T) {
+	t.Parallel()
+
+	verPaths := []versionPath{
+		{version: "2.0.0"},
+		{version: "1.0.0"},
+		{version: "1.1.0", launch: launchConfig{Port: 9000}},
+		{version: "1.2.0", launch: launchConfig{Socket: "ab.sock"}},
+		{version: "1.3.0", launch: launchConfig{Host: "10.0.0.5"}},
+	}
+
+	tests := []struct {
+		name    string
+		options []Option
+		want    []int
+	}{
+		{name: "Sequential", want: []int{firstPort, firstPort + 1, 9000}},
+		{name: "Sequential with replicas", options: []Option{WithReplicas(2)}, want: []int{firstPort, firstPort + 1, firstPort + 2, firstPort + 3, 9000, 9001}},
+		{name: "Stable", options: []Option{WithStablePorts(40000)}, want: []int{9000, 40000, 40004}},
+	}
+
+	for _, test := range tests {
+		options := append([]Option{WithDiscoverer(fakeDiscoverer{verPaths: verPaths})}, test.options...)
+		infos, err := Discover(context.Background(), options...)
+		if err != nil {
+			t.Fatalf("TestPorts(%s): %s", test.name, err)
+		}
+		got, err := Ports(infos, options...)
+		if err != nil {
+			t.Errorf("TestPorts(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+		if diff := pretty.Compare(test.want, got); diff != "" {
+			t.Errorf("TestPorts(%s): -want/+got:\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestPortsErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		verPaths []versionPath
+		options  []Option
+	}{
+		{
+			name:     "Error: Launch config port with replicas past 65535",
+			verPaths: []versionPath{{version: "1.0.0", launch: launchConfig{Port: 65535}}},
+			options:  []Option{WithReplicas(2)},
+		},
+		{
+			name:     "Error: Stable ports past 65535",
+			verPaths: []versionPath{{version: "1.0.0"}, {version: "1.1.0"}, {version: "1.2.0"}},
+			options:  []Option{WithStablePorts(65534)},
+		},
+		{
+			name:     "Error: Launch config port in the stable ports of another version",
+			verPaths: []versionPath{{version: "1.0.0"}, {version: "1.1.0", launch: launchConfig{Port: 40001}}},
+			options:  []Option{WithStablePorts(40000), WithReplicas(2)},
+		},
+		{
+			name:     "Error: Launch config ports that overlap",
+			verPaths: []versionPath{{version: "1.0.0", launch: launchConfig{Port: 9000}}, {version: "1.1.0", launch: launchConfig{Port: 9001}}},
+			options:  []Option{WithReplicas(2)},
+		},
+	}
+
+	for _, test := range tests {
+		options := append([]Option{WithDiscoverer(fakeDiscoverer{verPaths: test.verPaths})}, test.options...)
+		infos, err := Discover(context.Background(), options...)
+		if err != nil {
+			t.Fatalf("TestPortsErrors(%s): %s", test.name, err)
+		}
+		if _, err := Ports(infos, options...); err == nil {
+			t.Errorf("TestPortsErrors(%s): got err == nil, want err != nil", test.name)
+		}
+		// Nothing is started with ports that can't work.
+		mu := sync.Mutex{}
+		started := map[Version][]int32{}
+		if _, err := New(context.Background(), append(options, portRecorder(&mu, started))...); !errors.Is(err, ErrSpawn) {
+			t.Errorf("TestPortsErrors(%s): got err == %v from New(), want an error that is %v", test.name, err, ErrSpawn)
+		}
+		if len(started) != 0 {
+			t.Errorf("TestPortsErrors(%s): started versions %v, want none", test.name, started)
+		}
+	}
+
+	// Ports handed out in start order can run out too.
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	vp := versionPath{version: "1.0.0"}
+	p := newPortPicker([]versionPath{vp}, options{replicas: 1, log: log})
+	p.next.Store(maxPort + 1)
+	if _, err := p.port(vp, 0); err == nil {
+		t.Errorf("TestPortsErrors(start order): got err == nil for port %d, want err != nil", maxPort+1)
+	}
+}
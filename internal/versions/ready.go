@@ -0,0 +1,217 @@
+package versions
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/backoff"
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+	"github.com/gostdlib/concurrency/prim/wait"
+)
+
+const (
+	// readyPath is the path on an agent baker that WaitReady() probes.
+	readyPath = "/healthz"
+	// readyInterval is the longest WaitReady() waits between probes of a version that is not ready.
+	readyInterval = 250 * time.Millisecond
+	// readyProbeTimeout is how long WaitReady() waits for an agent baker to answer a probe.
+	readyProbeTimeout = 2 * time.Second
+)
+
+// readyBackoff is how long WaitReady() waits between probes. Replicas start at about the same time,
+// so the jitter keeps them from being probed in lockstep.
+var readyBackoff = &backoff.Backoff{Base: 25 * time.Millisecond, Max: readyInterval}
+
+// ReadyErrors is returned by Mapping.WaitReady() when some versions did not become ready.
+// It maps each version that is not ready to the reason.
+type ReadyErrors map[Version]error
+
+// Error implements the error interface.
+func (r ReadyErrors) Error() string {
+	vers := make([]Version, 0, len(r))
+	for v := range r {
+		vers = append(vers, v)
+	}
+	SortVersions(vers)
+
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("%d version(s) are not ready: ", len(r)))
+	for i, v := range vers {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(fmt.Sprintf("version(%s): %s", v, r[v]))
+	}
+	return b.String()
+}
+
+// Unwrap returns the errors for each version.
+func (r ReadyErrors) Unwrap() []error {
+	errs := make([]error, 0, len(r))
+	for _, err := range r {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Is makes ReadyErrors an ErrNotReady for errors.Is().
+func (r ReadyErrors) Is(target error) bool {
+	return target == ErrNotReady
+}
+
+// ProbeError is the reason a replica of a version did not become ready in WaitReady().
+type ProbeError struct {
+	// Version is the version of the replica.
+	Version Version
+	// URL is the health endpoint that was probed.
+	URL string
+	// Attempts is how many times the replica was probed.
+	Attempts int
+	// Elapsed is how long we probed the replica for.
+	Elapsed time.Duration
+	// Err is the error from the last probe.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf(
+		"version(%s) was not ready at %s after %d probes over %v, the last probe failed: %s",
+		e.Version, e.URL, e.Attempts, e.Elapsed.Round(time.Millisecond), e.Err,
+	)
+}
+
+// Unwrap returns the error from the last probe.
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// WaitReady blocks until every replica of every version answers a health probe or ctx expires.
+// This is for programs that want to wait for the agent bakers before saying they are healthy themselves.
+// If ctx expires first, the returned error is a ReadyErrors with the versions that never came up.
+// The error for a version that was probed is a *ProbeError.
+// Versions that failed to start are never ready, so if there are any WaitReady returns a ReadyErrors
+// with them once the other versions are ready, without waiting for ctx to expire.
+func (m Mapping) WaitReady(ctx context.Context) error {
+	mu := sync.Mutex{}
+	errs := ReadyErrors{}
+
+	g := wait.Group{}
+	for v, r := range m.current().versions {
+		// Latest is an alias of another version, which is already being waited on.
+		if v == Latest {
+			continue
+		}
+		if State(r.state.Load()) == StateFailed {
+			errs[v] = fmt.Errorf("version failed to start")
+			continue
+		}
+		if len(r.addrs) == 0 {
+			errs[v] = fmt.Errorf("version has no agent bakers")
+			continue
+		}
+
+		v, r := v, r
+		g.Go(
+			ctx,
+			func(ctx context.Context) error {
+				if err := waitReplicas(ctx, m.clock, v, r); err != nil {
+					mu.Lock()
+					errs[v] = err
+					mu.Unlock()
+				}
+				return nil
+			},
+		)
+	}
+	g.Wait(ctx)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// waitReplicas probes the replicas in r, which are for version v, until they are all healthy or ctx expires.
+// If ctx expires, it returns a *ProbeError for the replica that was being probed. c times the waits between probes.
+func waitReplicas(ctx context.Context, c clock.Clock, v Version, r *replicas) error {
+	for _, addr := range r.addrs {
+		if err := waitReplica(ctx, c, v, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitReplica probes the replica at addr until it is healthy or ctx expires.
+func waitReplica(ctx context.Context, c clock.Clock, v Version, addr string) error {
+	client, base := agentClient(addr)
+	defer client.CloseIdleConnections()
+	url := base + readyPath
+
+	b := *readyBackoff
+	b.Clock = c
+	start := c.Now()
+	var lastErr error
+	for attempts := 1; ; attempts++ {
+		err := probeReady(ctx, client, url)
+		if err == nil {
+			return nil
+		}
+		// A probe cut short by ctx expiring doesn't tell us why the replica isn't ready, unless it is all we have.
+		if ctx.Err() == nil || lastErr == nil {
+			lastErr = err
+		}
+		if err := b.Wait(ctx, attempts-1); err != nil {
+			// For unix sockets, the URL is a stand-in, so we report the socket.
+			if strings.HasPrefix(addr, "unix://") {
+				url = addr
+			}
+			return &ProbeError{Version: v, URL: url, Attempts: attempts, Elapsed: c.Now().Sub(start), Err: lastErr}
+		}
+	}
+}
+
+// probeReady returns an error if the agent baker at url does not answer with a 200 OK.
+func probeReady(ctx context.Context, client *http.Client, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health probe returned status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// agentClient returns an http.Client for probing the agent baker at addr and the base URL to send
+// requests to. Agent bakers serving https are ones we started, so their certificates are not verified.
+// Nothing but probes and warmups are sent to them.
+func agentClient(addr string) (*http.Client, string) {
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	// Requests over a unix socket are still HTTP requests, they are just dialed over the socket.
+	if sock, ok := strings.CutPrefix(addr, "unix://"); ok {
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", sock)
+		}
+		addr = "http://localhost"
+	}
+	return &http.Client{Transport: transport}, addr
+}
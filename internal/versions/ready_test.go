@@ -0,0 +1,192 @@
+package versions
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+)
+
+// newReadyServer returns an agent baker stand-in that fails health probes until ready is set.
+func newReadyServer(t *testing.T, ready *atomic.Bool) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != readyPath || !ready.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			},
+		),
+	)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestWaitReady(t *testing.T) {
+	t.Parallel()
+
+	fast, slow := &atomic.Bool{}, &atomic.Bool{}
+	fast.Store(true)
+	fastServ, slowServ := newReadyServer(t, fast), newReadyServer(t, slow)
+
+	m := newMapping(
+		[]versionPath{
+			{version: "1.0.0", addrs: []string{fastServ.URL}},
+			{version: "1.1.0", addrs: []string{slowServ.URL}, latest: true},
+		},
+	)
+
+	time.AfterFunc(2*readyInterval, func() { slow.Store(true) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := m.WaitReady(ctx); err != nil {
+		t.Errorf("TestWaitReady: got err == %s, want err == nil", err)
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	t.Parallel()
+
+	fast, never := &atomic.Bool{}, &atomic.Bool{}
+	fast.Store(true)
+	fastServ, neverServ := newReadyServer(t, fast), newReadyServer(t, never)
+
+	m := newMapping(
+		[]versionPath{
+			{version: "1.0.0", addrs: []string{fastServ.URL}},
+			{version: "1.1.0", addrs: []string{neverServ.URL}},
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*readyInterval)
+	defer cancel()
+	err := m.WaitReady(ctx)
+
+	var rerr ReadyErrors
+	if !errors.As(err, &rerr) {
+		t.Fatalf("TestWaitReadyTimeout: got err == %v, want ReadyErrors", err)
+	}
+	if len(rerr) != 1 || rerr["1.1.0"] == nil {
+		t.Errorf("TestWaitReadyTimeout: got %v, want only version 1.1.0 not ready", rerr)
+	}
+}
+
+func TestWaitReadyClockTimeout(t *testing.T) {
+	t.Parallel()
+
+	const timeout = 5 * time.Second
+
+	never := &atomic.Bool{}
+	m := newMapping([]versionPath{{version: "1.0.0", addrs: []string{newReadyServer(t, never).URL}}})
+	fake := clock.NewFake(time.Now())
+	m.clock = fake
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waited := make(chan error, 1)
+	go func() { waited <- m.WaitReady(ctx) }()
+
+	// Each step fires the wait between probes, which is never longer than readyInterval.
+	for elapsed := time.Duration(0); elapsed < timeout; elapsed += readyInterval {
+		// The wait between probes.
+		fake.BlockUntil(1)
+		select {
+		case err := <-waited:
+			t.Fatalf("TestWaitReadyClockTimeout: WaitReady() returned %v after %v, before the timeout", err, elapsed)
+		default:
+		}
+		fake.Advance(readyInterval)
+	}
+	// The clock is at the timeout, which is when ctx would expire.
+	cancel()
+
+	var err error
+	select {
+	case err = <-waited:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("TestWaitReadyClockTimeout: WaitReady() did not return once ctx expired")
+	}
+	var perr *ProbeError
+	if !errors.As(err, &perr) {
+		t.Fatalf("TestWaitReadyClockTimeout: got err == %v, want a *ProbeError", err)
+	}
+	if perr.Elapsed != timeout {
+		t.Errorf("TestWaitReadyClockTimeout: got elapsed %v, want %v", perr.Elapsed, timeout)
+	}
+	if perr.Attempts < int(timeout/readyInterval) {
+		t.Errorf("TestWaitReadyClockTimeout: got %d attempts, want at least one for each wait", perr.Attempts)
+	}
+}
+
+func TestWaitReadyFailed(t *testing.T) {
+	t.Parallel()
+
+	m := newMapping([]versionPath{{version: "1.0.0"}})
+	m.current().versions["1.0.0"].state.Store(int32(StateFailed))
+
+	// This must not wait for the context, a failed version can never be ready.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	err := m.WaitReady(ctx)
+
+	var rerr ReadyErrors
+	if !errors.As(err, &rerr) || rerr["1.0.0"] == nil {
+		t.Errorf("TestWaitReadyFailed: got err == %v, want ReadyErrors with version 1.0.0", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("TestWaitReadyFailed: WaitReady waited on the context")
+	}
+}
+
+func TestWaitReadyDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	// Nothing listens on a port we just closed, so every probe gets connection refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "http://" + l.Addr().String()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	m := newMapping([]versionPath{{version: "1.0.0", addrs: []string{addr}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*readyInterval)
+	defer cancel()
+	err = m.WaitReady(ctx)
+
+	var perr *ProbeError
+	if !errors.As(err, &perr) {
+		t.Fatalf("TestWaitReadyDiagnostics: got err == %v, want a *ProbeError", err)
+	}
+	if perr.Version != "1.0.0" {
+		t.Errorf("TestWaitReadyDiagnostics: got version %s, want 1.0.0", perr.Version)
+	}
+	if perr.Attempts < 2 {
+		t.Errorf("TestWaitReadyDiagnostics: got %d attempts, want the probe to be retried", perr.Attempts)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("TestWaitReadyDiagnostics: got err == %v, want it to wrap connection refused", err)
+	}
+	msg := err.Error()
+	for _, want := range []string{port, "connection refused", "1.0.0"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("TestWaitReadyDiagnostics: error %q does not mention %q", msg, want)
+		}
+	}
+}
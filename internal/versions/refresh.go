@@ -0,0 +1,238 @@
+package versions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-json-experiment/json"
+	"github.com/gostdlib/concurrency/prim/wait"
+)
+
+// Delta is what Mapping.Refresh() changed. The versions in each list are sorted.
+type Delta struct {
+	// Added are the versions that were found that we did not have. They were started.
+	Added []Version
+	// Removed are the versions that are no longer found. They were stopped.
+	Removed []Version
+	// Restarted are the versions whose binaries or launch config changed, or that had failed to start.
+	// They were started again and their old processes were stopped. Each of their replicas counts this
+	// as a restart, see ReplicaStatus.Restarts.
+	Restarted []Version
+	// Latest is the version Latest points to after the refresh. If empty, no version is the latest.
+	Latest Version
+}
+
+// Empty reports if the refresh changed no version.
+func (d Delta) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Restarted) == 0
+}
+
+// refresher holds what Mapping.Refresh() needs to discover and start versions again.
+type refresher struct {
+	// mu is held while a Refresh() or Shutdown() runs, so that they don't change the topology at the same time.
+	mu sync.Mutex
+	// opts are the options the Mapping was created with.
+	opts options
+	// gen is the number of the last Refresh(). It is the versionPath.gen of the versions that Refresh() started.
+	gen uint64
+	// stopped is set by Shutdown(), after which Refresh() fails.
+	stopped bool
+}
+
+// checksums returns the checksum() of every version in verPaths. A version that can't be read gets an empty
+// checksum, which never matches, so that Refresh() restarts it.
+func checksums(verPaths []versionPath) map[Version]string {
+	sums := make(map[Version]string, len(verPaths))
+	for _, vp := range verPaths {
+		sums[vp.version], _ = checksum(vp)
+	}
+	return sums
+}
+
+// checksum returns a SHA-256 of what vp is started from: its launch config, its binary and its helpers.
+// If any of them changes, so does this.
+func checksum(vp versionPath) (string, error) {
+	h := sha256.New()
+	launch, err := json.Marshal(vp.launch)
+	if err != nil {
+		return "", fmt.Errorf("could not encode the launch config of version(%s): %w", vp.version, err)
+	}
+	h.Write(launch)
+
+	bins := append([]helperBin{{name: primaryName, bin: vp.bin}}, vp.helpers...)
+	for _, b := range bins {
+		if b.bin == nil {
+			continue
+		}
+		// The name keeps the same bytes moving from one file to another from having the same checksum.
+		fmt.Fprintf(h, "\x00%s\x00", b.name)
+		r, err := b.bin.open()
+		if err != nil {
+			return "", fmt.Errorf("%w: could not open %s for version(%s): %w", ErrExtract, b.name, vp.version, err)
+		}
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return "", fmt.Errorf("%w: could not read %s for version(%s): %w", ErrExtract, b.name, vp.version, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Refresh discovers the versions again, with the options m was created with, and applies the difference to m:
+// versions that are new are started, versions that are gone are stopped and versions whose binaries, helpers
+// or launch config changed are restarted. Versions that failed to start are restarted too. This is for
+// replacing binaries in a WithBinaryDir() directory without stopping the versions that didn't change.
+//
+// The versions that are started must answer a health probe, and are warmed up if WithWarmup() is set,
+// before m sends them requests. Until then the versions they replace keep serving. Once requests go to
+// the new versions, the replaced processes are sent a SIGTERM and killed if they haven't exited when ctx
+// is done. If WithStartTimeout() is set it bounds discovering and starting the versions, otherwise ctx
+// must, as a version that never answers its health probe would be waited on until ctx is done.
+//
+// If anything fails before requests go to the new versions, such as a version that doesn't start, the
+// versions that were started are stopped and m is left as it was. Every copy of m sees the change.
+// Refreshes are done one at a time. m must come from New() or Spawn() with WithBinaryDir() or WithDiscoverer(),
+// as the embedded binaries can't change.
+func (m Mapping) Refresh(ctx context.Context) (Delta, error) {
+	rf := m.refresher
+	if rf == nil {
+		return Delta{}, fmt.Errorf("the Mapping can't be refreshed, its versions can't change")
+	}
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.stopped {
+		return Delta{}, fmt.Errorf("the Mapping was shut down")
+	}
+
+	opts := rf.opts
+	// The versions that are running hold the ports that would be handed out first.
+	opts.skipBusyPorts = true
+	ctx, cancel := opts.startContext(ctx)
+	defer cancel()
+
+	verPaths, err := discover(ctx, opts)
+	if err != nil {
+		return Delta{}, opts.timedOut(ctx, err)
+	}
+
+	cur := m.current()
+	rf.gen++
+	delta := Delta{}
+	found := make(map[Version]bool, len(verPaths))
+	sums := checksums(verPaths)
+	start := []versionPath{}
+	for _, vp := range verPaths {
+		found[vp.version] = true
+		r := cur.versions[vp.version]
+		switch {
+		case r == nil:
+			delta.Added = append(delta.Added, vp.version)
+		case r.sum == "" || r.sum != sums[vp.version] || State(r.state.Load()) == StateFailed:
+			delta.Restarted = append(delta.Restarted, vp.version)
+		default:
+			continue
+		}
+		vp.gen = rf.gen
+		start = append(start, vp)
+	}
+	for v := range cur.versions {
+		if v != Latest && !found[v] {
+			delta.Removed = append(delta.Removed, v)
+		}
+	}
+
+	started, err := m.startRefreshed(ctx, start, opts)
+	if err != nil {
+		return Delta{}, opts.timedOut(ctx, err)
+	}
+
+	next := &topology{versions: make(map[Version]*replicas, len(verPaths)+1), gen: rf.gen}
+	for _, vp := range verPaths {
+		r := started[vp.version]
+		if r == nil {
+			r = cur.versions[vp.version]
+		} else {
+			r.sum = sums[vp.version]
+			// The version was restarted, rather than added.
+			if old := cur.versions[vp.version]; old != nil {
+				r.restarted(old)
+			}
+		}
+		next.add(vp, r)
+	}
+	m.topo.Store(next)
+	delta.Latest = next.latest
+
+	// Requests no longer go to the replaced versions, so they can be stopped.
+	replaced := append(append([]Version{}, delta.Removed...), delta.Restarted...)
+	g := wait.Group{}
+	for _, v := range replaced {
+		v, r := v, cur.versions[v]
+		r.state.Store(int32(StateStopped))
+		// ctx may be done, but the processes must still be stopped.
+		g.Go(
+			context.Background(),
+			func(context.Context) error {
+				if err := r.shutdown(ctx); err != nil {
+					opts.log.Warn("replaced version did not exit in time and was killed", "version", v)
+				}
+				return nil
+			},
+		)
+	}
+	g.Wait(context.Background())
+
+	SortVersions(delta.Added)
+	SortVersions(delta.Removed)
+	SortVersions(delta.Restarted)
+	opts.log.Info(
+		"versions refreshed",
+		"added", delta.Added,
+		"removed", delta.Removed,
+		"restarted", delta.Restarted,
+		"latest", delta.Latest,
+	)
+	return delta, nil
+}
+
+// startRefreshed starts the versions in verPaths for Refresh() and returns their replicas once they are
+// ready. If any version doesn't start or become ready, the versions that started are stopped.
+func (m Mapping) startRefreshed(ctx context.Context, verPaths []versionPath, opts options) (map[Version]*replicas, error) {
+	if len(verPaths) == 0 {
+		return nil, nil
+	}
+	stop := func() {
+		for _, vp := range verPaths {
+			if len(vp.procs) > 0 {
+				reap(vp.binDir(), vp.procs)
+			}
+		}
+	}
+
+	// spawnVersions() only stops the versions that started on errors other than StartErrors.
+	if err := spawnVersions(ctx, verPaths, opts); err != nil {
+		stop()
+		return nil, fmt.Errorf("could not start the refreshed versions: %w", err)
+	}
+
+	started := newMapping(verPaths)
+	started.clock = m.clock
+	if err := started.WaitReady(ctx); err != nil {
+		stop()
+		return nil, fmt.Errorf("refreshed versions did not become ready: %w", err)
+	}
+	if opts.warmup != nil {
+		started.warmUp(ctx, *opts.warmup, opts.log)
+	}
+
+	replicas := make(map[Version]*replicas, len(verPaths))
+	for _, vp := range verPaths {
+		replicas[vp.version] = started.current().versions[vp.version]
+	}
+	return replicas, nil
+}
@@ -0,0 +1,403 @@
+package versions
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// binStarter is a starter that doesn't run the binary. Each replica is a server that answers health probes
+// and, on any other path, the content of the binary it was started from, so tests can tell what a version runs.
+type binStarter struct {
+	t *testing.T
+
+	mu sync.Mutex
+	// fail makes starting these versions fail.
+	fail map[Version]bool
+}
+
+func (b *binStarter) start(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+	b.mu.Lock()
+	fail := b.fail[vp.version]
+	b.mu.Unlock()
+	if fail {
+		return "", nil, errors.New("broken binary")
+	}
+
+	r, err := vp.bin.open()
+	if err != nil {
+		return "", nil, err
+	}
+	content, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return "", nil, err
+	}
+
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != readyPath {
+					w.Write(content)
+				}
+			},
+		),
+	)
+	b.t.Cleanup(s.Close)
+	return s.URL, nil, nil
+}
+
+func (b *binStarter) setFail(v Version) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail == nil {
+		b.fail = map[Version]bool{}
+	}
+	b.fail[v] = true
+}
+
+// running returns the content of the binary that version v of m was started from.
+func running(t *testing.T, m Mapping, v Version) string {
+	t.Helper()
+
+	base := m.Base(v)
+	if base == "" {
+		return ""
+	}
+	resp, err := http.Get(base + "/binary")
+	if err != nil {
+		t.Fatalf("could not reach version(%s): %s", v, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read from version(%s): %s", v, err)
+	}
+	return string(b)
+}
+
+// writeVersion writes a version to dir, as WithBinaryDir() expects, whose binary is content.
+func writeVersion(t *testing.T, dir string, v Version, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Join(dir, v.String()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, v.String(), primaryName), []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newDirMapping returns a Mapping of the versions in dir that are started with b.
+func newDirMapping(t *testing.T, dir string, b *binStarter) Mapping {
+	t.Helper()
+
+	opts, err := newOptions([]Option{WithBinaryDir(dir), WithStartTimeout(10 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.start = b.start
+
+	verPaths, err := discover(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := make([]VersionInfo, 0, len(verPaths))
+	for _, vp := range verPaths {
+		infos = append(infos, VersionInfo{Version: vp.version, Latest: vp.latest, vp: vp})
+	}
+	m, err := spawn(context.Background(), infos, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+	return m
+}
+
+func TestRefresh(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeVersion(t, dir, "1.0.0", "one")
+	writeVersion(t, dir, "1.1.0", "eleven")
+	writeVersion(t, dir, "1.2.0", "twelve")
+
+	m := newDirMapping(t, dir, &binStarter{t: t})
+	// Copies of the Mapping, such as the one the HTTP server has, see the refresh.
+	cp := m
+
+	// Nothing changed on disk, so nothing is restarted.
+	unchanged := m.Base("1.0.0")
+	delta, err := m.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("TestRefresh(no change): got err == %s, want err == nil", err)
+	}
+	if diff := pretty.Compare(Delta{Latest: "1.2.0"}, delta); diff != "" {
+		t.Errorf("TestRefresh(no change): delta -want/+got:\n%s", diff)
+	}
+	if !delta.Empty() {
+		t.Errorf("TestRefresh(no change): got delta.Empty() == false, want true")
+	}
+	if got := m.Base("1.0.0"); got != unchanged {
+		t.Errorf("TestRefresh(no change): version(1.0.0) moved from %s to %s", unchanged, got)
+	}
+
+	old := m.current().versions
+	writeVersion(t, dir, "1.3.0", "thirteen")
+	if err := os.RemoveAll(filepath.Join(dir, "1.1.0")); err != nil {
+		t.Fatal(err)
+	}
+	writeVersion(t, dir, "1.2.0", "twelve, patched")
+
+	delta, err = m.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("TestRefresh(changes): got err == %s, want err == nil", err)
+	}
+	want := Delta{Added: []Version{"1.3.0"}, Removed: []Version{"1.1.0"}, Restarted: []Version{"1.2.0"}, Latest: "1.3.0"}
+	if diff := pretty.Compare(want, delta); diff != "" {
+		t.Errorf("TestRefresh(changes): delta -want/+got:\n%s", diff)
+	}
+
+	wantRunning := map[Version]string{
+		"1.0.0": "one",
+		"1.1.0": "",
+		"1.2.0": "twelve, patched",
+		"1.3.0": "thirteen",
+		Latest:  "thirteen",
+	}
+	for v, want := range wantRunning {
+		if got := running(t, cp, v); got != want {
+			t.Errorf("TestRefresh(changes): version(%s) runs %q, want %q", v, got, want)
+		}
+	}
+	if cp.Has("1.1.0") {
+		t.Errorf("TestRefresh(changes): removed version(1.1.0) is still in the Mapping")
+	}
+	if got := m.Base("1.0.0"); got != unchanged {
+		t.Errorf("TestRefresh(changes): unchanged version(1.0.0) moved from %s to %s", unchanged, got)
+	}
+	for _, v := range []Version{"1.1.0", "1.2.0"} {
+		if got := State(old[v].state.Load()); got != StateStopped {
+			t.Errorf("TestRefresh(changes): replaced version(%s) is %s, want %s", v, got, StateStopped)
+		}
+	}
+	if got := State(old["1.0.0"].state.Load()); got != StateReady {
+		t.Errorf("TestRefresh(changes): kept version(1.0.0) is %s, want %s", got, StateReady)
+	}
+	wantRestarts := map[Version]int{"1.0.0": 0, "1.2.0": 1, "1.3.0": 0}
+	if diff := pretty.Compare(wantRestarts, restarts(m)); diff != "" {
+		t.Errorf("TestRefresh(changes): restarts -want/+got:\n%s", diff)
+	}
+
+	// Restarts add up over refreshes.
+	writeVersion(t, dir, "1.2.0", "twelve, patched again")
+	if _, err := m.Refresh(context.Background()); err != nil {
+		t.Fatalf("TestRefresh(restart again): got err == %s, want err == nil", err)
+	}
+	wantRestarts["1.2.0"] = 2
+	if diff := pretty.Compare(wantRestarts, restarts(m)); diff != "" {
+		t.Errorf("TestRefresh(restart again): restarts -want/+got:\n%s", diff)
+	}
+}
+
+// restarts returns the ReplicaStatus.Restarts of each version in m, which has one replica per version.
+func restarts(m Mapping) map[Version]int {
+	got := map[Version]int{}
+	for _, vs := range m.Status() {
+		for _, rs := range vs.Replicas {
+			got[vs.Version] += rs.Restarts
+		}
+	}
+	return got
+}
+
+func TestRefreshFailure(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeVersion(t, dir, "1.0.0", "one")
+	writeVersion(t, dir, "1.1.0", "eleven")
+
+	b := &binStarter{t: t}
+	m := newDirMapping(t, dir, b)
+
+	// 1.2.0 starts, but 1.3.0 doesn't, so neither is used and 1.0.0 is not replaced.
+	writeVersion(t, dir, "1.0.0", "one, patched")
+	writeVersion(t, dir, "1.2.0", "twelve")
+	writeVersion(t, dir, "1.3.0", "thirteen")
+	b.setFail("1.3.0")
+
+	if _, err := m.Refresh(context.Background()); err == nil {
+		t.Fatalf("TestRefreshFailure: got err == nil, want err != nil")
+	}
+	for v, want := range map[Version]string{"1.0.0": "one", "1.1.0": "eleven", Latest: "eleven"} {
+		if got := running(t, m, v); got != want {
+			t.Errorf("TestRefreshFailure: version(%s) runs %q, want %q", v, got, want)
+		}
+	}
+	for _, v := range []Version{"1.2.0", "1.3.0"} {
+		if m.Has(v) {
+			t.Errorf("TestRefreshFailure: version(%s) is in the Mapping after a failed refresh", v)
+		}
+	}
+
+	// A refresh that finds no versions fails, and the Mapping keeps the ones it has.
+	for _, v := range []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0"} {
+		if err := os.RemoveAll(filepath.Join(dir, v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Refresh(context.Background()); !errors.Is(err, ErrNoVersions) {
+		t.Errorf("TestRefreshFailure(empty dir): got err == %v, want ErrNoVersions", err)
+	}
+	if !m.Has("1.0.0") {
+		t.Errorf("TestRefreshFailure(empty dir): version(1.0.0) was removed")
+	}
+}
+
+func TestRefreshNotRefreshable(t *testing.T) {
+	t.Parallel()
+
+	static, err := NewStatic(map[Version]string{"1.0.0": "http://localhost:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := static.Refresh(context.Background()); err == nil {
+		t.Errorf("TestRefreshNotRefreshable(static): got err == nil, want err != nil")
+	}
+
+	dir := t.TempDir()
+	writeVersion(t, dir, "1.0.0", "one")
+	m := newDirMapping(t, dir, &binStarter{t: t})
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Refresh(context.Background()); err == nil || !strings.Contains(err.Error(), "shut down") {
+		t.Errorf("TestRefreshNotRefreshable(shut down): got err == %v, want a shut down error", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+
+	base := versionPath{version: "1.0.0", bin: memBinary("binary")}
+	tests := []struct {
+		name string
+		vp   versionPath
+		same bool
+	}{
+		{name: "Same", vp: versionPath{version: "1.0.0", bin: memBinary("binary")}, same: true},
+		{name: "Binary changed", vp: versionPath{version: "1.0.0", bin: memBinary("binary2")}},
+		{name: "Launch config changed", vp: versionPath{version: "1.0.0", bin: memBinary("binary"), launch: launchConfig{Flags: []string{"-v"}}}},
+		{
+			name: "Helper added",
+			vp:   versionPath{version: "1.0.0", bin: memBinary("binary"), helpers: []helperBin{{name: "helper", bin: memBinary("h")}}},
+		},
+	}
+
+	want, err := checksum(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		got, err := checksum(test.vp)
+		if err != nil {
+			t.Errorf("TestChecksum(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+		if (got == want) != test.same {
+			t.Errorf("TestChecksum(%s): got same checksum == %v, want %v", test.name, got == want, test.same)
+		}
+	}
+}
+
+func TestWithBinaryDir(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		dir  string
+		err  bool
+	}{
+		{name: "Directory", dir: t.TempDir()},
+		{name: "Error: empty", dir: "", err: true},
+		{name: "Error: missing", dir: filepath.Join(t.TempDir(), "missing"), err: true},
+		{name: "Error: a file", dir: file, err: true},
+	}
+
+	for _, test := range tests {
+		_, err := newOptions([]Option{WithBinaryDir(test.dir)})
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestWithBinaryDir(%s): got err == nil, want err != nil", test.name)
+		case err != nil && !test.err:
+			t.Errorf("TestWithBinaryDir(%s): got err == %s, want err == nil", test.name, err)
+		}
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeVersion(t, dir, "1.0.0", "one")
+	m := newDirMapping(t, dir, &binStarter{t: t})
+
+	seen := map[uint64]string{m.Generation(): "start"}
+	steps := []struct {
+		name   string
+		change func()
+	}{
+		{name: "Add", change: func() { writeVersion(t, dir, "1.1.0", "eleven") }},
+		{
+			name: "Remove",
+			change: func() {
+				if err := os.RemoveAll(filepath.Join(dir, "1.1.0")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{name: "No change", change: func() {}},
+	}
+
+	for _, step := range steps {
+		step.change()
+		if _, err := m.Refresh(context.Background()); err != nil {
+			t.Fatalf("TestGeneration(%s): got err == %s, want err == nil", step.name, err)
+		}
+		gen := m.Generation()
+		if prev, ok := seen[gen]; ok {
+			t.Errorf("TestGeneration(%s): got generation %d, which %s had", step.name, gen, prev)
+		}
+		seen[gen] = step.name
+	}
+
+	// A refresh that fails leaves the versions, and so the generation, as they were.
+	before := m.Generation()
+	if err := os.RemoveAll(filepath.Join(dir, "1.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Refresh(context.Background()); err == nil {
+		t.Fatalf("TestGeneration(failed refresh): got err == nil, want err != nil")
+	}
+	if got := m.Generation(); got != before {
+		t.Errorf("TestGeneration(failed refresh): got generation %d, want %d", got, before)
+	}
+}
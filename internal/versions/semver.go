@@ -0,0 +1,158 @@
+package versions
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version. See https://semver.org.
+type semver struct {
+	major, minor, patch uint64
+	// pre are the dot separated prerelease identifiers. If empty, this is not a prerelease.
+	pre []string
+}
+
+// isRelease reports if v is a semantic version that is not a prerelease.
+func isRelease(v Version) bool {
+	sv, ok := parseSemver(string(v))
+	return ok && len(sv.pre) == 0
+}
+
+// parseSemver parses s as a semantic version. A leading "v" is allowed. Build metadata is
+// dropped, as it has no effect on precedence. ok is false if s is not a semantic version.
+func parseSemver(s string) (sv semver, ok bool) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		if !validIdents(s[i+1:], false) {
+			return semver{}, false
+		}
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		if !validIdents(s[i+1:], true) {
+			return semver{}, false
+		}
+		sv.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	nums := [3]*uint64{&sv.major, &sv.minor, &sv.patch}
+	for i, p := range parts {
+		if !isNum(p) || (len(p) > 1 && p[0] == '0') {
+			return semver{}, false
+		}
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return semver{}, false
+		}
+		*nums[i] = n
+	}
+	return sv, true
+}
+
+// validIdents reports if s is a valid dot separated list of prerelease or build identifiers.
+// Numeric prerelease identifiers may not have leading zeros.
+func validIdents(s string, pre bool) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, r := range id {
+			if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-') {
+				return false
+			}
+		}
+		if pre && isNum(id) && len(id) > 1 && id[0] == '0' {
+			return false
+		}
+	}
+	return true
+}
+
+// isNum reports if s is only ASCII digits.
+func isNum(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// compare returns -1, 0 or 1 if a has lower, equal or higher precedence than b.
+func (a semver) compare(b semver) int {
+	for _, p := range [][2]uint64{{a.major, b.major}, {a.minor, b.minor}, {a.patch, b.patch}} {
+		if c := cmpInt(p[0], p[1]); c != 0 {
+			return c
+		}
+	}
+
+	// A prerelease has lower precedence than the release.
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		if c := compareIdent(a.pre[i], b.pre[i]); c != 0 {
+			return c
+		}
+	}
+	// A larger set of prerelease identifiers has higher precedence if the others are equal.
+	return cmpInt(len(a.pre), len(b.pre))
+}
+
+// compareIdent compares prerelease identifiers. Numeric identifiers are compared numerically
+// and have lower precedence than alphanumeric ones, which are compared in ASCII order.
+func compareIdent(a, b string) int {
+	an, bn := isNum(a), isNum(b)
+	switch {
+	case an && bn:
+		// Leading zeros are not allowed, so the longer number is larger.
+		if c := cmpInt(len(a), len(b)); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	case an:
+		return -1
+	case bn:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func cmpInt[T ~int | ~uint64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// SortVersions sorts vers by precedence. Versions with the same precedence, such as ones
+// that only differ by build metadata, are sorted by their string so the order is stable.
+func SortVersions(vers []Version) {
+	sort.Slice(
+		vers,
+		func(i, j int) bool {
+			if c := vers[i].Compare(vers[j]); c != 0 {
+				return c < 0
+			}
+			return vers[i] < vers[j]
+		},
+	)
+}
@@ -0,0 +1,123 @@
+package versions
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestVersionCompare(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		a, b Version
+		want int
+	}{
+		{name: "Equal", a: "1.0.0", b: "1.0.0", want: 0},
+		{name: "Major", a: "1.0.0", b: "2.0.0", want: -1},
+		{name: "Minor", a: "1.2.0", b: "1.1.0", want: 1},
+		{name: "Patch", a: "1.1.1", b: "1.1.2", want: -1},
+		{name: "Numeric not lexical", a: "1.10.0", b: "1.9.0", want: 1},
+		{name: "Leading v is allowed", a: "v1.0.0", b: "1.0.1", want: -1},
+		{name: "Prerelease is before the release", a: "1.0.0-alpha", b: "1.0.0", want: -1},
+		{name: "Prerelease is after the previous release", a: "1.0.0-alpha", b: "0.9.9", want: 1},
+		{name: "Prerelease alphanumeric order", a: "1.0.0-alpha", b: "1.0.0-beta", want: -1},
+		{name: "Prerelease numeric order", a: "1.0.0-beta.2", b: "1.0.0-beta.11", want: -1},
+		{name: "Prerelease numeric is before alphanumeric", a: "1.0.0-1", b: "1.0.0-alpha", want: -1},
+		{name: "Prerelease with more identifiers is after", a: "1.0.0-alpha", b: "1.0.0-alpha.1", want: -1},
+		{name: "Build metadata is ignored", a: "1.0.0+build.1", b: "1.0.0+build.2", want: 0},
+		{name: "Build metadata with prerelease", a: "1.0.0-rc.1+build.5", b: "1.0.0-rc.1", want: 0},
+		{name: "Latest is after everything", a: Latest, b: "99.0.0", want: 1},
+		{name: "Everything is before latest", a: "99.0.0", b: Latest, want: -1},
+		{name: "Latest equals latest", a: Latest, b: Latest, want: 0},
+		{name: "Not semver is before semver", a: "banana", b: "0.0.1", want: -1},
+		{name: "Not semver is compared as strings", a: "apple", b: "banana", want: -1},
+		{name: "Leading zero is not semver", a: "01.0.0", b: "0.0.1", want: -1},
+		{name: "Leading zero in numeric prerelease is not semver", a: "1.0.0-01", b: "0.0.1", want: -1},
+		{name: "Two components is not semver", a: "1.0", b: "0.0.1", want: -1},
+	}
+
+	for _, test := range tests {
+		if got := test.a.Compare(test.b); got != test.want {
+			t.Errorf("TestVersionCompare(%s): got %s.Compare(%s) == %d, want %d", test.name, test.a, test.b, got, test.want)
+		}
+		if got := test.b.Compare(test.a); got != -test.want {
+			t.Errorf("TestVersionCompare(%s): got %s.Compare(%s) == %d, want %d", test.name, test.b, test.a, got, -test.want)
+		}
+		if got := test.a.Less(test.b); got != (test.want < 0) {
+			t.Errorf("TestVersionCompare(%s): got %s.Less(%s) == %v, want %v", test.name, test.a, test.b, got, test.want < 0)
+		}
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	t.Parallel()
+
+	vers := []Version{Latest, "1.10.0", "1.0.0+b", "1.0.0-rc.1", "1.9.0", "1.0.0+a", "dev", "1.0.0-beta"}
+	want := []Version{"dev", "1.0.0-beta", "1.0.0-rc.1", "1.0.0+a", "1.0.0+b", "1.9.0", "1.10.0", Latest}
+
+	SortVersions(vers)
+	if diff := pretty.Compare(want, vers); diff != "" {
+		t.Errorf("TestSortVersions: -want/+got:\n%s", diff)
+	}
+}
+
+func TestMarkLatest(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		verPaths []versionPath
+		stable   bool
+		want     Version
+	}{
+		{
+			name:     "Highest precedence is latest",
+			verPaths: []versionPath{{version: "1.9.0"}, {version: "1.10.0"}, {version: "1.11.0-rc.1"}, {version: "1.2.0"}},
+			want:     "1.11.0-rc.1",
+		},
+		{
+			name:     "Declared latest is kept",
+			verPaths: []versionPath{{version: "1.0.0", latest: true}, {version: "2.0.0"}},
+			want:     "1.0.0",
+		},
+		{
+			name:     "Stable skips prereleases",
+			verPaths: []versionPath{{version: "1.9.0"}, {version: "1.10.0"}, {version: "1.11.0-rc.1"}, {version: "dev"}},
+			stable:   true,
+			want:     "1.10.0",
+		},
+		{
+			name:     "Stable with only prereleases has no latest",
+			verPaths: []versionPath{{version: "1.11.0-rc.1"}},
+			stable:   true,
+		},
+		{
+			name:     "Stable keeps a declared prerelease",
+			verPaths: []versionPath{{version: "1.0.0"}, {version: "1.1.0-rc.1", latest: true}},
+			stable:   true,
+			want:     "1.1.0-rc.1",
+		},
+		{
+			name: "No versions",
+		},
+	}
+
+	for _, test := range tests {
+		markLatest(test.verPaths, test.stable)
+
+		var got Version
+		for _, vp := range test.verPaths {
+			if vp.latest {
+				if got != "" {
+					t.Errorf("TestMarkLatest(%s): more than one version is latest", test.name)
+				}
+				got = vp.version
+			}
+		}
+		if got != test.want {
+			t.Errorf("TestMarkLatest(%s): got latest %q, want %q", test.name, got, test.want)
+		}
+	}
+}
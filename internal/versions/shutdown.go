@@ -0,0 +1,72 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/gostdlib/concurrency/prim/wait"
+)
+
+// Shutdown stops the agent baker processes that were started for m and removes their binaries. Each process
+// is sent a SIGTERM and has until ctx is done to exit, after which it is killed. Versions are StateStopped once
+// Shutdown() is called, so m no longer hands out their addresses. Versions m didn't start, such as those
+// from NewStatic(), are only marked as stopped. It returns an error listing the versions that had to be killed.
+func (m Mapping) Shutdown(ctx context.Context) error {
+	// A Refresh() that is running finishes first, so that the versions it starts are stopped too,
+	// and later ones fail.
+	if m.refresher != nil {
+		m.refresher.mu.Lock()
+		defer m.refresher.mu.Unlock()
+		m.refresher.stopped = true
+	}
+
+	mu := sync.Mutex{}
+	killed := []Version{}
+
+	g := wait.Group{}
+	for v, r := range m.current().versions {
+		r.state.Store(int32(StateStopped))
+		// Latest is an alias of another version, which is already being stopped.
+		if v == Latest {
+			continue
+		}
+
+		v, r := v, r
+		g.Go(
+			ctx,
+			func(ctx context.Context) error {
+				if err := r.shutdown(ctx); err != nil {
+					mu.Lock()
+					killed = append(killed, v)
+					mu.Unlock()
+				}
+				return nil
+			},
+		)
+	}
+	// The processes are killed when ctx is done, so we wait for them even if it is.
+	g.Wait(context.Background())
+
+	if len(killed) > 0 {
+		SortVersions(killed)
+		return fmt.Errorf("these agent baker versions did not exit in time and were killed: %v", killed)
+	}
+	return nil
+}
+
+// shutdown stops the processes of r like Shutdown() does and removes their binaries. It returns an
+// error if a process had to be killed.
+func (r *replicas) shutdown(ctx context.Context) error {
+	var err error
+	for _, p := range r.procs {
+		if pErr := p.shutdown(ctx); pErr != nil {
+			err = pErr
+		}
+	}
+	if len(r.procs) > 0 {
+		os.RemoveAll(r.dir)
+	}
+	return err
+}
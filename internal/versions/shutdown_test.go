@@ -0,0 +1,92 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		// script is the agent baker, with %s for a directory it writes a file to once its trap is set.
+		// The loop lets a trap run between sleeps.
+		script string
+		err    bool
+	}{
+		{
+			name:   "Exits on SIGTERM",
+			script: "#!/bin/sh\ntrap 'exit 0' TERM\ntouch %s/$$\nwhile :; do sleep 0.1; done\n",
+		},
+		{
+			name:   "Ignores SIGTERM and is killed",
+			script: "#!/bin/sh\ntrap '' TERM\ntouch %s/$$\nwhile :; do sleep 0.1; done\n",
+			err:    true,
+		},
+	}
+
+	for i, test := range tests {
+		ver := Version(fmt.Sprintf("0.0.0-shutdown-%d-%d", i, time.Now().UnixNano()))
+		t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+		trapped := t.TempDir()
+		script := fmt.Sprintf(test.script, trapped)
+
+		m, err := New(
+			context.Background(),
+			WithDiscoverer(fakeDiscoverer{verPaths: []versionPath{{version: ver, bin: memBinary(script), latest: true}}}),
+			WithReplicas(2),
+		)
+		if err != nil {
+			t.Fatalf("TestShutdown(%s): got err == %s, want err == nil", test.name, err)
+		}
+		procs := m.current().versions[ver].procs
+		for _, p := range procs {
+			p := p
+			t.Cleanup(p.stop)
+		}
+		// A SIGTERM that comes before the trap is set kills the shell, whatever the trap would do.
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if ents, _ := os.ReadDir(trapped); len(ents) == len(procs) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("TestShutdown(%s): the agent bakers never set their traps", test.name)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		start := time.Now()
+		err = m.Shutdown(ctx)
+		cancel()
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestShutdown(%s): got err == nil, want err != nil", test.name)
+		case !test.err && err != nil:
+			t.Errorf("TestShutdown(%s): got err == %s, want err == nil", test.name, err)
+		}
+		if took := time.Since(start); took > 5*time.Second {
+			t.Errorf("TestShutdown(%s): took %v, want it to give up when ctx is done", test.name, took)
+		}
+
+		for i, p := range procs {
+			if p.cmd.ProcessState == nil {
+				t.Errorf("TestShutdown(%s): replica %d is still running", test.name, i)
+			}
+		}
+		for _, v := range []Version{ver, Latest} {
+			if state, _ := m.State(v); state != StateStopped {
+				t.Errorf("TestShutdown(%s): version(%s) is %s, want %s", test.name, v, state, StateStopped)
+			}
+			if base := m.Base(v); base != "" {
+				t.Errorf("TestShutdown(%s): version(%s) got Base() == %s, want it to hand out no address", test.name, v, base)
+			}
+		}
+		if _, err := os.Stat(versionDir(ver)); err == nil {
+			t.Errorf("TestShutdown(%s): the binaries were not removed", test.name)
+		}
+	}
+}
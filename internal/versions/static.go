@@ -0,0 +1,63 @@
+package versions
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// NewStatic creates a Mapping of agent bakers that something else runs, such as containers or other
+// hosts, instead of starting them. urls maps each version to the URL of its agent baker, which is
+// an http or https URL with no path, or a unix socket as "unix://<path>". Latest points to the
+// version with the highest precedence and can't be set in urls. Every version is StateReady, so
+// WaitReady() can be used to wait for the agent bakers to come up.
+func NewStatic(urls map[Version]string) (Mapping, error) {
+	if len(urls) == 0 {
+		return Mapping{}, fmt.Errorf("NewStatic() needs at least one version")
+	}
+
+	verPaths := make([]versionPath, 0, len(urls))
+	for v, u := range urls {
+		switch {
+		case v == "":
+			return Mapping{}, fmt.Errorf("version must not be empty")
+		case v == Latest:
+			return Mapping{}, fmt.Errorf("version(%s) can't be set, it points to the version with the highest precedence", Latest)
+		}
+		if err := v.validate(); err != nil {
+			return Mapping{}, fmt.Errorf("version(%s) is invalid: %w", v, err)
+		}
+		if err := validateUpstream(u); err != nil {
+			return Mapping{}, fmt.Errorf("version(%s) has an invalid URL: %w", v, err)
+		}
+		verPaths = append(verPaths, versionPath{version: v, addrs: []string{u}})
+	}
+	markLatest(verPaths, false)
+
+	return newMapping(verPaths), nil
+}
+
+// validateUpstream returns an error if u is not an address we can send agent baker requests to.
+func validateUpstream(u string) error {
+	if sock, ok := strings.CutPrefix(u, "unix://"); ok {
+		if sock == "" {
+			return fmt.Errorf("url(%s) has no socket path", u)
+		}
+		return nil
+	}
+
+	p, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	switch {
+	case p.Scheme != "http" && p.Scheme != "https":
+		return fmt.Errorf("url(%s) must be http, https or unix", u)
+	case p.Host == "":
+		return fmt.Errorf("url(%s) has no host", u)
+	case p.Path != "" || p.RawQuery != "" || p.Fragment != "" || p.User != nil:
+		// Request paths are added to the URL, so anything after the host would end up in the middle.
+		return fmt.Errorf("url(%s) must only have a scheme, host and port", u)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package versions
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestNewStatic(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		urls       map[Version]string
+		wantLatest Version
+		err        bool
+	}{
+		{
+			name: "Success",
+			urls: map[Version]string{
+				"1.0.0":       "http://10.0.0.1:8080",
+				"1.1.0":       "https://agentbaker.example.com",
+				"1.1.0-beta":  "unix:///run/agentbaker.sock",
+				"not-semver!": "http://localhost:9000",
+			},
+			wantLatest: "1.1.0",
+		},
+		{name: "No versions", urls: map[Version]string{}, err: true},
+		{name: "Empty version", urls: map[Version]string{"": "http://localhost:8080"}, err: true},
+		{name: "Latest", urls: map[Version]string{Latest: "http://localhost:8080"}, err: true},
+		{name: "Not a URL", urls: map[Version]string{"1.0.0": "http://[::1"}, err: true},
+		{name: "Bad scheme", urls: map[Version]string{"1.0.0": "ftp://localhost"}, err: true},
+		{name: "No host", urls: map[Version]string{"1.0.0": "http://"}, err: true},
+		{name: "Path", urls: map[Version]string{"1.0.0": "http://localhost:8080/v1"}, err: true},
+		{name: "Query", urls: map[Version]string{"1.0.0": "http://localhost:8080?a=b"}, err: true},
+		{name: "Empty socket", urls: map[Version]string{"1.0.0": "unix://"}, err: true},
+	}
+
+	for _, test := range tests {
+		m, err := NewStatic(test.urls)
+		switch {
+		case err == nil && test.err:
+			t.Errorf("TestNewStatic(%s): got err == nil, want err != nil", test.name)
+			continue
+		case err != nil && !test.err:
+			t.Errorf("TestNewStatic(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+
+		want := map[Version][]string{}
+		for v, u := range test.urls {
+			want[v] = []string{u}
+		}
+		want[Latest] = want[test.wantLatest]
+		if diff := pretty.Compare(want, m.All()); diff != "" {
+			t.Errorf("TestNewStatic(%s): -want/+got:\n%s", test.name, diff)
+		}
+		if got := m.Resolve(Latest); got != test.wantLatest {
+			t.Errorf("TestNewStatic(%s): got latest %s, want %s", test.name, got, test.wantLatest)
+		}
+		for v := range test.urls {
+			if state, _ := m.State(v); state != StateReady {
+				t.Errorf("TestNewStatic(%s): version(%s) is %s, want %s", test.name, v, state, StateReady)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package versions
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// proc is the process of an agent baker replica. A restart replaces the process, so the fields are guarded by mu.
+type proc struct {
+	mu sync.Mutex
+	// cmd is the running process. It is nil if the replica isn't a process we started.
+	cmd *exec.Cmd
+	// started is when the current process was started.
+	started time.Time
+	// restarts is how many times the replica has been restarted.
+	restarts int
+
+	// restart starts the process again after it exited. If nil, the process isn't restarted.
+	restart func(ctx context.Context) (*exec.Cmd, error)
+	// ctx is cancelled by cancel when the replica is stopped, so that it isn't restarted.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed once supervise() returns, after the last process exited. It is nil if cmd is.
+	done chan struct{}
+}
+
+// stop kills the process and waits for it to exit, so that it isn't left running or as a zombie.
+func (p *proc) stop() {
+	if p.done == nil {
+		return
+	}
+	p.cancel()
+
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+	cmd.Process.Kill()
+	<-p.done
+}
+
+// shutdown asks the process to exit with a SIGTERM and waits for it to. If it hasn't exited when ctx
+// is done, or can't be sent a SIGTERM, it is killed. It returns ctx.Err() if the process had to be killed.
+func (p *proc) shutdown(ctx context.Context) error {
+	if p.done == nil {
+		return nil
+	}
+	// The process must not be restarted once it exits.
+	p.cancel()
+
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+
+	// Windows can't send a SIGTERM, so there we go straight to killing the process.
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+		<-p.done
+		return nil
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-p.done
+		return ctx.Err()
+	}
+}
+
+// restarted records that r replaces old, the replicas of the same version, so each process of r has
+// been restarted once more than the process it replaces.
+func (r *replicas) restarted(old *replicas) {
+	for i, p := range r.procs {
+		n := 0
+		if i < len(old.procs) {
+			o := old.procs[i]
+			o.mu.Lock()
+			n = o.restarts
+			o.mu.Unlock()
+		}
+		p.mu.Lock()
+		p.restarts = n + 1
+		p.mu.Unlock()
+	}
+}
+
+// status returns the ReplicaStatus of the process. It is reached at addr.
+func (p *proc) status(addr string) ReplicaStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rs := ReplicaStatus{Addr: addr, Uptime: time.Since(p.started), Restarts: p.restarts}
+	if p.cmd != nil && p.cmd.Process != nil {
+		rs.PID = p.cmd.Process.Pid
+	}
+	return rs
+}
+
+// VersionStatus is the status of a version in a Mapping, as returned by Mapping.Status().
+type VersionStatus struct {
+	// Version is the version.
+	Version Version
+	// Latest indicates that requests for Latest go to this version.
+	Latest bool
+	// State is the State of the version.
+	State State
+	// Ready indicates the version can be sent requests.
+	Ready bool
+	// Err is why the version failed to start, if State is StateFailed.
+	Err error
+	// Replicas are the agent baker replicas of the version. This is empty if the version failed to start.
+	Replicas []ReplicaStatus
+}
+
+// ReplicaStatus is the status of a single agent baker replica.
+type ReplicaStatus struct {
+	// Addr is the address the replica is reached at.
+	Addr string
+	// PID is the process ID of the replica. This is 0 if the replica isn't a process we started.
+	PID int
+	// Uptime is how long the current process has been running.
+	Uptime time.Duration
+	// Restarts is how many times the replica has been restarted.
+	Restarts int
+}
+
+// Status returns the status of every version in the Mapping, sorted by version. Latest is not
+// included, instead the version it points to has Latest set.
+func (m Mapping) Status() []VersionStatus {
+	t := m.current()
+	vers := t.available()
+
+	statuses := make([]VersionStatus, 0, len(vers))
+	for _, v := range vers {
+		if v == Latest {
+			continue
+		}
+		r := t.versions[v]
+		vs := VersionStatus{
+			Version: v,
+			Latest:  v == t.latest,
+			State:   State(r.state.Load()),
+			Ready:   r.ready(),
+			Err:     r.err,
+		}
+		for i, addr := range r.addrs {
+			rs := ReplicaStatus{Addr: addr}
+			if i < len(r.procs) {
+				rs = r.procs[i].status(addr)
+			}
+			vs.Replicas = append(vs.Replicas, rs)
+		}
+		statuses = append(statuses, vs)
+	}
+	return statuses
+}
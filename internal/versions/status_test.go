@@ -0,0 +1,78 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestStatus(t *testing.T) {
+	t.Parallel()
+
+	// The child has to outlive the test's look at it, so it sleeps until we kill it.
+	script := memBinary("#!/bin/sh\nexec sleep 60\n")
+	ver := Version(fmt.Sprintf("0.0.0-status-%d", time.Now().UnixNano()))
+	t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+	m, err := New(
+		context.Background(),
+		WithDiscoverer(fakeDiscoverer{verPaths: []versionPath{{version: ver, bin: script, latest: true}}}),
+	)
+	if err != nil {
+		t.Fatalf("TestStatus: got err == %s, want err == nil", err)
+	}
+	for _, p := range m.current().versions[ver].procs {
+		p := p
+		t.Cleanup(p.stop)
+	}
+
+	got := m.Status()
+	if len(got) != 1 {
+		t.Fatalf("TestStatus: got %d versions, want 1 (Latest must not be listed)", len(got))
+	}
+	vs := got[0]
+	if vs.Version != ver || !vs.Latest || vs.State != StateReady || !vs.Ready {
+		t.Errorf("TestStatus: got %+v, want version %s that is latest and ready", vs, ver)
+	}
+	if len(vs.Replicas) != 1 {
+		t.Fatalf("TestStatus: got %d replicas, want 1", len(vs.Replicas))
+	}
+	rs := vs.Replicas[0]
+	if rs.PID == 0 {
+		t.Errorf("TestStatus: got PID 0, want the PID of the child")
+	}
+	if rs.PID != m.current().versions[ver].procs[0].cmd.Process.Pid {
+		t.Errorf("TestStatus: got PID %d, want %d", rs.PID, m.current().versions[ver].procs[0].cmd.Process.Pid)
+	}
+	if rs.Uptime <= 0 {
+		t.Errorf("TestStatus: got uptime %v, want > 0", rs.Uptime)
+	}
+	if rs.Restarts != 0 {
+		t.Errorf("TestStatus: got %d restarts, want 0", rs.Restarts)
+	}
+}
+
+func TestStatusNoProcess(t *testing.T) {
+	t.Parallel()
+
+	m := newMapping(
+		[]versionPath{
+			{version: "1.0.0", addrs: []string{"http://localhost:8080"}},
+			{version: "1.1.0"},
+		},
+	)
+	m.current().versions["1.1.0"].state.Store(int32(StateFailed))
+
+	got := m.Status()
+	want := []VersionStatus{
+		{Version: "1.0.0", State: StateReady, Ready: true, Replicas: []ReplicaStatus{{Addr: "http://localhost:8080"}}},
+		{Version: "1.1.0", State: StateFailed},
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("TestStatusNoProcess: -want/+got:\n%s", diff)
+	}
+}
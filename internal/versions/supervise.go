@@ -0,0 +1,80 @@
+package versions
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"time"
+
+	"github.com/element-of-surprise/bakedbaker/internal/backoff"
+)
+
+// restartStable is how long a replica must run before it exiting is no longer counted as crashing
+// in a loop, so the next restart waits the shortest backoff again.
+const restartStable = time.Minute
+
+// restartBackoff is how long the supervisor waits before starting a replica that exited again.
+var restartBackoff = &backoff.Backoff{Base: 100 * time.Millisecond, Max: 30 * time.Second}
+
+// newProc returns the proc of a replica of version v that was started as cmd. If cmd isn't nil, the
+// replica is supervised: whenever it exits without being stopped, it is started again with restart.
+func newProc(v Version, cmd *exec.Cmd, restart func(ctx context.Context) (*exec.Cmd, error), log *slog.Logger) *proc {
+	p := &proc{cmd: cmd, started: time.Now(), restart: restart}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if cmd == nil {
+		return p
+	}
+	p.done = make(chan struct{})
+	go p.supervise(v, log)
+	return p
+}
+
+// supervise waits for the process to exit and starts it again, until the proc is stopped. It is the
+// only caller of Wait() on the processes, and closes p.done when it returns.
+func (p *proc) supervise(v Version, log *slog.Logger) {
+	defer close(p.done)
+
+	attempt := 0
+	for {
+		p.mu.Lock()
+		cmd, started := p.cmd, p.started
+		p.mu.Unlock()
+
+		err := cmd.Wait()
+		if p.ctx.Err() != nil || p.restart == nil {
+			return
+		}
+		if time.Since(started) >= restartStable {
+			attempt = 0
+		}
+		log.Warn("agent baker exited, restarting it", "version", v, "pid", cmd.Process.Pid, "err", err)
+
+		for {
+			if err := restartBackoff.Wait(p.ctx, attempt); err != nil {
+				return
+			}
+			attempt++
+
+			cmd, err = p.restart(p.ctx)
+			if err != nil {
+				log.Error("could not restart agent baker", "version", v, "err", err)
+				continue
+			}
+			break
+		}
+
+		p.mu.Lock()
+		// stop() may have been called while we were starting it, in which case it didn't see this process.
+		if p.ctx.Err() != nil {
+			p.mu.Unlock()
+			cmd.Process.Kill()
+			cmd.Wait()
+			return
+		}
+		p.cmd = cmd
+		p.started = time.Now()
+		p.restarts++
+		p.mu.Unlock()
+		log.Info("agent baker restarted", "version", v, "pid", cmd.Process.Pid)
+	}
+}
@@ -0,0 +1,65 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSupervise(t *testing.T) {
+	t.Parallel()
+
+	script := memBinary("#!/bin/sh\nexec sleep 60\n")
+	ver := Version(fmt.Sprintf("0.0.0-supervise-%d", time.Now().UnixNano()))
+	t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+	m, err := New(
+		context.Background(),
+		WithDiscoverer(fakeDiscoverer{verPaths: []versionPath{{version: ver, bin: script, latest: true}}}),
+	)
+	if err != nil {
+		t.Fatalf("TestSupervise: got err == %s, want err == nil", err)
+	}
+	p := m.current().versions[ver].procs[0]
+	t.Cleanup(p.stop)
+
+	// A replica that exits, such as by crashing, is started again.
+	for want := 1; want <= 2; want++ {
+		old := m.Status()[0].Replicas[0]
+		proc, err := os.FindProcess(old.PID)
+		if err != nil {
+			t.Fatalf("TestSupervise: %s", err)
+		}
+		proc.Kill()
+
+		var got ReplicaStatus
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			got = m.Status()[0].Replicas[0]
+			if got.Restarts == want {
+				break
+			}
+		}
+		if got.Restarts != want {
+			t.Fatalf("TestSupervise: got %d restarts after killing the replica, want %d", got.Restarts, want)
+		}
+		if got.PID == old.PID || got.Addr != old.Addr {
+			t.Errorf("TestSupervise: got replica %+v, want a new process at %s", got, old.Addr)
+		}
+	}
+
+	// A replica that is stopped stays stopped.
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatalf("TestSupervise: got err == %s, want err == nil", err)
+	}
+	time.Sleep(2 * restartBackoff.Base)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd.ProcessState == nil {
+		t.Errorf("TestSupervise: the replica was restarted after Shutdown()")
+	}
+	if p.restarts != 2 {
+		t.Errorf("TestSupervise: got %d restarts after Shutdown(), want 2", p.restarts)
+	}
+}
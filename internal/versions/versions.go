@@ -9,9 +9,14 @@ to the localhost addresses that the agent bakers are running on.
 
 If a directory has a bad version or the agent won't start, an error is returned.
 
+Versions can come from somewhere other than the embedded binaries by passing a Discoverer with WithDiscoverer().
+New() finds the versions and starts them. To look at the versions without starting them, use Discover(), and
+then Spawn() to start them.
+Programs that must not report themselves healthy until the agent bakers answer can use Mapping.WaitReady().
+
 Usage is simple:
 
-	verMap, err := versions.New()
+	verMap, err := versions.New(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -30,13 +35,26 @@ package versions
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
+	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/element-of-surprise/bakedbaker/internal/clock"
+	"github.com/go-json-experiment/json"
 	"github.com/gostdlib/concurrency/prim/wait"
 )
 
@@ -46,8 +64,21 @@ var binariesFS embed.FS
 // Version describes a AgentBaker version.
 type Version string
 
+// validate returns an error if v can't be used as a version. Versions name the directory their
+// binaries are written to, so v must be usable as a single path element.
 func (v Version) validate() error {
-	// Some detection logic here
+	s := string(v)
+	switch {
+	case s == "":
+		return errors.New("version is empty")
+	case s == "." || s == "..":
+		return fmt.Errorf("version(%s) is not a valid name", s)
+	// This also rules out absolute paths, which need a separator or, on Windows, a volume name.
+	case strings.ContainsAny(s, `/\:`):
+		return fmt.Errorf("version(%s) must not contain a path separator or volume name", s)
+	case strings.ContainsRune(s, 0):
+		return fmt.Errorf("version(%q) must not contain a NUL", s)
+	}
 	return nil
 }
 
@@ -56,61 +87,1207 @@ func (v Version) String() string {
 	return string(v)
 }
 
+// Compare returns -1, 0 or 1 if v has lower, equal or higher precedence than other. Versions
+// are compared using semantic versioning (https://semver.org) precedence, so prereleases come before
+// their release and build metadata is ignored. Latest is higher than any other version. Versions that
+// are not semantic versions are lower than those that are and are compared as strings.
+func (v Version) Compare(other Version) int {
+	switch {
+	case v == other:
+		return 0
+	case v == Latest:
+		return 1
+	case other == Latest:
+		return -1
+	}
+
+	a, aok := parseSemver(string(v))
+	b, bok := parseSemver(string(other))
+	switch {
+	case aok && bok:
+		return a.compare(b)
+	case aok:
+		return 1
+	case bok:
+		return -1
+	}
+	return strings.Compare(string(v), string(other))
+}
+
+// Less reports if v has lower precedence than other. See Compare().
+func (v Version) Less(other Version) bool {
+	return v.Compare(other) < 0
+}
+
 // Latest is a special version that always points to the latest version.
 var Latest = Version("latest")
 
 // Mapping is a map of versions to connections.
 type Mapping struct {
-	versions map[Version]string
+	// topo holds the current topology. Refresh() replaces it, which copies of the Mapping share.
+	// It is nil in the zero Mapping.
+	topo *atomic.Pointer[topology]
+	// clock is what WaitReady() times its probes with.
+	clock clock.Clock
+	// refresher re-discovers the versions for Refresh(). It is nil if the Mapping can't be refreshed.
+	refresher *refresher
+}
+
+// topology is the versions in a Mapping. It is not changed once it is stored in a Mapping, other
+// than the state of its replicas, so it can be read without a lock.
+type topology struct {
+	versions map[Version]*replicas
+	// latest is the version that Latest points to. If empty, there is no latest version.
+	latest Version
+	// gen is the Refresh() that made this topology, or 0 if it is the one the Mapping was created with.
+	gen uint64
+}
+
+// current returns the topology of m.
+func (m Mapping) current() *topology {
+	if m.topo == nil {
+		return &topology{}
+	}
+	return m.topo.Load()
+}
+
+// Generation returns a number that changes whenever the versions in m are replaced, which Refresh() does
+// even when no version changed. Something that was worked out from m, such as what Resolve() returned,
+// still holds while this is the same. Only the states of the versions can change without it changing.
+func (m Mapping) Generation() uint64 {
+	return m.current().gen
+}
+
+// State is the state of a version in a Mapping.
+type State int32
+
+const (
+	// StateStarting means the version is known but its agent bakers are not running yet.
+	StateStarting State = iota
+	// StateReady means the version's agent bakers are running and can be sent requests.
+	StateReady
+	// StateFailed means the version's agent bakers could not be started.
+	StateFailed
+	// StateStopped means the version's agent bakers were stopped by Shutdown().
+	StateStopped
+)
+
+// String implements fmt.Stringer.
+func (s State) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateReady:
+		return "ready"
+	case StateFailed:
+		return "failed"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// replicas are the addresses of every agent baker process running a version.
+type replicas struct {
+	addrs []string
+	// procs are the processes of the replicas, in the same order as addrs.
+	procs []*proc
+	// next is the index of the next address to hand out.
+	next atomic.Uint64
+	// state holds the State of the version.
+	state atomic.Int32
+	// err is why the version failed to start, if it is StateFailed. It is set before the Mapping is used.
+	err error
+	// endpoints are the endpoints the version serves. If nil, it serves every endpoint.
+	endpoints map[string]bool
+	// dir is where the binaries of procs were written. It is removed when they are stopped.
+	dir string
+	// sum is the checksum() of the version when it was started. It is only set if the Mapping can be refreshed.
+	sum string
+}
+
+// pick returns the next address in round-robin order.
+func (r *replicas) pick() string {
+	n := r.next.Add(1) - 1
+	return r.addrs[n%uint64(len(r.addrs))]
+}
+
+// ready reports if the version can be sent requests.
+func (r *replicas) ready() bool {
+	return State(r.state.Load()) == StateReady && len(r.addrs) > 0
 }
 
 // Base returns the base address where the agent baker service for the given version is running.
-// If this is empty string, the version is not found. The returned address will be in the form of
-// "http://localhost:<port>".
+// If this is empty string, the version is not found or is not ready. The returned address will be in the form of
+// "http://localhost:<port>", or "https://localhost:<port>" if the version's launch config sets the scheme to https.
+// The launch config can also change the host, or make this a unix socket in the form "unix://<path>".
+// If the version has more than one replica, each call returns the next replica in round-robin order.
 func (m Mapping) Base(v Version) string {
-	return m.versions[v]
+	r := m.current().versions[v]
+	if r == nil || !r.ready() {
+		return ""
+	}
+	return r.pick()
+}
+
+// Resolve returns the concrete version that requests for v are sent to. This is v, unless v is Latest,
+// in which case it is the version that Latest points to. If Latest doesn't point to a version, Latest is returned.
+func (m Mapping) Resolve(v Version) Version {
+	return m.current().resolve(v)
+}
+
+// resolve implements Mapping.Resolve() for t.
+func (t *topology) resolve(v Version) Version {
+	if v == Latest && t.latest != "" {
+		return t.latest
+	}
+	return v
+}
+
+// Has reports if version v is in the Mapping, whether or not it is ready. Use this to check a version
+// without its address, as Base() returns the empty string both for versions we don't have and for
+// versions that are not ready. Has(Latest) is false if no version is the latest.
+func (m Mapping) Has(v Version) bool {
+	return m.current().versions[v] != nil
+}
+
+// State returns the State of version v. ok is false if the version is not in the Mapping.
+func (m Mapping) State(v Version) (state State, ok bool) {
+	r := m.current().versions[v]
+	if r == nil {
+		return 0, false
+	}
+	return State(r.state.Load()), true
+}
+
+// Supports reports if version v serves endpoint, which is a path such as "/getnodebootstrapdata".
+// A version serves every endpoint unless its launch config lists the ones it serves. Versions that
+// are not in the Mapping are reported as serving every endpoint, so that the caller's error for a
+// missing version is not replaced.
+func (m Mapping) Supports(v Version, endpoint string) bool {
+	r := m.current().versions[v]
+	if r == nil || r.endpoints == nil {
+		return true
+	}
+	return r.endpoints[endpoint]
+}
+
+// All returns a copy of the mapping of versions that are ready to the addresses of every agent baker replica
+// for that version. Changing the returned map does not change the Mapping.
+func (m Mapping) All() map[Version][]string {
+	t := m.current()
+	all := make(map[Version][]string, len(t.versions))
+	for v, r := range t.versions {
+		if !r.ready() {
+			continue
+		}
+		all[v] = append([]string(nil), r.addrs...)
+	}
+	return all
+}
+
+// String implements fmt.Stringer. It returns a table of versions and their addresses sorted by version.
+// This is meant for debugging.
+func (m Mapping) String() string {
+	t := m.current()
+	vers := t.available()
+
+	width := len("VERSION")
+	for _, v := range vers {
+		if len(v) > width {
+			width = len(v)
+		}
+	}
+
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("%-*s  %s\n", width, "VERSION", "ADDRESS"))
+	for _, v := range vers {
+		r := t.versions[v]
+		addrs := strings.Join(r.addrs, ", ")
+		if !r.ready() {
+			addrs = fmt.Sprintf("(%s)", State(r.state.Load()))
+		}
+		b.WriteString(fmt.Sprintf("%-*s  %s\n", width, v, addrs))
+	}
+	return b.String()
+}
+
+// ErrVersionNotFound is returned when a version is requested that is not in the Mapping.
+type ErrVersionNotFound struct {
+	// Version is the version that was requested.
+	Version Version
+	// Available are the versions that could have been requested, sorted.
+	Available []Version
+}
+
+// Error implements the error interface.
+func (e *ErrVersionNotFound) Error() string {
+	return fmt.Sprintf("agent baker version(%s) not found, available versions are: %v", e.Version, e.Available)
+}
+
+// ErrVersionNotReady is returned when a version is requested that is in the Mapping, but is not ready
+// to be sent requests.
+type ErrVersionNotReady struct {
+	// Version is the version that was requested.
+	Version Version
+	// State is the state the version is in. This is never StateReady.
+	State State
+}
+
+// Error implements the error interface.
+func (e *ErrVersionNotReady) Error() string {
+	return fmt.Sprintf("agent baker version(%s) is not ready, it is %s", e.Version, e.State)
+}
+
+// ErrNoLatest is returned when Latest is requested, but no version is the latest. This happens when
+// there are no versions or WithStableLatest() is used and there are only prereleases.
+type ErrNoLatest struct {
+	// Available are the versions that can be requested by their version, sorted.
+	Available []Version
+}
+
+// Error implements the error interface.
+func (e *ErrNoLatest) Error() string {
+	if len(e.Available) == 0 {
+		return "no agent baker version is latest, there are no versions"
+	}
+	return fmt.Sprintf("no agent baker version is latest, request one of these versions: %v", e.Available)
+}
+
+// ErrVersionUnhealthy is returned by HealthyBase() when none of the replicas of a version are healthy.
+type ErrVersionUnhealthy struct {
+	// Version is the version that was requested.
+	Version Version
+	// Replicas is the number of replicas of the version, none of which are healthy.
+	Replicas int
+}
+
+// Error implements the error interface.
+func (e *ErrVersionUnhealthy) Error() string {
+	return fmt.Sprintf("agent baker version(%s) has no healthy replicas, all %d are unhealthy", e.Version, e.Replicas)
+}
+
+// BaseOrErr is like Base() except that if the version is not found, it returns an *ErrVersionNotFound
+// that lists the versions that are available. If Latest is requested but no version is the latest,
+// it returns an *ErrNoLatest. If the version is known but not ready, it returns an *ErrVersionNotReady.
+func (m Mapping) BaseOrErr(v Version) (string, error) {
+	return m.HealthyBase(v, nil)
+}
+
+// HealthyBase is like BaseOrErr() except that replicas that healthy reports false for are skipped,
+// so that requests aren't sent to a replica that is known to be down. A replica is used again once
+// healthy reports true for it. If healthy is false for every replica, it returns an *ErrVersionUnhealthy.
+// If healthy is nil, every replica is healthy.
+func (m Mapping) HealthyBase(v Version, healthy func(addr string) bool) (string, error) {
+	t := m.current()
+	r := t.versions[v]
+	switch {
+	case r == nil && v == Latest:
+		return "", &ErrNoLatest{Available: t.available()}
+	case r == nil:
+		return "", &ErrVersionNotFound{Version: v, Available: t.available()}
+	case !r.ready():
+		return "", &ErrVersionNotReady{Version: v, State: State(r.state.Load())}
+	}
+	if healthy == nil {
+		return r.pick(), nil
+	}
+	// Other requests move r.next on while we try, so we only take one place in the round-robin order
+	// and try each replica from there.
+	n := r.next.Add(1) - 1
+	for i := range r.addrs {
+		if addr := r.addrs[(n+uint64(i))%uint64(len(r.addrs))]; healthy(addr) {
+			return addr, nil
+		}
+	}
+	return "", &ErrVersionUnhealthy{Version: t.resolve(v), Replicas: len(r.addrs)}
+}
+
+// available returns the sorted list of versions in the topology.
+func (t *topology) available() []Version {
+	vers := make([]Version, 0, len(t.versions))
+	for v := range t.versions {
+		vers = append(vers, v)
+	}
+	SortVersions(vers)
+	return vers
 }
 
 // launchConfig holds configuration elements for launching a version.
 // This can be stored next to an agent baker binary to configure it via flags and toggles.
 type launchConfig struct {
+	// Flags are extra flags passed to the agent baker binary when it is started.
+	Flags []string `json:"flags,omitempty"`
+	// Scheme is the URL scheme the agent baker serves, either "http" or "https". Defaults to "http".
+	Scheme string `json:"scheme,omitempty"`
+	// Host is the host the agent baker can be reached at. Defaults to "localhost". This is for agent bakers
+	// that don't share our network, such as ones that run in their own network namespace.
+	Host string `json:"host,omitempty"`
+	// Socket is the path of a unix socket to serve on instead of a port. If set, the agent baker is started
+	// with "-socket <path>" instead of "-port <port>". Any "{port}" in the path is replaced with the port the
+	// agent baker would have been given, which keeps the paths of replicas apart.
+	Socket string `json:"socket,omitempty"`
+	// Env are extra environment variables set for the agent baker. These override variables
+	// of the same name in our environment.
+	Env map[string]string `json:"env,omitempty"`
+	// CleanEnv causes the agent baker to only get the variables in Env instead of also
+	// getting our environment.
+	CleanEnv bool `json:"cleanEnv,omitempty"`
+	// Limits caps the resources the agent baker can use.
+	Limits limits `json:"limits,omitempty"`
+	// Port is the port the first replica is started on, the next replica gets Port+1 and so on.
+	// If not set, the port comes from WithStablePorts() or is the next free one.
+	Port int `json:"port,omitempty"`
+	// Binary is the file name of the agent baker binary in a version directory. Defaults to "agentbaker".
+	// This can't be used in a manifest, which has a path for the binary instead.
+	Binary string `json:"binary,omitempty"`
+	// Helpers are the file names of other executables in the same directory as the agent baker binary.
+	// They are written next to the agent baker, which is started in that directory with it on the PATH.
+	Helpers []string `json:"helpers,omitempty"`
+	// Endpoints are the paths of the endpoints the agent baker serves, such as "/getnodebootstrapdata".
+	// Requests for other endpoints are refused instead of being sent to it. If not set, the agent baker
+	// is taken to serve every endpoint.
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// launchFile is the name of an optional file next to an agent baker binary that holds its launchConfig.
+const launchFile = "launch.json"
+
+// validate validates the launchConfig.
+func (l launchConfig) validate() error {
+	switch l.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("scheme(%s) must be http or https", l.Scheme)
+	}
+	if l.Socket != "" {
+		if l.Host != "" {
+			return fmt.Errorf("host and socket cannot both be set")
+		}
+		if l.Scheme == "https" {
+			return fmt.Errorf("https is not supported over a socket")
+		}
+	}
+	if strings.ContainsAny(l.Host, "/:@?#") {
+		return fmt.Errorf("host(%s) must be a host name or IPv4 address", l.Host)
+	}
+	for k := range l.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("env has an invalid variable name(%q)", k)
+		}
+	}
+	if err := l.Limits.validate(); err != nil {
+		return fmt.Errorf("limits: %w", err)
+	}
+	if l.Port < 0 || l.Port > maxPort {
+		return fmt.Errorf("port(%d) must be between 1 and %d, or 0 to not set one", l.Port, maxPort)
+	}
+	if l.Binary != "" && !isFileName(l.Binary) {
+		return fmt.Errorf("binary(%s) must be a file name", l.Binary)
+	}
+	seen := map[string]bool{primaryName: true}
+	for _, h := range l.Helpers {
+		switch {
+		case !isFileName(h):
+			return fmt.Errorf("helper(%s) must be a file name", h)
+		case seen[h]:
+			return fmt.Errorf("helper(%s) is listed twice or has the name of the agent baker binary", h)
+		}
+		seen[h] = true
+	}
+	if l.Endpoints != nil && len(l.Endpoints) == 0 {
+		return fmt.Errorf("endpoints must list at least one endpoint if it is set")
+	}
+	seenEP := map[string]bool{}
+	for _, ep := range l.Endpoints {
+		switch {
+		case !strings.HasPrefix(ep, "/"):
+			return fmt.Errorf("endpoint(%s) must be a path starting with /", ep)
+		case seenEP[ep]:
+			return fmt.Errorf("endpoint(%s) is listed twice", ep)
+		}
+		seenEP[ep] = true
+	}
+	return nil
+}
+
+// isFileName reports if name is the name of a file in a directory, not a path.
+func isFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// listen returns the flags that tell the agent baker where to listen and the address to reach it at.
+// bindHost is the address from WithBindHost(). An agent baker with a Host listens on that, as that is
+// where we reach it. If neither is set, the agent baker is not given "-host", as agent bakers that
+// predate it reject it, and it listens on its default of localhost.
+func (l launchConfig) listen(port int32, bindHost string) (args []string, addr string) {
+	if l.Socket != "" {
+		sock := strings.ReplaceAll(l.Socket, "{port}", strconv.Itoa(int(port)))
+		return []string{"-socket", sock}, "unix://" + sock
+	}
+
+	host := l.Host
+	if host == "" {
+		host = "localhost"
+	} else {
+		bindHost = l.Host
+	}
+	args = []string{"-port", strconv.Itoa(int(port))}
+	if bindHost != "" {
+		args = append(args, "-host", bindHost)
+	}
+	return args, fmt.Sprintf("%s://%s:%d", l.scheme(), host, port)
+}
+
+// environ returns the environment the agent baker is started with, in the form of os.Environ().
+func (l launchConfig) environ() []string {
+	// This must not be nil, as a nil exec.Cmd.Env inherits our environment.
+	env := []string{}
+	if !l.CleanEnv {
+		env = append(env, os.Environ()...)
+	}
+	// Later entries win in exec.Cmd.Env, so these override what we inherited.
+	for _, k := range sortedKeys(l.Env) {
+		env = append(env, k+"="+l.Env[k])
+	}
+	return env
+}
+
+// secretMarkers are parts of environment variable names that mean the value is a secret.
+var secretMarkers = []string{"SECRET", "PASSWORD", "PASSWD", "TOKEN", "KEY", "CREDENTIAL"}
+
+// redactedEnv returns the variables in Env in the form "name=value" with the value of any
+// variable that looks like it holds a secret replaced. This is what is safe to log.
+func (l launchConfig) redactedEnv() []string {
+	env := make([]string, 0, len(l.Env))
+	for _, k := range sortedKeys(l.Env) {
+		v := l.Env[k]
+		upper := strings.ToUpper(k)
+		for _, m := range secretMarkers {
+			if strings.Contains(upper, m) {
+				v = "REDACTED"
+				break
+			}
+		}
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scheme returns the URL scheme to use to talk to the agent baker.
+func (l launchConfig) scheme() string {
+	if l.Scheme == "" {
+		return "http"
+	}
+	return l.Scheme
 }
 
 type versionPath struct {
 	version Version
-	bin     []byte
-	addr    string
+	// bin is the agent baker binary. It isn't read until the version is started.
+	bin binSource
+	// addrs are the addresses of the replicas that were started.
+	addrs []string
+	// procs are the processes of the replicas that were started, in the same order as addrs.
+	procs []*proc
+
+	// helpers are the executables that are written next to bin. They are read when the version is started.
+	helpers []helperBin
+
+	// launch is how the version should be started.
+	launch launchConfig
+	// platform is the declared platform of the binary. If not set, it is detected from the binary.
+	platform platform
+	// latest indicates this version was declared as the latest version.
+	latest bool
+	// bindHost is the address the agent baker is told to listen on, from WithBindHost().
+	bindHost string
+	// workDir is the working directory of the agent baker, from WithWorkDir(). If empty, it is the
+	// directory its binaries are written to.
+	workDir string
+	// gen is the Refresh() that started the version, or 0 if it wasn't. It keeps the binaries of a
+	// version that is restarted apart from those of the processes it replaces.
+	gen uint64
+}
+
+// binDir is the directory the binaries of vp are written to before it is started.
+func (vp versionPath) binDir() string {
+	if vp.gen == 0 {
+		return versionDir(vp.version)
+	}
+	// Versions started by New() use "bakedbaker-<version>", so this can't be the directory of another version.
+	return filepath.Join(os.TempDir(), fmt.Sprintf("bakedbaker.%s.%d", vp.version, vp.gen))
+}
+
+// Option is an option for the New() constructor, Discover() and Spawn().
+type Option func(*options) error
+
+// options holds the settings that can be changed with an Option.
+type options struct {
+	// concurrency is the maximum number of versions that are extracted and started at the same time.
+	concurrency int
+	// replicas is the number of agent baker processes started for each version.
+	replicas int
+	// bestEffort indicates that versions that fail to start are left out of the Mapping instead
+	// of failing New().
+	bestEffort bool
+	// log is where we log what happens while starting versions.
+	log *slog.Logger
+	// discover finds the versions to start. If nil, the embedded binaries are used.
+	discover Discoverer
+	// binDir is the directory from WithBinaryDir(). If discover is nil and this is set, the versions
+	// are found here instead of in the embedded binaries.
+	binDir string
+	// allowNoVersions allows New() to succeed when no versions are found.
+	allowNoVersions bool
+	// latest is the version that Latest points to. If empty, it is the version with the highest precedence
+	// or the one a manifest declares.
+	latest Version
+	// stableLatest keeps Latest from pointing to a prerelease when it is picked by precedence.
+	stableLatest bool
+	// basePort is the port WithStablePorts() starts from. If 0, ports are handed out in the order replicas start.
+	basePort int32
+	// warmup is the request sent to every replica once it is ready. If nil, no warmup is done.
+	warmup *warmup
+	// bindHost is the address agent bakers listen on. If empty, they listen on their default.
+	bindHost string
+	// workDir holds the working directory of each version. If empty, each version runs in the
+	// directory its binaries are written to.
+	workDir string
+	// startTimeout bounds New() and Spawn(), which then wait for the versions to be ready. If 0, they
+	// return once the versions are started.
+	startTimeout time.Duration
+	// skipBusyPorts hands out the next free port when ports are handed out in start order, instead
+	// of the next port. Refresh() sets this, as the versions that are already running hold ports.
+	skipBusyPorts bool
+	// start starts a single version. This is only changed in tests.
+	start starter
+}
+
+// refreshable reports if the versions found with o can change while we run, so that Refresh() is useful.
+func (o options) refreshable() bool {
+	return o.discover != nil || o.binDir != ""
+}
+
+// WithConcurrency sets the maximum number of versions that are extracted and started at the same time.
+// This defaults to runtime.GOMAXPROCS(0).
+func WithConcurrency(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			return fmt.Errorf("concurrency must be at least 1, was %d", n)
+		}
+		o.concurrency = n
+		return nil
+	}
+}
+
+// WithReplicas sets the number of agent baker processes that are started for each version.
+// Requests for a version are spread across its replicas in round-robin order. This defaults to 1.
+func WithReplicas(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			return fmt.Errorf("replicas must be at least 1, was %d", n)
+		}
+		o.replicas = n
+		return nil
+	}
+}
+
+// WithLogger sets the logger used to record what happens as versions are discovered and started.
+// By default nothing is logged.
+func WithLogger(log *slog.Logger) Option {
+	return func(o *options) error {
+		if log == nil {
+			return fmt.Errorf("logger cannot be nil")
+		}
+		o.log = log
+		return nil
+	}
+}
+
+// WithDiscoverer sets where New() finds the agent baker versions to start. By default the binaries
+// embedded in this package are used.
+func WithDiscoverer(d Discoverer) Option {
+	return func(o *options) error {
+		if d == nil {
+			return fmt.Errorf("discoverer cannot be nil")
+		}
+		o.discover = d
+		return nil
+	}
+}
+
+// WithBinaryDir finds the agent baker versions in dir instead of in the binaries embedded in this package.
+// dir is laid out like the embedded binaries: a manifest file, or a directory for each version. Unlike the
+// embedded binaries, these can be changed while we run, so the Mapping can be refreshed to pick up the
+// change, see Mapping.Refresh(). WithDiscoverer() wins over this if both are set.
+func WithBinaryDir(dir string) Option {
+	return func(o *options) error {
+		if dir == "" {
+			return fmt.Errorf("binary dir cannot be empty")
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("binary dir(%s) could not be made absolute: %w", dir, err)
+		}
+		fi, err := os.Stat(abs)
+		if err != nil {
+			return fmt.Errorf("binary dir(%s) could not be read: %w", abs, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("binary dir(%s) is not a directory", abs)
+		}
+		o.binDir = abs
+		return nil
+	}
+}
+
+// WithAllowNoVersions allows New() to return an empty Mapping when no versions are found instead of
+// ErrNoVersions. This is mostly useful in tests.
+func WithAllowNoVersions() Option {
+	return func(o *options) error {
+		o.allowNoVersions = true
+		return nil
+	}
+}
+
+// ErrNoVersions is returned by New() when no agent baker versions are found. It is also an ErrDiscover.
+var ErrNoVersions = errors.New(
+	"no agent baker versions were found, when using the embedded binaries internal/versions/binaries " +
+		"must have a <version>/agentbaker file for each version",
+)
+
+// These are the stages of starting versions. An error from New(), Discover(), Spawn() or
+// Mapping.WaitReady() wraps the one for the stage that failed, so callers can use errors.Is() to
+// find out what went wrong. With WithBestEffort(), each error in the StartErrors wraps its stage.
+var (
+	// ErrDiscover means the versions could not be found or what was found is not valid.
+	ErrDiscover = errors.New("discovering versions failed")
+	// ErrExtract means a version's binaries could not be read from where they were found.
+	ErrExtract = errors.New("extracting a version failed")
+	// ErrWrite means a version's binaries could not be written to disk.
+	ErrWrite = errors.New("writing a version failed")
+	// ErrSpawn means a version's agent baker could not be started.
+	ErrSpawn = errors.New("starting a version failed")
+	// ErrNotReady means a version did not answer its health probes. Mapping.WaitReady() returns a
+	// ReadyErrors, which is an ErrNotReady.
+	ErrNotReady = errors.New("versions are not ready")
+)
+
+// WithLatest makes Latest point to version v instead of the version with the highest precedence.
+// This overrides the latest version in a manifest. This allows a newer version to be run, such as
+// for a canary, without it getting the requests for Latest. New() returns an error if v is not found.
+func WithLatest(v Version) Option {
+	return func(o *options) error {
+		if v == "" || v == Latest {
+			return fmt.Errorf("latest must be a concrete version, was %q", v)
+		}
+		o.latest = v
+		return nil
+	}
+}
+
+// WithStableLatest keeps Latest from pointing to a prerelease, or to a version that is not a semantic version,
+// when it is picked by precedence. If there are no releases, no version is latest and requests for
+// Latest get an *ErrNoLatest. A latest version declared in a manifest or set with WithLatest() is
+// always used.
+func WithStableLatest() Option {
+	return func(o *options) error {
+		o.stableLatest = true
+		return nil
+	}
+}
+
+// WithBindHost sets the IP address agent bakers are told to listen on with the "-host" flag. By
+// default they are not given "-host" and listen on localhost, so that only this host can reach them.
+// Use "0.0.0.0" to have them listen on every interface, which agent bakers must support "-host" for.
+// Versions whose launch config sets a host listen on that host instead.
+func WithBindHost(host string) Option {
+	return func(o *options) error {
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("bind host(%s) must be an IP address", host)
+		}
+		o.bindHost = host
+		return nil
+	}
+}
+
+// WithWorkDir runs each agent baker in its own directory under dir, named after its version, instead
+// of the directory its binaries are written to, which is removed when it stops. Use this for agent
+// bakers that keep files in their working directory that should outlive them. The directories are
+// created if needed and must be writable. Replicas of a version share its directory.
+func WithWorkDir(dir string) Option {
+	return func(o *options) error {
+		if dir == "" {
+			return errors.New("work dir must not be empty")
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("work dir(%s) could not be made absolute: %w", dir, err)
+		}
+		o.workDir = abs
+		return nil
+	}
+}
+
+// WithStartTimeout bounds New() and Spawn() to d, which includes discovering the versions for New(),
+// and makes them wait for every version to be ready, so that an agent baker that never answers its
+// health probes can't hang the program. If d expires, the versions that were started are killed and
+// the error is a context.DeadlineExceeded. Without it, they return once the versions are started and
+// are only bounded by their ctx.
+func WithStartTimeout(d time.Duration) Option {
+	return func(o *options) error {
+		if d <= 0 {
+			return fmt.Errorf("start timeout must be positive, was %v", d)
+		}
+		o.startTimeout = d
+		return nil
+	}
+}
+
+// WithBestEffort causes New() to return a Mapping of the versions that started even if some
+// versions failed to start. In that case New() returns both the Mapping and a StartErrors describing
+// the versions that failed. Without this, New() fails if any version fails to start.
+// Versions that are found without their agent baker binary are left out with a warning, rather than
+// failing discovery with a *MissingBinaryError.
+func WithBestEffort() Option {
+	return func(o *options) error {
+		o.bestEffort = true
+		return nil
+	}
+}
+
+// MissingBinaryError is returned by discovery when a version has no agent baker binary, such as a
+// directory of the embedded binaries that only has a launch file. It wraps fs.ErrNotExist.
+type MissingBinaryError struct {
+	// Version is the version without a binary.
+	Version Version
+	// Path is where the binary should have been.
+	Path string
+}
+
+// Error implements the error interface.
+func (e *MissingBinaryError) Error() string {
+	return fmt.Sprintf("version(%s) does not have an agent baker binary at %s", e.Version, e.Path)
+}
+
+// Unwrap returns fs.ErrNotExist.
+func (e *MissingBinaryError) Unwrap() error {
+	return fs.ErrNotExist
+}
+
+// StartErrors is returned by New() when WithBestEffort() is used and some versions could not
+// be started. It maps each version that failed to the reason.
+type StartErrors map[Version]error
+
+// Error implements the error interface.
+func (s StartErrors) Error() string {
+	vers := make([]Version, 0, len(s))
+	for v := range s {
+		vers = append(vers, v)
+	}
+	SortVersions(vers)
+
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("%d version(s) failed to start: ", len(s)))
+	for i, v := range vers {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(fmt.Sprintf("version(%s): %s", v, s[v]))
+	}
+	return b.String()
+}
+
+// Unwrap returns the errors for each version.
+func (s StartErrors) Unwrap() []error {
+	errs := make([]error, 0, len(s))
+	for _, err := range s {
+		errs = append(errs, err)
+	}
+	return errs
 }
 
-// New creates a new mapping of versions to localhost addresses.
-func New(ctx context.Context) (Mapping, error) {
-	// TODO: Need to add some logic to find the latest version and make a mapping to that.
-	verPaths, err := extractBinaries(binariesFS)
+// New creates a new mapping of versions to localhost addresses. This is Discover() followed by Spawn().
+func New(ctx context.Context, options ...Option) (Mapping, error) {
+	opts, err := newOptions(options)
 	if err != nil {
 		return Mapping{}, err
 	}
+	// The start timeout covers discovering the versions as well as starting them.
+	ctx, cancel := opts.startContext(ctx)
+	defer cancel()
 
-	if err := spawnVersions(ctx, verPaths); err != nil {
+	infos, err := Discover(ctx, options...)
+	if err != nil {
+		return Mapping{}, opts.timedOut(ctx, err)
+	}
+	return spawn(ctx, infos, opts)
+}
+
+// Spawn starts the agent baker versions in infos, which must come from Discover(), and returns
+// a Mapping of them. The Latest field of infos decides which version Latest points to, so it can
+// be changed between the calls. Options that change what is discovered are ignored, other than by
+// Mapping.Refresh(), which discovers the versions again with them.
+func Spawn(ctx context.Context, infos []VersionInfo, options ...Option) (Mapping, error) {
+	opts, err := newOptions(options)
+	if err != nil {
 		return Mapping{}, err
 	}
+	ctx, cancel := opts.startContext(ctx)
+	defer cancel()
+
+	return spawn(ctx, infos, opts)
+}
 
-	m := Mapping{
-		versions: map[Version]string{},
+// spawn implements Spawn(). ctx already has the start timeout applied.
+func spawn(ctx context.Context, infos []VersionInfo, opts options) (Mapping, error) {
+	latest := 0
+	verPaths := make([]versionPath, 0, len(infos))
+	for _, info := range infos {
+		if info.vp.version == "" || info.vp.version != info.Version {
+			return Mapping{}, fmt.Errorf("version(%s) did not come from Discover()", info.Version)
+		}
+		if info.Latest {
+			latest++
+		}
+		vp := info.vp
+		vp.latest = info.Latest
+		verPaths = append(verPaths, vp)
+	}
+	if latest > 1 {
+		return Mapping{}, fmt.Errorf("only one version can be latest, %d are", latest)
 	}
 
-	for _, vp := range verPaths {
-		m.versions[vp.version] = vp.addr
+	// The checksums are taken before the versions start, so a binary that changes while they do is
+	// restarted by the next Refresh().
+	var sums map[Version]string
+	if opts.refreshable() {
+		sums = checksums(verPaths)
+	}
+
+	var startErrs StartErrors
+	if err := spawnVersions(ctx, verPaths, opts); err != nil {
+		if !errors.As(err, &startErrs) {
+			return Mapping{}, opts.timedOut(ctx, err)
+		}
+	}
+
+	m := newMapping(verPaths)
+	for v, err := range startErrs {
+		r := m.current().versions[v]
+		r.err = err
+		r.state.Store(int32(StateFailed))
+	}
+	// Versions that failed to start are never ready, which only matters if they kept the others
+	// from being ready in time.
+	if opts.startTimeout > 0 {
+		if err := m.WaitReady(ctx); err != nil && ctx.Err() != nil {
+			// Nothing will use the versions, so they must not outlive us.
+			for v, r := range m.current().versions {
+				r.state.Store(int32(StateStopped))
+				// Latest is an alias of another version, which is already being reaped.
+				if v != Latest {
+					reap(r.dir, r.procs)
+				}
+			}
+			return Mapping{}, opts.timedOut(ctx, err)
+		}
+	}
+	if opts.warmup != nil {
+		m.warmUp(ctx, *opts.warmup, opts.log)
+	}
+	if opts.refreshable() {
+		for v, sum := range sums {
+			m.current().versions[v].sum = sum
+		}
+		m.refresher = &refresher{opts: opts}
+	}
+	if len(startErrs) > 0 {
+		return m, startErrs
 	}
 	return m, nil
 }
 
+// startContext returns ctx bounded by the start timeout, if there is one.
+func (o options) startContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.startTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.startTimeout)
+}
+
+// timedOut returns err, which happened while starting versions with ctx. If the start timeout expired,
+// err is wrapped to say so and to be a context.DeadlineExceeded.
+func (o options) timedOut(ctx context.Context, err error) error {
+	if o.startTimeout == 0 || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("versions did not start within %v: %w", o.startTimeout, err)
+	}
+	return fmt.Errorf("versions did not start within %v: %w: %w", o.startTimeout, context.DeadlineExceeded, err)
+}
+
+// VersionInfo describes an agent baker version that was found, but has not been started.
+type VersionInfo struct {
+	// Version is the agent baker version.
+	Version Version
+	// Latest is true if requests for Latest go to this version.
+	Latest bool
+
+	// vp is how to start the version.
+	vp versionPath
+}
+
+// Discover finds the agent baker versions that New() would start with the same options, without starting
+// them or writing anything to disk. The versions are sorted. Pass them to Spawn() to start them.
+func Discover(ctx context.Context, options ...Option) ([]VersionInfo, error) {
+	opts, err := newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	verPaths, err := discover(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]VersionInfo, 0, len(verPaths))
+	for _, vp := range verPaths {
+		infos = append(infos, VersionInfo{Version: vp.version, Latest: vp.latest, vp: vp})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Version.Less(infos[j].Version) })
+	return infos, nil
+}
+
+// discover finds the versions to start using opts and marks the latest version.
+func discover(ctx context.Context, opts options) ([]versionPath, error) {
+	d := opts.discover
+	if d == nil {
+		e := embedDiscoverer{log: opts.log, bestEffort: opts.bestEffort}
+		if opts.binDir != "" {
+			e.fs = os.DirFS(opts.binDir).(binFS)
+		}
+		d = e
+	}
+
+	verPaths, err := d.Discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDiscover, err)
+	}
+	for _, vp := range verPaths {
+		if err := vp.version.validate(); err != nil {
+			return nil, fmt.Errorf("%w: discovered a version that did not validate: %w", ErrDiscover, err)
+		}
+	}
+	if err := checkDuplicates(verPaths); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDiscover, err)
+	}
+	if len(verPaths) == 0 {
+		if !opts.allowNoVersions {
+			return nil, fmt.Errorf("%w: %w", ErrDiscover, ErrNoVersions)
+		}
+		opts.log.Warn("no agent baker versions were found, every request will fail")
+	}
+	if opts.latest != "" {
+		if err := pinLatest(verPaths, opts.latest); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrDiscover, err)
+		}
+	} else {
+		markLatest(verPaths, opts.stableLatest)
+	}
+	return verPaths, nil
+}
+
+// checkDuplicates returns an error naming two versions in verPaths that are the same version, either
+// because they are equal or because they only differ in what has no effect on precedence, such as a
+// leading "v" or build metadata. Requests for one could be served by the other, so that is an error
+// rather than one of them silently winning.
+func checkDuplicates(verPaths []versionPath) error {
+	for i, a := range verPaths {
+		for _, b := range verPaths[i+1:] {
+			switch {
+			case a.version == b.version:
+				return fmt.Errorf("version(%s) was found more than once", a.version)
+			case a.version.Compare(b.version) == 0:
+				return fmt.Errorf("version(%s) and version(%s) are the same version", a.version, b.version)
+			}
+		}
+	}
+	return nil
+}
+
+// markLatest marks the version with the highest precedence as the latest version, unless
+// one of the versions was already declared as the latest. If stable is set, only releases can
+// be marked, so if there are none no version is latest.
+func markLatest(verPaths []versionPath, stable bool) {
+	newest := -1
+	for i, vp := range verPaths {
+		if vp.latest {
+			return
+		}
+		if stable && !isRelease(vp.version) {
+			continue
+		}
+		if newest < 0 || verPaths[newest].version.Less(vp.version) {
+			newest = i
+		}
+	}
+	if newest >= 0 {
+		verPaths[newest].latest = true
+	}
+}
+
+// pinLatest marks v as the latest version, replacing any version that was declared as latest.
+// It returns an error if v is not in verPaths.
+func pinLatest(verPaths []versionPath, v Version) error {
+	found := false
+	for _, vp := range verPaths {
+		if vp.version == v {
+			found = true
+			break
+		}
+	}
+	if !found {
+		vers := make([]Version, 0, len(verPaths))
+		for _, vp := range verPaths {
+			vers = append(vers, vp.version)
+		}
+		SortVersions(vers)
+		return fmt.Errorf("latest version(%s) was not found, found versions are: %v", v, vers)
+	}
+
+	for i := range verPaths {
+		verPaths[i].latest = verPaths[i].version == v
+	}
+	return nil
+}
+
+// newMapping creates a Mapping from the versions in verPaths. Versions that were started are
+// StateReady, the rest are StateStarting.
+func newMapping(verPaths []versionPath) Mapping {
+	t := &topology{versions: map[Version]*replicas{}}
+	for _, vp := range verPaths {
+		t.add(vp, newReplicas(vp))
+	}
+
+	m := Mapping{topo: &atomic.Pointer[topology]{}, clock: clock.Real{}}
+	m.topo.Store(t)
+	return m
+}
+
+// newReplicas returns the replicas of vp. If vp was started they are StateReady, otherwise StateStarting.
+func newReplicas(vp versionPath) *replicas {
+	r := &replicas{addrs: vp.addrs, procs: vp.procs, dir: vp.binDir()}
+	if vp.launch.Endpoints != nil {
+		r.endpoints = make(map[string]bool, len(vp.launch.Endpoints))
+		for _, ep := range vp.launch.Endpoints {
+			r.endpoints[ep] = true
+		}
+	}
+	if len(vp.addrs) > 0 {
+		r.state.Store(int32(StateReady))
+	}
+	return r
+}
+
+// add adds r, the replicas of vp, to t.
+func (t *topology) add(vp versionPath, r *replicas) {
+	t.versions[vp.version] = r
+	// Latest shares the replicas so that round-robin is shared with the version it points to.
+	if vp.latest {
+		t.versions[Latest] = r
+		t.latest = vp.version
+	}
+}
+
+// newOptions returns the options with defaults applied and then all options applied.
+func newOptions(opts []Option) (options, error) {
+	o := options{
+		concurrency: runtime.GOMAXPROCS(0),
+		replicas:    1,
+		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		start:       startVersion,
+	}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return options{}, err
+		}
+	}
+	return o, nil
+}
+
+// Discoverer finds the agent baker versions that should be started. Each versionPath must have
+// its version and binary set. This allows versions to come from somewhere other than the binaries
+// embedded in this package.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]versionPath, error)
+}
+
+// embedDiscoverer is a Discoverer for the binaries embedded in this package.
+type embedDiscoverer struct {
+	// fs holds the binaries. If nil, the embedded binaries are used. This is set by WithBinaryDir().
+	fs  binFS
+	log *slog.Logger
+	// bestEffort is from WithBestEffort(). It causes versions without a binary to be skipped.
+	bestEffort bool
+}
+
+// Discover implements Discoverer.
+func (e embedDiscoverer) Discover(ctx context.Context) ([]versionPath, error) {
+	rdfs := e.fs
+	if rdfs == nil {
+		var err error
+		rdfs, err = embedded()
+		if err != nil {
+			return nil, err
+		}
+	}
+	log := e.log
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return extractBinaries(rdfs, log, e.bestEffort)
+}
+
 type binFS interface {
 	fs.ReadDirFS
 	fs.ReadFileFS
 }
 
-// extractBinaries reads the embedded filesystem and extracts the agent baker binaries.
-func extractBinaries(rdfs binFS) ([]versionPath, error) {
+// embedded returns the embedded binaries filesystem rooted at the binaries directory.
+func embedded() (binFS, error) {
+	sub, err := fs.Sub(binariesFS, "binaries")
+	if err != nil {
+		return nil, fmt.Errorf("could not open the embedded binaries directory: %w", err)
+	}
+	return sub.(binFS), nil
+}
+
+// extractBinaries reads the embedded filesystem and finds the agent baker binaries. If the filesystem
+// has a manifest file, the versions in the manifest are used. Otherwise every directory is a version.
+// A version without its binary is an error, unless skipMissing is set, in which case it is left out
+// and a warning is logged.
+func extractBinaries(rdfs binFS, log *slog.Logger, skipMissing bool) ([]versionPath, error) {
+	man, err := readManifest(rdfs)
+	switch {
+	case err != nil:
+		return nil, err
+	case man != nil:
+		return man.extract(rdfs, log, skipMissing)
+	}
+
 	versions, err := rdfs.ReadDir(".")
 	if err != nil {
 		return nil, fmt.Errorf("could not read the versions directory: %v", err)
@@ -127,55 +1304,284 @@ func extractBinaries(rdfs binFS) ([]versionPath, error) {
 			return nil, fmt.Errorf("embed filesystem had version that did not validate: %v", err)
 		}
 
-		binPath := filepath.Join(fn.Name(), "agentbaker")
-		content, err := binariesFS.ReadFile(binPath)
+		vp := versionPath{version: ver}
+		launch, err := rdfs.ReadFile(path.Join(fn.Name(), launchFile))
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(launch, &vp.launch); err != nil {
+				return nil, fmt.Errorf("could not decode %s file for version(%v): %w", launchFile, ver, err)
+			}
+			if err := vp.launch.validate(); err != nil {
+				return nil, fmt.Errorf("version(%v) has a bad %s file: %w", ver, launchFile, err)
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, fmt.Errorf("could not read %s file for version(%v): %w", launchFile, ver, err)
+		}
+
+		binName := vp.launch.Binary
+		if binName == "" {
+			binName = primaryName
+		}
+		binPath := path.Join(fn.Name(), binName)
+		info, err := fs.Stat(rdfs, binPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			err = &MissingBinaryError{Version: ver, Path: binPath}
+			if skipMissing {
+				log.Warn("skipping version", "version", ver, "err", err)
+				continue
+			}
+			return nil, err
+		case err != nil:
+			return nil, fmt.Errorf("could not read %s file for version(%v): %v", binName, ver, err)
+		}
+		vp.bin = fsBinary{fsys: rdfs, path: binPath}
+		vp.helpers, err = findHelpers(rdfs, fn.Name(), vp.launch.Helpers)
 		if err != nil {
-			return nil, fmt.Errorf("could not read agentbaker file for version(%v): %v", ver, err)
+			return nil, fmt.Errorf("version(%v): %w", ver, err)
+		}
+
+		plat, err := rdfs.ReadFile(path.Join(fn.Name(), platformFile))
+		switch {
+		case err == nil:
+			vp.platform, err = parsePlatform(string(plat))
+			if err != nil {
+				return nil, fmt.Errorf("version(%v) has a bad %s file: %w", ver, platformFile, err)
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, fmt.Errorf("could not read %s file for version(%v): %w", platformFile, ver, err)
 		}
-		verPaths = append(verPaths, versionPath{version: ver, bin: content})
+
+		log.Info("version discovered", "version", ver, "size", info.Size())
+		verPaths = append(verPaths, vp)
 	}
 	return verPaths, nil
 }
 
+// starter starts the agent baker for a version so that it listens on port. It returns the
+// address the agent baker can be reached at and its process. The process may be nil if
+// the agent baker isn't a process we started.
+type starter func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error)
+
 // spawnVersion takes a list of agent baker versions and the relevant binaries and runs them.
-// It modifies the versionPath slice in place to add the address of the running agent baker instances.
-func spawnVersions(ctx context.Context, verPaths []versionPath) error {
-	ports := atomic.Int32{}
-	ports.Store(8080)
+// It modifies the versionPath slice in place to add the addresses of the running agent baker instances.
+// Each version is started opts.replicas times, each on its own port. At most opts.concurrency
+// versions are started at the same time. If any version fails to start, versions that have not
+// started yet will not be started. If opts.bestEffort is set, all versions are tried and a
+// StartErrors is returned with the versions that failed.
+func spawnVersions(ctx context.Context, verPaths []versionPath, opts options) error {
+	ports := newPortPicker(verPaths, opts)
+	if err := ports.validate(verPaths); err != nil {
+		return fmt.Errorf("%w: %w", ErrSpawn, err)
+	}
 
-	tmpdir := os.TempDir()
+	mu := sync.Mutex{}
+	startErrs := StartErrors{}
 
-	g := wait.Group{}
+	// spawnCtx is cancelled when any version fails to start, so that no more versions are started.
+	spawnCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g := wait.Group{CancelOnErr: cancel}
+
+	// limit holds a slot for every version that is currently starting. We don't use a limited.Pool
+	// here because it releases a slot when the job is submitted, not when it finishes.
+	limit := make(chan struct{}, opts.concurrency)
+
+	if opts.bindHost != "" && !net.ParseIP(opts.bindHost).IsLoopback() {
+		opts.log.Warn("agent bakers listen on an address other hosts may reach", "bindHost", opts.bindHost)
+	}
 
 	for i, vp := range verPaths {
 		i := i
 		vp := vp
+		vp.bindHost = opts.bindHost
+		if opts.workDir != "" {
+			vp.workDir = filepath.Join(opts.workDir, vp.version.String())
+		}
+
+		select {
+		case <-spawnCtx.Done():
+		case limit <- struct{}{}:
+		}
+		if spawnCtx.Err() != nil {
+			break
+		}
 
 		g.Go(
-			ctx,
+			spawnCtx,
 			func(ctx context.Context) error {
-				fp := filepath.Join(tmpdir, vp.version.String())
-
-				if err := os.WriteFile(fp, vp.bin, 0755); err != nil {
-					return fmt.Errorf("could not write agentbaker binary file(%v): %v", vp.version, err)
-				}
-				port := ports.Add(1) - 1
-
-				vp.addr = fmt.Sprintf("http://localhost:%d", port)
+				defer func() { <-limit }()
 
-				// NOTE: We would really want to monitor the health of the binary after start. And should decide what to do
-				// if an underlying binary crashes.
-				if err := exec.Command(fp, "-port", vp.addr).Start(); err != nil {
-					return fmt.Errorf("could not start agentbaker binary(%v): %v", vp.version, err)
+				addrs := make([]string, 0, opts.replicas)
+				procs := make([]*proc, 0, opts.replicas)
+				for r := 0; r < opts.replicas; r++ {
+					addr, port, cmd, err := startReplica(ctx, vp, r, ports, opts)
+					if err != nil {
+						// A version is started with all of its replicas or not at all.
+						reap(vp.binDir(), procs)
+						if opts.bestEffort {
+							opts.log.Warn("version failed to start, continuing without it", "version", vp.version, "err", err)
+							mu.Lock()
+							startErrs[vp.version] = err
+							mu.Unlock()
+							return nil
+						}
+						return err
+					}
+					opts.log.Info("version started", "version", vp.version, "addr", addr, "replica", r)
+					addrs = append(addrs, addr)
+					// A replica that exits is started again on the same port, so its address doesn't change.
+					// vp gets the addresses below, so the restart gets its own copy.
+					vp := vp
+					restart := func(ctx context.Context) (*exec.Cmd, error) {
+						_, cmd, err := opts.start(ctx, vp, port, opts.log)
+						return cmd, err
+					}
+					procs = append(procs, newProc(vp.version, cmd, restart, opts.log))
 				}
+				vp.addrs = addrs
+				vp.procs = procs
 				verPaths[i] = vp
 				return nil
 			},
 		)
 	}
 
-	if err := g.Wait(ctx); err != nil {
+	err := g.Wait(ctx)
+	// If our parent was cancelled, we may have stopped starting versions without any error.
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		// Nothing will use the versions that did start, so they must not outlive us.
+		for i, vp := range verPaths {
+			if len(vp.procs) > 0 {
+				reap(vp.binDir(), vp.procs)
+				verPaths[i].addrs, verPaths[i].procs = nil, nil
+			}
+		}
 		return err
 	}
+	if len(startErrs) > 0 {
+		return startErrs
+	}
 	return nil
 }
+
+// startReplica starts replica r of vp on the port that ports hands out for it. It returns the address
+// the replica is reached at, its port and its process.
+func startReplica(ctx context.Context, vp versionPath, r int, ports *portPicker, opts options) (string, int32, *exec.Cmd, error) {
+	port, err := ports.port(vp, r)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("%w: %w", ErrSpawn, err)
+	}
+	addr, cmd, err := opts.start(ctx, vp, port, opts.log)
+	return addr, port, cmd, err
+}
+
+// reap stops procs, which are the replicas of a version, and removes dir, the binaries they were started from.
+func reap(dir string, procs []*proc) {
+	for _, p := range procs {
+		p.stop()
+	}
+	os.RemoveAll(dir)
+}
+
+// versionDir is the directory the binaries of version v are written to before it is started.
+func versionDir(v Version) string {
+	return filepath.Join(os.TempDir(), "bakedbaker-"+v.String())
+}
+
+// workDir creates the working directory of vp if needed and returns it, after checking that it is writable.
+// This is vp.workDir, or the directory its binaries are written to if that isn't set.
+func workDir(vp versionPath) (string, error) {
+	dir := vp.workDir
+	if dir == "" {
+		dir = vp.binDir()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("%w: could not create the working directory for version(%v): %w", ErrWrite, vp.version, err)
+	}
+	// Permissions don't tell the whole story, such as for a read-only mount, so we try to write.
+	f, err := os.CreateTemp(dir, ".bakedbaker-write-check-*")
+	if err != nil {
+		return "", fmt.Errorf("%w: working directory(%s) of version(%v) is not writable: %w", ErrWrite, dir, vp.version, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return dir, nil
+}
+
+// binaryPath is where the agent baker binary of version v is written before it is started.
+func binaryPath(v Version) string {
+	return filepath.Join(versionDir(v), primaryName)
+}
+
+// prependPath returns env, which is in the form of os.Environ(), with dir at the front of PATH.
+func prependPath(env []string, dir string) []string {
+	cur := ""
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			cur = v
+		}
+	}
+	if cur != "" {
+		dir += string(os.PathListSeparator) + cur
+	}
+	// Later entries win in exec.Cmd.Env, so this replaces the PATH in env.
+	return append(env[:len(env):len(env)], "PATH="+dir)
+}
+
+// startVersion writes the agent baker binary for a version to disk and starts it.
+func startVersion(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+	// The version names the directory we write to, so it must not be able to point outside of it.
+	if err := vp.version.validate(); err != nil {
+		return "", nil, fmt.Errorf("%w: refusing to extract version: %w", ErrExtract, err)
+	}
+	if err := checkPlatform(vp, platform{OS: runtime.GOOS, Arch: runtime.GOARCH}); err != nil {
+		return "", nil, err
+	}
+
+	dir := vp.binDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("%w: could not create the directory for version(%v): %w", ErrWrite, vp.version, err)
+	}
+	fp := filepath.Join(dir, primaryName)
+
+	if err := writeBinary(ctx, vp.version, fp, vp.bin); err != nil {
+		return "", nil, err
+	}
+	for _, h := range vp.helpers {
+		if err := writeBinary(ctx, vp.version, filepath.Join(dir, h.name), h.bin); err != nil {
+			return "", nil, fmt.Errorf("helper(%s): %w", h.name, err)
+		}
+	}
+	log.Info("version extracted", "version", vp.version, "path", fp, "helpers", len(vp.helpers))
+
+	args, addr := vp.launch.listen(port, vp.bindHost)
+	args = append(args, vp.launch.Flags...)
+	cmd := exec.Command(fp, args...)
+	if len(vp.launch.Env) > 0 || vp.launch.CleanEnv {
+		cmd.Env = vp.launch.environ()
+		log.Info("version environment", "version", vp.version, "env", vp.launch.redactedEnv(), "cleanEnv", vp.launch.CleanEnv)
+	}
+	// The agent baker may keep files in its working directory, so it must be one it can write to.
+	work, err := workDir(vp)
+	if err != nil {
+		return "", nil, err
+	}
+	cmd.Dir = work
+	// The agent baker finds its helpers on its PATH, and in its working directory unless WithWorkDir() moved it.
+	if len(vp.helpers) > 0 {
+		env := cmd.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		cmd.Env = prependPath(env, dir)
+	}
+	if err := startLimited(cmd, vp.launch.Limits, log.With("version", vp.version)); err != nil {
+		return "", nil, fmt.Errorf("%w: could not start agentbaker binary(%v): %w", ErrSpawn, vp.version, err)
+	}
+	return addr, cmd, nil
+}
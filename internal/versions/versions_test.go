@@ -0,0 +1,1645 @@
+package versions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// fakeVersions returns n versionPaths named 0.0.<i>.
+func fakeVersions(n int) []versionPath {
+	verPaths := make([]versionPath, n)
+	for i := range verPaths {
+		verPaths[i] = versionPath{version: Version(fmt.Sprintf("0.0.%d", i))}
+	}
+	return verPaths
+}
+
+func TestSpawnVersionsConcurrency(t *testing.T) {
+	t.Parallel()
+
+	const limit = 3
+
+	var inFlight, maxInFlight atomic.Int32
+	start := func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return fmt.Sprintf("http://localhost:%d", port), nil, nil
+	}
+
+	verPaths := fakeVersions(50)
+	opts, err := newOptions([]Option{WithConcurrency(limit)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.start = start
+
+	if err := spawnVersions(context.Background(), verPaths, opts); err != nil {
+		t.Fatalf("TestSpawnVersionsConcurrency: got err == %s, want err == nil", err)
+	}
+
+	if got := maxInFlight.Load(); got > limit {
+		t.Errorf("TestSpawnVersionsConcurrency: got %d versions starting at once, want <= %d", got, limit)
+	}
+	for _, vp := range verPaths {
+		if len(vp.addrs) == 0 {
+			t.Errorf("TestSpawnVersionsConcurrency: version(%s) did not get an address", vp.version)
+		}
+	}
+}
+
+func TestSpawnVersionsFailFast(t *testing.T) {
+	t.Parallel()
+
+	var started atomic.Int32
+	start := func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+		started.Add(1)
+		if vp.version == "0.0.2" {
+			return "", nil, errors.New("bad binary")
+		}
+		return fmt.Sprintf("http://localhost:%d", port), nil, nil
+	}
+
+	verPaths := fakeVersions(10)
+	opts, err := newOptions([]Option{WithConcurrency(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.start = start
+
+	if err := spawnVersions(context.Background(), verPaths, opts); err == nil {
+		t.Fatalf("TestSpawnVersionsFailFast: got err == nil, want err != nil")
+	}
+	if got := started.Load(); got != 3 {
+		t.Errorf("TestSpawnVersionsFailFast: got %d versions started, want 3", got)
+	}
+}
+
+func TestWithConcurrency(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newOptions([]Option{WithConcurrency(0)}); err == nil {
+		t.Errorf("TestWithConcurrency: got err == nil, want err != nil")
+	}
+}
+
+func TestSpawnVersionsBestEffort(t *testing.T) {
+	t.Parallel()
+
+	badErr := errors.New("bad binary")
+	start := func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+		if vp.version == "0.0.1" {
+			return "", nil, badErr
+		}
+		return fmt.Sprintf("http://localhost:%d", port), nil, nil
+	}
+
+	tests := []struct {
+		name       string
+		bestEffort bool
+	}{
+		{name: "Strict mode fails if any version fails"},
+		{name: "Best effort mode routes to the versions that started", bestEffort: true},
+	}
+
+	for _, test := range tests {
+		var options []Option
+		if test.bestEffort {
+			options = append(options, WithBestEffort())
+		}
+		opts, err := newOptions(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.start = start
+
+		verPaths := fakeVersions(3)
+		err = spawnVersions(context.Background(), verPaths, opts)
+		if !errors.Is(err, badErr) {
+			t.Errorf("TestSpawnVersionsBestEffort(%s): got err == %v, want err to wrap %v", test.name, err, badErr)
+			continue
+		}
+		if !test.bestEffort {
+			continue
+		}
+
+		var startErrs StartErrors
+		if !errors.As(err, &startErrs) {
+			t.Errorf("TestSpawnVersionsBestEffort(%s): got err of type %T, want StartErrors", test.name, err)
+			continue
+		}
+		if len(startErrs) != 1 || startErrs["0.0.1"] == nil {
+			t.Errorf("TestSpawnVersionsBestEffort(%s): got StartErrors %v, want only version 0.0.1", test.name, startErrs)
+		}
+
+		m := newMapping(verPaths)
+		for _, v := range []Version{"0.0.0", "0.0.2"} {
+			if m.Base(v) == "" {
+				t.Errorf("TestSpawnVersionsBestEffort(%s): version(%s) is not routable", test.name, v)
+			}
+		}
+		if m.Base("0.0.1") != "" {
+			t.Errorf("TestSpawnVersionsBestEffort(%s): failed version(0.0.1) is routable", test.name)
+		}
+	}
+}
+
+func TestSpawnVersionsReapsOnFailure(t *testing.T) {
+	t.Parallel()
+
+	prefix := fmt.Sprintf("0.0.0-reap-%d", time.Now().UnixNano())
+	vers := []Version{Version(prefix + ".1"), Version(prefix + ".2"), Version(prefix + ".3")}
+	for _, v := range vers {
+		v := v
+		t.Cleanup(func() { os.RemoveAll(versionDir(v)) })
+	}
+
+	badErr := errors.New("bad binary")
+	mu := sync.Mutex{}
+	started := map[Version]*exec.Cmd{}
+	start := func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+		if err := os.MkdirAll(versionDir(vp.version), 0700); err != nil {
+			return "", nil, err
+		}
+		if err := os.WriteFile(binaryPath(vp.version), []byte("binary"), 0700); err != nil {
+			return "", nil, err
+		}
+		if vp.version == vers[1] {
+			return "", nil, badErr
+		}
+		cmd := exec.Command("sleep", "60")
+		if err := cmd.Start(); err != nil {
+			return "", nil, err
+		}
+		mu.Lock()
+		started[vp.version] = cmd
+		mu.Unlock()
+		return fmt.Sprintf("http://localhost:%d", port), cmd, nil
+	}
+
+	// With a concurrency of 1, the first version has started before the second fails and the third never starts.
+	opts, err := newOptions([]Option{WithConcurrency(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.start = start
+
+	verPaths := []versionPath{{version: vers[0]}, {version: vers[1]}, {version: vers[2]}}
+	if err := spawnVersions(context.Background(), verPaths, opts); !errors.Is(err, badErr) {
+		t.Fatalf("TestSpawnVersionsReapsOnFailure: got err == %v, want err to wrap %v", err, badErr)
+	}
+
+	cmd := started[vers[0]]
+	if cmd == nil {
+		t.Fatalf("TestSpawnVersionsReapsOnFailure: version(%s) was never started", vers[0])
+	}
+	if cmd.ProcessState == nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Errorf("TestSpawnVersionsReapsOnFailure: version(%s) is still running, want it reaped", vers[0])
+	}
+	if started[vers[2]] != nil {
+		t.Errorf("TestSpawnVersionsReapsOnFailure: version(%s) was started after a failure", vers[2])
+	}
+	for _, v := range vers[:2] {
+		if _, err := os.Stat(binaryPath(v)); !os.IsNotExist(err) {
+			t.Errorf("TestSpawnVersionsReapsOnFailure: binary of version(%s) was not removed: %v", v, err)
+		}
+	}
+	if verPaths[0].addrs != nil || verPaths[0].procs != nil {
+		t.Errorf("TestSpawnVersionsReapsOnFailure: version(%s) still has addresses after it was reaped", vers[0])
+	}
+}
+
+func TestSpawnVersionsReplicas(t *testing.T) {
+	t.Parallel()
+
+	start := func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+		return fmt.Sprintf("http://localhost:%d", port), nil, nil
+	}
+
+	opts, err := newOptions([]Option{WithReplicas(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.start = start
+
+	verPaths := fakeVersions(1)
+	verPaths[0].latest = true
+	if err := spawnVersions(context.Background(), verPaths, opts); err != nil {
+		t.Fatalf("TestSpawnVersionsReplicas: got err == %s, want err == nil", err)
+	}
+	if got := len(verPaths[0].addrs); got != 2 {
+		t.Fatalf("TestSpawnVersionsReplicas: got %d replicas, want 2", got)
+	}
+
+	m := newMapping(verPaths)
+	for _, v := range []Version{"0.0.0", Latest} {
+		counts := map[string]int{}
+		for i := 0; i < 10; i++ {
+			counts[m.Base(v)]++
+		}
+
+		want := map[string]int{verPaths[0].addrs[0]: 5, verPaths[0].addrs[1]: 5}
+		if diff := pretty.Compare(want, counts); diff != "" {
+			t.Errorf("TestSpawnVersionsReplicas(%s): requests per replica -want/+got:\n%s", v, diff)
+		}
+	}
+}
+
+func TestWithReplicas(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newOptions([]Option{WithReplicas(0)}); err == nil {
+		t.Errorf("TestWithReplicas: got err == nil, want err != nil")
+	}
+}
+
+func TestBaseOrErr(t *testing.T) {
+	t.Parallel()
+
+	m := newMapping(
+		[]versionPath{
+			{version: "1.1.0", addrs: []string{"http://localhost:8081"}},
+			{version: "1.0.0", addrs: []string{"http://localhost:8080"}},
+		},
+	)
+
+	base, err := m.BaseOrErr("1.0.0")
+	if err != nil {
+		t.Fatalf("TestBaseOrErr: got err == %s, want err == nil", err)
+	}
+	if base != "http://localhost:8080" {
+		t.Errorf("TestBaseOrErr: got base %s, want http://localhost:8080", base)
+	}
+
+	_, err = m.BaseOrErr("2.0.0")
+	var notFound *ErrVersionNotFound
+	if !errors.As(err, &notFound) {
+		t.Fatalf("TestBaseOrErr: got err == %v, want *ErrVersionNotFound", err)
+	}
+	if notFound.Version != "2.0.0" {
+		t.Errorf("TestBaseOrErr: got .Version %s, want 2.0.0", notFound.Version)
+	}
+	if diff := pretty.Compare([]Version{"1.0.0", "1.1.0"}, notFound.Available); diff != "" {
+		t.Errorf("TestBaseOrErr: .Available -want/+got:\n%s", diff)
+	}
+}
+
+func TestHealthyBase(t *testing.T) {
+	t.Parallel()
+
+	const a, b = "http://localhost:8080", "http://localhost:8081"
+	vp := versionPath{version: "1.0.0", addrs: []string{a, b}, latest: true}
+
+	tests := []struct {
+		name      string
+		unhealthy map[string]bool
+		want      map[string]int
+		err       bool
+	}{
+		{name: "All healthy", unhealthy: map[string]bool{}, want: map[string]int{a: 5, b: 5}},
+		{name: "One unhealthy", unhealthy: map[string]bool{a: true}, want: map[string]int{b: 10}},
+		{name: "All unhealthy", unhealthy: map[string]bool{a: true, b: true}, err: true},
+	}
+
+	for _, test := range tests {
+		m := newMapping([]versionPath{vp})
+		healthy := func(addr string) bool { return !test.unhealthy[addr] }
+
+		counts := map[string]int{}
+		for i := 0; i < 10; i++ {
+			base, err := m.HealthyBase(Latest, healthy)
+			if test.err {
+				var unhealthy *ErrVersionUnhealthy
+				if !errors.As(err, &unhealthy) || unhealthy.Version != "1.0.0" || unhealthy.Replicas != 2 {
+					t.Errorf("TestHealthyBase(%s): got err == %v, want *ErrVersionUnhealthy for 1.0.0 with 2 replicas", test.name, err)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("TestHealthyBase(%s): got err == %s, want err == nil", test.name, err)
+			}
+			counts[base]++
+		}
+		if test.err {
+			continue
+		}
+		if diff := pretty.Compare(test.want, counts); diff != "" {
+			t.Errorf("TestHealthyBase(%s): requests per replica -want/+got:\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestHealthyBaseConcurrent(t *testing.T) {
+	t.Parallel()
+
+	addrs := []string{"http://localhost:8080", "http://localhost:8081", "http://localhost:8082", "http://localhost:8083"}
+	healthyAddr := addrs[2]
+	m := newMapping([]versionPath{{version: "1.0.0", addrs: addrs, latest: true}})
+	healthy := func(addr string) bool {
+		// Let other requests move the round-robin on between our tries.
+		runtime.Gosched()
+		return addr == healthyAddr
+	}
+
+	var failed atomic.Int64
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				base, err := m.HealthyBase(Latest, healthy)
+				if err != nil || base != healthyAddr {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := failed.Load(); got != 0 {
+		t.Errorf("TestHealthyBaseConcurrent: %d requests did not get the healthy replica, want 0", got)
+	}
+}
+
+func TestWithStableLatest(t *testing.T) {
+	t.Parallel()
+
+	script := memBinary("#!/bin/sh\nexit 0\n")
+	ver := Version(fmt.Sprintf("1.0.0-rc.%d", time.Now().UnixNano()))
+	t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+	m, err := New(
+		context.Background(),
+		WithDiscoverer(fakeDiscoverer{verPaths: []versionPath{{version: ver, bin: script}}}),
+		WithStableLatest(),
+	)
+	if err != nil {
+		t.Fatalf("TestWithStableLatest: %s", err)
+	}
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+
+	if m.Base(ver) == "" {
+		t.Errorf("TestWithStableLatest: version(%s) is not routable by its version", ver)
+	}
+	_, err = m.BaseOrErr(Latest)
+	var noLatest *ErrNoLatest
+	if !errors.As(err, &noLatest) {
+		t.Fatalf("TestWithStableLatest: got err == %v, want *ErrNoLatest", err)
+	}
+	if diff := pretty.Compare([]Version{ver}, noLatest.Available); diff != "" {
+		t.Errorf("TestWithStableLatest: .Available -want/+got:\n%s", diff)
+	}
+}
+
+// captureHandler is a slog.Handler that records every log record.
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (c *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (c *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return c }
+func (c *captureHandler) WithGroup(string) slog.Handler            { return c }
+
+func (c *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = append(c.records, r)
+	return nil
+}
+
+// messages returns the messages logged for version v.
+func (c *captureHandler) messages(v Version) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var msgs []string
+	for _, r := range c.records {
+		r.Attrs(
+			func(a slog.Attr) bool {
+				if a.Key == "version" && a.Value.String() == v.String() {
+					msgs = append(msgs, r.Message)
+					return false
+				}
+				return true
+			},
+		)
+	}
+	return msgs
+}
+
+func TestWithLogger(t *testing.T) {
+	t.Parallel()
+
+	ver := Version(fmt.Sprintf("0.0.0-logger-%d", time.Now().UnixNano()))
+	t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+	rdfs := fstest.MapFS{
+		path.Join(ver.String(), "agentbaker"): &fstest.MapFile{Data: []byte("#!/bin/sh\nexec sleep 60\n"), Mode: 0755},
+	}
+
+	capture := &captureHandler{}
+	opts, err := newOptions([]Option{WithLogger(slog.New(capture))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verPaths, err := extractBinaries(rdfs, opts.log, false)
+	if err != nil {
+		t.Fatalf("TestWithLogger: extractBinaries: %s", err)
+	}
+	if err := spawnVersions(context.Background(), verPaths, opts); err != nil {
+		t.Fatalf("TestWithLogger: spawnVersions: %s", err)
+	}
+	for _, vp := range verPaths {
+		vp := vp
+		t.Cleanup(func() { reap(vp.binDir(), vp.procs) })
+	}
+
+	want := []string{"version discovered", "version extracted", "version started"}
+	if diff := pretty.Compare(want, capture.messages(ver)); diff != "" {
+		t.Errorf("TestWithLogger: logged messages -want/+got:\n%s", diff)
+	}
+}
+
+func TestMappingHas(t *testing.T) {
+	t.Parallel()
+
+	// 1.1.0 has not been started yet.
+	m := newMapping(
+		[]versionPath{
+			{version: "1.0.0", addrs: []string{"http://localhost:8080"}},
+			{version: "1.1.0"},
+		},
+	)
+
+	tests := []struct {
+		name string
+		ver  Version
+		want bool
+	}{
+		{name: "Ready version", ver: "1.0.0", want: true},
+		{name: "Starting version", ver: "1.1.0", want: true},
+		{name: "Unknown version", ver: "9.9.9"},
+		{name: "No latest version", ver: Latest},
+	}
+
+	for _, test := range tests {
+		if got := m.Has(test.ver); got != test.want {
+			t.Errorf("TestMappingHas(%s): got %v, want %v", test.name, got, test.want)
+		}
+		// Base() can't tell a starting version from an unknown one, which is why Has() exists.
+		if test.ver == "1.1.0" && m.Base(test.ver) != "" {
+			t.Errorf("TestMappingHas(%s): got a Base() for a version that is not ready", test.name)
+		}
+	}
+}
+
+func TestMappingState(t *testing.T) {
+	t.Parallel()
+
+	// 1.1.0 has not been started yet.
+	m := newMapping(
+		[]versionPath{
+			{version: "1.0.0", addrs: []string{"http://localhost:8080"}},
+			{version: "1.1.0", latest: true},
+		},
+	)
+
+	tests := []struct {
+		name      string
+		ver       Version
+		wantState State
+		wantOK    bool
+		wantErr   any
+	}{
+		{name: "Ready version", ver: "1.0.0", wantState: StateReady, wantOK: true},
+		{name: "Starting version", ver: "1.1.0", wantState: StateStarting, wantOK: true, wantErr: &ErrVersionNotReady{}},
+		{name: "Latest points at a starting version", ver: Latest, wantState: StateStarting, wantOK: true, wantErr: &ErrVersionNotReady{}},
+		{name: "Unknown version", ver: "9.9.9", wantErr: &ErrVersionNotFound{}},
+	}
+
+	for _, test := range tests {
+		state, ok := m.State(test.ver)
+		if state != test.wantState || ok != test.wantOK {
+			t.Errorf("TestMappingState(%s): got State() == %s, %v, want %s, %v", test.name, state, ok, test.wantState, test.wantOK)
+		}
+
+		_, err := m.BaseOrErr(test.ver)
+		switch want := test.wantErr.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("TestMappingState(%s): got err == %s, want err == nil", test.name, err)
+			}
+		case *ErrVersionNotReady:
+			if !errors.As(err, &want) {
+				t.Errorf("TestMappingState(%s): got err == %v, want *ErrVersionNotReady", test.name, err)
+			} else if want.State != StateStarting {
+				t.Errorf("TestMappingState(%s): got .State %s, want %s", test.name, want.State, StateStarting)
+			}
+		case *ErrVersionNotFound:
+			if !errors.As(err, &want) {
+				t.Errorf("TestMappingState(%s): got err == %v, want *ErrVersionNotFound", test.name, err)
+			}
+		}
+	}
+
+	if _, ok := m.All()["1.1.0"]; ok {
+		t.Errorf("TestMappingState: All() included a version that is not ready")
+	}
+}
+
+// fakeDiscoverer is a Discoverer that returns in-memory versions.
+type fakeDiscoverer struct {
+	verPaths []versionPath
+	err      error
+}
+
+func (f fakeDiscoverer) Discover(ctx context.Context) ([]versionPath, error) {
+	return f.verPaths, f.err
+}
+
+func TestWithDiscoverer(t *testing.T) {
+	t.Parallel()
+
+	script := memBinary("#!/bin/sh\nexit 0\n")
+	ver := Version(fmt.Sprintf("0.0.0-discover-%d", time.Now().UnixNano()))
+	t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+	tests := []struct {
+		name     string
+		discover Discoverer
+		want     []Version
+		err      bool
+	}{
+		{
+			name:     "Versions from the discoverer are started",
+			discover: fakeDiscoverer{verPaths: []versionPath{{version: ver, bin: script, latest: true}}},
+			want:     []Version{ver, Latest},
+		},
+		{
+			name:     "Error: Discoverer fails",
+			discover: fakeDiscoverer{err: errors.New("registry is down")},
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		m, err := New(context.Background(), WithDiscoverer(test.discover))
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestWithDiscoverer(%s): got err == nil, want err != nil", test.name)
+			continue
+		case !test.err && err != nil:
+			t.Errorf("TestWithDiscoverer(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+		t.Cleanup(func() { m.Shutdown(context.Background()) })
+
+		for _, v := range test.want {
+			if m.Base(v) == "" {
+				t.Errorf("TestWithDiscoverer(%s): version(%s) is not routable", test.name, v)
+			}
+		}
+	}
+
+	if _, err := newOptions([]Option{WithDiscoverer(nil)}); err == nil {
+		t.Errorf("TestWithDiscoverer: got err == nil for a nil Discoverer, want err != nil")
+	}
+}
+
+func TestMappingResolve(t *testing.T) {
+	t.Parallel()
+
+	m := newMapping(
+		[]versionPath{
+			{version: "1.0.0", addrs: []string{"http://localhost:8080"}},
+			{version: "1.1.0", addrs: []string{"http://localhost:8081"}, latest: true},
+		},
+	)
+	for v, want := range map[Version]Version{Latest: "1.1.0", "1.0.0": "1.0.0", "9.9.9": "9.9.9"} {
+		if got := m.Resolve(v); got != want {
+			t.Errorf("TestMappingResolve(%s): got %s, want %s", v, got, want)
+		}
+	}
+
+	if got := (Mapping{}).Resolve(Latest); got != Latest {
+		t.Errorf("TestMappingResolve: got %s for an empty Mapping, want %s", got, Latest)
+	}
+}
+
+func TestNewNoVersions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		options []Option
+		wantErr error
+	}{
+		{
+			name:    "Error: No versions",
+			options: []Option{WithDiscoverer(embedDiscoverer{fs: fstest.MapFS{}})},
+			wantErr: ErrNoVersions,
+		},
+		{
+			name:    "Only files, no version directories",
+			options: []Option{WithDiscoverer(embedDiscoverer{fs: fstest.MapFS{"README": &fstest.MapFile{}}})},
+			wantErr: ErrNoVersions,
+		},
+		{
+			name:    "No versions are allowed",
+			options: []Option{WithDiscoverer(embedDiscoverer{fs: fstest.MapFS{}}), WithAllowNoVersions()},
+		},
+	}
+
+	for _, test := range tests {
+		m, err := New(context.Background(), test.options...)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("TestNewNoVersions(%s): got err == %v, want %v", test.name, err, test.wantErr)
+			continue
+		}
+		if len(m.All()) != 0 {
+			t.Errorf("TestNewNoVersions(%s): got versions %v, want none", test.name, m.All())
+		}
+	}
+}
+
+func TestWithStartTimeout(t *testing.T) {
+	t.Parallel()
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		if _, err := newOptions([]Option{WithStartTimeout(d)}); err == nil {
+			t.Errorf("TestWithStartTimeout(%v): got err == nil, want err != nil", d)
+		}
+	}
+
+	// The agent baker starts, but never listens, so it never answers its health probes.
+	ver := Version(fmt.Sprintf("0.0.0-timeout-%d", time.Now().UnixNano()))
+	t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	script := fmt.Sprintf("#!/bin/sh\necho $$ > %s\nexec sleep 60\n", pidFile)
+
+	const timeout = 500 * time.Millisecond
+	start := time.Now()
+	_, err := New(
+		context.Background(),
+		WithDiscoverer(fakeDiscoverer{verPaths: []versionPath{{version: ver, bin: memBinary(script)}}}),
+		WithStartTimeout(timeout),
+	)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("TestWithStartTimeout: got err == %v, want an error that is %v", err, context.DeadlineExceeded)
+	}
+	if !errors.Is(err, ErrNotReady) {
+		t.Errorf("TestWithStartTimeout: got err == %v, want an error that is %v", err, ErrNotReady)
+	}
+	if took := time.Since(start); took > timeout+5*time.Second {
+		t.Errorf("TestWithStartTimeout: New() took %v, want about %v", took, timeout)
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("TestWithStartTimeout: the agent baker did not start: %s", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatalf("TestWithStartTimeout: bad pid %q: %s", b, err)
+	}
+	p, err := os.FindProcess(pid)
+	if err == nil {
+		if err := p.Signal(syscall.Signal(0)); err == nil {
+			p.Kill()
+			t.Errorf("TestWithStartTimeout: the agent baker(%d) is still running", pid)
+		}
+	}
+	if _, err := os.Stat(versionDir(ver)); err == nil {
+		t.Errorf("TestWithStartTimeout: the version directory was not removed")
+	}
+}
+
+func TestDiscoverDuplicates(t *testing.T) {
+	t.Parallel()
+
+	bin := &fstest.MapFile{Data: []byte("binary")}
+
+	tests := []struct {
+		name      string
+		discover  Discoverer
+		wantNames []string
+	}{
+		{
+			name:      "Leading v",
+			discover:  embedDiscoverer{fs: fstest.MapFS{"1.0.0/agentbaker": bin, "v1.0.0/agentbaker": bin, "1.1.0/agentbaker": bin}},
+			wantNames: []string{"version(1.0.0)", "version(v1.0.0)"},
+		},
+		{
+			name:      "Build metadata",
+			discover:  embedDiscoverer{fs: fstest.MapFS{"1.0.0+a/agentbaker": bin, "1.0.0+b/agentbaker": bin}},
+			wantNames: []string{"version(1.0.0+a)", "version(1.0.0+b)"},
+		},
+		{
+			name:      "Same version twice",
+			discover:  fakeDiscoverer{verPaths: []versionPath{{version: "1.0.0", bin: memBinary("a")}, {version: "1.0.0", bin: memBinary("b")}}},
+			wantNames: []string{"version(1.0.0)"},
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Discover(context.Background(), WithDiscoverer(test.discover))
+		if !errors.Is(err, ErrDiscover) {
+			t.Errorf("TestDiscoverDuplicates(%s): got err == %v, want ErrDiscover", test.name, err)
+			continue
+		}
+		for _, name := range test.wantNames {
+			if !strings.Contains(err.Error(), name) {
+				t.Errorf("TestDiscoverDuplicates(%s): got err == %s, want it to name %s", test.name, err, name)
+			}
+		}
+	}
+
+	// Prereleases of the same version are different versions.
+	fsys := fstest.MapFS{"1.0.0/agentbaker": bin, "1.0.0-rc.1/agentbaker": bin}
+	if _, err := Discover(context.Background(), WithDiscoverer(embedDiscoverer{fs: fsys})); err != nil {
+		t.Errorf("TestDiscoverDuplicates(prerelease): got err == %s, want err == nil", err)
+	}
+}
+
+func TestDiscoverMissingBinary(t *testing.T) {
+	t.Parallel()
+
+	bin := &fstest.MapFile{Data: []byte("binary")}
+	launch := &fstest.MapFile{Data: []byte(`{"flags": ["-v"]}`)}
+
+	tests := []struct {
+		name       string
+		fs         fstest.MapFS
+		bestEffort bool
+		want       []VersionInfo
+		wantErr    bool
+	}{
+		{
+			name:    "Error: Version directory without a binary",
+			fs:      fstest.MapFS{"1.0.0/agentbaker": bin, "1.1.0/launch.json": launch},
+			wantErr: true,
+		},
+		{
+			name:       "Version directory without a binary is skipped",
+			fs:         fstest.MapFS{"1.0.0/agentbaker": bin, "1.1.0/launch.json": launch},
+			bestEffort: true,
+			want:       []VersionInfo{{Version: "1.0.0", Latest: true}},
+		},
+		{
+			name:    "Error: Manifest version without a binary",
+			fs:      fstest.MapFS{manifestFile: &fstest.MapFile{Data: []byte(`{"versions": [{"version": "1.0.0"}, {"version": "1.1.0"}]}`)}, "1.0.0/agentbaker": bin},
+			wantErr: true,
+		},
+		{
+			name:       "Manifest version without a binary is skipped",
+			fs:         fstest.MapFS{manifestFile: &fstest.MapFile{Data: []byte(`{"versions": [{"version": "1.0.0"}, {"version": "1.1.0"}]}`)}, "1.0.0/agentbaker": bin},
+			bestEffort: true,
+			want:       []VersionInfo{{Version: "1.0.0", Latest: true}},
+		},
+	}
+
+	for _, test := range tests {
+		capture := &captureHandler{}
+		options := []Option{WithDiscoverer(embedDiscoverer{fs: test.fs, log: slog.New(capture), bestEffort: test.bestEffort})}
+		got, err := Discover(context.Background(), options...)
+		if test.wantErr {
+			var missing *MissingBinaryError
+			switch {
+			case !errors.As(err, &missing):
+				t.Errorf("TestDiscoverMissingBinary(%s): got err == %v, want a *MissingBinaryError", test.name, err)
+			case missing.Version != "1.1.0":
+				t.Errorf("TestDiscoverMissingBinary(%s): got an error for version(%s), want version(1.1.0)", test.name, missing.Version)
+			case !errors.Is(err, ErrDiscover) || !errors.Is(err, fs.ErrNotExist):
+				t.Errorf("TestDiscoverMissingBinary(%s): got err == %s, want it to be ErrDiscover and fs.ErrNotExist", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TestDiscoverMissingBinary(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+
+		for i := range got {
+			got[i].vp = versionPath{}
+		}
+		if diff := pretty.Compare(test.want, got); diff != "" {
+			t.Errorf("TestDiscoverMissingBinary(%s): -want/+got:\n%s", test.name, diff)
+		}
+		if msgs := capture.messages("1.1.0"); !slices.Contains(msgs, "skipping version") {
+			t.Errorf("TestDiscoverMissingBinary(%s): got messages %v for version(1.1.0), want a warning that it was skipped", test.name, msgs)
+		}
+	}
+}
+
+// brokenBinary is a binSource that can't be opened.
+type brokenBinary struct{}
+
+func (brokenBinary) open() (io.ReadCloser, error) {
+	return nil, errors.New("binary is gone")
+}
+
+func TestStartupStages(t *testing.T) {
+	t.Parallel()
+
+	// Each version gets its own name, so that the versions directories of tests don't collide.
+	newVer := func(stage string) Version {
+		return Version(fmt.Sprintf("0.0.0-stage-%s-%d", stage, time.Now().UnixNano()))
+	}
+	discovered := func(vp versionPath) Option {
+		return WithDiscoverer(fakeDiscoverer{verPaths: []versionPath{vp}})
+	}
+
+	extractVer := newVer("extract")
+	writeVer := newVer("write")
+	spawnVer := newVer("spawn")
+	bestVer := newVer("best")
+	for _, v := range []Version{extractVer, writeVer, spawnVer, bestVer} {
+		v := v
+		t.Cleanup(func() { os.RemoveAll(versionDir(v)) })
+	}
+	// A file where the version directory goes can't be made into a directory.
+	if err := os.WriteFile(versionDir(writeVer), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The shebang gets the script past the platform check, but there is no interpreter to start it.
+	noInterpreter := memBinary("#!/does/not/exist\n")
+
+	tests := []struct {
+		name    string
+		options []Option
+		want    error
+		// failed is a version the Mapping must report as failed with the error, see Mapping.Status().
+		failed Version
+	}{
+		{
+			name:    "Discoverer fails",
+			options: []Option{WithDiscoverer(fakeDiscoverer{err: errors.New("registry is down")})},
+			want:    ErrDiscover,
+		},
+		{
+			name:    "No versions",
+			options: []Option{WithDiscoverer(fakeDiscoverer{})},
+			want:    ErrDiscover,
+		},
+		{
+			name:    "Latest is not found",
+			options: []Option{discovered(versionPath{version: "1.0.0", bin: noInterpreter}), WithLatest("2.0.0")},
+			want:    ErrDiscover,
+		},
+		{
+			name:    "Binary can't be opened",
+			options: []Option{discovered(versionPath{version: extractVer, bin: brokenBinary{}})},
+			want:    ErrExtract,
+		},
+		{
+			name:    "Version directory can't be made",
+			options: []Option{discovered(versionPath{version: writeVer, bin: noInterpreter})},
+			want:    ErrWrite,
+		},
+		{
+			name:    "Binary can't be started",
+			options: []Option{discovered(versionPath{version: spawnVer, bin: noInterpreter})},
+			want:    ErrSpawn,
+		},
+		{
+			name:    "Best effort keeps the stage",
+			options: []Option{discovered(versionPath{version: bestVer, bin: noInterpreter}), WithBestEffort()},
+			want:    ErrSpawn,
+			failed:  bestVer,
+		},
+	}
+
+	for _, test := range tests {
+		m, err := New(context.Background(), test.options...)
+		if !errors.Is(err, test.want) {
+			t.Errorf("TestStartupStages(%s): got err == %v, want an error that is %v", test.name, err, test.want)
+		}
+		if test.failed == "" {
+			continue
+		}
+		statuses := m.Status()
+		if len(statuses) != 1 || statuses[0].Version != test.failed || statuses[0].State != StateFailed || !errors.Is(statuses[0].Err, test.want) {
+			t.Errorf("TestStartupStages(%s): got statuses %+v, want version(%s) failed with an error that is %v", test.name, statuses, test.failed, test.want)
+		}
+	}
+
+	// A version without agent bakers can never be ready.
+	m := newMapping([]versionPath{{version: "1.0.0"}})
+	if err := m.WaitReady(context.Background()); !errors.Is(err, ErrNotReady) {
+		t.Errorf("TestStartupStages(Not ready): got err == %v, want an error that is %v", err, ErrNotReady)
+	}
+}
+
+func TestMappingAll(t *testing.T) {
+	t.Parallel()
+
+	m := newMapping([]versionPath{{version: "1.0.0", addrs: []string{"http://localhost:8080"}}})
+
+	all := m.All()
+	all["1.0.0"][0] = "http://localhost:9999"
+	all["2.0.0"] = []string{"http://localhost:9998"}
+
+	if got := m.Base("1.0.0"); got != "http://localhost:8080" {
+		t.Errorf("TestMappingAll: changing the result of All() changed the Mapping, got base %s", got)
+	}
+	if got := m.Base("2.0.0"); got != "" {
+		t.Errorf("TestMappingAll: adding to the result of All() changed the Mapping, got base %s", got)
+	}
+}
+
+func TestMappingString(t *testing.T) {
+	t.Parallel()
+
+	m := newMapping(
+		[]versionPath{
+			{version: "1.1.0", addrs: []string{"http://localhost:8081"}, latest: true},
+			{version: "1.0.0", addrs: []string{"http://localhost:8080"}},
+			{version: "1.10.0", addrs: []string{"http://localhost:8082", "http://localhost:8083"}},
+		},
+	)
+
+	want := "VERSION  ADDRESS\n" +
+		"1.0.0    http://localhost:8080\n" +
+		"1.1.0    http://localhost:8081\n" +
+		"1.10.0   http://localhost:8082, http://localhost:8083\n" +
+		"latest   http://localhost:8081\n"
+
+	for i := 0; i < 10; i++ {
+		if got := m.String(); got != want {
+			t.Fatalf("TestMappingString: got:\n%s\nwant:\n%s", got, want)
+		}
+	}
+}
+
+func TestVersionValidate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		ver  Version
+		err  bool
+	}{
+		{name: "Semantic version", ver: "1.2.3-beta+build.1"},
+		{name: "Other name", ver: "v20240101"},
+		{name: "Latest", ver: Latest},
+		{name: "Error: Empty", ver: "", err: true},
+		{name: "Error: Dot", ver: ".", err: true},
+		{name: "Error: Parent", ver: "..", err: true},
+		{name: "Error: Parent prefix", ver: "../evil", err: true},
+		{name: "Error: Nested", ver: "1.0.0/../../evil", err: true},
+		{name: "Error: Separator", ver: "a/b", err: true},
+		{name: "Error: Backslash", ver: `..\evil`, err: true},
+		{name: "Error: Absolute", ver: "/etc/evil", err: true},
+		{name: "Error: Volume", ver: "C:evil", err: true},
+		{name: "Error: NUL", ver: "1.0.0\x00", err: true},
+	}
+
+	for _, test := range tests {
+		err := test.ver.validate()
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestVersionValidate(%s): got err == nil, want err != nil", test.name)
+		case !test.err && err != nil:
+			t.Errorf("TestVersionValidate(%s): got err == %s, want err == nil", test.name, err)
+		}
+	}
+}
+
+func TestStartVersionBadVersion(t *testing.T) {
+	t.Parallel()
+
+	// This is where "../<name>" would land if it wasn't rejected.
+	name := fmt.Sprintf("evil-%d", time.Now().UnixNano())
+	escaped := filepath.Join(os.TempDir(), name)
+	t.Cleanup(func() { os.RemoveAll(escaped) })
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	vp := versionPath{version: Version("../" + name), bin: memBinary("#!/bin/sh\nexit 0\n")}
+	if _, _, err := startVersion(context.Background(), vp, 9000, log); err == nil {
+		t.Errorf("TestStartVersionBadVersion: got err == nil, want err != nil")
+	}
+	if _, err := os.Stat(escaped); err == nil {
+		t.Errorf("TestStartVersionBadVersion: a file was written outside of the temp directory")
+	}
+}
+
+func TestStartVersionScheme(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		launch launchConfig
+		want   string
+	}{
+		{name: "Default is http", want: "http://localhost:"},
+		{name: "https from the launch config", launch: launchConfig{Scheme: "https"}, want: "https://localhost:"},
+		{name: "Host from the launch config", launch: launchConfig{Host: "10.0.0.5"}, want: "http://10.0.0.5:9000"},
+		{name: "Socket from the launch config", launch: launchConfig{Socket: "/run/ab-{port}.sock"}, want: "unix:///run/ab-9000.sock"},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for i, test := range tests {
+		ver := Version(fmt.Sprintf("0.0.0-scheme-%d-%d", i, time.Now().UnixNano()))
+		t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+		vp := versionPath{version: ver, bin: memBinary("#!/bin/sh\nexit 0\n"), launch: test.launch}
+		addr, _, err := startVersion(context.Background(), vp, 9000, log)
+		if err != nil {
+			t.Fatalf("TestStartVersionScheme(%s): %s", test.name, err)
+		}
+		if !strings.HasPrefix(addr, test.want) {
+			t.Errorf("TestStartVersionScheme(%s): got address %s, want prefix %s", test.name, addr, test.want)
+		}
+	}
+}
+
+func TestStartVersionBindHost(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		bindHost string
+		launch   launchConfig
+		want     string
+	}{
+		{name: "No host by default", want: "-port 9000"},
+		{name: "Bind host from WithBindHost", bindHost: "0.0.0.0", want: "-port 9000 -host 0.0.0.0"},
+		{name: "Host from the launch config", bindHost: "0.0.0.0", launch: launchConfig{Host: "10.0.0.5"}, want: "-port 9000 -host 10.0.0.5"},
+		{name: "Socket has no host", launch: launchConfig{Socket: "/run/ab-{port}.sock"}, want: "-socket /run/ab-9000.sock"},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for i, test := range tests {
+		ver := Version(fmt.Sprintf("0.0.0-bind-%d-%d", i, time.Now().UnixNano()))
+		out := filepath.Join(t.TempDir(), "args")
+		t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+		script := fmt.Sprintf("#!/bin/sh\necho \"$*\" > %s\n", out)
+		vp := versionPath{version: ver, bin: memBinary(script), launch: test.launch, bindHost: test.bindHost}
+		_, cmd, err := startVersion(context.Background(), vp, 9000, log)
+		if err != nil {
+			t.Fatalf("TestStartVersionBindHost(%s): %s", test.name, err)
+		}
+		cmd.Wait()
+
+		b, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatalf("TestStartVersionBindHost(%s): %s", test.name, err)
+		}
+		if got := strings.TrimSpace(string(b)); got != test.want {
+			t.Errorf("TestStartVersionBindHost(%s): child got flags %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWithBindHost(t *testing.T) {
+	t.Parallel()
+
+	for _, host := range []string{"", "localhost", "10.0.0.5:80"} {
+		if _, err := newOptions([]Option{WithBindHost(host)}); err == nil {
+			t.Errorf("TestWithBindHost(%q): got err == nil, want err != nil", host)
+		}
+	}
+
+	opts, err := newOptions([]Option{WithBindHost("0.0.0.0")})
+	if err != nil {
+		t.Fatalf("TestWithBindHost: %s", err)
+	}
+	mu := sync.Mutex{}
+	got := map[Version]string{}
+	opts.start = func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		got[vp.version] = vp.bindHost
+		return fmt.Sprintf("http://localhost:%d", port), nil, nil
+	}
+
+	verPaths := fakeVersions(2)
+	if err := spawnVersions(context.Background(), verPaths, opts); err != nil {
+		t.Fatalf("TestWithBindHost: %s", err)
+	}
+	want := map[Version]string{}
+	for _, vp := range verPaths {
+		want[vp.version] = "0.0.0.0"
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("TestWithBindHost: bind host per version -want/+got:\n%s", diff)
+	}
+}
+
+func TestStartVersionEnv(t *testing.T) {
+	t.Parallel()
+
+	// HOME tells us if the child inherited our environment. The shell does not set it on its own.
+	if os.Getenv("HOME") == "" {
+		t.Skip("TestStartVersionEnv: HOME is not set")
+	}
+
+	tests := []struct {
+		name   string
+		launch launchConfig
+		want   string
+	}{
+		{
+			name:   "Env is added to our environment",
+			launch: launchConfig{Env: map[string]string{"BB_FEATURE": "on"}},
+			want:   "on:inherited",
+		},
+		{
+			name:   "Env overrides our environment",
+			launch: launchConfig{Env: map[string]string{"BB_FEATURE": "on", "HOME": "/nowhere"}},
+			want:   "on:/nowhere",
+		},
+		{
+			name:   "CleanEnv only has Env",
+			launch: launchConfig{Env: map[string]string{"BB_FEATURE": "on"}, CleanEnv: true},
+			want:   "on:",
+		},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for i, test := range tests {
+		ver := Version(fmt.Sprintf("0.0.0-env-%d-%d", i, time.Now().UnixNano()))
+		out := filepath.Join(t.TempDir(), "env")
+		t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+		// The script can't rely on PATH to find anything, so it only uses shell builtins.
+		script := fmt.Sprintf(
+			"#!/bin/sh\nh=\"$HOME\"\nif [ \"$h\" = \"%s\" ]; then h=inherited; fi\necho \"$BB_FEATURE:$h\" > %s\n",
+			os.Getenv("HOME"), out,
+		)
+		vp := versionPath{version: ver, bin: memBinary(script), launch: test.launch}
+		if _, _, err := startVersion(context.Background(), vp, 9000, log); err != nil {
+			t.Fatalf("TestStartVersionEnv(%s): %s", test.name, err)
+		}
+
+		var got []byte
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			b, err := os.ReadFile(out)
+			if err == nil && strings.HasSuffix(string(b), "\n") {
+				got = b
+				break
+			}
+		}
+		if strings.TrimSpace(string(got)) != test.want {
+			t.Errorf("TestStartVersionEnv(%s): child saw %q, want %q", test.name, strings.TrimSpace(string(got)), test.want)
+		}
+	}
+}
+
+func TestStartVersionHelpers(t *testing.T) {
+	t.Parallel()
+
+	ver := Version(fmt.Sprintf("0.0.0-helpers-%d", time.Now().UnixNano()))
+	t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+	// The agent baker runs its helper from the PATH, which writes a file in the working directory.
+	vp := versionPath{
+		version: ver,
+		bin:     memBinary("#!/bin/sh\nexec helper\n"),
+		helpers: []helperBin{{name: "helper", bin: memBinary("#!/bin/sh\necho ran > ran\n")}},
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, cmd, err := startVersion(context.Background(), vp, 9000, log)
+	if err != nil {
+		t.Fatalf("TestStartVersionHelpers: %s", err)
+	}
+	cmd.Wait()
+
+	for _, name := range []string{primaryName, "helper"} {
+		if _, err := os.Stat(filepath.Join(versionDir(ver), name)); err != nil {
+			t.Errorf("TestStartVersionHelpers: %s is not in the version directory: %s", name, err)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(versionDir(ver), "ran"))
+	if err != nil || strings.TrimSpace(string(b)) != "ran" {
+		t.Errorf("TestStartVersionHelpers: the helper did not run in the version directory: %v", err)
+	}
+}
+
+func TestStartVersionWorkDir(t *testing.T) {
+	t.Parallel()
+
+	// A regular file can't hold a working directory, whatever our permissions are.
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatalf("TestStartVersionWorkDir: %s", err)
+	}
+	configured := t.TempDir()
+
+	tests := []struct {
+		name string
+		// workDir is the parent of versionPath.workDir, as WithWorkDir() would set it.
+		workDir string
+		wantErr bool
+	}{
+		{name: "Version directory by default"},
+		{name: "Configured directory", workDir: configured},
+		{name: "Error: not a directory", workDir: notDir, wantErr: true},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for i, test := range tests {
+		ver := Version(fmt.Sprintf("0.0.0-workdir-%d-%d", i, time.Now().UnixNano()))
+		t.Cleanup(func() { os.RemoveAll(versionDir(ver)) })
+
+		// The agent baker writes a file relative to its working directory.
+		vp := versionPath{version: ver, bin: memBinary("#!/bin/sh\necho ran > marker\n")}
+		want := versionDir(ver)
+		if test.workDir != "" {
+			vp.workDir = filepath.Join(test.workDir, ver.String())
+			want = vp.workDir
+		}
+
+		_, cmd, err := startVersion(context.Background(), vp, 9000, log)
+		switch {
+		case err == nil && test.wantErr:
+			cmd.Wait()
+			t.Errorf("TestStartVersionWorkDir(%s): got err == nil, want err != nil", test.name)
+			continue
+		case err != nil && !test.wantErr:
+			t.Errorf("TestStartVersionWorkDir(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			if !errors.Is(err, ErrWrite) {
+				t.Errorf("TestStartVersionWorkDir(%s): got err == %s, want ErrWrite", test.name, err)
+			}
+			continue
+		}
+		cmd.Wait()
+
+		if cmd.Dir != want {
+			t.Errorf("TestStartVersionWorkDir(%s): got cmd.Dir %s, want %s", test.name, cmd.Dir, want)
+		}
+		b, err := os.ReadFile(filepath.Join(want, "marker"))
+		if err != nil || strings.TrimSpace(string(b)) != "ran" {
+			t.Errorf("TestStartVersionWorkDir(%s): the agent baker did not run in %s: %v", test.name, want, err)
+		}
+		// Nothing but the marker is left behind by the check that the directory is writable.
+		entries, err := os.ReadDir(want)
+		if err != nil {
+			t.Fatalf("TestStartVersionWorkDir(%s): %s", test.name, err)
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".bakedbaker-write-check-") {
+				t.Errorf("TestStartVersionWorkDir(%s): left %s in the working directory", test.name, e.Name())
+			}
+		}
+	}
+}
+
+func TestWithWorkDir(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newOptions([]Option{WithWorkDir("")}); err == nil {
+		t.Errorf("TestWithWorkDir(empty): got err == nil, want err != nil")
+	}
+
+	dir := t.TempDir()
+	opts, err := newOptions([]Option{WithWorkDir(dir)})
+	if err != nil {
+		t.Fatalf("TestWithWorkDir: %s", err)
+	}
+	mu := sync.Mutex{}
+	got := map[Version]string{}
+	opts.start = func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		got[vp.version] = vp.workDir
+		return fmt.Sprintf("http://localhost:%d", port), nil, nil
+	}
+
+	verPaths := fakeVersions(2)
+	if err := spawnVersions(context.Background(), verPaths, opts); err != nil {
+		t.Fatalf("TestWithWorkDir: %s", err)
+	}
+	want := map[Version]string{}
+	for _, vp := range verPaths {
+		want[vp.version] = filepath.Join(dir, vp.version.String())
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("TestWithWorkDir: work dir per version -want/+got:\n%s", diff)
+	}
+}
+
+func TestPrependPath(t *testing.T) {
+	t.Parallel()
+
+	sep := string(os.PathListSeparator)
+	tests := []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{name: "No PATH", env: []string{"A=B"}, want: "/v"},
+		{name: "PATH", env: []string{"PATH=/bin"}, want: "/v" + sep + "/bin"},
+		{name: "Last PATH wins", env: []string{"PATH=/bin", "PATH=/usr/bin"}, want: "/v" + sep + "/usr/bin"},
+	}
+
+	for _, test := range tests {
+		got := prependPath(test.env, "/v")
+		if last := got[len(got)-1]; last != "PATH="+test.want {
+			t.Errorf("TestPrependPath(%s): got %s, want PATH=%s", test.name, last, test.want)
+		}
+	}
+}
+
+func TestRedactedEnv(t *testing.T) {
+	t.Parallel()
+
+	l := launchConfig{
+		Env: map[string]string{
+			"REGION":           "westus",
+			"CLIENT_SECRET":    "hunter2",
+			"api_token":        "abc",
+			"STORAGE_KEY":      "xyz",
+			"DB_PASSWORD":      "pw",
+			"AZURE_CREDENTIAL": "cred",
+		},
+	}
+
+	want := []string{
+		"AZURE_CREDENTIAL=REDACTED",
+		"CLIENT_SECRET=REDACTED",
+		"DB_PASSWORD=REDACTED",
+		"REGION=westus",
+		"STORAGE_KEY=REDACTED",
+		"api_token=REDACTED",
+	}
+	if diff := pretty.Compare(want, l.redactedEnv()); diff != "" {
+		t.Errorf("TestRedactedEnv: -want/+got:\n%s", diff)
+	}
+}
+
+func TestWithLatest(t *testing.T) {
+	t.Parallel()
+
+	script := memBinary("#!/bin/sh\nexit 0\n")
+	now := time.Now().UnixNano()
+	older := Version(fmt.Sprintf("1.0.0-latest-%d", now))
+	newer := Version(fmt.Sprintf("1.1.0-latest-%d", now))
+	t.Cleanup(
+		func() {
+			os.RemoveAll(versionDir(older))
+			os.RemoveAll(versionDir(newer))
+		},
+	)
+
+	tests := []struct {
+		name     string
+		verPaths []versionPath
+		latest   Version
+		want     Version
+		err      bool
+	}{
+		{
+			name:     "Default is the highest version",
+			verPaths: []versionPath{{version: older, bin: script}, {version: newer, bin: script}},
+			want:     newer,
+		},
+		{
+			name:     "Override to an older version",
+			verPaths: []versionPath{{version: older, bin: script}, {version: newer, bin: script}},
+			latest:   older,
+			want:     older,
+		},
+		{
+			name:     "Override replaces a declared latest",
+			verPaths: []versionPath{{version: older, bin: script}, {version: newer, bin: script, latest: true}},
+			latest:   older,
+			want:     older,
+		},
+		{
+			name:     "Error: Override to a version that does not exist",
+			verPaths: []versionPath{{version: older, bin: script}},
+			latest:   "9.9.9",
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		options := []Option{WithDiscoverer(fakeDiscoverer{verPaths: test.verPaths})}
+		if test.latest != "" {
+			options = append(options, WithLatest(test.latest))
+		}
+
+		m, err := New(context.Background(), options...)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestWithLatest(%s): got err == nil, want err != nil", test.name)
+			continue
+		case !test.err && err != nil:
+			t.Errorf("TestWithLatest(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+		t.Cleanup(func() { m.Shutdown(context.Background()) })
+
+		if got := m.Resolve(Latest); got != test.want {
+			t.Errorf("TestWithLatest(%s): got latest %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	for _, v := range []Version{"", Latest} {
+		if _, err := newOptions([]Option{WithLatest(v)}); err == nil {
+			t.Errorf("TestWithLatest: got err == nil for WithLatest(%q), want err != nil", v)
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	t.Parallel()
+
+	// This would leave a file behind if it were extracted and started.
+	ver := Version(fmt.Sprintf("1.1.0-discover-only-%d", time.Now().UnixNano()))
+	bin := memBinary("#!/bin/sh\nexit 0\n")
+
+	tests := []struct {
+		name     string
+		options  []Option
+		verPaths []versionPath
+		want     []VersionInfo
+		err      bool
+	}{
+		{
+			name:     "Versions are sorted and the highest is latest",
+			verPaths: []versionPath{{version: ver, bin: bin}, {version: "1.0.0", bin: bin}},
+			want:     []VersionInfo{{Version: "1.0.0"}, {Version: ver, Latest: true}},
+		},
+		{
+			name:     "WithLatest is used",
+			options:  []Option{WithLatest("1.0.0")},
+			verPaths: []versionPath{{version: ver, bin: bin}, {version: "1.0.0", bin: bin}},
+			want:     []VersionInfo{{Version: "1.0.0", Latest: true}, {Version: ver}},
+		},
+		{
+			name:     "Error: Version is a path",
+			verPaths: []versionPath{{version: "../1.0.0", bin: bin}},
+			err:      true,
+		},
+		{
+			name: "Error: No versions",
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		options := append([]Option{WithDiscoverer(fakeDiscoverer{verPaths: test.verPaths})}, test.options...)
+		got, err := Discover(context.Background(), options...)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("TestDiscover(%s): got err == nil, want err != nil", test.name)
+			continue
+		case !test.err && err != nil:
+			t.Errorf("TestDiscover(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		case err != nil:
+			continue
+		}
+
+		// How the versions are started is tested elsewhere.
+		for i := range got {
+			got[i].vp = versionPath{}
+		}
+		if diff := pretty.Compare(test.want, got); diff != "" {
+			t.Errorf("TestDiscover(%s): -want/+got:\n%s", test.name, diff)
+		}
+	}
+
+	if _, err := os.Stat(versionDir(ver)); err == nil {
+		t.Errorf("TestDiscover: a binary was extracted")
+	}
+}
+
+func TestSpawn(t *testing.T) {
+	t.Parallel()
+
+	script := memBinary("#!/bin/sh\nexit 0\n")
+	now := time.Now().UnixNano()
+	older := Version(fmt.Sprintf("1.0.0-spawn-%d", now))
+	newer := Version(fmt.Sprintf("1.1.0-spawn-%d", now))
+	t.Cleanup(
+		func() {
+			os.RemoveAll(versionDir(older))
+			os.RemoveAll(versionDir(newer))
+		},
+	)
+
+	options := []Option{
+		WithDiscoverer(fakeDiscoverer{verPaths: []versionPath{{version: older, bin: script}, {version: newer, bin: script}}}),
+	}
+	infos, err := Discover(context.Background(), options...)
+	if err != nil {
+		t.Fatalf("TestSpawn: Discover(): %s", err)
+	}
+
+	// Latest can be moved between Discover() and Spawn().
+	infos[0].Latest, infos[1].Latest = true, false
+	m, err := Spawn(context.Background(), infos, options...)
+	if err != nil {
+		t.Fatalf("TestSpawn: Spawn(): %s", err)
+	}
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+	for _, v := range []Version{older, newer, Latest} {
+		if m.Base(v) == "" {
+			t.Errorf("TestSpawn: version(%s) is not routable", v)
+		}
+	}
+	if got := m.Resolve(Latest); got != older {
+		t.Errorf("TestSpawn: got latest %s, want %s", got, older)
+	}
+
+	errTests := []struct {
+		name  string
+		infos []VersionInfo
+	}{
+		{name: "Error: VersionInfo not from Discover()", infos: []VersionInfo{{Version: older}}},
+		{name: "Error: Version was changed", infos: []VersionInfo{{Version: "9.9.9", vp: infos[0].vp}}},
+		{name: "Error: More than one latest", infos: []VersionInfo{{Version: older, Latest: true, vp: infos[0].vp}, {Version: newer, Latest: true, vp: infos[1].vp}}},
+	}
+	for _, test := range errTests {
+		if _, err := Spawn(context.Background(), test.infos); err == nil {
+			t.Errorf("TestSpawn(%s): got err == nil, want err != nil", test.name)
+		}
+	}
+}
+
+func TestExtractBinariesMemory(t *testing.T) {
+	// This is not parallel, other tests allocating at the same time would be counted.
+
+	const size = 8 << 20
+	fsys := fstest.MapFS{}
+	for i := 0; i < 4; i++ {
+		fsys[fmt.Sprintf("1.%d.0/agentbaker", i)] = &fstest.MapFile{Data: make([]byte, size)}
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// allocated returns how many bytes were allocated while running f.
+	allocated := func(f func()) uint64 {
+		before, after := runtime.MemStats{}, runtime.MemStats{}
+		runtime.ReadMemStats(&before)
+		f()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	var verPaths []versionPath
+	var err error
+	got := allocated(func() { verPaths, err = extractBinaries(fsys, log, false) })
+	if err != nil {
+		t.Fatalf("TestExtractBinariesMemory: got err == %s, want err == nil", err)
+	}
+	if got >= size {
+		t.Errorf("TestExtractBinariesMemory: extracting allocated %d bytes, want less than one binary(%d bytes)", got, size)
+	}
+
+	fp := filepath.Join(t.TempDir(), "agentbaker")
+	got = allocated(func() { err = writeBinary(context.Background(), verPaths[0].version, fp, verPaths[0].bin) })
+	if err != nil {
+		t.Fatalf("TestExtractBinariesMemory: got err == %s, want err == nil", err)
+	}
+	if got >= size/4 {
+		t.Errorf("TestExtractBinariesMemory: writing allocated %d bytes, want less than %d bytes", got, size/4)
+	}
+	info, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Errorf("TestExtractBinariesMemory: got binary of %d bytes, want %d bytes", info.Size(), size)
+	}
+}
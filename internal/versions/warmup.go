@@ -0,0 +1,112 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gostdlib/concurrency/prim/wait"
+)
+
+// warmupTimeout is how long New() waits for the versions to be ready and warmed up.
+const warmupTimeout = 30 * time.Second
+
+// warmup is the request WithWarmup() sends to every replica.
+type warmup struct {
+	path string
+	body []byte
+}
+
+// WithWarmup causes New() and Spawn() to send a request to every replica once it is ready and to
+// return only after those requests are answered. This lets an agent baker load what it needs before
+// real requests arrive. The request is a GET of path if body is nil, otherwise a POST of body as JSON,
+// so path should be an endpoint that changes nothing. A warmup that fails is logged and does not fail New().
+func WithWarmup(path string, body []byte) Option {
+	return func(o *options) error {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("warmup path(%s) must start with /", path)
+		}
+		o.warmup = &warmup{path: path, body: body}
+		return nil
+	}
+}
+
+// warmUp waits for the versions in m to be ready and sends w to every replica of the ones that are.
+// Nothing that goes wrong here is an error, it is only logged.
+func (m Mapping) warmUp(ctx context.Context, w warmup, log *slog.Logger) {
+	ctx, cancel := context.WithTimeout(ctx, warmupTimeout)
+	defer cancel()
+
+	var notReady ReadyErrors
+	if err := m.WaitReady(ctx); err != nil {
+		if !errors.As(err, &notReady) {
+			log.Warn("could not wait for versions to be ready, skipping warmup", "err", err)
+			return
+		}
+	}
+
+	g := wait.Group{}
+	for v, r := range m.current().versions {
+		// Latest is an alias of another version, which is already being warmed up.
+		if v == Latest {
+			continue
+		}
+		if err, ok := notReady[v]; ok {
+			log.Warn("version is not ready, skipping warmup", "version", v, "err", err)
+			continue
+		}
+		for _, addr := range r.addrs {
+			v, addr := v, addr
+			g.Go(
+				ctx,
+				func(ctx context.Context) error {
+					if err := sendWarmup(ctx, addr, w); err != nil {
+						log.Warn("version warmup failed", "version", v, "addr", addr, "err", err)
+						return nil
+					}
+					log.Info("version warmed up", "version", v, "addr", addr)
+					return nil
+				},
+			)
+		}
+	}
+	g.Wait(ctx)
+}
+
+// sendWarmup sends w to the agent baker at addr and returns an error if it doesn't answer with a 2xx.
+func sendWarmup(ctx context.Context, addr string, w warmup) error {
+	client, base := agentClient(addr)
+	defer client.CloseIdleConnections()
+
+	method := http.MethodGet
+	var body io.Reader
+	if w.body != nil {
+		method = http.MethodPost
+		body = bytes.NewReader(w.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+w.path, body)
+	if err != nil {
+		return err
+	}
+	if w.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("warmup returned status code: %d", resp.StatusCode)
+	}
+	return nil
+}
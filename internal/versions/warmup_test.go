@@ -0,0 +1,147 @@
+package versions
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+// warmupServer is an agent baker stand-in that records the warmup requests it gets.
+type warmupServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// newWarmupServer returns a warmupServer that answers warmup requests with status.
+func newWarmupServer(t *testing.T, status int) *warmupServer {
+	t.Helper()
+
+	ws := &warmupServer{}
+	ws.Server = httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == readyPath {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				b, _ := io.ReadAll(r.Body)
+				ws.mu.Lock()
+				ws.requests = append(ws.requests, r.Method+" "+r.URL.Path+" "+string(b))
+				ws.mu.Unlock()
+				w.WriteHeader(status)
+			},
+		),
+	)
+	t.Cleanup(ws.Close)
+	return ws
+}
+
+func (ws *warmupServer) got() []string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return append([]string(nil), ws.requests...)
+}
+
+func TestWithWarmup(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		status  int
+		body    []byte
+		want    string
+		wantLog string
+	}{
+		{
+			name:    "GET warmup",
+			status:  http.StatusOK,
+			want:    "GET /warmup ",
+			wantLog: "version warmed up",
+		},
+		{
+			name:    "POST warmup",
+			status:  http.StatusNoContent,
+			body:    []byte(`{"Region":"westus"}`),
+			want:    `POST /warmup {"Region":"westus"}`,
+			wantLog: "version warmed up",
+		},
+		{
+			name:    "Warmup fails",
+			status:  http.StatusInternalServerError,
+			want:    "GET /warmup ",
+			wantLog: "version warmup failed",
+		},
+	}
+
+	for _, test := range tests {
+		// Two versions with two replicas each, every replica is its own server.
+		servers := map[string]*warmupServer{}
+		for i := 0; i < 4; i++ {
+			ws := newWarmupServer(t, test.status)
+			servers[ws.URL] = ws
+		}
+		urls := make(chan string, len(servers))
+		for u := range servers {
+			urls <- u
+		}
+		start := func(ctx context.Context, vp versionPath, port int32, log *slog.Logger) (string, *exec.Cmd, error) {
+			return <-urls, nil, nil
+		}
+
+		infos := []VersionInfo{
+			{Version: "1.0.0", vp: versionPath{version: "1.0.0"}},
+			{Version: "1.1.0", Latest: true, vp: versionPath{version: "1.1.0"}},
+		}
+		h := &captureHandler{}
+		_, err := Spawn(
+			context.Background(),
+			infos,
+			WithReplicas(2),
+			WithLogger(slog.New(h)),
+			WithWarmup("/warmup", test.body),
+			func(o *options) error {
+				o.start = start
+				return nil
+			},
+		)
+		if err != nil {
+			t.Errorf("TestWithWarmup(%s): got err == %s, want err == nil", test.name, err)
+			continue
+		}
+
+		// Spawn() must not return before every replica got its warmup.
+		for u, ws := range servers {
+			if diff := pretty.Compare([]string{test.want}, ws.got()); diff != "" {
+				t.Errorf("TestWithWarmup(%s): replica(%s) warmups: -want/+got:\n%s", test.name, u, diff)
+			}
+		}
+		for _, v := range []Version{"1.0.0", "1.1.0"} {
+			n := 0
+			for _, msg := range h.messages(v) {
+				if msg == test.wantLog {
+					n++
+				}
+			}
+			if n != 2 {
+				t.Errorf("TestWithWarmup(%s): version(%s) logged %q %d times, want 2", test.name, v, test.wantLog, n)
+			}
+		}
+	}
+}
+
+func TestWithWarmupBadPath(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newOptions([]Option{WithWarmup("warmup", nil)}); err == nil {
+		t.Errorf("TestWithWarmupBadPath: got err == nil, want err != nil")
+	}
+}